@@ -2,4 +2,13 @@ package api
 
 type DecodeImageRequest struct {
 	ImageToDecode []byte `json:"image_to_decode"`
+
+	// Key Key of the hidden volume to decode, for images encoded with a key or decoy key
+	Key string `json:"key,omitempty"`
+
+	// Identity Identity, as generated by nsteg keygen, of a recipient of the files, for images encoded for recipients
+	Identity string `json:"identity,omitempty"`
+
+	// TrustedSigners Public keys of trusted signers. If supplied, only files signed by one of them are decoded
+	TrustedSigners []string `json:"trusted_signers,omitempty"`
 }
@@ -4,4 +4,7 @@ import "nsteg/pkg/model"
 
 type DecodeImageResponse struct {
 	DecodedFiles []model.OutputFile `json:"decoded_files"`
+
+	// Signer Who signed the decoded files, omitted if they were not signed
+	Signer *model.Signer `json:"signer,omitempty"`
 }
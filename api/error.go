@@ -3,4 +3,8 @@ package api
 type Error struct {
 	Code  string `json:"code"`
 	Error string `json:"error,omitempty"`
+
+	// Details Specifics of the error, such as the bytes needed and available when the files do not fit in the image,
+	// omitted if there are none
+	Details map[string]any `json:"details,omitempty"`
 }
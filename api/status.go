@@ -0,0 +1,5 @@
+package api
+
+type Status struct {
+	Status string `json:"status"`
+}
@@ -0,0 +1,8 @@
+package api
+
+// StreamedFile Name and size of a file to hide, sent in the files part of a streamed encode request ahead of the
+// contents of the file, which are sent in a part of their own
+type StreamedFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
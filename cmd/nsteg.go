@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/spf13/cobra"
 	"log"
 	"nsteg/internal/cli"
@@ -17,42 +18,56 @@ func main() {
 		Short: "Steganography application",
 	}
 
-	rootCommand.AddCommand(cli.ImageCommands(), cli.ServeAppCommand())
+	rootCommand.AddCommand(cli.ImageCommands(), cli.AnalyzeCommand(), cli.KeygenCommand(), cli.ServeAppCommand(), cli.AdminCommand(), cli.ConfigCommand())
 
 	rootCommand.PersistentFlags().StringVar(&cpuProfile, "cpu-profile", "", "File to which to write the CPU profile")
 	rootCommand.PersistentFlags().StringVar(&memProfileDir, "mem-profile-dir", "", "Directory to which to write memory profiles")
+	cli.AddOutputFlag(rootCommand)
+	cli.AddConfigFlag(rootCommand)
+	cli.AddLoggingFlags(rootCommand)
 
 	var cpuProfTeardown, memProfTeardown func()
 	if cpuProfile != "" {
 		cpuProfTeardown = setupCPUProfilingAndReturnTeardown(cpuProfile)
-		defer cpuProfTeardown()
 	}
 
 	if memProfileDir != "" {
 		memProfTeardown = setupMemProfilingAndReturnTeardown(memProfileDir)
-		defer memProfTeardown()
 	}
 
+	// The first signal cancels the context of the command, and a second one kills the process
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	c := make(chan os.Signal, 2)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM) // subscribe to system signals
 	onKill := func(c chan os.Signal) {
 		select {
 		case <-c:
+			cancel()
+			if cli.StopsOnInterrupt() {
+				// The command cleans up and returns by itself, so only a second signal kills it
+				<-c
+			}
 			if cpuProfTeardown != nil {
 				cpuProfTeardown()
 			}
 			if memProfTeardown != nil {
 				memProfTeardown()
 			}
-			os.Exit(0)
+			os.Exit(cli.ExitInterrupted)
 		}
 	}
 
 	go onKill(c)
 
-	if err := rootCommand.Execute(); err != nil {
-		log.Fatal(err)
+	exitCode := cli.Execute(ctx, rootCommand)
+	if cpuProfTeardown != nil {
+		cpuProfTeardown()
+	}
+	if memProfTeardown != nil {
+		memProfTeardown()
 	}
+	os.Exit(exitCode)
 }
 
 func setupCPUProfilingAndReturnTeardown(cpuProfile string) (deferredTeardown func()) {
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeysFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	keys, err := ReadKeysFile(path)
+	if err != nil || len(keys.Keys) != 0 {
+		t.Fatalf("Expected missing keys file to hold no keys, got %v, %v", keys, err)
+	}
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	limits := Limits{RequestsPerMinute: 60, DailyBytes: 1 << 30}
+	key, apiKey, err := keys.CreateKey("ci", limits, now)
+	if err != nil {
+		t.Fatalf("Error creating key: %s", err)
+	}
+	if _, _, err = keys.CreateKey("revoked", Limits{}, now); err != nil {
+		t.Fatalf("Error creating key: %s", err)
+	}
+	if err = keys.Revoke(keys.Keys[1].ID, now); err != nil {
+		t.Fatalf("Error revoking key: %s", err)
+	}
+	if err = keys.Write(path); err != nil {
+		t.Fatalf("Error writing keys file: %s", err)
+	}
+	if content, _ := os.ReadFile(path); strings.Contains(string(content), strings.SplitN(apiKey, "_", 3)[2]) {
+		t.Error("Keys file holds the secret of the API key")
+	}
+
+	read, err := ReadKeysFile(path)
+	if err != nil {
+		t.Fatalf("Error reading keys file: %s", err)
+	}
+	readKey := read.Find(key.ID)
+	if readKey == nil || readKey.Limits != limits || readKey.Name != "ci" || !readKey.CreatedAt.Equal(now) || readKey.RevokedAt != nil {
+		t.Errorf("Expected key %+v to be read back, got %+v", key, readKey)
+	}
+	if revoked := read.Find(keys.Keys[1].ID); revoked == nil || revoked.RevokedAt == nil {
+		t.Errorf("Expected revoked key to be read back as revoked, got %+v", revoked)
+	}
+	if err = read.Revoke("unknown", now); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("Expected ErrUnknownKey revoking unknown key, got %v", err)
+	}
+
+	if err = os.WriteFile(path, []byte("keys:\n  - name: no id\n"), 0600); err != nil {
+		t.Fatalf("Error writing keys file: %s", err)
+	}
+	if _, err = ReadKeysFile(path); !errors.Is(err, ErrInvalidKeysFile) {
+		t.Errorf("Expected ErrInvalidKeysFile for key without ID, got %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	keys := &KeysFile{}
+	now := time.Now()
+	key, apiKey, err := keys.CreateKey("ci", Limits{RequestsPerMinute: 10}, now)
+	if err != nil {
+		t.Fatalf("Error creating key: %s", err)
+	}
+	revokedKey, revokedAPIKey, err := keys.CreateKey("revoked", Limits{}, now)
+	if err != nil {
+		t.Fatalf("Error creating key: %s", err)
+	}
+	if err = keys.Revoke(revokedKey.ID, now); err != nil {
+		t.Fatalf("Error revoking key: %s", err)
+	}
+	if err = keys.Write(path); err != nil {
+		t.Fatalf("Error writing keys file: %s", err)
+	}
+
+	secret, err := ReadTokenSecret(writeTokenSecret(t))
+	if err != nil {
+		t.Fatalf("Error reading token secret: %s", err)
+	}
+	store, err := NewKeyStore(path)
+	if err != nil {
+		t.Fatalf("Error creating key store: %s", err)
+	}
+	authenticator := NewAuthenticator(store, secret)
+
+	mintToken := func(secret []byte, id string, expiresAt time.Time) string {
+		token, err := MintToken(secret, id, expiresAt)
+		if err != nil {
+			t.Fatalf("Error minting token: %s", err)
+		}
+		return token
+	}
+	otherSecret := make([]byte, MinTokenSecretBytes)
+	validToken := mintToken(secret, key.ID, now.Add(time.Hour))
+
+	for _, testCase := range []struct {
+		name           string
+		credential     string
+		expectedMethod string
+		expectedErr    error
+	}{
+		{name: "API key", credential: apiKey, expectedMethod: MethodAPIKey},
+		{name: "token", credential: validToken, expectedMethod: MethodToken},
+		{name: "empty", credential: "", expectedErr: ErrInvalidCredential},
+		{name: "wrong secret", credential: APIKeyPrefix + key.ID + "_wrong", expectedErr: ErrInvalidCredential},
+		{name: "malformed API key", credential: APIKeyPrefix + key.ID, expectedErr: ErrInvalidCredential},
+		{name: "unknown key", credential: APIKeyPrefix + "unknown_secret", expectedErr: ErrUnknownKey},
+		{name: "revoked key", credential: revokedAPIKey, expectedErr: ErrRevokedKey},
+		{name: "expired token", credential: mintToken(secret, key.ID, now.Add(-time.Second)), expectedErr: ErrExpiredToken},
+		{name: "token signed with other secret", credential: mintToken(otherSecret, key.ID, now.Add(time.Hour)), expectedErr: ErrInvalidCredential},
+		{name: "tampered token", credential: strings.Replace(validToken, ".", "x.", 1), expectedErr: ErrInvalidCredential},
+		{name: "token for revoked key", credential: mintToken(secret, revokedKey.ID, now.Add(time.Hour)), expectedErr: ErrRevokedKey},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			principal, err := authenticator.Authenticate(testCase.credential)
+			if testCase.expectedErr != nil {
+				if !errors.Is(err, testCase.expectedErr) {
+					t.Errorf("Expected %v, got %v", testCase.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error authenticating: %s", err)
+			}
+			if principal.KeyID != key.ID || principal.Method != testCase.expectedMethod || principal.Limits != key.Limits {
+				t.Errorf("Expected principal of key %s by %s, got %+v", key.ID, testCase.expectedMethod, principal)
+			}
+		})
+	}
+
+	// Keys revoked once the store is created are no longer accepted, without creating it again
+	if err = keys.Revoke(key.ID, now); err != nil {
+		t.Fatalf("Error revoking key: %s", err)
+	}
+	if err = keys.Write(path); err != nil {
+		t.Fatalf("Error writing keys file: %s", err)
+	}
+	future := now.Add(time.Second)
+	if err = os.Chtimes(path, future, future); err != nil {
+		t.Fatalf("Error changing keys file time: %s", err)
+	}
+	if _, err = authenticator.Authenticate(apiKey); err != nil {
+		t.Errorf("Expected the keys file not to be checked again before the check interval, got %v", err)
+	}
+	store.now = func() time.Time { return time.Now().Add(keysCheckInterval) }
+	if _, err = authenticator.Authenticate(apiKey); !errors.Is(err, ErrRevokedKey) {
+		t.Errorf("Expected ErrRevokedKey once the keys file changed, got %v", err)
+	}
+
+	if _, err = NewAuthenticator(store, nil).Authenticate(validToken); !errors.Is(err, ErrInvalidCredential) {
+		t.Errorf("Expected tokens to be rejected without a token secret, got %v", err)
+	}
+}
+
+func TestTokenSecret(t *testing.T) {
+	if _, err := MintToken(make([]byte, MinTokenSecretBytes-1), "id", time.Now()); !errors.Is(err, ErrTokenSecretTooShort) {
+		t.Errorf("Expected ErrTokenSecretTooShort minting with a short secret, got %v", err)
+	}
+
+	dir := t.TempDir()
+	for _, testCase := range []struct {
+		name        string
+		content     string
+		expectedErr error
+	}{
+		{name: "not base64", content: "not base64!", expectedErr: ErrInvalidTokenSecret},
+		{name: "too short", content: "c2hvcnQ=", expectedErr: ErrTokenSecretTooShort},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			path := filepath.Join(dir, testCase.name)
+			if err := os.WriteFile(path, []byte(testCase.content), 0600); err != nil {
+				t.Fatalf("Error writing token secret: %s", err)
+			}
+			if _, err := ReadTokenSecret(path); !errors.Is(err, testCase.expectedErr) {
+				t.Errorf("Expected %v, got %v", testCase.expectedErr, err)
+			}
+		})
+	}
+}
+
+func TestMemoryQuotaStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 5, 1, 23, 59, 30, 0, time.UTC)
+	store := NewMemoryQuotaStore()
+	store.now = func() time.Time { return now }
+
+	for i := 1; i <= 3; i++ {
+		requests, resetAt, err := store.TakeRequest(ctx, "key")
+		if err != nil || requests != i || !resetAt.Equal(time.Date(2024, 5, 1, 23, 60, 0, 0, time.UTC)) {
+			t.Fatalf("Expected request %d of the minute resetting at midnight, got %d resetting at %s, %v", i, requests, resetAt, err)
+		}
+	}
+	if requests, _, _ := store.TakeRequest(ctx, "other"); requests != 1 {
+		t.Errorf("Expected requests to be counted per key, got %d for another key", requests)
+	}
+
+	if used, resetAt, _ := store.AddBytes(ctx, "key", 100); used != 100 || !resetAt.Equal(time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected 100 bytes used resetting at midnight, got %d resetting at %s", used, resetAt)
+	}
+	if used, _, _ := store.AddBytes(ctx, "key", 0); used != 100 {
+		t.Errorf("Expected adding 0 bytes to read the bytes used, got %d", used)
+	}
+
+	now = now.Add(time.Minute)
+	if requests, _, _ := store.TakeRequest(ctx, "key"); requests != 1 {
+		t.Errorf("Expected requests to reset the next minute, got %d", requests)
+	}
+	if used, _, _ := store.AddBytes(ctx, "key", 10); used != 10 {
+		t.Errorf("Expected bytes to reset the next day, got %d", used)
+	}
+	if used, _, _ := store.AddBytes(ctx, "key", -100); used != 0 {
+		t.Errorf("Expected bytes given back to not go below 0, got %d", used)
+	}
+
+	// Keys that only made requests are dropped once their minute ends, and those that used bytes once their day ends
+	if _, ok := store.usages["other"]; ok {
+		t.Error("Expected usage of a key whose windows ended to be dropped")
+	}
+	now = now.Add(24 * time.Hour)
+	store.TakeRequest(ctx, "other")
+	if _, ok := store.usages["key"]; ok || len(store.usages) != 1 {
+		t.Errorf("Expected only the usage of the key used in the current windows, got %d keys", len(store.usages))
+	}
+}
+
+func writeTokenSecret(t *testing.T) string {
+	secret, err := GenerateTokenSecret()
+	if err != nil {
+		t.Fatalf("Error generating token secret: %s", err)
+	}
+	path := filepath.Join(t.TempDir(), "token-secret.txt")
+	if err = os.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatalf("Error writing token secret: %s", err)
+	}
+	return path
+}
@@ -0,0 +1,145 @@
+package auth
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	MethodAPIKey = "api_key"
+	MethodToken  = "token"
+)
+
+// Principal Key a request was authenticated with, and how
+type Principal struct {
+	KeyID  string
+	Name   string
+	Limits Limits
+	Method string
+}
+
+// Authenticator Authenticates the credential supplied with a request, returning the key it belongs to.
+// ErrInvalidCredential, ErrUnknownKey, ErrRevokedKey or ErrExpiredToken are returned if it is not accepted
+type Authenticator interface {
+	Authenticate(credential string) (Principal, error)
+}
+
+// keysCheckInterval How often the key store checks whether the keys file changed. Revoked keys are accepted for up to
+// this long after the file is written
+const keysCheckInterval = 5 * time.Second
+
+// KeyStore Keys of the keys file, which is read again once it changes, so that keys created or revoked through nsteg
+// admin take effect without restarting the server. The file is checked at most once every keysCheckInterval, by a
+// single request while the others keep using the keys read last, so that requests are never held on the filesystem
+type KeyStore struct {
+	path string
+	now  func() time.Time
+
+	keys     atomic.Pointer[loadedKeys]
+	checking sync.Mutex
+}
+
+// loadedKeys Keys read from the keys file, along with the modification time of the file and when it was last checked
+type loadedKeys struct {
+	keys      *KeysFile
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+// NewKeyStore returns a store of the keys in the keys file at path, which must exist
+func NewKeyStore(path string) (*KeyStore, error) {
+	s := &KeyStore{path: path, now: time.Now}
+	if err := s.reload(nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// key returns the key with the ID, reading the keys file again first if it is due to be checked and it changed.
+// ErrRevokedKey is returned if the key was revoked
+func (s *KeyStore) key(id string) (Key, error) {
+	loaded := s.keys.Load()
+	if s.now().Sub(loaded.checkedAt) >= keysCheckInterval && s.checking.TryLock() {
+		err := s.reload(loaded)
+		s.checking.Unlock()
+		if err != nil {
+			return Key{}, err
+		}
+		loaded = s.keys.Load()
+	}
+
+	key := loaded.keys.Find(id)
+	if key == nil {
+		return Key{}, ErrUnknownKey
+	} else if key.RevokedAt != nil {
+		return Key{}, ErrRevokedKey
+	}
+	return *key, nil
+}
+
+// reload reads the keys file again unless it did not change since the loaded keys were read from it
+func (s *KeyStore) reload(loaded *loadedKeys) error {
+	checkedAt := s.now()
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if loaded != nil && info.ModTime().Equal(loaded.modTime) {
+		s.keys.Store(&loadedKeys{keys: loaded.keys, modTime: loaded.modTime, checkedAt: checkedAt})
+		return nil
+	}
+	keys, err := ReadKeysFile(s.path)
+	if err != nil {
+		return err
+	}
+	s.keys.Store(&loadedKeys{keys: keys, modTime: info.ModTime(), checkedAt: checkedAt})
+	return nil
+}
+
+// credentialAuthenticator Authenticates API keys against the key store, and tokens against the secret they were
+// signed with and the key store, telling them apart by their prefix
+type credentialAuthenticator struct {
+	keys        *KeyStore
+	tokenSecret []byte
+	now         func() time.Time
+}
+
+// NewAuthenticator returns an authenticator accepting the API keys of the key store, as well as the tokens signed for
+// them with the token secret, unless it is nil
+func NewAuthenticator(keys *KeyStore, tokenSecret []byte) Authenticator {
+	return &credentialAuthenticator{keys: keys, tokenSecret: tokenSecret, now: time.Now}
+}
+
+func (a *credentialAuthenticator) Authenticate(credential string) (Principal, error) {
+	switch {
+	case strings.HasPrefix(credential, APIKeyPrefix):
+		id, secret, err := parseAPIKey(credential)
+		if err != nil {
+			return Principal{}, err
+		}
+		key, err := a.keys.key(id)
+		if err != nil {
+			return Principal{}, err
+		}
+		if !key.matchesSecret(secret) {
+			return Principal{}, ErrInvalidCredential
+		}
+		return Principal{KeyID: key.ID, Name: key.Name, Limits: key.Limits, Method: MethodAPIKey}, nil
+	case strings.HasPrefix(credential, TokenPrefix) && a.tokenSecret != nil:
+		id, err := verifyToken(a.tokenSecret, credential, a.now())
+		if err != nil {
+			return Principal{}, err
+		}
+		key, err := a.keys.key(id)
+		if err != nil {
+			return Principal{}, fmt.Errorf("token for %s: %w", id, err)
+		}
+		return Principal{KeyID: key.ID, Name: key.Name, Limits: key.Limits, Method: MethodToken}, nil
+	default:
+		return Principal{}, ErrInvalidCredential
+	}
+}
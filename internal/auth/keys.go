@@ -0,0 +1,164 @@
+// Package auth authenticates the requests made to the server, with API keys listed in a keys file or with tokens
+// signed for those keys, and tracks how much each key uses the server so that its quotas can be enforced
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// APIKeyPrefix Prefix of API keys, which are made of the ID of the key and of its secret, separated by _
+	APIKeyPrefix = "nsk_"
+
+	keyIDBytes     = 8
+	keySecretBytes = 24
+)
+
+var (
+	ErrInvalidKeysFile   = errors.New("invalid keys file")
+	ErrInvalidCredential = errors.New("credential is neither a valid API key nor a valid token")
+	ErrUnknownKey        = errors.New("no key with this ID")
+	ErrRevokedKey        = errors.New("key was revoked")
+)
+
+// Limits Quotas of a key, each of them unlimited if 0
+type Limits struct {
+	RequestsPerMinute int `yaml:"requests_per_minute,omitempty"`
+
+	// DailyBytes Bytes of requests and responses per UTC day
+	DailyBytes int64 `yaml:"daily_bytes,omitempty"`
+}
+
+// Key Key allowed to use the server. Only the SHA-256 hash of its secret is stored, so the API key is only known to
+// whoever it was handed to when it was created
+type Key struct {
+	ID         string     `yaml:"id"`
+	Name       string     `yaml:"name"`
+	SecretHash string     `yaml:"secret_sha256"`
+	Limits     Limits     `yaml:",inline"`
+	CreatedAt  time.Time  `yaml:"created_at"`
+	RevokedAt  *time.Time `yaml:"revoked_at,omitempty"`
+}
+
+// KeysFile Keys allowed to use the server, as stored in the keys file
+type KeysFile struct {
+	Keys []Key `yaml:"keys"`
+}
+
+// ReadKeysFile reads the keys file at path. A missing file holds no keys, so that the first key can be created
+func ReadKeysFile(path string) (*KeysFile, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &KeysFile{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var keysFile KeysFile
+	if err = yaml.Unmarshal(content, &keysFile); err != nil {
+		return nil, fmt.Errorf("%w %s: %w", ErrInvalidKeysFile, path, err)
+	}
+	for _, key := range keysFile.Keys {
+		if key.ID == "" || key.SecretHash == "" {
+			return nil, fmt.Errorf("%w %s: every key needs an id and a secret_sha256", ErrInvalidKeysFile, path)
+		}
+	}
+	return &keysFile, nil
+}
+
+// Write writes the keys file to path, replacing the previous one at once so that servers reading it never see it half
+// written
+func (f *KeysFile) Write(path string) error {
+	content, err := yaml.Marshal(f)
+	if err != nil {
+		return err
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	if _, err = tempFile.Write(content); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err = tempFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tempFile.Name(), path)
+}
+
+// Find returns the key with the ID, or nil if there is none
+func (f *KeysFile) Find(id string) *Key {
+	for i := range f.Keys {
+		if f.Keys[i].ID == id {
+			return &f.Keys[i]
+		}
+	}
+	return nil
+}
+
+// CreateKey adds a new key to the file, returning it along with its API key, which is not stored anywhere
+func (f *KeysFile) CreateKey(name string, limits Limits, now time.Time) (Key, string, error) {
+	id, secret := make([]byte, keyIDBytes), make([]byte, keySecretBytes)
+	if _, err := rand.Read(id); err != nil {
+		return Key{}, "", err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return Key{}, "", err
+	}
+
+	encodedSecret := base64.RawURLEncoding.EncodeToString(secret)
+	key := Key{
+		ID:         hex.EncodeToString(id),
+		Name:       name,
+		SecretHash: hashSecret(encodedSecret),
+		Limits:     limits,
+		CreatedAt:  now.UTC(),
+	}
+	f.Keys = append(f.Keys, key)
+	return key, APIKeyPrefix + key.ID + "_" + encodedSecret, nil
+}
+
+// Revoke revokes the key with the ID, after which neither its API key nor the tokens signed for it are accepted
+func (f *KeysFile) Revoke(id string, now time.Time) error {
+	key := f.Find(id)
+	if key == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+	if key.RevokedAt == nil {
+		revokedAt := now.UTC()
+		key.RevokedAt = &revokedAt
+	}
+	return nil
+}
+
+// parseAPIKey returns the ID and secret of the API key
+func parseAPIKey(apiKey string) (string, string, error) {
+	id, secret, found := strings.Cut(strings.TrimPrefix(apiKey, APIKeyPrefix), "_")
+	if !strings.HasPrefix(apiKey, APIKeyPrefix) || !found || id == "" || secret == "" {
+		return "", "", ErrInvalidCredential
+	}
+	return id, secret, nil
+}
+
+// matchesSecret returns whether the secret is the one of the key, in constant time
+func (k Key) matchesSecret(secret string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(k.SecretHash)) == 1
+}
+
+func hashSecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])
+}
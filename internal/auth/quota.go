@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// QuotaStore Tracks how much each key uses the server. Requests are counted in fixed windows of a minute, and bytes in
+// UTC days. The in-memory store only tracks the usage of a single server, replicas sharing their quotas need a store
+// backed by an external service
+type QuotaStore interface {
+	// TakeRequest counts a request of the key, returning the requests it made in the current minute, this one
+	// included, and when the minute ends
+	TakeRequest(ctx context.Context, keyID string) (int, time.Time, error)
+
+	// AddBytes adds n bytes to those used by the key today, returning the bytes it used today and when the day ends.
+	// n can be 0 to only read the bytes used, and negative to give back bytes reserved for a request that used fewer
+	AddBytes(ctx context.Context, keyID string, n int64) (int64, time.Time, error)
+}
+
+// usage Usage of a key in the current windows
+type usage struct {
+	minute   time.Time
+	requests int
+
+	day   time.Time
+	bytes int64
+}
+
+// MemoryQuotaStore Quota store keeping the usage of the keys in memory, which is lost when the server restarts. The
+// usage of keys whose windows all ended is dropped once a minute, so that only keys used in the current day are kept
+type MemoryQuotaStore struct {
+	mu      sync.Mutex
+	usages  map[string]*usage
+	sweptAt time.Time
+	now     func() time.Time
+}
+
+func NewMemoryQuotaStore() *MemoryQuotaStore {
+	return &MemoryQuotaStore{usages: make(map[string]*usage), now: time.Now}
+}
+
+func (s *MemoryQuotaStore) TakeRequest(_ context.Context, keyID string) (int, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	usage := s.usage(keyID, now)
+	if minute := now.Truncate(time.Minute); !minute.Equal(usage.minute) {
+		usage.minute, usage.requests = minute, 0
+	}
+	usage.requests++
+	return usage.requests, usage.minute.Add(time.Minute), nil
+}
+
+func (s *MemoryQuotaStore) AddBytes(_ context.Context, keyID string, n int64) (int64, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now().UTC()
+	usage := s.usage(keyID, now)
+	if day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC); !day.Equal(usage.day) {
+		usage.day, usage.bytes = day, 0
+	}
+	// Bytes given back after the day rolled over were reserved the day before, and are not taken from the new one
+	usage.bytes = max(usage.bytes+n, 0)
+	return usage.bytes, usage.day.AddDate(0, 0, 1), nil
+}
+
+// usage returns the usage of the key, first dropping the usage of keys whose windows all ended if the minute rolled
+// over since they were last dropped
+func (s *MemoryQuotaStore) usage(keyID string, now time.Time) *usage {
+	if minute := now.Truncate(time.Minute); minute.After(s.sweptAt) {
+		s.sweptAt = minute
+		now = now.UTC()
+		day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		for id, u := range s.usages {
+			if u.minute.Before(minute) && u.day.Before(day) {
+				delete(s.usages, id)
+			}
+		}
+	}
+
+	u, ok := s.usages[keyID]
+	if !ok {
+		u = &usage{}
+		s.usages[keyID] = u
+	}
+	return u
+}
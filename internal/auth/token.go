@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// TokenPrefix Prefix of tokens, which are made of their claims and of the HMAC-SHA256 of the claims, separated by .
+	TokenPrefix = "nst_"
+
+	// MinTokenSecretBytes Minimum size of the secret tokens are signed with
+	MinTokenSecretBytes = 32
+)
+
+var (
+	ErrExpiredToken        = errors.New("token expired")
+	ErrInvalidTokenSecret  = errors.New("token secret file must hold a base64 encoded secret")
+	ErrTokenSecretTooShort = fmt.Errorf("token secret must be at least %d bytes", MinTokenSecretBytes)
+)
+
+// tokenClaims Claims of a token: the key it is signed for, and when it expires
+type tokenClaims struct {
+	KeyID     string `json:"kid"`
+	ExpiresAt int64  `json:"exp"`
+}
+
+// MintToken returns a token for the key, signed with the secret, which is accepted until expiresAt. Unlike API keys,
+// tokens can be handed out for a limited time without revealing the secret of the key
+func MintToken(secret []byte, keyID string, expiresAt time.Time) (string, error) {
+	if len(secret) < MinTokenSecretBytes {
+		return "", ErrTokenSecretTooShort
+	}
+	claims, err := json.Marshal(tokenClaims{KeyID: keyID, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", err
+	}
+	encodedClaims := base64.RawURLEncoding.EncodeToString(claims)
+	return TokenPrefix + encodedClaims + "." + base64.RawURLEncoding.EncodeToString(sign(secret, encodedClaims)), nil
+}
+
+// verifyToken returns the ID of the key the token is signed for, if it is signed with the secret and not expired
+func verifyToken(secret []byte, token string, now time.Time) (string, error) {
+	encodedClaims, encodedSignature, found := strings.Cut(strings.TrimPrefix(token, TokenPrefix), ".")
+	if !found {
+		return "", ErrInvalidCredential
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+	if err != nil || !hmac.Equal(signature, sign(secret, encodedClaims)) {
+		return "", ErrInvalidCredential
+	}
+
+	content, err := base64.RawURLEncoding.DecodeString(encodedClaims)
+	if err != nil {
+		return "", ErrInvalidCredential
+	}
+	var claims tokenClaims
+	if err = json.Unmarshal(content, &claims); err != nil || claims.KeyID == "" {
+		return "", ErrInvalidCredential
+	}
+	if !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return "", ErrExpiredToken
+	}
+	return claims.KeyID, nil
+}
+
+func sign(secret []byte, encodedClaims string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encodedClaims))
+	return mac.Sum(nil)
+}
+
+// GenerateTokenSecret returns a new random token secret, encoded as it is stored in the token secret file
+func GenerateTokenSecret() (string, error) {
+	secret := make([]byte, MinTokenSecretBytes)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(secret), nil
+}
+
+// ReadTokenSecret reads the base64 encoded token secret from the file at path
+func ReadTokenSecret(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("%w, %s does not: %w", ErrInvalidTokenSecret, path, err)
+	}
+	if len(secret) < MinTokenSecretBytes {
+		return nil, ErrTokenSecretTooShort
+	}
+	return secret, nil
+}
@@ -0,0 +1,282 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"nsteg/internal/auth"
+	"os"
+	"time"
+)
+
+const (
+	adminKeyCreateCommandPath = "nsteg admin key create"
+	adminKeyRevokeCommandPath = "nsteg admin key revoke"
+	adminKeyListCommandPath   = "nsteg admin key list"
+	adminTokenMintCommandPath = "nsteg admin token mint"
+)
+
+var (
+	ErrTokenSecretExists = errors.New("token secret file already exists")
+	ErrNoKeysFile        = errors.New("no keys file, set --auth-keys-file or auth.keys_file in the config")
+	ErrNoTokenSecretFile = errors.New("no token secret file, set --auth-token-secret-file or auth.token_secret_file in the config")
+)
+
+func AdminCommand() *cobra.Command {
+	adminCmd := &cobra.Command{
+		Use:   "admin",
+		Short: "Administer the API keys and tokens accepted by nsteg serve",
+		Long:  "Administer the API keys and tokens accepted by nsteg serve. Keys are stored in the keys file the server is started with, which it checks for changes every few seconds, so keys created or revoked take effect within seconds without restarting it",
+	}
+
+	keyCmd := &cobra.Command{
+		Use:   "key",
+		Short: "Create, revoke and list API keys",
+	}
+	keyCmd.AddCommand(adminKeyCreateCommand(), adminKeyRevokeCommand(), adminKeyListCommand())
+
+	tokenCmd := &cobra.Command{
+		Use:   "token",
+		Short: "Mint tokens signed for API keys, and generate the secret they are signed with",
+	}
+	tokenCmd.AddCommand(adminTokenMintCommand(), adminTokenSecretCommand())
+
+	adminCmd.AddCommand(keyCmd, tokenCmd)
+	return adminCmd
+}
+
+func adminKeyCreateCommand() *cobra.Command {
+	var keysFile, name string
+	var limits auth.Limits
+
+	command := &cobra.Command{
+		Use:     "create",
+		Short:   "Create an API key, which is printed once and cannot be recovered afterwards",
+		Example: "nsteg admin key create --name ci --requests-per-minute 60 --daily-bytes 1073741824",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if limits.RequestsPerMinute < 0 || limits.DailyBytes < 0 {
+				return fmt.Errorf("%w: limits cannot be negative", ErrInvalidFlags)
+			}
+			keys, err := readKeysFile(keysFile)
+			if err != nil {
+				return err
+			}
+			key, apiKey, err := keys.CreateKey(name, limits, time.Now())
+			if err != nil {
+				return err
+			}
+			if err = keys.Write(keysFile); err != nil {
+				return err
+			}
+			if jsonOutput() {
+				result := newKeyResult(key)
+				result.APIKey = apiKey
+				return printResult(os.Stdout, "create", result)
+			}
+			fmt.Printf("Created key %s in %s\n", key.ID, keysFile)
+			fmt.Printf("API key: %s\n", apiKey)
+			fmt.Println("The API key is only printed now, store it safely")
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&keysFile, "auth-keys-file", "", "Keys file to add the key to, created if it does not exist")
+	command.Flags().StringVar(&name, "name", "", "Name describing who the key is for")
+	command.Flags().IntVar(&limits.RequestsPerMinute, "requests-per-minute", 0, "Most requests the key can make per minute. Unlimited if 0")
+	command.Flags().Int64Var(&limits.DailyBytes, "daily-bytes", 0, "Most bytes of requests and responses the key can use per UTC day. Unlimited if 0")
+	MarkFlagsRequired(command, "name")
+	return command
+}
+
+func adminKeyRevokeCommand() *cobra.Command {
+	var keysFile, id string
+
+	command := &cobra.Command{
+		Use:     "revoke",
+		Short:   "Revoke an API key, along with the tokens signed for it",
+		Example: "nsteg admin key revoke --id 3f9a0c1b2d4e5f60",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keys, err := readKeysFile(keysFile)
+			if err != nil {
+				return err
+			}
+			if err = keys.Revoke(id, time.Now()); err != nil {
+				return err
+			}
+			if err = keys.Write(keysFile); err != nil {
+				return err
+			}
+			if jsonOutput() {
+				return printResult(os.Stdout, "revoke", newKeyResult(*keys.Find(id)))
+			}
+			fmt.Printf("Revoked key %s\n", id)
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&keysFile, "auth-keys-file", "", "Keys file holding the key")
+	command.Flags().StringVar(&id, "id", "", "ID of the key to revoke")
+	MarkFlagsRequired(command, "id")
+	return command
+}
+
+func adminKeyListCommand() *cobra.Command {
+	var keysFile string
+
+	command := &cobra.Command{
+		Use:   "list",
+		Short: "List the API keys of the keys file, revoked ones included",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			keys, err := readKeysFile(keysFile)
+			if err != nil {
+				return err
+			}
+			if jsonOutput() {
+				results := make([]KeyResult, 0, len(keys.Keys))
+				for _, key := range keys.Keys {
+					results = append(results, newKeyResult(key))
+				}
+				return printResult(os.Stdout, "list", results)
+			}
+			fmt.Printf("%-16s %-20s %-20s %-12s %-12s %s\n", "ID", "Name", "Created", "Requests/min", "Daily bytes", "Revoked")
+			for _, key := range keys.Keys {
+				revoked := ""
+				if key.RevokedAt != nil {
+					revoked = key.RevokedAt.Format(time.RFC3339)
+				}
+				fmt.Printf("%-16s %-20s %-20s %-12s %-12s %s\n", key.ID, key.Name, key.CreatedAt.Format(time.RFC3339),
+					formatLimit(int64(key.Limits.RequestsPerMinute), false), formatLimit(key.Limits.DailyBytes, true), revoked)
+			}
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&keysFile, "auth-keys-file", "", "Keys file to list the keys of")
+	return command
+}
+
+// readKeysFile reads the keys file set through --auth-keys-file or the config, which the admin commands cannot do without
+func readKeysFile(path string) (*auth.KeysFile, error) {
+	if path == "" {
+		return nil, ErrNoKeysFile
+	}
+	return auth.ReadKeysFile(path)
+}
+
+// newKeyResult returns the result for the key, which leaves out the hash of its secret
+func newKeyResult(key auth.Key) KeyResult {
+	return KeyResult{
+		ID:                key.ID,
+		Name:              key.Name,
+		RequestsPerMinute: key.Limits.RequestsPerMinute,
+		DailyBytes:        key.Limits.DailyBytes,
+		CreatedAt:         key.CreatedAt,
+		RevokedAt:         key.RevokedAt,
+	}
+}
+
+func formatLimit(limit int64, bytes bool) string {
+	if limit == 0 {
+		return "unlimited"
+	} else if bytes {
+		return humanize.Bytes(uint64(limit))
+	}
+	return fmt.Sprint(limit)
+}
+
+func adminTokenMintCommand() *cobra.Command {
+	var keysFile, tokenSecretFile, id string
+	var ttl time.Duration
+
+	command := &cobra.Command{
+		Use:     "mint",
+		Short:   "Mint a token for an API key, accepted by the server until it expires or the key is revoked",
+		Example: "nsteg admin token mint --id 3f9a0c1b2d4e5f60 --ttl 1h",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if ttl <= 0 {
+				return fmt.Errorf("%w: --ttl must be positive", ErrInvalidFlags)
+			}
+			keys, err := readKeysFile(keysFile)
+			if err != nil {
+				return err
+			}
+			key := keys.Find(id)
+			if key == nil {
+				return fmt.Errorf("%w: %s", auth.ErrUnknownKey, id)
+			} else if key.RevokedAt != nil {
+				return fmt.Errorf("%w: %s", auth.ErrRevokedKey, id)
+			}
+
+			if tokenSecretFile == "" {
+				return ErrNoTokenSecretFile
+			}
+			secret, err := auth.ReadTokenSecret(tokenSecretFile)
+			if err != nil {
+				return err
+			}
+			expiresAt := time.Now().Add(ttl)
+			token, err := auth.MintToken(secret, id, expiresAt)
+			if err != nil {
+				return err
+			}
+			if jsonOutput() {
+				return printResult(os.Stdout, "mint", TokenResult{KeyID: id, Token: token, ExpiresAt: expiresAt.UTC()})
+			}
+			fmt.Println(token)
+			fmt.Fprintf(os.Stderr, "Token for key %s expires at %s\n", id, expiresAt.UTC().Format(time.RFC3339))
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&keysFile, "auth-keys-file", "", "Keys file holding the key")
+	command.Flags().StringVar(&tokenSecretFile, "auth-token-secret-file", "", "File holding the secret tokens are signed with, as generated by nsteg admin token secret")
+	command.Flags().StringVar(&id, "id", "", "ID of the key to mint the token for")
+	command.Flags().DurationVar(&ttl, "ttl", time.Hour, "Time the token is accepted for")
+	MarkFlagsRequired(command, "id")
+	return command
+}
+
+func adminTokenSecretCommand() *cobra.Command {
+	var outputPath string
+
+	command := &cobra.Command{
+		Use:     "secret",
+		Short:   "Generate the secret tokens are signed with, to pass to nsteg serve as --auth-token-secret-file",
+		Example: "nsteg admin token secret --output-file token-secret.txt",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			secret, err := auth.GenerateTokenSecret()
+			if err != nil {
+				return err
+			}
+			if outputPath == "" {
+				if jsonOutput() {
+					return printResult(os.Stdout, "secret", TokenSecretResult{Secret: secret})
+				}
+				fmt.Println(secret)
+				return nil
+			}
+			// Replacing the secret would invalidate every token signed with it
+			file, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+			if errors.Is(err, os.ErrExist) {
+				return fmt.Errorf("%w: %s", ErrTokenSecretExists, outputPath)
+			} else if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintln(file, secret); err != nil {
+				file.Close()
+				return err
+			}
+			if err = file.Close(); err != nil {
+				return err
+			}
+			if jsonOutput() {
+				return printResult(os.Stdout, "secret", TokenSecretResult{Output: outputPath})
+			}
+			return nil
+		},
+	}
+
+	command.Flags().StringVar(&outputPath, "output-file", "", "File to which to write the secret. Printed to stdout if not supplied")
+	return command
+}
@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"nsteg/pkg/analysis"
+	"os"
+)
+
+func AnalyzeCommand() *cobra.Command {
+	var imagePath string
+
+	analyzeCmd := &cobra.Command{
+		Use:     "analyze",
+		Example: "nsteg analyze --image encoded-image.png",
+		Short:   "Estimate how detectable hidden data in an image is, using chi-square, RS and sample pair analysis",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return AnalyzeImage(imagePath)
+		},
+	}
+
+	analyzeCmd.Flags().StringVar(&imagePath, "image", "", "Image to analyze")
+	MarkFlagsRequired(analyzeCmd, "image")
+
+	return analyzeCmd
+}
+
+func AnalyzeImage(imagePath string) error {
+	s := NewSpinner()
+	s.Prefix = "Analyzing image "
+	s.Start()
+
+	img, err := getImageFromFilePath(imagePath)
+	if err != nil {
+		s.Stop()
+		return err
+	}
+	report := analysis.Analyze(img)
+	s.Stop()
+
+	if jsonOutput() {
+		return printResult(os.Stdout, "analyze", AnalyzeResult{Image: imagePath, Report: report})
+	}
+
+	fmt.Printf("%-8s %-18s %-16s %-10s %-10s\n", "Channel", "Chi-square prob.", "Chi-square rate", "RS rate", "SPA rate")
+	for _, channel := range report.Channels {
+		fmt.Printf("%-8s %-18.4f %-16.4f %-10.4f %-10.4f\n", channel.Channel, channel.ChiSquareProbability,
+			channel.ChiSquareRate, channel.RSRate, channel.SPARate)
+	}
+	fmt.Printf("Estimated embedding rate: %.2f%%\n", report.EmbeddingRate*100)
+	fmt.Printf("Suspicion score: %.2f\n", report.Suspicion)
+	return nil
+}
@@ -0,0 +1,429 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"nsteg"
+	"nsteg/internal/logging"
+	"nsteg/pkg/model"
+	"nsteg/pkg/seal"
+	"nsteg/pkg/signature"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+)
+
+const (
+	batchModeEncode = "encode"
+	batchModeDecode = "decode"
+)
+
+var (
+	ErrInvalidBatchMode = errors.New("batch job mode must be either encode or decode")
+	ErrBatchJobsFailed  = errors.New("some batch jobs failed")
+)
+
+// BatchManifest Jobs to run by nsteg image batch, as read from the manifest file
+type BatchManifest struct {
+	// Workers Jobs run at once, overridden by --workers. Defaults to the number of CPUs
+	Workers int        `yaml:"workers"`
+	Jobs    []BatchJob `yaml:"jobs"`
+}
+
+// BatchJob Encode or decode of a single image, with the same options as nsteg image encode and decode. Relative paths
+// are relative to the directory of the manifest
+type BatchJob struct {
+	// Name Identifies the job in the summary, defaults to its position in the manifest
+	Name string `yaml:"name"`
+	// Mode Either encode, the default, or decode
+	Mode  string `yaml:"mode"`
+	Image string `yaml:"image"`
+	// Output Image to generate when encoding, or directory to write the decoded files to when decoding, which defaults
+	// to the directory of the manifest
+	Output string   `yaml:"output"`
+	Files  []string `yaml:"files"`
+
+	LSBs           byte   `yaml:"lsbs"`
+	PngCompression string `yaml:"png_compression"`
+	QualityMetrics bool   `yaml:"quality_metrics"`
+
+	Key        string   `yaml:"key"`
+	DecoyKey   string   `yaml:"decoy_key"`
+	DecoyFiles []string `yaml:"decoy_files"`
+	Raw        bool     `yaml:"raw"`
+	Recipients []string `yaml:"recipients"`
+	SignKey    string   `yaml:"sign_key"`
+	Identity   string   `yaml:"identity"`
+	Trust      string   `yaml:"trust"`
+}
+
+// BatchJobResult Outcome of a batch job, with the stats of the encode or decode it performed
+type BatchJobResult struct {
+	Job         string             `json:"job"`
+	Mode        string             `json:"mode"`
+	Image       string             `json:"image"`
+	Output      string             `json:"output"`
+	Success     bool               `json:"success"`
+	Error       string             `json:"error,omitempty"`
+	Files       []string           `json:"files,omitempty"`
+	Duration    time.Duration      `json:"duration"`
+	EncodeStats *model.EncodeStats `json:"encode_stats,omitempty"`
+	DecodeStats *model.DecodeStats `json:"decode_stats,omitempty"`
+}
+
+func batchCommand() *cobra.Command {
+	var manifestPath string
+	var workers int
+	var jsonReport bool
+
+	batchCmd := &cobra.Command{
+		Use:     "batch",
+		Example: "nsteg image batch --manifest jobs.yaml --workers 4",
+		Short:   "Run the encode and decode jobs listed in a manifest file, printing a summary of every job",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return RunBatch(cmd.Context(), manifestPath, workers, jsonReport)
+		},
+	}
+
+	batchCmd.Flags().StringVar(&manifestPath, "manifest", "", "YAML manifest listing the jobs to run, each with an image, an output, files and the same options as encode and decode")
+	batchCmd.Flags().IntVar(&workers, "workers", 0, "Jobs to run at once, overriding the workers set in the manifest. Defaults to the number of CPUs")
+	batchCmd.Flags().BoolVar(&jsonReport, "json", false, "Print the report of every job as JSON instead of a summary table")
+	MarkFlagsRequired(batchCmd, "manifest")
+
+	return batchCmd
+}
+
+// RunBatch runs every job in the manifest with a pool of workers, carrying on past failed jobs, and prints a report of
+// all of them once done. ErrBatchJobsFailed is returned if any job failed
+func RunBatch(ctx context.Context, manifestPath string, workers int, jsonReport bool) error {
+	manifest, err := readBatchManifest(manifestPath)
+	if err != nil {
+		return err
+	}
+	if workers < 1 {
+		workers = manifest.Workers
+	}
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	// Interrupting the command fails the jobs still running or pending, and still prints the report
+	stopOnInterrupt()
+
+	results := make([]BatchJobResult, len(manifest.Jobs))
+	jobIndexes := make(chan int)
+	var wg sync.WaitGroup
+	var completed int
+	var progressLock sync.Mutex
+	for w := 0; w < min(workers, len(manifest.Jobs)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobIndexes {
+				results[i] = runBatchJob(ctx, manifest.Jobs[i])
+
+				progressLock.Lock()
+				completed++
+				status := "done"
+				if !results[i].Success {
+					status = "failed: " + results[i].Error
+				}
+				if !jsonOutput() {
+					fmt.Fprintf(os.Stderr, "[%d/%d] %s %s\n", completed, len(manifest.Jobs), results[i].Job, status)
+				}
+				progressLock.Unlock()
+			}
+		}()
+	}
+	for i := range manifest.Jobs {
+		jobIndexes <- i
+	}
+	close(jobIndexes)
+	wg.Wait()
+
+	var failed int
+	for _, result := range results {
+		if !result.Success {
+			failed++
+		}
+	}
+	if failed > 0 {
+		err = fmt.Errorf("%w: %d of %d", ErrBatchJobsFailed, failed, len(results))
+	}
+
+	if jsonOutput() {
+		// The report of the jobs is printed along with the error, instead of the error on its own
+		if printErr := printJSON(os.Stdout, newCommandResult("batch", results, err)); printErr != nil {
+			return printErr
+		}
+		if err != nil {
+			return reportedError{err}
+		}
+		return nil
+	}
+	if jsonReport {
+		if printErr := printJSON(os.Stdout, results); printErr != nil {
+			return printErr
+		}
+	} else {
+		printBatchSummary(results)
+	}
+	return err
+}
+
+func readBatchManifest(manifestPath string) (*BatchManifest, error) {
+	manifestFile, err := os.Open(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+	defer manifestFile.Close()
+
+	var manifest BatchManifest
+	decoder := yaml.NewDecoder(manifestFile)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("error reading manifest %s: %w", manifestPath, err)
+	}
+
+	manifestDir := filepath.Dir(manifestPath)
+	for i := range manifest.Jobs {
+		job := &manifest.Jobs[i]
+		if job.Name == "" {
+			job.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if job.Mode == "" {
+			job.Mode = batchModeEncode
+		}
+		if job.Mode == batchModeDecode && job.Output == "" {
+			job.Output = "."
+		}
+
+		for _, path := range []*string{&job.Image, &job.Output, &job.SignKey, &job.Identity, &job.Trust} {
+			*path = resolveManifestPath(manifestDir, *path)
+		}
+		for _, paths := range [][]string{job.Files, job.DecoyFiles} {
+			for p := range paths {
+				paths[p] = resolveManifestPath(manifestDir, paths[p])
+			}
+		}
+	}
+	return &manifest, nil
+}
+
+func resolveManifestPath(manifestDir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(manifestDir, path)
+}
+
+func runBatchJob(ctx context.Context, job BatchJob) BatchJobResult {
+	result := BatchJobResult{Job: job.Name, Mode: job.Mode, Image: job.Image, Output: job.Output}
+	jobStart := time.Now()
+
+	var err error
+	switch job.Mode {
+	case batchModeEncode:
+		var stats model.EncodeStats
+		stats, err = runBatchEncode(ctx, job)
+		result.EncodeStats = &stats
+		result.Files = append(append([]string{}, job.Files...), job.DecoyFiles...)
+	case batchModeDecode:
+		var revealed *nsteg.Revealed
+		revealed, err = runBatchDecode(ctx, job)
+		if revealed != nil {
+			result.DecodeStats = &revealed.Stats
+			for _, file := range revealed.Files {
+				result.Files = append(result.Files, file.Name)
+			}
+		}
+	default:
+		err = fmt.Errorf("%w, got %s", ErrInvalidBatchMode, job.Mode)
+	}
+
+	result.Duration = time.Since(jobStart)
+	result.Success = err == nil
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func runBatchEncode(ctx context.Context, job BatchJob) (model.EncodeStats, error) {
+	if job.Image == "" || job.Output == "" || len(job.Files) == 0 {
+		return model.EncodeStats{}, fmt.Errorf("encode jobs require an image, an output and files")
+	}
+
+	mappedCompression, found := pngCompressionMapping[job.PngCompression]
+	if !found {
+		mappedCompression = pngCompressionMapping["default"]
+	}
+	opts := []nsteg.Option{nsteg.WithPNGCompression(mappedCompression)}
+	if job.LSBs != 0 {
+		opts = append(opts, nsteg.WithLSBs(job.LSBs))
+	}
+	if job.QualityMetrics {
+		opts = append(opts, nsteg.WithQualityMetrics())
+	}
+	if job.SignKey != "" {
+		signingKey, err := signature.ReadPrivateKey(job.SignKey)
+		if err != nil {
+			return model.EncodeStats{}, err
+		}
+		opts = append(opts, nsteg.WithSigningKey(signingKey))
+	}
+	for _, recipientKey := range job.Recipients {
+		recipient, err := seal.ParseRecipient(recipientKey)
+		if err != nil {
+			return model.EncodeStats{}, err
+		}
+		opts = append(opts, nsteg.WithRecipients(recipient))
+	}
+	if job.Raw {
+		opts = append(opts, nsteg.WithRaw(optionalKey(job.Key)))
+	} else if job.Key != "" {
+		opts = append(opts, nsteg.WithKey([]byte(job.Key)))
+	}
+
+	filesToHide, err := openFilesToHide(job.Files)
+	if err != nil {
+		return model.EncodeStats{}, err
+	}
+	defer closeFilesToHide(filesToHide)
+	if job.DecoyKey == "" && len(job.DecoyFiles) > 0 {
+		return model.EncodeStats{}, fmt.Errorf("decoy files require a decoy_key to be encoded under")
+	} else if job.DecoyKey != "" {
+		decoyFiles, err := openFilesToHide(job.DecoyFiles)
+		if err != nil {
+			return model.EncodeStats{}, err
+		}
+		defer closeFilesToHide(decoyFiles)
+		opts = append(opts, nsteg.WithDecoy([]byte(job.DecoyKey), decoyFiles))
+	}
+
+	srcFile, err := os.Open(job.Image)
+	if err != nil {
+		return model.EncodeStats{}, err
+	}
+	defer srcFile.Close()
+	outputFile, err := os.Create(job.Output)
+	if err != nil {
+		return model.EncodeStats{}, err
+	}
+	defer outputFile.Close()
+
+	stats, err := nsteg.Hide(ctx, srcFile, outputFile, filesToHide, append(opts, nsteg.WithLogger(logging.Default().With("job", job.Name)))...)
+	if err != nil {
+		// The output image is left empty or incomplete, and would pass for the result of the job
+		outputFile.Close()
+		removeOutput(job.Output)
+	}
+	return stats, err
+}
+
+func runBatchDecode(ctx context.Context, job BatchJob) (*nsteg.Revealed, error) {
+	if job.Image == "" {
+		return nil, fmt.Errorf("decode jobs require an image")
+	}
+	if job.Raw && job.LSBs == 0 {
+		return nil, fmt.Errorf("raw decode jobs require the lsbs the image was encoded with, which raw images do not store")
+	}
+
+	var opts []nsteg.Option
+	if job.LSBs != 0 {
+		opts = append(opts, nsteg.WithLSBs(job.LSBs))
+	}
+	if job.Identity != "" {
+		identities, err := readIdentities(job.Identity)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nsteg.WithIdentities(identities...))
+	}
+	if job.Raw {
+		opts = append(opts, nsteg.WithRaw(optionalKey(job.Key)))
+	} else if job.Key != "" {
+		opts = append(opts, nsteg.WithKey([]byte(job.Key)))
+	}
+	if job.Trust != "" {
+		trustedKeys, err := signature.ReadTrustedKeys(job.Trust)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nsteg.WithTrustedSigners(trustedKeys...))
+	}
+
+	srcFile, err := os.Open(job.Image)
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+
+	revealed, err := nsteg.Reveal(ctx, srcFile, append(opts, nsteg.WithLogger(logging.Default().With("job", job.Name)))...)
+	if err != nil {
+		return revealed, err
+	}
+
+	if err = os.MkdirAll(job.Output, 0775); err != nil {
+		return revealed, err
+	}
+	for _, decodedFile := range revealed.Files {
+		// Only the base name is kept, so that files of different jobs never escape their output directory
+		if err = os.WriteFile(filepath.Join(job.Output, filepath.Base(decodedFile.Name)), decodedFile.Content, 0664); err != nil {
+			return revealed, err
+		}
+	}
+	return revealed, nil
+}
+
+// optionalKey returns nil for an empty key, so that options requiring a key reject it
+func optionalKey(key string) []byte {
+	if key == "" {
+		return nil
+	}
+	return []byte(key)
+}
+
+func printBatchSummary(results []BatchJobResult) {
+	fmt.Printf("%-20s %-7s %-8s %-14s %-14s %-14s %s\n", "Job", "Mode", "Status", "Capacity used", "Setup", "Data", "Output image")
+	for _, result := range results {
+		status := "ok"
+		if !result.Success {
+			status = "failed"
+		}
+
+		capacityUsed, setup, data, outputImage := "-", "-", "-", "-"
+		if stats := result.EncodeStats; stats != nil && stats.CapacityBytes > 0 {
+			capacityUsed = fmt.Sprintf("%.2f%%", stats.CapacityUsed()*100)
+		}
+		if stats := result.EncodeStats; stats != nil && result.Success {
+			setup, data, outputImage = formatDuration(stats.Setup), formatDuration(stats.DataEncoding), formatDuration(stats.OutputImageEncoding)
+		}
+		if stats := result.DecodeStats; stats != nil && result.Success {
+			data = formatDuration(stats.DataDecoding)
+		}
+		fmt.Printf("%-20s %-7s %-8s %-14s %-14s %-14s %s\n", result.Job, result.Mode, status, capacityUsed, setup, data, outputImage)
+	}
+
+	for _, result := range results {
+		if !result.Success {
+			fmt.Printf("%s failed: %s\n", result.Job, result.Error)
+		}
+	}
+	succeeded := 0
+	for _, result := range results {
+		if result.Success {
+			succeeded++
+		}
+	}
+	fmt.Printf("%d of %d jobs succeeded\n", succeeded, len(results))
+}
+
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Microsecond).String()
+}
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"nsteg/test"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunBatch(t *testing.T) {
+	jobsDir := filepath.Join(t.TempDir(), "jobs")
+	if err := os.Mkdir(jobsDir, 0775); err != nil {
+		t.Fatalf("Error creating jobs directory: %s", err)
+	}
+	carrier, err := os.Create(filepath.Join(jobsDir, "carrier.png"))
+	if err != nil {
+		t.Fatalf("Error creating carrier: %s", err)
+	}
+	if err = png.Encode(carrier, test.GenerateNaturalImage(100, 100, 4)); err != nil {
+		t.Fatalf("Error encoding carrier: %s", err)
+	}
+	carrier.Close()
+	secret := test.GenerateRandomBytes(500)
+	if err = os.WriteFile(filepath.Join(jobsDir, "secret.bin"), secret, 0664); err != nil {
+		t.Fatalf("Error writing file to hide: %s", err)
+	}
+
+	// A single worker runs the jobs in order, so that the decode job reads the image written by the encode job. The
+	// decode job does not set lsbs, which must be read from the image
+	manifestPath := filepath.Join(jobsDir, "manifest.yaml")
+	manifest := `workers: 1
+jobs:
+  - name: encode
+    image: carrier.png
+    output: encoded.png
+    files: [secret.bin]
+    lsbs: 2
+  - name: decode
+    mode: decode
+    image: encoded.png
+    output: decoded
+  - name: not an image
+    image: secret.bin
+    output: failed.png
+    files: [secret.bin]
+`
+	if err = os.WriteFile(manifestPath, []byte(manifest), 0664); err != nil {
+		t.Fatalf("Error writing manifest: %s", err)
+	}
+
+	parsed, err := readBatchManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("Error reading manifest: %s", err)
+	}
+	encodeJob := parsed.Jobs[0]
+	if encodeJob.Image != filepath.Join(jobsDir, "carrier.png") || encodeJob.Output != filepath.Join(jobsDir, "encoded.png") || encodeJob.Files[0] != filepath.Join(jobsDir, "secret.bin") {
+		t.Errorf("Expected paths relative to the manifest directory, got %+v", encodeJob)
+	}
+	if parsed.Jobs[1].Mode != batchModeDecode || parsed.Jobs[2].Mode != batchModeEncode {
+		t.Errorf("Expected modes decode and encode, got %s and %s", parsed.Jobs[1].Mode, parsed.Jobs[2].Mode)
+	}
+
+	err = RunBatch(context.Background(), manifestPath, 0, false)
+	if !errors.Is(err, ErrBatchJobsFailed) {
+		t.Fatalf("Expected %s, got %v", ErrBatchJobsFailed, err)
+	}
+	decoded, err := os.ReadFile(filepath.Join(jobsDir, "decoded", "secret.bin"))
+	if err != nil {
+		t.Fatalf("Error reading decoded file: %s", err)
+	}
+	if !bytes.Equal(decoded, secret) {
+		t.Error("Decoded file does not match the hidden one")
+	}
+	if _, err = os.Stat(filepath.Join(jobsDir, "failed.png")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the output of the failed job to be removed, got %v", err)
+	}
+}
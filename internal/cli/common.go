@@ -1,11 +1,26 @@
 package cli
 
 import (
+	"errors"
+	"fmt"
 	"github.com/briandowns/spinner"
 	"github.com/spf13/cobra"
+	"io"
+	"nsteg/pkg/payload"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"time"
 )
 
+// stdioPath Path standing for stdin when reading, and for stdout when writing
+const stdioPath = "-"
+
+var (
+	ErrStdoutSingleFile   = errors.New("only images holding a single file can be decoded to stdout")
+	ErrInvalidPayloadName = errors.New("payload name must be a file name, without any directories")
+)
+
 func MarkFlagsRequired(cmd *cobra.Command, flags ...string) {
 	for _, flag := range flags {
 		if err := cmd.MarkFlagRequired(flag); err != nil {
@@ -14,6 +29,96 @@ func MarkFlagsRequired(cmd *cobra.Command, flags ...string) {
 	}
 }
 
+// interruptible Set once the running command stops by itself when its context is cancelled on SIGINT or SIGTERM, in
+// which case the process is left running after the first signal, for the command to clean up. See StopsOnInterrupt
+var interruptible atomic.Bool
+
+// StopsOnInterrupt returns whether the running command stops by itself once its context is cancelled, rather than
+// having to be killed
+func StopsOnInterrupt() bool {
+	return interruptible.Load()
+}
+
+func stopOnInterrupt() {
+	interruptible.Store(true)
+}
+
+// NewSpinner returns a spinner, which renders nothing in json mode so that only the JSON document is printed
 func NewSpinner() *spinner.Spinner {
+	if jsonOutput() {
+		return spinner.New(spinner.CharSets[4], 100*time.Millisecond, spinner.WithWriter(io.Discard))
+	}
 	return spinner.New(spinner.CharSets[4], 100*time.Millisecond)
 }
+
+// openInput opens the file at the path for reading, or stdin if the path is stdioPath
+func openInput(path string) (io.ReadCloser, error) {
+	if path == stdioPath {
+		return io.NopCloser(os.Stdin), nil
+	}
+	return os.Open(path)
+}
+
+// createOutput creates the file at the path for writing, or returns stdout if the path is stdioPath, which is left
+// open once the returned writer is closed
+func createOutput(path string) (io.WriteCloser, error) {
+	if path == stdioPath {
+		return nopWriteCloser{Writer: os.Stdout}, nil
+	}
+	return os.Create(path)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// removeOutput removes the output file at the path, left incomplete by a command that failed, unless it is stdout
+func removeOutput(path string) {
+	if path != stdioPath {
+		os.Remove(path)
+	}
+}
+
+// describePath returns the path as shown to the user, which is stdout or stdin for stdioPath
+func describePath(path string) string {
+	if path == stdioPath {
+		return "stdout"
+	}
+	return path
+}
+
+// spoolStdinPayload copies stdin into a temporary file with the supplied name, since the size of every file must be
+// known before it is encoded, returning its path and a function removing it
+func spoolStdinPayload(name string) (string, func(), error) {
+	if name != payload.FileName(name) || name == "." || name == ".." {
+		return "", nil, fmt.Errorf("%w, got %s", ErrInvalidPayloadName, name)
+	}
+
+	spoolDir, err := os.MkdirTemp("", "nsteg-stdin-")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {
+		os.RemoveAll(spoolDir)
+	}
+
+	payloadPath := filepath.Join(spoolDir, name)
+	spoolFile, err := os.Create(payloadPath)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	_, err = io.Copy(spoolFile, os.Stdin)
+	if closeErr := spoolFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	return payloadPath, cleanup, nil
+}
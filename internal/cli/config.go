@@ -0,0 +1,298 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	configEnvPrefix = "NSTEG_"
+	configPathEnv   = configEnvPrefix + "CONFIG"
+
+	encodeCommandPath = "nsteg image encode"
+	serveCommandPath  = "nsteg serve"
+
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+var (
+	ErrInvalidConfig = errors.New("invalid configuration")
+)
+
+// setting Option that can be set in the config file, through its environment variable, and through its flag on the
+// commands listed, each one overriding the previous one. Settings without commands have a global flag instead. The
+// default of a setting is the default of its flag
+type setting struct {
+	key      string
+	flag     string
+	commands []string
+}
+
+// settings Every option of the config file, whose key is the section and the name of the option in the file
+var settings = []setting{
+	{key: "encode.lsbs", flag: "lsbs", commands: []string{encodeCommandPath}},
+	{key: "encode.png_compression", flag: "png-compression", commands: []string{encodeCommandPath}},
+	{key: "encode.use_slow_png", flag: "use-slow-png", commands: []string{encodeCommandPath}},
+	{key: "encode.chunk_size_multiplier", flag: "chunk-size-multiplier", commands: []string{encodeCommandPath}},
+	{key: "encode.quality_metrics", flag: "quality-metrics", commands: []string{encodeCommandPath}},
+	{key: "server.address", flag: "address", commands: []string{serveCommandPath}},
+	{key: "server.port", flag: "port", commands: []string{serveCommandPath}},
+	{key: "limits.max_request_bytes", flag: "max-request-bytes", commands: []string{serveCommandPath}},
+	{key: "limits.max_files_part_bytes", flag: "max-files-part-bytes", commands: []string{serveCommandPath}},
+	{key: "limits.max_carrier_pixels", flag: "max-carrier-pixels", commands: []string{serveCommandPath}},
+	{key: "limits.max_payload_bytes", flag: "max-payload-bytes", commands: []string{serveCommandPath}},
+	{key: "limits.max_files", flag: "max-files", commands: []string{serveCommandPath}},
+	{key: "limits.memory_budget_bytes", flag: "memory-budget-bytes", commands: []string{serveCommandPath}},
+	{key: "limits.admission_timeout", flag: "admission-timeout", commands: []string{serveCommandPath}},
+	{key: "timeouts.read", flag: "read-timeout", commands: []string{serveCommandPath}},
+	{key: "timeouts.write", flag: "write-timeout", commands: []string{serveCommandPath}},
+	{key: "timeouts.idle", flag: "idle-timeout", commands: []string{serveCommandPath}},
+	{key: "timeouts.shutdown_delay", flag: "shutdown-delay", commands: []string{serveCommandPath}},
+	{key: "timeouts.shutdown", flag: "shutdown-timeout", commands: []string{serveCommandPath}},
+	{key: "tracing.exporter", flag: "trace-exporter", commands: []string{serveCommandPath}},
+	{key: "tracing.endpoint", flag: "trace-endpoint", commands: []string{serveCommandPath}},
+	{key: "tracing.sample_ratio", flag: "trace-sample-ratio", commands: []string{serveCommandPath}},
+	{key: "auth.keys_file", flag: "auth-keys-file", commands: []string{serveCommandPath, adminKeyCreateCommandPath, adminKeyRevokeCommandPath, adminKeyListCommandPath, adminTokenMintCommandPath}},
+	{key: "auth.token_secret_file", flag: "auth-token-secret-file", commands: []string{serveCommandPath, adminTokenMintCommandPath}},
+	{key: "logging.level", flag: "log-level"},
+	{key: "logging.format", flag: "log-format"},
+}
+
+// configPath Config file set through the global --config flag
+var configPath string
+
+// loadedConfig Config loaded before running any command
+var loadedConfig *layeredConfig
+
+// layeredConfig Values of the settings from the config file, which are overridden by the environment variables
+type layeredConfig struct {
+	// path Config file the values were read from, if any
+	path       string
+	found      bool
+	fileValues map[string]string
+}
+
+// AddConfigFlag adds the global --config flag to the root command, and loads the config before running any command.
+// Flags not supplied take the value of their setting from the environment or the config file, in that order
+func AddConfigFlag(rootCommand *cobra.Command) {
+	rootCommand.PersistentFlags().StringVar(&configPath, "config", "", "Config file with the defaults of encode, serve, admin and the logging flags. Defaults to $"+configPathEnv+", or else nsteg/config.yaml in the user config directory, such as ~/.config/nsteg/config.yaml")
+
+	preRun := rootCommand.PersistentPreRunE
+	rootCommand.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if preRun != nil {
+			if err := preRun(cmd, args); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if loadedConfig, err = loadConfig(configPath); err != nil {
+			return err
+		}
+		return loadedConfig.applyToFlags(cmd)
+	}
+}
+
+func ConfigCommand() *cobra.Command {
+	configCmd := &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration read from the config file and the environment",
+	}
+
+	configCmd.AddCommand(&cobra.Command{
+		Use:     "show",
+		Example: "NSTEG_ENCODE_LSBS=2 nsteg config show",
+		Short:   "Print the effective configuration, merged from the defaults, the config file and the environment, along with the source of every value",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ShowConfig(cmd.Root())
+		},
+	})
+	return configCmd
+}
+
+// ConfigResult Result of nsteg config show
+type ConfigResult struct {
+	File      string          `json:"file"`
+	FileFound bool            `json:"file_found"`
+	Settings  []SettingResult `json:"settings"`
+}
+
+// SettingResult Effective value of a setting, and whether it comes from its default, the config file or its
+// environment variable
+type SettingResult struct {
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+	Env    string `json:"env"`
+
+	// Flags Flags overriding the setting, prefixed with the command they belong to
+	Flags []string `json:"flags,omitempty"`
+}
+
+// ShowConfig prints the effective value of every setting of the loaded config, along with where it comes from
+func ShowConfig(rootCommand *cobra.Command) error {
+	result := ConfigResult{File: loadedConfig.path, FileFound: loadedConfig.found}
+	for i := range settings {
+		s := &settings[i]
+		value, source := loadedConfig.value(s)
+		if source == sourceDefault {
+			value = s.flagDefault(rootCommand)
+		}
+
+		flags := []string{"--" + s.flag}
+		if len(s.commands) > 0 {
+			flags = nil
+			for _, commandPath := range s.commands {
+				flags = append(flags, commandPath+" --"+s.flag)
+			}
+		}
+		result.Settings = append(result.Settings, SettingResult{Key: s.key, Value: value, Source: source, Env: s.envVar(), Flags: flags})
+	}
+
+	if jsonOutput() {
+		return printResult(os.Stdout, "show", result)
+	}
+
+	fileStatus := ""
+	if !result.FileFound {
+		fileStatus = " (not found)"
+	}
+	fmt.Printf("Config file: %s%s\n", result.File, fileStatus)
+	fmt.Printf("%-30s %-10s %-8s %-36s %s\n", "Key", "Value", "Source", "Environment variable", "Flag")
+	for _, setting := range result.Settings {
+		fmt.Printf("%-30s %-10s %-8s %-36s %s\n", setting.Key, setting.Value, setting.Source, setting.Env, strings.Join(setting.Flags, ","))
+	}
+	fmt.Println("Environment variables override the config file, and flags override both")
+	return nil
+}
+
+// loadConfig reads the config file at path, or at the default path if empty, in which case the file may not exist
+func loadConfig(path string) (*layeredConfig, error) {
+	explicitPath := path != ""
+	if !explicitPath {
+		path = os.Getenv(configPathEnv)
+		explicitPath = path != ""
+	}
+	if !explicitPath {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return &layeredConfig{}, nil
+		}
+		path = filepath.Join(configDir, "nsteg", "config.yaml")
+	}
+
+	config := &layeredConfig{path: path, fileValues: map[string]string{}}
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) && !explicitPath {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	config.found = true
+
+	var sections map[string]map[string]any
+	if err = yaml.NewDecoder(file).Decode(&sections); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: reading %s: %w", ErrInvalidConfig, path, err)
+	}
+	for section, values := range sections {
+		for name, value := range values {
+			key := section + "." + name
+			if settingByKey(key) == nil {
+				return nil, fmt.Errorf("%w: unknown setting %s in %s", ErrInvalidConfig, key, path)
+			}
+			if value != nil {
+				config.fileValues[key] = fmt.Sprint(value)
+			}
+		}
+	}
+	return config, nil
+}
+
+// value returns the value of the setting from the environment, or from the config file, along with where it came from
+func (c *layeredConfig) value(s *setting) (string, string) {
+	if value, found := os.LookupEnv(s.envVar()); found {
+		return value, sourceEnv
+	}
+	if value, found := c.fileValues[s.key]; found {
+		return value, sourceFile
+	}
+	return "", sourceDefault
+}
+
+// applyToFlags sets the flags of the command not supplied to the value of their setting, if it is set
+func (c *layeredConfig) applyToFlags(cmd *cobra.Command) error {
+	for i := range settings {
+		s := &settings[i]
+		if len(s.commands) > 0 && !slices.Contains(s.commands, cmd.CommandPath()) {
+			continue
+		}
+		flag := cmd.Flags().Lookup(s.flag)
+		if flag == nil || flag.Changed {
+			continue
+		}
+		value, source := c.value(s)
+		if source == sourceDefault {
+			continue
+		}
+		if err := flag.Value.Set(value); err != nil {
+			return fmt.Errorf("%w: %s from %s: %w", ErrInvalidConfig, s.key, c.describeSource(s, source), err)
+		}
+	}
+	return nil
+}
+
+func (c *layeredConfig) describeSource(s *setting, source string) string {
+	switch source {
+	case sourceEnv:
+		return "$" + s.envVar()
+	case sourceFile:
+		return c.path
+	default:
+		return source
+	}
+}
+
+// flagDefault returns the default of the flag of the setting, as defined by the first command it belongs to, or by the
+// root command for global flags
+func (s *setting) flagDefault(rootCommand *cobra.Command) string {
+	if len(s.commands) == 0 {
+		if flag := rootCommand.PersistentFlags().Lookup(s.flag); flag != nil {
+			return flag.DefValue
+		}
+	}
+	for _, commandPath := range s.commands {
+		cmd, _, err := rootCommand.Find(strings.Fields(commandPath)[1:])
+		if err != nil {
+			continue
+		}
+		if flag := cmd.Flags().Lookup(s.flag); flag != nil {
+			return flag.DefValue
+		}
+	}
+	return ""
+}
+
+// envVar returns the environment variable of the setting, such as NSTEG_ENCODE_LSBS for encode.lsbs
+func (s *setting) envVar() string {
+	return configEnvPrefix + strings.ToUpper(strings.ReplaceAll(s.key, ".", "_"))
+}
+
+func settingByKey(key string) *setting {
+	for i := range settings {
+		if settings[i].key == key {
+			return &settings[i]
+		}
+	}
+	return nil
+}
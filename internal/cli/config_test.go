@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"errors"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	for _, testCase := range []struct {
+		name string
+		// file Contents of the config file passed as --config, which is not passed if empty
+		file string
+		env  map[string]string
+		args []string
+		// missingPath Passes a --config that does not exist, instead of the file
+		missingPath bool
+		// pathFromEnv Passes the path of the config file through $NSTEG_CONFIG instead of --config
+		pathFromEnv  bool
+		expectedLSBs string
+		expectedErr  error
+	}{
+		{name: "default", expectedLSBs: "3"},
+		{name: "file over default", file: "encode:\n  lsbs: 4\n", expectedLSBs: "4"},
+		{name: "env over file", file: "encode:\n  lsbs: 4\n", env: map[string]string{"NSTEG_ENCODE_LSBS": "5"}, expectedLSBs: "5"},
+		{name: "flag over env", file: "encode:\n  lsbs: 4\n", env: map[string]string{"NSTEG_ENCODE_LSBS": "5"}, args: []string{"--lsbs", "6"}, expectedLSBs: "6"},
+		{name: "config path from env", file: "encode:\n  lsbs: 4\n", pathFromEnv: true, expectedLSBs: "4"},
+		{name: "unknown key", file: "encode:\n  lsb: 4\n", expectedErr: ErrInvalidConfig},
+		{name: "invalid value", file: "encode:\n  lsbs: many\n", expectedErr: ErrInvalidConfig},
+		{name: "missing explicit path", missingPath: true, expectedErr: os.ErrNotExist},
+		{name: "missing path from env", missingPath: true, pathFromEnv: true, expectedErr: os.ErrNotExist},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			// The default config file is looked up in a directory of the test, where there is none
+			configDir := t.TempDir()
+			t.Setenv("XDG_CONFIG_HOME", configDir)
+			t.Setenv("HOME", configDir)
+			t.Setenv(configPathEnv, "")
+			for name, value := range testCase.env {
+				t.Setenv(name, value)
+			}
+
+			path := ""
+			if testCase.missingPath {
+				path = filepath.Join(configDir, "missing.yaml")
+			} else if testCase.file != "" {
+				path = filepath.Join(configDir, "config.yaml")
+				if err := os.WriteFile(path, []byte(testCase.file), 0664); err != nil {
+					t.Fatalf("Error writing config file: %s", err)
+				}
+			}
+
+			if testCase.pathFromEnv {
+				t.Setenv(configPathEnv, path)
+				path = ""
+			}
+
+			var lsbs int8
+			encodeCmd := &cobra.Command{Use: "encode"}
+			encodeCmd.Flags().Int8Var(&lsbs, "lsbs", 3, "")
+			imageCmd := &cobra.Command{Use: "image"}
+			imageCmd.AddCommand(encodeCmd)
+			(&cobra.Command{Use: "nsteg"}).AddCommand(imageCmd)
+			if err := encodeCmd.Flags().Parse(testCase.args); err != nil {
+				t.Fatalf("Error parsing flags: %s", err)
+			}
+
+			config, err := loadConfig(path)
+			if err == nil {
+				err = config.applyToFlags(encodeCmd)
+			}
+			if testCase.expectedErr != nil {
+				if !errors.Is(err, testCase.expectedErr) {
+					t.Fatalf("Expected %s, got %v", testCase.expectedErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error applying config: %s", err)
+			}
+			if value := encodeCmd.Flags().Lookup("lsbs").Value.String(); value != testCase.expectedLSBs {
+				t.Errorf("Expected lsbs %s, got %s", testCase.expectedLSBs, value)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"nsteg"
+	"nsteg/internal/auth"
+	"nsteg/internal/logging"
+	"nsteg/internal/telemetry"
+	"nsteg/pkg/analysis"
+	"nsteg/pkg/carrier"
+	nstegImage "nsteg/pkg/image"
+	"nsteg/pkg/payload"
+	"nsteg/pkg/seal"
+	"nsteg/pkg/signature"
+)
+
+// Exit codes of the nsteg command, one per class of error, which are stable so that scripts can rely on them
+const (
+	ExitOK                = 0
+	ExitError             = 1
+	ExitInvalidInput      = 2
+	ExitIO                = 3
+	ExitInvalidImage      = 4
+	ExitImageNotBigEnough = 5
+	ExitDecode            = 6
+	ExitSignature         = 7
+	ExitBatchJobsFailed   = 8
+	ExitInterrupted       = 130
+)
+
+var (
+	ErrInvalidFlags = errors.New("invalid flags")
+)
+
+// errorClass Errors sharing an error code and exit code
+type errorClass struct {
+	code     string
+	exitCode int
+	errs     []error
+}
+
+// errorClasses Classes of errors, checked in order, so more specific classes come first
+var errorClasses = []errorClass{
+	{code: "interrupted", exitCode: ExitInterrupted, errs: []error{context.Canceled}},
+	{code: "invalid_input", exitCode: ExitInvalidInput, errs: []error{
+		ErrInvalidFlags, ErrInvalidConfig, logging.ErrInvalidLogLevel, logging.ErrInvalidLogFormat, ErrInvalidOutputFormat, ErrInvalidPayloadName, ErrStdoutSingleFile, ErrInvalidBatchMode,
+		nsteg.ErrConflictingOptions, nstegImage.ErrInvalidLSBsToUse, nstegImage.ErrVolumeCount, nstegImage.ErrSameVolumeKeys,
+		signature.ErrInvalidKey, signature.ErrReservedFileName, seal.ErrInvalidRecipient, seal.ErrInvalidIdentity, seal.ErrNoRecipients,
+		telemetry.ErrInvalidExporter, telemetry.ErrInvalidEndpoint, telemetry.ErrInvalidSampleRatio,
+		ErrNoKeysFile, ErrNoTokenSecretFile, ErrTokenSecretExists, auth.ErrInvalidKeysFile, auth.ErrUnknownKey, auth.ErrRevokedKey, auth.ErrInvalidTokenSecret, auth.ErrTokenSecretTooShort,
+	}},
+	{code: "invalid_image", exitCode: ExitInvalidImage, errs: []error{nsteg.ErrInvalidCarrier, analysis.ErrDifferentBounds}},
+	{code: "image_not_big_enough", exitCode: ExitImageNotBigEnough, errs: []error{nstegImage.ErrImageNotBigEnough, carrier.ErrCarrierTooSmall}},
+	{code: "decode_error", exitCode: ExitDecode, errs: []error{
+		nstegImage.ErrDecodeFileBounds, nstegImage.ErrNoVolumeFoundForKey, payload.ErrMaxAllocExceeded, payload.ErrMissingSignature, carrier.ErrOutOfBounds,
+		seal.ErrNoMatchingIdentity, seal.ErrWrongKey, seal.ErrAuthentication,
+	}},
+	{code: "signature_error", exitCode: ExitSignature, errs: []error{signature.ErrInvalidSignature, signature.ErrUnsigned, signature.ErrUntrustedSigner}},
+	{code: "batch_jobs_failed", exitCode: ExitBatchJobsFailed, errs: []error{ErrBatchJobsFailed}},
+}
+
+// classifyError returns the error code and exit code of the error
+func classifyError(err error) (string, int) {
+	for _, class := range errorClasses {
+		for _, classErr := range class.errs {
+			if errors.Is(err, classErr) {
+				return class.code, class.exitCode
+			}
+		}
+	}
+
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return "io_error", ExitIO
+	}
+	return "error", ExitError
+}
@@ -1,18 +1,24 @@
 package cli
 
 import (
+	"context"
 	"fmt"
 	"github.com/spf13/cobra"
 	"image"
-	"image/draw"
 	"image/png"
+	"io"
+	"nsteg"
+	"nsteg/internal/logging"
+	"nsteg/pkg/analysis"
 	"nsteg/pkg/config"
 	nstegImage "nsteg/pkg/image"
 	"nsteg/pkg/model"
+	"nsteg/pkg/payload"
+	"nsteg/pkg/seal"
+	"nsteg/pkg/signature"
 	"os"
+	"path/filepath"
 	"strings"
-	"sync"
-	"time"
 )
 
 var (
@@ -31,7 +37,7 @@ func ImageCommands() *cobra.Command {
 		Example: "nsteg image encode --image source.png --output-file output.png --files file1.txt,file2.txt --files file3.txt",
 	}
 
-	imageCmd.AddCommand(encodeImageCommand(), decodeFilesFromImage())
+	imageCmd.AddCommand(encodeImageCommand(), decodeFilesFromImage(), capacityCommand(), compareImagesCommand(), pickCoverCommand(), batchCommand())
 	return imageCmd
 }
 
@@ -40,6 +46,7 @@ type commonOpts struct {
 	chunkSizeMultiplier int
 	pngCompression      string
 	slowPngEncode       bool
+	qualityMetrics      bool
 }
 
 func (o commonOpts) toEncodeConfig() config.ImageEncodeConfig {
@@ -48,18 +55,26 @@ func (o commonOpts) toEncodeConfig() config.ImageEncodeConfig {
 		mappedCompression = png.DefaultCompression
 	}
 	return config.ImageEncodeConfig{
-		LSBsToUse:           byte(o.lsbsToUse),
-		ChunkSizeMultiplier: o.chunkSizeMultiplier,
-		PngCompressionLevel: mappedCompression,
-		SlowPngEncode:       o.slowPngEncode,
+		LSBsToUse:             byte(o.lsbsToUse),
+		ChunkSizeMultiplier:   o.chunkSizeMultiplier,
+		PngCompressionLevel:   mappedCompression,
+		SlowPngEncode:         o.slowPngEncode,
+		ComputeQualityMetrics: o.qualityMetrics,
 	}
 }
 
 type encodeImageOpts struct {
-	sourceImage string
-	outputImage string
-	fileNames   []string
-	config      commonOpts
+	sourceImage    string
+	outputImage    string
+	fileNames      []string
+	key            string
+	decoyKey       string
+	decoyFileNames []string
+	raw            bool
+	recipients     []string
+	signKeyPath    string
+	stdinPayload   string
+	config         commonOpts
 }
 
 func encodeImageCommand() *cobra.Command {
@@ -70,170 +85,675 @@ func encodeImageCommand() *cobra.Command {
 		Example: "nsteg image encode --image source.png --output-file output.png --files file1.txt,file2.txt --files file3.txt",
 		Short:   "Encode data into an image",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return EncodeImageWithFiles(opts.sourceImage, opts.outputImage, opts.fileNames, opts.config.toEncodeConfig())
+			if opts.stdinPayload != "" {
+				if opts.sourceImage == stdioPath {
+					return fmt.Errorf("%w: the image and the payload cannot both be read from stdin", ErrInvalidFlags)
+				}
+				payloadPath, cleanup, err := spoolStdinPayload(opts.stdinPayload)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+				opts.fileNames = append(opts.fileNames, payloadPath)
+			}
+
+			encodeConfig := opts.config.toEncodeConfig()
+			if opts.signKeyPath != "" {
+				signingKey, err := signature.ReadPrivateKey(opts.signKeyPath)
+				if err != nil {
+					return err
+				}
+				encodeConfig.SigningKey = signingKey
+			}
+
+			if len(opts.recipients) > 0 {
+				if opts.raw || opts.key != "" || opts.decoyKey != "" || len(opts.decoyFileNames) > 0 {
+					return fmt.Errorf("%w: files encoded for recipients cannot also be encoded with a key or decoy files", ErrInvalidFlags)
+				}
+				return EncodeImageWithFilesForRecipients(cmd.Context(), opts.sourceImage, opts.outputImage, opts.fileNames, opts.recipients, encodeConfig)
+			}
+			if opts.raw {
+				if opts.key == "" || opts.decoyKey != "" || len(opts.decoyFileNames) > 0 {
+					return fmt.Errorf("%w: raw mode requires a --key, and does not support decoy files", ErrInvalidFlags)
+				}
+				return EncodeImageWithFilesRaw(cmd.Context(), opts.sourceImage, opts.outputImage, opts.fileNames, opts.key, encodeConfig)
+			}
+			if opts.key == "" {
+				if opts.decoyKey != "" || len(opts.decoyFileNames) > 0 {
+					return fmt.Errorf("%w: decoy files can only be encoded along with files hidden under --key", ErrInvalidFlags)
+				}
+				return EncodeImageWithFiles(cmd.Context(), opts.sourceImage, opts.outputImage, opts.fileNames, encodeConfig)
+			}
+
+			volumes := []HiddenVolume{{Key: opts.key, FileNames: opts.fileNames}}
+			if opts.decoyKey != "" {
+				volumes = append(volumes, HiddenVolume{Key: opts.decoyKey, FileNames: opts.decoyFileNames})
+			} else if len(opts.decoyFileNames) > 0 {
+				return fmt.Errorf("%w: decoy files require a --decoy-key to be encoded under", ErrInvalidFlags)
+			}
+			return EncodeImageWithHiddenVolumes(cmd.Context(), opts.sourceImage, opts.outputImage, volumes, encodeConfig)
 		},
 	}
 
-	encImgCmd.Flags().StringVar(&opts.sourceImage, "image", "", "Image to encode data to")
-	encImgCmd.Flags().StringVar(&opts.outputImage, "output-file", "", "Name for the encoded image that will be generated")
+	encImgCmd.Flags().StringVar(&opts.sourceImage, "image", "", "Image to encode data to, or - to read it from stdin")
+	encImgCmd.Flags().StringVar(&opts.outputImage, "output-file", "", "Name for the encoded image that will be generated, or - to write it to stdout, in which case stats are printed to stderr")
 	encImgCmd.Flags().StringSliceVar(&opts.fileNames, "files", nil, "Files to encode into the source image. Can be comma separated, or you can supply the files param several times with each file")
+	encImgCmd.Flags().StringVar(&opts.stdinPayload, "stdin-payload", "", "Read a file to encode from stdin, encoding it under this name along with any --files")
+	encImgCmd.Flags().StringSliceVar(&opts.recipients, "recipient", nil, "Public key, as generated by nsteg keygen, of a recipient able to decode the files. Can be supplied several times to encode the files for several recipients")
+	encImgCmd.Flags().StringVar(&opts.signKeyPath, "sign-key", "", "Signing key file, as generated by nsteg keygen --signing, with which to sign the files so that recipients can verify who sent them. Signed images cannot be decoded by versions of nsteg from before signing")
+	encImgCmd.Flags().StringVar(&opts.key, "key", "", "Encrypt the files into a hidden volume that can only be decoded with this key, and which cannot be told apart from noise without it")
+	encImgCmd.Flags().StringVar(&opts.decoyKey, "decoy-key", "", "Key for a second hidden volume holding the decoy files, which can be revealed under coercion without giving away the files hidden under --key")
+	encImgCmd.Flags().BoolVar(&opts.raw, "raw", false, "Store nothing in the clear, masking the files with --key instead of encrypting them into a hidden volume. Decoding requires the same --key and --lsbs, which are not stored in the image")
+	encImgCmd.Flags().StringSliceVar(&opts.decoyFileNames, "decoy-files", nil, "Harmless files to encode into the decoy volume. Can be comma separated, or you can supply the decoy-files param several times with each file")
 
 	encImgCmd.Flags().Int8Var(&opts.config.lsbsToUse, "lsbs", 3, "Least significant bits to use from each pixel. Can be 1-8. The more LSBs are used, the more distortion will be noticeable in the final image")
 	encImgCmd.Flags().IntVar(&opts.config.chunkSizeMultiplier, "chunk-size-multiplier", config.DefaultChunkSizeMultiplier, "Chunk size to be handled by a single goroutine")
 	encImgCmd.Flags().StringVar(&opts.config.pngCompression, "png-compression", "default", "Compression for output png. Options are default, none, fast, best")
 	encImgCmd.Flags().BoolVar(&opts.config.slowPngEncode, "use-slow-png", false, "Provided in case the preferred faster png encoder causes issues, to fallback on the slower standard one")
+	encImgCmd.Flags().BoolVar(&opts.config.qualityMetrics, "quality-metrics", false, "Compute the PSNR, MSE and SSIM between the source and encoded images. Off by default, since it keeps a copy of the source image in memory and computing them takes extra time")
 
-	MarkFlagsRequired(encImgCmd, "image", "output-file", "files")
+	MarkFlagsRequired(encImgCmd, "image", "output-file")
+	encImgCmd.MarkFlagsOneRequired("files", "stdin-payload")
 
 	return encImgCmd
 }
 
-func EncodeImageWithFiles(imageSourcePath, outputPath string, fileNames []string, config config.ImageEncodeConfig) error {
-	srcImage, err := getImageFromFilePath(imageSourcePath)
+// HiddenVolume Files to be hidden under their own key
+type HiddenVolume struct {
+	Key       string
+	FileNames []string
+}
+
+func EncodeImageWithFiles(ctx context.Context, imageSourcePath, outputPath string, fileNames []string, config config.ImageEncodeConfig) error {
+	filesToHide, err := openFilesToHide(fileNames)
 	if err != nil {
 		return err
 	}
+	defer closeFilesToHide(filesToHide)
 
-	iEncoder, err := nstegImage.NewImageEncoder(srcImage, config)
+	return encodeImage(ctx, imageSourcePath, outputPath, fileNames, filesToHide, config)
+}
+
+// EncodeImageWithFilesRaw encodes the files in raw mode, where neither the LSBs setting nor the file table are stored
+// in the clear, so both the key and LSBs setting must be shared with the recipient out of band
+func EncodeImageWithFilesRaw(ctx context.Context, imageSourcePath, outputPath string, fileNames []string, key string, encodeConfig config.ImageEncodeConfig) error {
+	filesToHide, err := openFilesToHide(fileNames)
 	if err != nil {
 		return err
 	}
+	defer closeFilesToHide(filesToHide)
 
-	var filesToHide []model.InputFile
-	for _, fileName := range fileNames {
-		file, err := os.Open(fileName)
+	return encodeImage(ctx, imageSourcePath, outputPath, fileNames, filesToHide, encodeConfig, nsteg.WithRaw([]byte(key)))
+}
+
+// EncodeImageWithFilesForRecipients encodes the files encrypted for the supplied public keys, so that they can only be
+// decoded with the identity of one of the recipients
+func EncodeImageWithFilesForRecipients(ctx context.Context, imageSourcePath, outputPath string, fileNames, recipientKeys []string, config config.ImageEncodeConfig) error {
+	var recipients []*seal.Recipient
+	for _, recipientKey := range recipientKeys {
+		recipient, err := seal.ParseRecipient(recipientKey)
 		if err != nil {
 			return err
 		}
+		recipients = append(recipients, recipient)
+	}
 
-		fileStat, err := file.Stat()
+	filesToHide, err := openFilesToHide(fileNames)
+	if err != nil {
+		return err
+	}
+	defer closeFilesToHide(filesToHide)
+
+	return encodeImage(ctx, imageSourcePath, outputPath, fileNames, filesToHide, config, nsteg.WithRecipients(recipients...))
+}
+
+// EncodeImageWithHiddenVolumes encodes each volume into the image encrypted under its key, so that decoding with one
+// key never reveals the existence of the other volume. The first volume holds the files, and the optional second one
+// the decoy files
+func EncodeImageWithHiddenVolumes(ctx context.Context, imageSourcePath, outputPath string, volumes []HiddenVolume, config config.ImageEncodeConfig) error {
+	if len(volumes) == 0 || len(volumes) > nstegImage.MaxVolumes {
+		return nstegImage.ErrVolumeCount
+	}
+
+	var allFileNames []string
+	var volumeFiles [][]model.InputFile
+	for _, volume := range volumes {
+		filesToHide, err := openFilesToHide(volume.FileNames)
 		if err != nil {
 			return err
 		}
-		filesToHide = append(filesToHide, model.InputFile{
-			Name:    file.Name(),
-			Content: file,
-			Size:    fileStat.Size(),
-		})
+		defer closeFilesToHide(filesToHide)
+
+		allFileNames = append(allFileNames, volume.FileNames...)
+		volumeFiles = append(volumeFiles, filesToHide)
+	}
+
+	opts := []nsteg.Option{nsteg.WithKey([]byte(volumes[0].Key))}
+	if len(volumes) > 1 {
+		opts = append(opts, nsteg.WithDecoy([]byte(volumes[1].Key), volumeFiles[1]))
 	}
+	return encodeImage(ctx, imageSourcePath, outputPath, allFileNames, volumeFiles[0], config, opts...)
+}
 
-	outputFile, err := os.Create(outputPath)
+func encodeImage(ctx context.Context, imageSourcePath, outputPath string, fileNames []string, filesToHide []model.InputFile, encodeConfig config.ImageEncodeConfig, opts ...nsteg.Option) error {
+	// Interrupting the command stops encoding right away, instead of once all the data is embedded, and removes the
+	// output file
+	stopOnInterrupt()
+	srcFile, err := openInput(imageSourcePath)
 	if err != nil {
 		return err
 	}
+	defer srcFile.Close()
 
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		s := NewSpinner()
-		s.FinalMSG = fmt.Sprintf("Generated %s which has the following files encoded: %s\n", outputPath, strings.Join(fileNames, ","))
-		s.Start()
-		for {
-			if iEncoder.Stats().Setup == 0 {
-				s.Prefix = "Setting up encoder "
-			} else if iEncoder.Stats().Setup > 0 && iEncoder.Stats().DataEncoding == 0 {
-				s.Prefix = "Encoding data "
-			} else if iEncoder.Stats().DataEncoding > 0 && iEncoder.Stats().OutputImageEncoding == 0 {
-				s.Prefix = "Generating output PNG image "
-			} else {
-				break
-			}
-			time.Sleep(time.Millisecond * 500)
-		}
-		s.Stop()
-	}()
-
-	defer outputFile.Close()
-	err = iEncoder.EncodeFiles(filesToHide)
+	outputFile, err := createOutput(outputPath)
 	if err != nil {
 		return err
 	}
-	err = iEncoder.WriteEncodedPNG(outputFile)
+	defer outputFile.Close()
+
+	bar := newProgressBar()
+	defer bar.Finish("")
+	opts = append([]nsteg.Option{nsteg.WithEncodeConfig(encodeConfig), nsteg.WithProgress(bar.Update), nsteg.WithLogger(logging.Default())}, opts...)
+	stats, err := nsteg.Hide(ctx, srcFile, outputFile, filesToHide, opts...)
 	if err != nil {
+		// Nothing was encoded, so the output file created beforehand is left empty or incomplete
+		outputFile.Close()
+		removeOutput(outputPath)
 		return err
 	}
+	// Files are listed by the name they are stored under, which leaves out the temporary directory of a stdin payload
+	storedNames := make([]string, 0, len(fileNames))
+	for _, fileName := range fileNames {
+		storedNames = append(storedNames, payload.FileName(fileName))
+	}
+
+	// Stats are kept out of the way of the image when it is written to stdout
+	statsOutput := os.Stdout
+	if outputPath == stdioPath {
+		statsOutput = os.Stderr
+	}
+	if jsonOutput() {
+		files := make([]FileResult, 0, len(fileNames))
+		for i, fileName := range fileNames {
+			fileStat, err := os.Stat(fileName)
+			if err != nil {
+				return err
+			}
+			files = append(files, FileResult{Name: storedNames[i], Size: fileStat.Size()})
+		}
+		return printResult(statsOutput, "encode", EncodeResult{
+			Output:       outputPath,
+			LSBs:         encodeConfig.LSBsToUse,
+			Files:        files,
+			CapacityUsed: stats.CapacityUsed(),
+			Stats:        stats,
+		})
+	}
 
-	wg.Wait()
-	// Change to use logger with global config for log level
-	fmt.Printf("Encoder setup time: %s\n", iEncoder.Stats().Setup)
-	fmt.Printf("Data encode time: %s\n", iEncoder.Stats().DataEncoding)
-	fmt.Printf("Output image encode time: %s\n", iEncoder.Stats().OutputImageEncoding)
+	bar.Finish(fmt.Sprintf("Generated %s which has the following files encoded: %s\n", describePath(outputPath), strings.Join(storedNames, ",")))
+	logging.Default().Info("Encoded image",
+		"setup", stats.Setup,
+		"data_encoding", stats.DataEncoding,
+		"output_image_encoding", stats.OutputImageEncoding,
+		"capacity_used", stats.CapacityUsed(),
+	)
+	if quality := stats.Quality; quality != nil {
+		printImageQuality(statsOutput, *quality)
+	}
 	return nil
 }
 
+func openFilesToHide(fileNames []string) ([]model.InputFile, error) {
+	var filesToHide []model.InputFile
+	for _, fileName := range fileNames {
+		file, err := os.Open(fileName)
+		if err != nil {
+			closeFilesToHide(filesToHide)
+			return nil, err
+		}
+
+		fileStat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			closeFilesToHide(filesToHide)
+			return nil, err
+		}
+		filesToHide = append(filesToHide, model.InputFile{
+			Name:    file.Name(),
+			Content: file,
+			Size:    fileStat.Size(),
+		})
+	}
+	return filesToHide, nil
+}
+
+func closeFilesToHide(files []model.InputFile) {
+	for _, file := range files {
+		if closer, ok := file.Content.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+func printImageQuality(output io.Writer, quality model.ImageQuality) {
+	fmt.Fprintf(output, "PSNR: %.2f dB\n", quality.PSNR)
+	fmt.Fprintf(output, "MSE: %.4f\n", quality.MSE)
+	fmt.Fprintf(output, "SSIM: %.4f\n", quality.SSIM)
+}
+
+// DecodeOpts Parameters needed to decode images encoded with a key, either into a hidden volume or in raw mode, or
+// encoded for recipients
+type DecodeOpts struct {
+	Key string
+
+	// IdentityPath File holding the identities, as generated by nsteg keygen, of the recipient of the files
+	IdentityPath string
+
+	// TrustedKeysDir Directory holding the public keys of trusted signers. If set, only files signed by one of them
+	// are decoded
+	TrustedKeysDir string
+
+	// Raw Whether the image was encoded in raw mode, in which case LSBsToUse must match the one used to encode it
+	Raw       bool
+	LSBsToUse byte
+
+	// ChunkSizeMultiplier Size of the chunks decoded by a single goroutine, see config.ImageEncodeConfig
+	ChunkSizeMultiplier int
+
+	// Stdout Whether to write the decoded file to stdout instead of to disk, which requires the image to hold a single
+	// file
+	Stdout bool
+}
+
 func decodeFilesFromImage() *cobra.Command {
-	var encodedImageFile string
+	var encodedImageFile, key, identityPath, trustedKeysDir string
+	var raw, toStdout bool
+	var lsbsToUse int8
+	var chunkSizeMultiplier int
 
 	decodeCommand := &cobra.Command{
 		Use:     "decode",
 		Example: "nsteg image decode --source encoded-image.png",
 		Short:   "Decode files from image encoded by nsteg",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			if err := cmd.MarkFlagRequired("source"); err != nil {
-				return err
+			// Raw images store no LSBs setting, and decoding with the wrong one yields garbage rather than an error
+			if raw && (key == "" || lsbsToUse == 0) {
+				return fmt.Errorf("%w: raw mode requires the --key and --lsbs the image was encoded with", ErrInvalidFlags)
 			}
-			return DecodeFilesFromImage(encodedImageFile)
+			if identityPath != "" && key != "" {
+				return fmt.Errorf("%w: files encoded for recipients are decoded with an --identity, not a --key", ErrInvalidFlags)
+			}
+			return DecodeFilesFromImage(cmd.Context(), encodedImageFile, DecodeOpts{
+				Key:                 key,
+				IdentityPath:        identityPath,
+				TrustedKeysDir:      trustedKeysDir,
+				Raw:                 raw,
+				LSBsToUse:           byte(lsbsToUse),
+				ChunkSizeMultiplier: chunkSizeMultiplier,
+				Stdout:              toStdout,
+			})
 		},
 	}
 
-	decodeCommand.Flags().StringVar(&encodedImageFile, "source", "", "Image generated by nsteg to decode")
+	decodeCommand.Flags().StringVar(&encodedImageFile, "source", "", "Image generated by nsteg to decode, or - to read it from stdin")
+	decodeCommand.Flags().StringVar(&key, "key", "", "Key of the hidden volume to decode, for images encoded with --key or --decoy-key")
+	decodeCommand.Flags().StringVar(&identityPath, "identity", "", "Identity file, as generated by nsteg keygen, to decode files encoded with --recipient")
+	decodeCommand.Flags().StringVar(&trustedKeysDir, "trust", "", "Directory holding the public keys of trusted signers, one file per signer. If supplied, only files signed by one of them are decoded")
+	decodeCommand.Flags().BoolVar(&raw, "raw", false, "Decode an image encoded with --raw, which requires the --key and --lsbs it was encoded with")
+	decodeCommand.Flags().Int8Var(&lsbsToUse, "lsbs", 0, "Least significant bits the image was encoded with, required in raw mode, since raw images do not store it")
+	decodeCommand.Flags().IntVar(&chunkSizeMultiplier, "chunk-size-multiplier", config.DefaultChunkSizeMultiplier, "Chunk size to be handled by a single goroutine")
+	decodeCommand.Flags().BoolVar(&toStdout, "stdout", false, "Write the decoded file to stdout instead of to disk, for images holding a single file")
+	MarkFlagsRequired(decodeCommand, "source")
 	return decodeCommand
 }
 
-func DecodeFilesFromImage(encodedMediaFile string) error {
-	s := NewSpinner()
-	s.Prefix = "Reading source image from disk "
-	s.Start()
+// DecodeFilesFromImage decodes the files hidden in the image, the files of the hidden volume opened by the key if one
+// is supplied, the files encoded in raw mode with the key and LSBs setting if raw mode is enabled, or the files encoded
+// for the identity if one is supplied
+func DecodeFilesFromImage(ctx context.Context, encodedMediaFile string, opts DecodeOpts) error {
+	// Interrupting the command stops decoding right away, before any decoded file is written
+	stopOnInterrupt()
+	revealOpts := []nsteg.Option{nsteg.WithChunkSizeMultiplier(opts.ChunkSizeMultiplier)}
+	if opts.IdentityPath != "" {
+		identities, err := readIdentities(opts.IdentityPath)
+		if err != nil {
+			return err
+		}
+		revealOpts = append(revealOpts, nsteg.WithIdentities(identities...))
+	} else if opts.Raw {
+		revealOpts = append(revealOpts, nsteg.WithRaw([]byte(opts.Key)), nsteg.WithLSBs(opts.LSBsToUse))
+	} else if opts.Key != "" {
+		revealOpts = append(revealOpts, nsteg.WithKey([]byte(opts.Key)))
+	}
 
-	srcImage, err := getImageFromFilePath(encodedMediaFile)
-	if err != nil {
-		return err
+	if opts.TrustedKeysDir != "" {
+		trustedKeys, err := signature.ReadTrustedKeys(opts.TrustedKeysDir)
+		if err != nil {
+			return err
+		}
+		revealOpts = append(revealOpts, nsteg.WithTrustedSigners(trustedKeys...))
 	}
 
-	s.Prefix = "Setting up decoder "
-	decoder, err := nstegImage.NewImageDecoder(srcImage)
+	srcFile, err := openInput(encodedMediaFile)
 	if err != nil {
 		return err
 	}
+	defer srcFile.Close()
 
-	s.Prefix = "Decoding files "
-	decodedFiles, err := decoder.DecodeFiles()
+	bar := newProgressBar()
+	defer bar.Finish("")
+	revealed, err := nsteg.Reveal(ctx, srcFile, append(revealOpts, nsteg.WithProgress(bar.Update), nsteg.WithLogger(logging.Default()))...)
 	if err != nil {
+		if revealed != nil && revealed.Signer != nil {
+			return fmt.Errorf("%w: %s", err, revealed.Signer.PublicKey)
+		}
 		return err
 	}
 
-	s.Prefix = "Writing decoded files to disk "
-	fileNames := make([]string, 0, len(decodedFiles))
-	for _, decodedFile := range decodedFiles {
+	if opts.Stdout {
+		if len(revealed.Files) != 1 {
+			return fmt.Errorf("%w, the image holds %d", ErrStdoutSingleFile, len(revealed.Files))
+		}
+		if _, err = os.Stdout.Write(revealed.Files[0].Content); err != nil {
+			return err
+		}
+		if jsonOutput() {
+			// The document is kept out of the way of the file written to stdout
+			return printResult(os.Stderr, "decode", newDecodeResult(encodedMediaFile, revealed, false))
+		}
+		bar.Finish(fmt.Sprintf("Decoded %s from the source image to stdout\n%s\n", revealed.Files[0].Name, describeSigner(revealed.Signer)))
+		return nil
+	}
+
+	bar.Stage("Writing decoded files to disk")
+	fileNames := make([]string, 0, len(revealed.Files))
+	for _, decodedFile := range revealed.Files {
 		fileNames = append(fileNames, decodedFile.Name)
 		err = os.WriteFile(decodedFile.Name, decodedFile.Content, 0664)
 		if err != nil {
 			return err
 		}
 	}
+	if jsonOutput() {
+		return printResult(os.Stdout, "decode", newDecodeResult(encodedMediaFile, revealed, true))
+	}
 
-	s.FinalMSG = fmt.Sprintf("Decoded the following files from the source image: %s\n", strings.Join(fileNames, ","))
+	bar.Finish(fmt.Sprintf("Decoded the following files from the source image: %s\n%s\n", strings.Join(fileNames, ","), describeSigner(revealed.Signer)))
+	return nil
+}
 
-	s.Stop()
+// newDecodeResult returns the result of decoding the files revealed from the source image, which are listed along with
+// the path they were written to if they were written to disk
+func newDecodeResult(source string, revealed *nsteg.Revealed, writtenToDisk bool) DecodeResult {
+	files := make([]FileResult, 0, len(revealed.Files))
+	for _, decodedFile := range revealed.Files {
+		file := FileResult{Name: decodedFile.Name, Size: int64(len(decodedFile.Content))}
+		if writtenToDisk {
+			file.Path = decodedFile.Name
+		}
+		files = append(files, file)
+	}
+	return DecodeResult{Source: source, Files: files, Signer: revealed.Signer, Stats: revealed.Stats}
+}
+
+func capacityCommand() *cobra.Command {
+	var imagePath string
+	var fileNames []string
+
+	capacityCmd := &cobra.Command{
+		Use:     "capacity",
+		Example: "nsteg image capacity --image source.png --files secret.tar",
+		Short:   "Report how much data can be encoded into an image, with and without hidden volumes",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return ReportCapacity(imagePath, fileNames)
+		},
+	}
+
+	capacityCmd.Flags().StringVar(&imagePath, "image", "", "Image to report the capacity of")
+	capacityCmd.Flags().StringSliceVar(&fileNames, "files", nil, "Optional files to check against the capacity of the image. Can be comma separated, or you can supply the files param several times with each file")
+	MarkFlagsRequired(capacityCmd, "image")
+
+	return capacityCmd
+}
+
+// ReportCapacity prints the bytes that can be encoded into the image for every LSBs setting, both as plain files and
+// as hidden volumes, along with the trade-offs of hidden volumes. If files are supplied, the smallest LSBs setting
+// they fit with is printed too
+func ReportCapacity(imagePath string, fileNames []string) error {
+	img, err := getImageFromFilePath(imagePath)
+	if err != nil {
+		return err
+	}
+	capacity := nstegImage.ScanCapacity(img)
+	if jsonOutput() {
+		return printCapacityResult(capacity, fileNames)
+	}
+
+	fmt.Printf("Opaque pixels: %d\n", capacity.OpaquePixels)
+	fmt.Printf("%-6s %-18s %s\n", "LSBs", "Files (bytes)", "Per hidden volume (bytes)")
+	for LSBsToUse := byte(1); LSBsToUse <= 8; LSBsToUse++ {
+		fmt.Printf("%-6d %-18d %d\n", LSBsToUse, capacity.AvailableBytes(LSBsToUse), capacity.VolumeAvailableBytes(LSBsToUse))
+	}
+	fmt.Printf("Hidden volumes trade capacity for deniability: each of the %d volumes only gets half of the opaque pixels, "+
+		"minus %d pixels for its salt and LSBs setting and %d bytes for its encryption. The LSBs of every opaque pixel are "+
+		"overwritten with noise, so the image shows the same distortion as a fully used one whatever the size of the volumes\n",
+		nstegImage.MaxVolumes, nstegImage.VolumeReservedPixels, seal.Overhead)
+
+	if len(fileNames) == 0 {
+		return nil
+	}
+	payloadSize, err := payloadSizeOfFiles(fileNames)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Supplied files take up %d bytes\n", payloadSize)
+	if LSBsToUse, fits := capacity.MinLSBsToFit(payloadSize); fits {
+		fmt.Printf("As files they fit with %d LSBs\n", LSBsToUse)
+	} else {
+		fmt.Println("As files they do not fit with any LSBs setting")
+	}
+	if LSBsToUse, fits := capacity.MinLSBsToFitVolume(payloadSize); fits {
+		fmt.Printf("As a hidden volume they fit with %d LSBs\n", LSBsToUse)
+	} else {
+		fmt.Println("As a hidden volume they do not fit with any LSBs setting")
+	}
 	return nil
 }
 
-func getImageFromFilePath(filePath string) (*image.RGBA, error) {
-	f, err := os.Open(filePath)
+// printCapacityResult prints the capacity of the image, and the smallest LSBs settings the files fit with, as a JSON
+// document
+func printCapacityResult(capacity nstegImage.Capacity, fileNames []string) error {
+	result := CapacityResult{OpaquePixels: capacity.OpaquePixels}
+	for LSBsToUse := byte(1); LSBsToUse <= 8; LSBsToUse++ {
+		result.LSBs = append(result.LSBs, LSBsCapacity{
+			LSBs:                 LSBsToUse,
+			AvailableBytes:       capacity.AvailableBytes(LSBsToUse),
+			VolumeAvailableBytes: capacity.VolumeAvailableBytes(LSBsToUse),
+		})
+	}
+
+	if len(fileNames) > 0 {
+		payloadSize, err := payloadSizeOfFiles(fileNames)
+		if err != nil {
+			return err
+		}
+		result.PayloadBytes = payloadSize
+		if LSBsToUse, fits := capacity.MinLSBsToFit(payloadSize); fits {
+			result.MinLSBs = LSBsToUse
+		}
+		if LSBsToUse, fits := capacity.MinLSBsToFitVolume(payloadSize); fits {
+			result.MinVolumeLSBs = LSBsToUse
+		}
+	}
+	return printResult(os.Stdout, "capacity", result)
+}
+
+// payloadSizeOfFiles returns the size of the payload the files would be encoded as
+func payloadSizeOfFiles(fileNames []string) (int64, error) {
+	var filesToHide []model.InputFile
+	for _, fileName := range fileNames {
+		fileStat, err := os.Stat(fileName)
+		if err != nil {
+			return 0, err
+		}
+		filesToHide = append(filesToHide, model.InputFile{Name: fileName, Size: fileStat.Size()})
+	}
+	return payload.Size(filesToHide), nil
+}
+
+func describeSigner(signer *model.Signer) string {
+	if signer == nil {
+		return "The files are not signed"
+	} else if signer.Trusted {
+		return fmt.Sprintf("Signed by trusted signer %s (%s)", signer.Name, signer.PublicKey)
+	}
+	return fmt.Sprintf("Signed by %s, which is not in the trusted keys, so the sender cannot be verified", signer.PublicKey)
+}
+
+func readIdentities(identityPath string) ([]*seal.Identity, error) {
+	identityFile, err := os.Open(identityPath)
 	if err != nil {
 		return nil, err
 	}
-	srcImage, _, err := image.Decode(f)
+	defer identityFile.Close()
+
+	return seal.ParseIdentities(identityFile)
+}
+
+func compareImagesCommand() *cobra.Command {
+	var heatmapPath string
+	var amplification int
+
+	compareCommand := &cobra.Command{
+		Use:     "compare <original-image> <encoded-image>",
+		Example: "nsteg image compare source.png output.png --heatmap difference.png",
+		Short:   "Measure the visual damage done to an image by encoding data into it",
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return CompareImages(args[0], args[1], heatmapPath, amplification)
+		},
+	}
+
+	compareCommand.Flags().StringVar(&heatmapPath, "heatmap", "heatmap.png", "File to which to write an image highlighting the pixels that differ between both images")
+	compareCommand.Flags().IntVar(&amplification, "amplification", 64, "Factor by which to multiply the differences between both images in the heatmap, so that changes to the LSBs become visible")
+	return compareCommand
+}
+
+func CompareImages(originalPath, modifiedPath, heatmapPath string, amplification int) error {
+	originalImage, err := getImageFromFilePath(originalPath)
+	if err != nil {
+		return err
+	}
+	modifiedImage, err := getImageFromFilePath(modifiedPath)
 	if err != nil {
-		return nil, err
-	} else if err = f.Close(); err != nil {
-		return nil, err
+		return err
 	}
 
-	// TODO: Work with 16-bit images
-	img := image.NewRGBA(srcImage.Bounds())
-	draw.Draw(img, img.Bounds(), srcImage, img.Bounds().Min, draw.Src)
+	quality, err := analysis.Compare(originalImage, modifiedImage)
+	if err != nil {
+		return err
+	}
+	heatmap, err := analysis.DifferenceHeatmap(originalImage, modifiedImage, amplification)
+	if err != nil {
+		return err
+	}
+
+	heatmapFile, err := os.Create(heatmapPath)
+	if err != nil {
+		return err
+	}
+	defer heatmapFile.Close()
+	if err = png.Encode(heatmapFile, heatmap); err != nil {
+		return err
+	}
+
+	if jsonOutput() {
+		return printResult(os.Stdout, "compare", CompareResult{Original: originalPath, Modified: modifiedPath, Heatmap: heatmapPath, Quality: quality})
+	}
+	printImageQuality(os.Stdout, quality)
+	fmt.Printf("Wrote difference heatmap to %s\n", heatmapPath)
+	return nil
+}
+
+func pickCoverCommand() *cobra.Command {
+	var coversDir string
+	var fileNames []string
+
+	pickCoverCmd := &cobra.Command{
+		Use:     "pick-cover",
+		Example: "nsteg image pick-cover --dir covers/ --files secret.tar",
+		Short:   "Rank the images in a directory by how well they would hide the supplied files",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return PickCover(coversDir, fileNames)
+		},
+	}
+
+	pickCoverCmd.Flags().StringVar(&coversDir, "dir", "", "Directory containing the candidate cover images")
+	pickCoverCmd.Flags().StringSliceVar(&fileNames, "files", nil, "Files to be hidden in the chosen cover. Can be comma separated, or you can supply the files param several times with each file")
+	MarkFlagsRequired(pickCoverCmd, "dir", "files")
+
+	return pickCoverCmd
+}
+
+func PickCover(coversDir string, fileNames []string) error {
+	payloadSize, err := payloadSizeOfFiles(fileNames)
+	if err != nil {
+		return err
+	}
+
+	dirEntries, err := os.ReadDir(coversDir)
+	if err != nil {
+		return err
+	}
+
+	s := NewSpinner()
+	s.Start()
+	var evaluations []nstegImage.CoverEvaluation
+	var skippedFiles []string
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			continue
+		}
+		coverPath := filepath.Join(coversDir, dirEntry.Name())
+		s.Prefix = fmt.Sprintf("Evaluating %s ", coverPath)
+
+		coverImage, err := getImageFromFilePath(coverPath)
+		if err != nil {
+			skippedFiles = append(skippedFiles, coverPath)
+			continue
+		}
+		evaluation, err := nstegImage.EvaluateCover(coverPath, coverImage, payloadSize)
+		if err != nil {
+			s.Stop()
+			return err
+		}
+		evaluations = append(evaluations, evaluation)
+	}
+	s.Stop()
+
+	nstegImage.RankCovers(evaluations)
+	if jsonOutput() {
+		return printResult(os.Stdout, "pick-cover", PickCoverResult{Covers: evaluations, Skipped: skippedFiles})
+	}
+	for rank, evaluation := range evaluations {
+		fmt.Printf("%d. %s (score %.2f)\n", rank+1, evaluation.Name, evaluation.Score)
+		for _, reason := range evaluation.Reasons {
+			fmt.Printf("   - %s\n", reason)
+		}
+	}
+	if len(skippedFiles) > 0 {
+		fmt.Printf("Skipped files that are not supported images: %s\n", strings.Join(skippedFiles, ","))
+	}
+	return nil
+}
+
+func getImageFromFilePath(filePath string) (*image.RGBA, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-	return img, nil
+	return nsteg.DecodeCarrier(f)
 }
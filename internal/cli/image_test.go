@@ -0,0 +1,33 @@
+package cli
+
+import (
+	"context"
+	"github.com/spf13/cobra"
+	"io"
+	"testing"
+)
+
+func TestImageCommandFlags(t *testing.T) {
+	for _, testCase := range []struct {
+		name             string
+		args             []string
+		expectedExitCode int
+	}{
+		{name: "decode without source", args: []string{"image", "decode"}, expectedExitCode: ExitInvalidInput},
+		{name: "raw decode without lsbs", args: []string{"image", "decode", "--source", "encoded.png", "--raw", "--key", "key"}, expectedExitCode: ExitInvalidInput},
+		{name: "encode without image", args: []string{"image", "encode", "--output-file", "out.png"}, expectedExitCode: ExitInvalidInput},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			rootCommand := &cobra.Command{Use: "nsteg"}
+			rootCommand.AddCommand(ImageCommands())
+			AddOutputFlag(rootCommand)
+			rootCommand.SetArgs(testCase.args)
+			rootCommand.SetOut(io.Discard)
+			rootCommand.SetErr(io.Discard)
+
+			if exitCode := Execute(context.Background(), rootCommand); exitCode != testCase.expectedExitCode {
+				t.Errorf("Expected exit code %d, got %d", testCase.expectedExitCode, exitCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package cli
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"github.com/spf13/cobra"
+	"nsteg/pkg/seal"
+	"nsteg/pkg/signature"
+	"os"
+)
+
+func KeygenCommand() *cobra.Command {
+	var outputPath string
+	var signing bool
+
+	keygenCmd := &cobra.Command{
+		Use:     "keygen",
+		Example: "nsteg keygen --output-file identity.txt",
+		Short:   "Generate a key pair to receive files encoded with --recipient, or to sign files with --sign-key",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if signing {
+				return GenerateSigningKeyPair(outputPath)
+			}
+			return GenerateKeyPair(outputPath)
+		},
+	}
+
+	keygenCmd.Flags().StringVar(&outputPath, "output-file", "", "File to which to write the secret key. Printed to stdout if not supplied")
+	keygenCmd.Flags().BoolVar(&signing, "signing", false, "Generate a signing key pair instead, whose public key recipients add to their trusted keys")
+	return keygenCmd
+}
+
+// GenerateKeyPair writes a new identity to outputPath, or to stdout if it is empty, and prints its public key, which
+// is to be shared with senders to pass as --recipient
+func GenerateKeyPair(outputPath string) error {
+	identity, err := seal.GenerateIdentity()
+	if err != nil {
+		return err
+	}
+	publicKey := identity.Recipient().String()
+	return writeKeyFile(outputPath, publicKey, identity.String())
+}
+
+// GenerateSigningKeyPair writes a new signing key to outputPath, or to stdout if it is empty, and prints its public
+// key, which is to be shared with recipients to add to their trusted keys
+func GenerateSigningKeyPair(outputPath string) error {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	return writeKeyFile(outputPath, signature.FormatPublicKey(publicKey), signature.FormatPrivateKey(privateKey))
+}
+
+func writeKeyFile(outputPath, publicKey, secretKey string) error {
+	keyFile := fmt.Sprintf("# public key: %s\n%s\n", publicKey, secretKey)
+	if outputPath == "" {
+		if jsonOutput() {
+			return printResult(os.Stdout, "keygen", KeygenResult{PublicKey: publicKey, SecretKey: secretKey})
+		}
+		fmt.Print(keyFile)
+		return nil
+	}
+	if err := os.WriteFile(outputPath, []byte(keyFile), 0600); err != nil {
+		return err
+	}
+	if jsonOutput() {
+		return printResult(os.Stdout, "keygen", KeygenResult{PublicKey: publicKey, Output: outputPath})
+	}
+	fmt.Printf("Public key: %s\n", publicKey)
+	return nil
+}
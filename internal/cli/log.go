@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"github.com/spf13/cobra"
+	"nsteg/internal/logging"
+	"os"
+)
+
+const (
+	// logFormatAuto Logs as JSON when serving, where logs are usually collected, and as text otherwise
+	logFormatAuto = "auto"
+)
+
+var logLevel, logFormat string
+
+// AddLoggingFlags adds the global --log-level and --log-format flags to the root command, and configures the shared
+// logger with them before running any command. Commands log to stderr, keeping stdout for their output, except for
+// serve, which has no other output
+func AddLoggingFlags(rootCommand *cobra.Command) {
+	rootCommand.PersistentFlags().StringVar(&logLevel, "log-level", "info", "Lowest level of the messages logged, one of debug, info, warn or error")
+	rootCommand.PersistentFlags().StringVar(&logFormat, "log-format", logFormatAuto, "Format of the messages logged, either text or json. Defaults to json for serve and text for every other command")
+
+	preRun := rootCommand.PersistentPreRunE
+	rootCommand.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if preRun != nil {
+			if err := preRun(cmd, args); err != nil {
+				return err
+			}
+		}
+
+		serving := cmd.CommandPath() == serveCommandPath
+		format := logFormat
+		if format == logFormatAuto {
+			format = logging.FormatText
+			if serving {
+				format = logging.FormatJSON
+			}
+		}
+		output := os.Stderr
+		if serving {
+			output = os.Stdout
+		}
+		return logging.Configure(logLevel, format, output)
+	}
+}
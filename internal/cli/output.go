@@ -0,0 +1,233 @@
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"log/slog"
+	"nsteg/api"
+	"nsteg/pkg/analysis"
+	nstegImage "nsteg/pkg/image"
+	"nsteg/pkg/model"
+	"os"
+	"time"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+var (
+	ErrInvalidOutputFormat = errors.New("output format must be either " + OutputText + " or " + OutputJSON)
+)
+
+// outputFormat Format of the results printed by commands, set through the global --output flag
+var outputFormat = OutputText
+
+// AddOutputFlag adds the global --output flag to the root command. In json mode commands print a single JSON
+// document, either with their result or with their error, and neither progress nor usage are printed
+func AddOutputFlag(rootCommand *cobra.Command) {
+	rootCommand.PersistentFlags().StringVar(&outputFormat, "output", OutputText, "Format of the results of the commands, either text or json. In json mode a single JSON document is printed, holding either the result or the error of the command")
+	rootCommand.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return fmt.Errorf("%w: %w", ErrInvalidFlags, err)
+	})
+	rootCommand.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if outputFormat != OutputText && outputFormat != OutputJSON {
+			return fmt.Errorf("%w, got %s", ErrInvalidOutputFormat, outputFormat)
+		}
+		if jsonOutput() {
+			cmd.SilenceErrors, cmd.SilenceUsage = true, true
+		}
+
+		// Cobra does not report missing required flags through the flag error func, so they are validated here to
+		// fail as invalid flags too
+		if err := cmd.ValidateRequiredFlags(); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidFlags, err)
+		}
+		if err := cmd.ValidateFlagGroups(); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidFlags, err)
+		}
+		return nil
+	}
+}
+
+// Execute runs the root command with the context, which is cancelled on interrupt, and returns the exit code for the
+// error it failed with, if any. Errors are printed as a JSON document in json mode
+func Execute(ctx context.Context, rootCommand *cobra.Command) int {
+	cmd, err := rootCommand.ExecuteContextC(ctx)
+	if err == nil {
+		return ExitOK
+	}
+
+	_, exitCode := classifyError(err)
+	var reported reportedError
+	if errors.As(err, &reported) {
+		return exitCode
+	}
+	if jsonOutput() {
+		printJSON(os.Stdout, newCommandResult(cmd.Name(), nil, err))
+	} else {
+		slog.Error("Command failed", "error", err)
+	}
+	return exitCode
+}
+
+// reportedError Error of a command that already printed it as part of its JSON document
+type reportedError struct {
+	err error
+}
+
+func (e reportedError) Error() string {
+	return e.err.Error()
+}
+
+func (e reportedError) Unwrap() error {
+	return e.err
+}
+
+func jsonOutput() bool {
+	return outputFormat == OutputJSON
+}
+
+// newProgressBar returns a progress bar rendering to stderr, or discarding everything in json mode
+func newProgressBar() *ProgressBar {
+	if jsonOutput() {
+		return NewProgressBar(io.Discard)
+	}
+	return NewProgressBar(os.Stderr)
+}
+
+// commandResult Document printed by commands in json mode
+type commandResult struct {
+	Command string     `json:"command"`
+	Success bool       `json:"success"`
+	Error   *api.Error `json:"error,omitempty"`
+	Result  any        `json:"result,omitempty"`
+}
+
+// FileResult File encoded or decoded by a command, along with where it was written to when decoded
+type FileResult struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Path string `json:"path,omitempty"`
+}
+
+// EncodeResult Result of nsteg image encode
+type EncodeResult struct {
+	Output string       `json:"output"`
+	LSBs   byte         `json:"lsbs"`
+	Files  []FileResult `json:"files"`
+
+	// CapacityUsed Fraction of the capacity of the image taken up by the payload, from 0 to 1
+	CapacityUsed float64           `json:"capacity_used"`
+	Stats        model.EncodeStats `json:"stats"`
+}
+
+// DecodeResult Result of nsteg image decode
+type DecodeResult struct {
+	Source string            `json:"source"`
+	Files  []FileResult      `json:"files"`
+	Signer *model.Signer     `json:"signer"`
+	Stats  model.DecodeStats `json:"stats"`
+}
+
+// CapacityResult Result of nsteg image capacity
+type CapacityResult struct {
+	OpaquePixels uint64         `json:"opaque_pixels"`
+	LSBs         []LSBsCapacity `json:"lsbs"`
+
+	// PayloadBytes Size of the payload of the supplied files, with the smallest LSBs setting they fit with as files
+	// and as a hidden volume, which are 0 if they do not fit or no files were supplied
+	PayloadBytes  int64 `json:"payload_bytes,omitempty"`
+	MinLSBs       byte  `json:"min_lsbs,omitempty"`
+	MinVolumeLSBs byte  `json:"min_volume_lsbs,omitempty"`
+}
+
+// LSBsCapacity Bytes that can be encoded into an image with an LSBs setting
+type LSBsCapacity struct {
+	LSBs                 byte  `json:"lsbs"`
+	AvailableBytes       int64 `json:"available_bytes"`
+	VolumeAvailableBytes int64 `json:"volume_available_bytes"`
+}
+
+// AnalyzeResult Result of nsteg analyze
+type AnalyzeResult struct {
+	Image  string          `json:"image"`
+	Report analysis.Report `json:"report"`
+}
+
+// CompareResult Result of nsteg image compare
+type CompareResult struct {
+	Original string             `json:"original"`
+	Modified string             `json:"modified"`
+	Heatmap  string             `json:"heatmap"`
+	Quality  model.ImageQuality `json:"quality"`
+}
+
+// PickCoverResult Result of nsteg image pick-cover, with the covers ranked from best to worst
+type PickCoverResult struct {
+	Covers []nstegImage.CoverEvaluation `json:"covers"`
+
+	// Skipped Files of the directory that are not supported images
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// KeygenResult Result of nsteg keygen
+type KeygenResult struct {
+	PublicKey string `json:"public_key"`
+
+	// Output File the secret key was written to. The secret key is part of the result instead if there is none
+	Output    string `json:"output,omitempty"`
+	SecretKey string `json:"secret_key,omitempty"`
+}
+
+// KeyResult API key created, revoked or listed by nsteg admin key
+type KeyResult struct {
+	ID                string     `json:"id"`
+	Name              string     `json:"name"`
+	RequestsPerMinute int        `json:"requests_per_minute"`
+	DailyBytes        int64      `json:"daily_bytes"`
+	CreatedAt         time.Time  `json:"created_at"`
+	RevokedAt         *time.Time `json:"revoked_at,omitempty"`
+
+	// APIKey Only set when the key is created, since it cannot be recovered afterwards
+	APIKey string `json:"api_key,omitempty"`
+}
+
+// TokenResult Result of nsteg admin token mint
+type TokenResult struct {
+	KeyID     string    `json:"key_id"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// TokenSecretResult Result of nsteg admin token secret
+type TokenSecretResult struct {
+	// Output File the secret was written to. The secret is part of the result instead if there is none
+	Output string `json:"output,omitempty"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// newCommandResult returns the document of the command, which failed if err is not nil
+func newCommandResult(command string, result any, err error) commandResult {
+	if err == nil {
+		return commandResult{Command: command, Success: true, Result: result}
+	}
+	code, _ := classifyError(err)
+	return commandResult{Command: command, Error: &api.Error{Code: code, Error: err.Error()}, Result: result}
+}
+
+// printResult prints the successful result of the command as a JSON document
+func printResult(output io.Writer, command string, result any) error {
+	return printJSON(output, newCommandResult(command, result, nil))
+}
+
+func printJSON(output io.Writer, document any) error {
+	encoder := json.NewEncoder(output)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(document)
+}
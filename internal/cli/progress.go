@@ -0,0 +1,87 @@
+package cli
+
+import (
+	"fmt"
+	"github.com/dustin/go-humanize"
+	"io"
+	"nsteg/pkg/model"
+	"strings"
+	"time"
+)
+
+const (
+	progressBarWidth       = 30
+	progressRenderInterval = 100 * time.Millisecond
+)
+
+var stageLabels = map[model.Stage]string{
+	model.StageReading:    "Reading source image",
+	model.StageSetup:      "Setting up",
+	model.StageEmbedding:  "Encoding data",
+	model.StageExtracting: "Decoding data",
+	model.StageWriting:    "Generating output PNG image",
+}
+
+// ProgressBar Renders the progress reported by encoders and decoders on a single terminal line
+type ProgressBar struct {
+	output     io.Writer
+	lastStage  model.Stage
+	lastRender time.Time
+	finished   bool
+}
+
+func NewProgressBar(output io.Writer) *ProgressBar {
+	return &ProgressBar{output: output}
+}
+
+// Update renders the progress, at most once every progressRenderInterval unless the stage changed or is complete, so
+// that it can be passed as a model.ProgressFunc
+func (b *ProgressBar) Update(progress model.Progress) {
+	complete := progress.TotalBytes > 0 && progress.BytesProcessed >= progress.TotalBytes
+	if progress.Stage == b.lastStage && !complete && time.Since(b.lastRender) < progressRenderInterval {
+		return
+	}
+	b.lastStage, b.lastRender = progress.Stage, time.Now()
+
+	label, found := stageLabels[progress.Stage]
+	if !found {
+		label = string(progress.Stage)
+	}
+	if progress.TotalBytes <= 0 && progress.BytesProcessed == 0 {
+		b.render(label)
+		return
+	} else if progress.TotalBytes <= 0 {
+		b.render(fmt.Sprintf("%-14s %s", label, humanize.Bytes(uint64(progress.BytesProcessed))))
+		return
+	}
+
+	// Files growing after their size was read may make the processed bytes exceed the total
+	processed := min(max(progress.BytesProcessed, 0), progress.TotalBytes)
+	filled := int(processed * progressBarWidth / progress.TotalBytes)
+	b.render(fmt.Sprintf("%-14s [%s%s] %3d%% %s/%s", label,
+		strings.Repeat("#", filled), strings.Repeat("-", progressBarWidth-filled),
+		processed*100/progress.TotalBytes,
+		humanize.Bytes(uint64(progress.BytesProcessed)), humanize.Bytes(uint64(progress.TotalBytes))))
+}
+
+// Stage renders a stage that is not reported by Hide and Reveal, such as writing the decoded files to disk
+func (b *ProgressBar) Stage(label string) {
+	b.lastStage = ""
+	b.render(label)
+}
+
+// Finish clears the progress line, and prints the final message. Only the first call has any effect, so that it can be
+// deferred to clear the line on errors
+func (b *ProgressBar) Finish(message string) {
+	if b.finished {
+		return
+	}
+	b.finished = true
+	b.render("")
+	fmt.Fprint(b.output, message)
+}
+
+func (b *ProgressBar) render(line string) {
+	// Clear the rest of the line, in case the previous render was longer
+	fmt.Fprintf(b.output, "\r%s\033[K", line)
+}
@@ -0,0 +1,18 @@
+package cli
+
+import (
+	"bytes"
+	"nsteg/pkg/model"
+	"strings"
+	"testing"
+)
+
+func TestProgressBarBeyondTotal(t *testing.T) {
+	output := bytes.NewBuffer(nil)
+	// Files growing after their size was read are embedded past the total the bar was set up with
+	NewProgressBar(output).Update(model.Progress{Stage: model.StageEmbedding, BytesProcessed: 150, TotalBytes: 100})
+
+	if !strings.Contains(output.String(), "["+strings.Repeat("#", progressBarWidth)+"] 100%") {
+		t.Errorf("Expected a full bar at 100%%, got %q", output.String())
+	}
+}
@@ -1,23 +1,90 @@
 package cli
 
 import (
+	"context"
+	"fmt"
 	"github.com/spf13/cobra"
+	"net"
+	"nsteg/internal/auth"
+	"nsteg/internal/logging"
 	"nsteg/internal/server"
+	"nsteg/internal/telemetry"
 )
 
 func ServeAppCommand() *cobra.Command {
-	var port string
+	var address, port, keysFile, tokenSecretFile string
+	limits := server.DefaultLimits()
+	timeouts := server.DefaultTimeouts()
+	tracing := telemetry.Config{Exporter: telemetry.ExporterNone, SampleRatio: 1}
 
 	command := &cobra.Command{
 		Use:     "serve",
 		Short:   "Serve an API to perform steganography over the web",
-		Example: "nsteg serve --port 8888",
-		Run: func(cmd *cobra.Command, args []string) {
-			server.StartServer(port)
+		Long:    "Serve an API to perform steganography over the web. On SIGINT or SIGTERM the server stops accepting requests and drains the ones in flight, up to the shutdown timeout, before exiting. A second signal exits right away. The API is open to anyone unless a keys file is supplied, see nsteg admin",
+		Example: "nsteg serve --port 8888\nnsteg serve --trace-exporter otlp --trace-endpoint http://localhost:4318/v1/traces\nnsteg serve --shutdown-delay 5s --shutdown-timeout 1m\nnsteg serve --auth-keys-file nsteg-keys.yaml --auth-token-secret-file token-secret.txt",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			shutdownTracing, err := telemetry.Setup(cmd.Context(), tracing)
+			if err != nil {
+				return err
+			}
+			defer func() {
+				if err := shutdownTracing(context.Background()); err != nil {
+					logging.Default().Error("Error flushing traces", "error", err)
+				}
+			}()
+
+			authConfig, err := newAuthConfig(keysFile, tokenSecretFile)
+			if err != nil {
+				return err
+			}
+
+			stopOnInterrupt()
+			return server.StartServer(cmd.Context(), server.Config{Address: net.JoinHostPort(address, port), Limits: limits, Timeouts: timeouts, Auth: authConfig})
 		},
 	}
 
+	command.Flags().StringVar(&address, "address", "", "Host or IP on which to start the server. Listens on every interface if not supplied")
 	command.Flags().StringVar(&port, "port", "8080", "Port on which to start the server")
+	command.Flags().Int64Var(&limits.MaxRequestBytes, "max-request-bytes", limits.MaxRequestBytes, "Largest request body accepted, in bytes. Unlimited if 0")
+	command.Flags().Int64Var(&limits.MaxFilesPartBytes, "max-files-part-bytes", limits.MaxFilesPartBytes, "Largest files part accepted by the streamed encode endpoint, in bytes. Unlimited if 0")
+	command.Flags().Int64Var(&limits.MaxCarrierPixels, "max-carrier-pixels", limits.MaxCarrierPixels, "Largest image accepted, in pixels, checked from its header before decoding it. Unlimited if 0")
+	command.Flags().Int64Var(&limits.MaxPayloadBytes, "max-payload-bytes", limits.MaxPayloadBytes, "Largest total size of the files encoded by a request, in bytes. Unlimited if 0")
+	command.Flags().IntVar(&limits.MaxFiles, "max-files", limits.MaxFiles, "Most files encoded by a request. Unlimited if 0")
+	command.Flags().Int64Var(&limits.MemoryBudgetBytes, "memory-budget-bytes", limits.MemoryBudgetBytes, "Memory the requests being handled may take altogether, in bytes, estimated from the dimensions of their images and the size of their bodies. Requests wait for room in it, and are rejected with 429 if there is none before the admission timeout. Unlimited if 0")
+	command.Flags().DurationVar(&limits.AdmissionTimeout, "admission-timeout", limits.AdmissionTimeout, "Time a request waits for room in the memory budget before being rejected. Requests do not wait at all if 0")
+	command.Flags().DurationVar(&timeouts.Read, "read-timeout", timeouts.Read, "Time allowed to read a whole request, including its body. Unlimited if 0")
+	command.Flags().DurationVar(&timeouts.Write, "write-timeout", timeouts.Write, "Time allowed to handle a request and write its response once its headers are read. Unlimited if 0")
+	command.Flags().DurationVar(&timeouts.Idle, "idle-timeout", timeouts.Idle, "Time a keep-alive connection is kept open waiting for the next request. Unlimited if 0")
+	command.Flags().DurationVar(&timeouts.ShutdownDelay, "shutdown-delay", timeouts.ShutdownDelay, "Time between /readyz failing and the server no longer accepting connections when shutting down, for load balancers to notice")
+	command.Flags().DurationVar(&timeouts.Shutdown, "shutdown-timeout", timeouts.Shutdown, "Time allowed for requests in flight to complete when shutting down, after which they are aborted. Unlimited if 0")
+	command.Flags().StringVar(&tracing.Exporter, "trace-exporter", tracing.Exporter, "Where spans are exported to, either none, stdout or otlp. Incoming W3C trace context is propagated whatever the exporter")
+	command.Flags().StringVar(&tracing.Endpoint, "trace-endpoint", "", "URL of the OTLP/HTTP collector spans are exported to with the otlp exporter. Defaults to the OTEL_EXPORTER_OTLP_* environment variables, or to a local collector")
+	command.Flags().Float64Var(&tracing.SampleRatio, "trace-sample-ratio", tracing.SampleRatio, "Share of traces started by the server that are sampled, from 0 to 1. Traces sampled by the client are always sampled")
+	command.Flags().StringVar(&keysFile, "auth-keys-file", "", "Keys file, managed with nsteg admin key, whose API keys are required to use the API. The API is open to anyone if not supplied")
+	command.Flags().StringVar(&tokenSecretFile, "auth-token-secret-file", "", "File holding the secret tokens are signed with, generated by nsteg admin token secret. Tokens are only accepted if supplied, and require --auth-keys-file")
 
 	return command
 }
+
+// newAuthConfig returns the authentication of the API for the keys file and token secret file, or nil if there is no
+// keys file. Quotas are tracked in memory, so each replica of the server enforces them on its own
+func newAuthConfig(keysFile, tokenSecretFile string) (*server.Auth, error) {
+	if keysFile == "" {
+		if tokenSecretFile != "" {
+			return nil, fmt.Errorf("%w: --auth-token-secret-file requires --auth-keys-file", ErrInvalidFlags)
+		}
+		return nil, nil
+	}
+	keys, err := auth.NewKeyStore(keysFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokenSecret []byte
+	if tokenSecretFile != "" {
+		if tokenSecret, err = auth.ReadTokenSecret(tokenSecretFile); err != nil {
+			return nil, err
+		}
+	}
+	return &server.Auth{Authenticator: auth.NewAuthenticator(keys, tokenSecret), Quotas: auth.NewMemoryQuotaStore()}, nil
+}
@@ -0,0 +1,23 @@
+// Package keystring formats keys as the strings nsteg keygen writes to key files: a prefix identifying the type of key,
+// followed by the key encoded as unpadded URL safe base64
+package keystring
+
+import (
+	"encoding/base64"
+	"strings"
+)
+
+func Format(prefix string, key []byte) string {
+	return prefix + base64.RawURLEncoding.EncodeToString(key)
+}
+
+// Parse returns the key in s, ignoring surrounding whitespace, and false if s does not start with the prefix or is not
+// valid base64 after it
+func Parse(s, prefix string) ([]byte, bool) {
+	encoded, found := strings.CutPrefix(strings.TrimSpace(s), prefix)
+	if !found {
+		return nil, false
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	return decoded, err == nil
+}
@@ -0,0 +1,27 @@
+package keystring
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	key := []byte{0xfb, 0xff, 0x00, 0x01}
+	formatted := Format("prefix-", key)
+
+	for _, testCase := range []struct {
+		s             string
+		expectedFound bool
+	}{
+		{s: formatted, expectedFound: true},
+		{s: " " + formatted + "\n", expectedFound: true},
+		{s: formatted[len("prefix-"):]},
+		{s: "other-" + formatted[len("prefix-"):]},
+		{s: formatted + "="},
+	} {
+		parsed, found := Parse(testCase.s, "prefix-")
+		if found != testCase.expectedFound || (found && !bytes.Equal(parsed, key)) {
+			t.Errorf("Expected parsing %q to find the key: %t, got %t with %x", testCase.s, testCase.expectedFound, found, parsed)
+		}
+	}
+}
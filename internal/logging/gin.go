@@ -1,54 +1,97 @@
 package logging
 
 import (
-	"fmt"
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/dustin/go-humanize"
 	"github.com/gin-gonic/gin"
+	"log/slog"
 	"time"
 )
 
 const (
-	rfc3339Millis = "2006-01-02T15:04:05.000Z07:00"
+	RequestIDHeader = "X-Request-ID"
+
+	// maxRequestIDLength Longest request ID propagated from a request, longer ones are replaced by a generated one
+	maxRequestIDLength = 128
+
+	loggerContextKey = "logger"
 )
 
-func NewGinLogger() gin.HandlerFunc {
-	return gin.LoggerWithConfig(gin.LoggerConfig{Formatter: logFormatter})
+// RequestID assigns every request an ID, propagated from its X-Request-ID header if it has a valid one and generated
+// otherwise, which is returned in the X-Request-ID header of the response. A logger carrying the request ID, client IP
+// and route is stored in the context, which BuildLoggerFromCtx returns to the handlers
+func RequestID() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestID := ctx.GetHeader(RequestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		ctx.Header(RequestIDHeader, requestID)
+
+		ctx.Set(loggerContextKey, &Logger{Logger: logger.With(
+			"request_id", requestID,
+			"client_ip", ctx.ClientIP(),
+			"route", ctx.FullPath(),
+		)})
+		ctx.Next()
+	}
 }
 
-func logFormatter(param gin.LogFormatterParams) string {
-	if param.Latency > time.Minute {
-		param.Latency = param.Latency.Truncate(time.Second)
+// NewGinLogger logs every request once handled, with the logger of the request so that access logs can be correlated
+// with the logs of the handler. Server errors are logged at error level and client errors at warn level
+func NewGinLogger() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+		latency := time.Since(start)
+		if latency > time.Minute {
+			latency = latency.Truncate(time.Second)
+		}
+
+		status := ctx.Writer.Status()
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		} else if status >= 400 {
+			level = slog.LevelWarn
+		}
+
+		requestSize, responseSize := ctx.Request.ContentLength, int64(max(ctx.Writer.Size(), 0))
+		attrs := []slog.Attr{
+			slog.Int("status_code", status),
+			slog.String("latency", latency.String()),
+			slog.Int64("latency_raw", int64(latency)),
+			slog.String("request_size", humanize.Bytes(uint64(max(requestSize, 0)))),
+			slog.Int64("request_size_raw", requestSize),
+			slog.String("response_size", humanize.Bytes(uint64(responseSize))),
+			slog.Int64("response_size_raw", responseSize),
+			slog.String("method", ctx.Request.Method),
+			slog.String("path", ctx.Request.URL.Path),
+		}
+		if errorMessage := ctx.Errors.ByType(gin.ErrorTypePrivate).String(); errorMessage != "" {
+			attrs = append(attrs, slog.String("error", errorMessage))
+		}
+		BuildLoggerFromCtx(ctx).LogAttrs(ctx.Request.Context(), level, "Request handled", attrs...)
 	}
+}
 
-	if param.ErrorMessage == "" {
-		return fmt.Sprintf("{\"timestamp\":\"%v\", \"status_code\": \"%d\", \"latency\": \"%v\", \"latency_raw\": \"%d\", \"request_size\": \"%s\", \"request_size_raw\": \"%d\", \"response_size\": \"%s\", \"response_size_raw\": \"%d\", \"client_ip\":\"%s\", \"method\": \"%s\", \"path\": \"%v\"}\n",
-			param.TimeStamp.Format(rfc3339Millis),
-			param.StatusCode,
-			param.Latency,
-			param.Latency,
-			humanize.Bytes(uint64(param.Request.ContentLength)),
-			param.Request.ContentLength,
-			humanize.Bytes(uint64(param.BodySize)),
-			param.BodySize,
-			param.ClientIP,
-			param.Method,
-			param.Path,
-		)
+func validRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
 	}
+	for _, c := range []byte(requestID) {
+		if c < '!' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
 
-	// TODO: validate that JSON produced is valid with marshal/unmarshal test
-	return fmt.Sprintf("{\"timestamp\":\"%v\", \"status_code\": \"%d\", \"latency\": \"%v\", \"latency_raw\": \"%d\", \"request_size\": \"%s\", \"request_size_raw\": \"%d\", \"response_size\": \"%s\", \"response_size_raw\": \"%d\", \"client_ip\":\"%s\", \"method\": \"%s\", \"path\": \"%v\", \"error\": \"%s\"}\n",
-		param.TimeStamp.Format(rfc3339Millis),
-		param.StatusCode,
-		param.Latency,
-		param.Latency,
-		humanize.Bytes(uint64(param.Request.ContentLength)),
-		param.Request.ContentLength,
-		humanize.Bytes(uint64(param.BodySize)),
-		param.BodySize,
-		param.ClientIP,
-		param.Method,
-		param.Path,
-		param.ErrorMessage,
-	)
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(id)
 }
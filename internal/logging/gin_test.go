@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLogging(t *testing.T) {
+	logs := bytes.NewBuffer(nil)
+	if err := Configure("info", FormatJSON, logs); err != nil {
+		t.Fatalf("Error configuring logger: %s", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(RequestID(), NewGinLogger())
+	router.GET("/items/:id", func(ctx *gin.Context) {
+		BuildLoggerFromCtx(ctx).Info("Handling request")
+		ctx.Error(gin.Error{Err: errors.New(`broken "quoted" error`), Type: gin.ErrorTypePrivate})
+		ctx.Status(http.StatusInternalServerError)
+	})
+
+	for _, testCase := range []struct {
+		name             string
+		requestID        string
+		expectPropagated bool
+	}{
+		{name: "propagated", requestID: "client-request-1", expectPropagated: true},
+		{name: "generated", requestID: ""},
+		{name: "invalid", requestID: "spaces are not allowed"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			logs.Reset()
+			request := httptest.NewRequest(http.MethodGet, "/items/1", nil)
+			if testCase.requestID != "" {
+				request.Header.Set(RequestIDHeader, testCase.requestID)
+			}
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+
+			requestID := response.Header().Get(RequestIDHeader)
+			if testCase.expectPropagated && requestID != testCase.requestID {
+				t.Errorf("Expected request ID %s to be propagated, got %s", testCase.requestID, requestID)
+			} else if !testCase.expectPropagated && (requestID == "" || requestID == testCase.requestID) {
+				t.Errorf("Expected a generated request ID, got %q", requestID)
+			}
+
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("Expected a handler log and an access log, got %s", logs.String())
+			}
+			for _, line := range lines {
+				var record map[string]any
+				if err := json.Unmarshal([]byte(line), &record); err != nil {
+					t.Fatalf("Expected valid JSON, got %s: %s", line, err)
+				}
+				if record["request_id"] != requestID || record["route"] != "/items/:id" {
+					t.Errorf("Expected request ID %s and route /items/:id, got %s", requestID, line)
+				}
+			}
+
+			var accessLog map[string]any
+			json.Unmarshal([]byte(lines[1]), &accessLog)
+			if accessLog["level"] != "ERROR" || accessLog["status_code"] != float64(http.StatusInternalServerError) {
+				t.Errorf("Expected access log of a server error, got %s", lines[1])
+			}
+			if !strings.Contains(accessLog["error"].(string), `broken "quoted" error`) {
+				t.Errorf("Expected the error of the handler in the access log, got %s", lines[1])
+			}
+		})
+	}
+}
@@ -1,27 +1,80 @@
 package logging
 
 import (
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
+	"io"
 	"log/slog"
 	"os"
+	"strings"
 )
 
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+var (
+	ErrInvalidLogLevel  = errors.New("log level must be one of debug, info, warn or error")
+	ErrInvalidLogFormat = errors.New("log format must be either " + FormatJSON + " or " + FormatText)
+)
+
+// logger Logger shared by the CLI, the server and the encoders and decoders, writing JSON at debug level to stdout
+// unless changed through Configure
+var logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
 type Logger struct {
 	*slog.Logger
 }
 
+// Configure replaces the shared logger with one writing records of at least the level to output, in the format, json
+// or text. It also becomes the slog default logger, so that records logged through slog or the log package end up in
+// the same output
+func Configure(level, format string, output io.Writer) error {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("%w, got %s", ErrInvalidLogLevel, level)
+	}
+
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch strings.ToLower(format) {
+	case FormatJSON:
+		logger = slog.New(slog.NewJSONHandler(output, options))
+	case FormatText:
+		logger = slog.New(slog.NewTextHandler(output, options))
+	default:
+		return fmt.Errorf("%w, got %s", ErrInvalidLogFormat, format)
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+// Default returns the shared logger, as set by Configure
+func Default() *slog.Logger {
+	return logger
+}
+
 func BuildLogger() *Logger {
-	logger := Logger{Logger: slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))}
-	return &logger
+	return &Logger{Logger: logger}
 }
 
+// BuildLoggerFromCtx returns the logger of the request stored by RequestID, or a logger carrying the path of the
+// request if there is none
 func BuildLoggerFromCtx(ctx *gin.Context) *Logger {
-	logger := Logger{Logger: slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))}
-	logger = Logger{Logger: logger.With("path", ctx.Request.URL.Path)}
-	return &logger
+	if requestLogger, ok := ctx.Value(loggerContextKey).(*Logger); ok {
+		return requestLogger
+	}
+	return &Logger{Logger: logger.With("path", ctx.Request.URL.Path)}
 }
 
 func (l *Logger) WithError(err error) *Logger {
 	modifiedLogger := Logger{Logger: l.With("error", err.Error())}
 	return &modifiedLogger
 }
+
+// AddToRequestLogger adds the attributes to the logger of the request, so that the logs of the handlers and the
+// access log carry them
+func AddToRequestLogger(ctx *gin.Context, args ...any) {
+	ctx.Set(loggerContextKey, &Logger{Logger: BuildLoggerFromCtx(ctx).With(args...)})
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/semaphore"
+	"image"
+	"io"
+	"net/http"
+	"nsteg/api"
+	"nsteg/internal/logging"
+	"strconv"
+	"time"
+)
+
+const (
+	// carrierBytesPerPixel Memory a carrier is estimated to take per pixel while it is handled: the decoded image, of
+	// up to 4 bytes per pixel for 8-bit formats, and the RGBA image it is converted into
+	carrierBytesPerPixel = 8
+
+	// qualityMetricsBytesPerPixel Memory taken per pixel by the copy of the carrier kept to measure the quality of the
+	// encoded image against it
+	qualityMetricsBytesPerPixel = 4
+
+	// revealedBytesPerPixel Memory the files revealed from a carrier may take per pixel: up to 3 bytes per pixel when
+	// all 8 LSBs are used, and their base64 encoding in the response
+	revealedBytesPerPixel = 7
+
+	// bodyReservationStep Least the reservation of a body of unknown size grows by at a time, see budgetedBody
+	bodyReservationStep = 1 << 20
+
+	// retryAfterSeconds Time clients are asked to wait before retrying a request rejected because the server is busy
+	retryAfterSeconds = 1
+
+	memoryBudgetContextKey = "memory_budget"
+)
+
+var (
+	errCarrierTooLarge = api.Error{Code: "carrier_too_large", Error: "Image has more pixels than the server accepts"}
+	errPayloadTooLarge = api.Error{Code: "payload_too_large", Error: "Files to encode are larger than the server accepts"}
+	errTooManyFiles    = api.Error{Code: "too_many_files", Error: "More files to encode than the server accepts"}
+	errServerBusy      = api.Error{Code: "server_busy", Error: "Server does not have the memory to handle the request right now, retry later"}
+)
+
+// memoryBudget Memory shared by the requests being handled, which wait for room in it before binding their body and
+// before decoding their carrier. A nil budget is unlimited
+type memoryBudget struct {
+	semaphore *semaphore.Weighted
+	size      int64
+}
+
+// newMemoryBudget returns a budget of size bytes, or nil if size is 0
+func newMemoryBudget(size int64) *memoryBudget {
+	if size <= 0 {
+		return nil
+	}
+	return &memoryBudget{semaphore: semaphore.NewWeighted(size), size: size}
+}
+
+// acquire waits up to the timeout for the budget to have room for n bytes, returning context.DeadlineExceeded if it
+// does not by then. A timeout of 0 does not wait at all
+func (b *memoryBudget) acquire(ctx context.Context, n int64, timeout time.Duration) error {
+	if b == nil {
+		return nil
+	}
+	if timeout <= 0 {
+		if !b.semaphore.TryAcquire(n) {
+			return context.DeadlineExceeded
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return b.semaphore.Acquire(ctx, n)
+}
+
+func (b *memoryBudget) release(n int64) {
+	if b != nil {
+		b.semaphore.Release(n)
+	}
+}
+
+// fits returns whether n bytes fit in the whole budget, once the requests using it are done
+func (b *memoryBudget) fits(n int64) bool {
+	return b == nil || n <= b.size
+}
+
+// requestMemoryBudget returns the budget stored in the context by limitRequests, or nil if there is none
+func requestMemoryBudget(ctx *gin.Context) *memoryBudget {
+	budget, _ := ctx.Value(memoryBudgetContextKey).(*memoryBudget)
+	return budget
+}
+
+// bodyReservation Memory reserved from the budget for the body of a JSON request
+type bodyReservation struct {
+	budget *memoryBudget
+	bytes  int64
+}
+
+// shrink gives back to the budget the bytes reserved above n, once the body is bound and its size known
+func (r *bodyReservation) shrink(n int64) {
+	if n < r.bytes {
+		r.budget.release(r.bytes - n)
+		r.bytes = n
+	}
+}
+
+func (r *bodyReservation) release() {
+	r.budget.release(r.bytes)
+	r.bytes = 0
+}
+
+// admitBody waits for the memory budget to have room for the body of a JSON request before it is bound, since binding
+// holds the whole body along with the bytes decoded from its base64 fields. The request is aborted, and false returned,
+// if the body is too large for the budget or if the budget has no room for it before the admission timeout. Bodies of
+// unknown size reserve nothing up front, their reservation grows as they are read instead, failing the read once the
+// budget has no room left for them, see abortIfBodyOverBudget. Otherwise the returned reservation must be released once
+// the body is no longer needed
+func admitBody(ctx *gin.Context, logger *logging.Logger) (*bodyReservation, bool) {
+	budget, limits := requestMemoryBudget(ctx), requestLimits(ctx)
+	if budget == nil {
+		return &bodyReservation{}, true
+	}
+
+	if ctx.Request.ContentLength < 0 {
+		reservation := &bodyReservation{budget: budget}
+		ctx.Request.Body = &budgetedBody{ReadCloser: ctx.Request.Body, reservation: reservation}
+		return reservation, true
+	}
+
+	estimatedBytes := jsonBodyHeldBytes(ctx.Request.ContentLength)
+	if !budget.fits(estimatedBytes) {
+		logger.Info("Rejected body larger than the memory budget", "content_length", ctx.Request.ContentLength, "estimated_bytes", estimatedBytes)
+		abortWithError(ctx, http.StatusRequestEntityTooLarge, withDetails(errRequestTooLarge, map[string]any{"max_request_bytes": maxJSONBodyBytes(budget.size)}))
+		return nil, false
+	}
+	if !waitForBudget(ctx, logger, budget, estimatedBytes, limits.AdmissionTimeout) {
+		return nil, false
+	}
+	return &bodyReservation{budget: budget, bytes: estimatedBytes}, true
+}
+
+// budgetedBody Body of unknown size, whose reservation grows as it is read, by at least bodyReservationStep at a time.
+// Reads fail with a bodyOverBudgetError once the budget has no room left for the body read so far, without waiting for
+// it, since the reservation is held meanwhile and bodies waiting on each other would never be admitted
+type budgetedBody struct {
+	io.ReadCloser
+	reservation *bodyReservation
+	n           int64
+}
+
+func (b *budgetedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if growErr := b.reservation.grow(jsonBodyHeldBytes(b.n)); growErr != nil {
+		// The bytes read are dropped, so that the body is never bound past the budget
+		return 0, growErr
+	}
+	return n, err
+}
+
+// bodyOverBudgetError Error reading a body of unknown size past the room left in the memory budget, or past the whole
+// budget if tooLarge is set
+type bodyOverBudgetError struct {
+	heldBytes int64
+	tooLarge  bool
+}
+
+func (e *bodyOverBudgetError) Error() string {
+	return fmt.Sprintf("memory budget has no room for a request body holding %d bytes", e.heldBytes)
+}
+
+// grow reserves from the budget up to n bytes, and more up to bodyReservationStep, so that the budget is not reserved
+// from on every read
+func (r *bodyReservation) grow(n int64) error {
+	if n <= r.bytes {
+		return nil
+	}
+	if !r.budget.fits(n) {
+		return &bodyOverBudgetError{heldBytes: n, tooLarge: true}
+	}
+	for _, target := range []int64{min(max(n, r.bytes+bodyReservationStep), r.budget.size), n} {
+		if r.budget.acquire(context.Background(), target-r.bytes, 0) == nil {
+			r.bytes = target
+			return nil
+		}
+	}
+	return &bodyOverBudgetError{heldBytes: n}
+}
+
+// abortIfBodyOverBudget aborts the request as too large or as the server being busy if err was caused by reading its
+// body past the room in the memory budget, returning whether it did
+func abortIfBodyOverBudget(ctx *gin.Context, logger *logging.Logger, err error) bool {
+	var overBudgetErr *bodyOverBudgetError
+	if !errors.As(err, &overBudgetErr) {
+		return false
+	}
+	if overBudgetErr.tooLarge {
+		logger.WithError(err).Info("Rejected body larger than the memory budget")
+		abortWithError(ctx, http.StatusRequestEntityTooLarge, withDetails(errRequestTooLarge, map[string]any{"max_request_bytes": maxJSONBodyBytes(requestMemoryBudget(ctx).size)}))
+		return true
+	}
+	logger.WithError(err).Warn("Rejected request, memory budget has no room for its body")
+	ctx.Header("Retry-After", strconv.Itoa(retryAfterSeconds))
+	abortWithError(ctx, http.StatusTooManyRequests, errServerBusy)
+	return true
+}
+
+// jsonBodyHeldBytes estimates the memory held by binding a JSON body of n bytes: the body as read, and the bytes
+// decoded from its base64 fields, about 3 for every 4 of the body
+func jsonBodyHeldBytes(n int64) int64 {
+	return n + n/4*3
+}
+
+// maxJSONBodyBytes returns the size of the largest JSON body whose bound memory, as estimated by jsonBodyHeldBytes,
+// fits in heldBytes. Every 4 bytes of the body hold 7, and up to 3 bytes past the last 4 hold no more than themselves
+func maxJSONBodyBytes(heldBytes int64) int64 {
+	return heldBytes/7*4 + min(heldBytes%7, 3)
+}
+
+// admitCarrier checks the dimensions of the carrier, read from its header, against the limits, and waits for the memory
+// budget to have room for the request. The memory of the request is estimated as bytesPerPixel for every pixel of the
+// carrier, which depends on what the handler does with it, plus the heldBytes the handler holds regardless of the
+// carrier, such as its response body. The reservedBytes the handler already reserved from the budget, such as for its
+// request body, are not waited for again, but must fit in the budget along with the carrier. The request is aborted,
+// and false returned, if the carrier is invalid or too large, or if the budget has no room for it before the admission
+// timeout. Otherwise the returned reader reads the whole carrier, header included, and the returned function must be
+// called once the carrier is no longer needed
+func admitCarrier(ctx *gin.Context, logger *logging.Logger, carrier io.Reader, bytesPerPixel, heldBytes, reservedBytes int64) (io.Reader, func(), bool) {
+	header := bytes.NewBuffer(nil)
+	config, _, err := image.DecodeConfig(io.TeeReader(carrier, header))
+	if abortIfBodyOverQuota(ctx, logger, err) {
+		return nil, nil, false
+	} else if err != nil {
+		logger.WithError(err).Error("Error decoding request image header")
+		abortWithError(ctx, http.StatusBadRequest, errInvalidImage)
+		return nil, nil, false
+	}
+
+	limits := requestLimits(ctx)
+	pixels := int64(config.Width) * int64(config.Height)
+	if limits.MaxCarrierPixels > 0 && pixels > limits.MaxCarrierPixels {
+		logger.Info("Rejected carrier larger than the limit", "width", config.Width, "height", config.Height)
+		abortWithError(ctx, http.StatusRequestEntityTooLarge, withDetails(errCarrierTooLarge, map[string]any{"pixels": pixels, "max_pixels": limits.MaxCarrierPixels}))
+		return nil, nil, false
+	}
+
+	budget := requestMemoryBudget(ctx)
+	estimatedBytes := pixels*bytesPerPixel + heldBytes
+	if !budget.fits(estimatedBytes + reservedBytes) {
+		logger.Info("Rejected carrier larger than the memory budget", "width", config.Width, "height", config.Height, "estimated_bytes", estimatedBytes, "reserved_bytes", reservedBytes)
+		abortWithError(ctx, http.StatusRequestEntityTooLarge, withDetails(errCarrierTooLarge, map[string]any{"pixels": pixels, "max_pixels": max(budget.size-heldBytes-reservedBytes, 0) / bytesPerPixel}))
+		return nil, nil, false
+	}
+	if !waitForBudget(ctx, logger, budget, estimatedBytes, limits.AdmissionTimeout) {
+		return nil, nil, false
+	}
+	logger.Debug("Admitted carrier", "width", config.Width, "height", config.Height, "estimated_bytes", estimatedBytes)
+
+	return io.MultiReader(header, carrier), func() { budget.release(estimatedBytes) }, true
+}
+
+// waitForBudget waits up to the admission timeout for the budget to have room for n bytes, aborting the request and
+// returning false if it does not by then, or if the client disconnects meanwhile
+func waitForBudget(ctx *gin.Context, logger *logging.Logger, budget *memoryBudget, n int64, timeout time.Duration) bool {
+	admissionStart := time.Now()
+	if err := budget.acquire(ctx.Request.Context(), n, timeout); errors.Is(err, context.DeadlineExceeded) {
+		logger.Warn("Rejected request, memory budget has no room for it", "estimated_bytes", n, "waited", time.Since(admissionStart))
+		ctx.Header("Retry-After", strconv.Itoa(retryAfterSeconds))
+		abortWithError(ctx, http.StatusTooManyRequests, errServerBusy)
+		return false
+	} else if err != nil {
+		logger.WithError(err).Warn("Client disconnected while waiting for the memory budget")
+		ctx.AbortWithStatus(statusClientClosedRequest)
+		return false
+	}
+	return true
+}
+
+// admitPayload checks the number and total size of the files to encode against the limits, aborting the request and
+// returning false if they exceed them
+func admitPayload(ctx *gin.Context, logger *logging.Logger, fileSizes []int64) bool {
+	limits := requestLimits(ctx)
+	if limits.MaxFiles > 0 && len(fileSizes) > limits.MaxFiles {
+		logger.Info("Rejected request with more files than the limit", "files", len(fileSizes))
+		abortWithError(ctx, http.StatusRequestEntityTooLarge, withDetails(errTooManyFiles, map[string]any{"files": len(fileSizes), "max_files": limits.MaxFiles}))
+		return false
+	}
+
+	var payloadBytes int64
+	for _, size := range fileSizes {
+		payloadBytes += size
+	}
+	if limits.MaxPayloadBytes > 0 && payloadBytes > limits.MaxPayloadBytes {
+		logger.Info("Rejected payload larger than the limit", "payload_bytes", payloadBytes)
+		abortWithError(ctx, http.StatusRequestEntityTooLarge, withDetails(errPayloadTooLarge, map[string]any{"payload_bytes": payloadBytes, "max_payload_bytes": limits.MaxPayloadBytes}))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"nsteg/api"
+	"nsteg/internal/logging"
+	"nsteg/test"
+	"testing"
+	"time"
+)
+
+func TestAdmissionLimits(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	carrierPNG := testCarrierPNG(t)
+	files := []api.FileToHide{{Name: "first", Content: test.GenerateRandomBytes(100)}, {Name: "second", Content: test.GenerateRandomBytes(100)}}
+	// Encode requests hold a copy of the carrier for the quality metrics, along with their bodies, while their responses
+	// are streamed
+	encodeBytes := 100*100*(carrierBytesPerPixel+qualityMetricsBytesPerPixel) + boundBodyHeldBytes(int64(len(carrierPNG))+200)
+
+	for _, testCase := range []struct {
+		name           string
+		limits         Limits
+		image          []byte
+		chunked        bool
+		expectedStatus int
+		expectedCode   string
+	}{
+		{name: "within limits", limits: Limits{MaxCarrierPixels: 100 * 100, MaxPayloadBytes: 200, MaxFiles: 2, MemoryBudgetBytes: encodeBytes}, image: carrierPNG, expectedStatus: http.StatusOK},
+		{name: "carrier over pixel limit", limits: Limits{MaxCarrierPixels: 100*100 - 1}, image: carrierPNG, expectedStatus: http.StatusRequestEntityTooLarge, expectedCode: errCarrierTooLarge.Code},
+		{name: "carrier over memory budget", limits: Limits{MemoryBudgetBytes: encodeBytes - 1}, image: carrierPNG, expectedStatus: http.StatusRequestEntityTooLarge, expectedCode: errCarrierTooLarge.Code},
+		{name: "body over memory budget", limits: Limits{MemoryBudgetBytes: 1000}, image: carrierPNG, expectedStatus: http.StatusRequestEntityTooLarge, expectedCode: errRequestTooLarge.Code},
+		{name: "chunked body within memory budget", limits: Limits{MemoryBudgetBytes: encodeBytes}, image: carrierPNG, chunked: true, expectedStatus: http.StatusOK},
+		{name: "chunked body over memory budget", limits: Limits{MemoryBudgetBytes: 1000}, image: carrierPNG, chunked: true, expectedStatus: http.StatusRequestEntityTooLarge, expectedCode: errRequestTooLarge.Code},
+		{name: "payload over limit", limits: Limits{MaxPayloadBytes: 199}, image: carrierPNG, expectedStatus: http.StatusRequestEntityTooLarge, expectedCode: errPayloadTooLarge.Code},
+		{name: "too many files", limits: Limits{MaxFiles: 1}, image: carrierPNG, expectedStatus: http.StatusRequestEntityTooLarge, expectedCode: errTooManyFiles.Code},
+		{name: "invalid image header", image: []byte("not an image"), expectedStatus: http.StatusBadRequest, expectedCode: errInvalidImage.Code},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			encodeRequest, err := json.Marshal(api.EncodeImageRequest{LsbsToUse: 3, ImageToEncode: testCase.image, FilesToHide: files})
+			if err != nil {
+				t.Fatalf("Error building encode request: %s", err)
+			}
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/image/encode", bytes.NewReader(encodeRequest))
+			request.Header.Set("Content-Type", "application/json")
+			if testCase.chunked {
+				request.ContentLength = -1
+			}
+			response := httptest.NewRecorder()
+			newRouter(Config{Limits: testCase.limits}).ServeHTTP(response, request)
+
+			if response.Code != testCase.expectedStatus {
+				t.Fatalf("Expected status %d, got %d", testCase.expectedStatus, response.Code)
+			}
+			if testCase.expectedCode != "" {
+				var apiErr api.Error
+				if err = json.Unmarshal(response.Body.Bytes(), &apiErr); err != nil || apiErr.Code != testCase.expectedCode {
+					t.Errorf("Expected error code %s, got %s", testCase.expectedCode, response.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	carrierPNG := testCarrierPNG(t)
+
+	// The budget has room for a single carrier, which is held until the first request is released
+	admitted, release := make(chan struct{}), make(chan struct{})
+	router := gin.New()
+	router.Use(limitRequests(Limits{MemoryBudgetBytes: 100 * 100 * carrierBytesPerPixel, AdmissionTimeout: 50 * time.Millisecond}))
+	router.POST("/carrier", func(ctx *gin.Context) {
+		carrier, releaseCarrier, ok := admitCarrier(ctx, logging.BuildLoggerFromCtx(ctx), ctx.Request.Body, carrierBytesPerPixel, 0, 0)
+		if !ok {
+			return
+		}
+		defer releaseCarrier()
+		if read, err := io.ReadAll(carrier); err != nil || !bytes.Equal(read, carrierPNG) {
+			t.Errorf("Expected the admitted carrier to read the whole image")
+		}
+		if ctx.Query("hold") != "" {
+			admitted <- struct{}{}
+			<-release
+		}
+		ctx.Status(http.StatusOK)
+	})
+	postCarrier := func(query string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, httptest.NewRequest(http.MethodPost, "/carrier"+query, bytes.NewReader(carrierPNG)))
+		return response
+	}
+
+	held := make(chan int)
+	go func() {
+		held <- postCarrier("?hold=true").Code
+	}()
+	<-admitted
+
+	response := postCarrier("")
+	if response.Code != http.StatusTooManyRequests || response.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected status %d with Retry-After while the budget is used up, got %d", http.StatusTooManyRequests, response.Code)
+	}
+
+	close(release)
+	if status := <-held; status != http.StatusOK {
+		t.Errorf("Expected status %d for the held request, got %d", http.StatusOK, status)
+	}
+	if response = postCarrier(""); response.Code != http.StatusOK {
+		t.Errorf("Expected status %d once the budget is released, got %d", http.StatusOK, response.Code)
+	}
+}
+
+func TestMaxJSONBodyBytes(t *testing.T) {
+	for heldBytes := int64(0); heldBytes < 1000; heldBytes++ {
+		maxBodyBytes := maxJSONBodyBytes(heldBytes)
+		if jsonBodyHeldBytes(maxBodyBytes) > heldBytes {
+			t.Fatalf("Expected a body of %d bytes to hold at most %d bytes, it holds %d", maxBodyBytes, heldBytes, jsonBodyHeldBytes(maxBodyBytes))
+		}
+		if jsonBodyHeldBytes(maxBodyBytes+1) <= heldBytes {
+			t.Fatalf("Expected %d bytes to be the largest body holding at most %d bytes, %d bytes hold %d", maxBodyBytes, heldBytes, maxBodyBytes+1, jsonBodyHeldBytes(maxBodyBytes+1))
+		}
+	}
+}
+
+func TestBodyReservationGrowth(t *testing.T) {
+	budget := newMemoryBudget(100)
+	reservation := &bodyReservation{budget: budget}
+	// Bodies of unknown size reserve the step at once, capped to the budget
+	if err := reservation.grow(10); err != nil || reservation.bytes != 100 {
+		t.Fatalf("Expected the whole budget to be reserved, got %d bytes: %v", reservation.bytes, err)
+	}
+	reservation.shrink(40)
+
+	// Another request holds the rest of the budget, so the body can only grow up to the room left
+	if err := budget.acquire(context.Background(), 50, 0); err != nil {
+		t.Fatalf("Error acquiring the budget: %s", err)
+	}
+	if err := reservation.grow(50); err != nil || reservation.bytes != 50 {
+		t.Fatalf("Expected 50 bytes to be reserved, got %d bytes: %v", reservation.bytes, err)
+	}
+	var overBudgetErr *bodyOverBudgetError
+	if err := reservation.grow(60); !errors.As(err, &overBudgetErr) || overBudgetErr.tooLarge {
+		t.Errorf("Expected the budget to have no room for the body, got %v", err)
+	}
+	if err := reservation.grow(101); !errors.As(err, &overBudgetErr) || !overBudgetErr.tooLarge {
+		t.Errorf("Expected the body to be too large for the budget, got %v", err)
+	}
+
+	reservation.release()
+	budget.release(50)
+	if err := budget.acquire(context.Background(), 100, 0); err != nil {
+		t.Errorf("Expected the whole budget to be released, got %v", err)
+	}
+}
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"math"
+	"net/http"
+	"nsteg/api"
+	"nsteg/internal/auth"
+	"nsteg/internal/logging"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiKeyHeader = "X-API-Key"
+
+var (
+	errUnauthorized     = api.Error{Code: "unauthorized", Error: "Request must carry a valid API key or token, in the Authorization header as a bearer credential or in the X-API-Key header"}
+	errRateLimited      = api.Error{Code: "rate_limited", Error: "Key made more requests this minute than it is allowed, retry after the Retry-After header"}
+	errQuotaExceeded    = api.Error{Code: "quota_exceeded", Error: "Key used more bytes today than it is allowed"}
+	errQuotaUnavailable = api.Error{Code: "quota_unavailable", Error: "Usage of the key could not be checked, retry later"}
+	errAuthUnavailable  = api.Error{Code: "auth_unavailable", Error: "Credential could not be checked, retry later"}
+)
+
+// Auth Authentication of the requests to the API, and quotas of the keys they are authenticated with
+type Auth struct {
+	Authenticator auth.Authenticator
+	Quotas        auth.QuotaStore
+}
+
+// authenticate rejects requests to the API without a valid credential, and requests of keys that exceeded their rate
+// limit or their daily bytes. The bytes of the request body are reserved from the daily bytes of the key when the
+// request is admitted, and the bytes actually used by the body and the response are charged once it is handled
+func authenticate(config Auth) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		logger := logging.BuildLoggerFromCtx(ctx)
+		principal, err := config.Authenticator.Authenticate(requestCredential(ctx))
+		if err != nil && !isAuthError(err) {
+			logger.WithError(err).Error("Error authenticating request")
+			abortWithError(ctx, http.StatusServiceUnavailable, errAuthUnavailable)
+			return
+		} else if err != nil {
+			logger.WithError(err).Warn("Rejected unauthenticated request")
+			ctx.Header("WWW-Authenticate", `Bearer realm="nsteg"`)
+			abortWithError(ctx, http.StatusUnauthorized, errUnauthorized)
+			return
+		}
+
+		logging.AddToRequestLogger(ctx, "key_id", principal.KeyID)
+		logger = logging.BuildLoggerFromCtx(ctx)
+		trace.SpanFromContext(ctx.Request.Context()).SetAttributes(attribute.String("nsteg.key_id", principal.KeyID))
+
+		reservation, admitted := admitKey(ctx, logger, config.Quotas, principal)
+		if !admitted {
+			return
+		}
+
+		body := &countingReadCloser{ReadCloser: ctx.Request.Body}
+		if principal.Limits.DailyBytes > 0 && ctx.Request.ContentLength < 0 {
+			// Bodies of unknown size cannot be read past the bytes reserved for them
+			body.limit = &bodyOverQuotaError{reservedBytes: reservation.bytes, resetAt: reservation.resetAt}
+		}
+		ctx.Request.Body = body
+		ctx.Next()
+
+		usedBytes := body.n + int64(max(ctx.Writer.Size(), 0))
+		if _, _, err = config.Quotas.AddBytes(ctx.Request.Context(), principal.KeyID, usedBytes-reservation.bytes); err != nil {
+			logger.WithError(err).Error("Error recording the bytes used by the key", "bytes", usedBytes, "reserved_bytes", reservation.bytes)
+		}
+	}
+}
+
+// quotaReservation Bytes reserved from the daily bytes of a key for the body of a request, and when the day ends
+type quotaReservation struct {
+	bytes   int64
+	resetAt time.Time
+}
+
+// admitKey checks the rate limit and daily bytes of the key, aborting the request and returning false if it exceeded
+// them. The bytes of the body are reserved from the daily bytes as the request is admitted, so that concurrent requests
+// of the key cannot all pass the check before any of them is charged: the declared length for requests declaring it,
+// and every byte left to the key for requests that do not, whose body is then cut once it reaches them
+func admitKey(ctx *gin.Context, logger *logging.Logger, quotas auth.QuotaStore, principal auth.Principal) (quotaReservation, bool) {
+	limits := principal.Limits
+	if limits.RequestsPerMinute > 0 {
+		requests, resetAt, err := quotas.TakeRequest(ctx.Request.Context(), principal.KeyID)
+		if err != nil {
+			logger.WithError(err).Error("Error counting the requests of the key")
+			abortWithError(ctx, http.StatusServiceUnavailable, errQuotaUnavailable)
+			return quotaReservation{}, false
+		}
+		if requests > limits.RequestsPerMinute {
+			logger.Info("Rejected request over the rate limit of the key", "requests", requests)
+			ctx.Header("Retry-After", strconv.Itoa(retryAfter(resetAt)))
+			abortWithError(ctx, http.StatusTooManyRequests, withDetails(errRateLimited, map[string]any{
+				"requests_per_minute": limits.RequestsPerMinute,
+				"resets_at":           resetAt.UTC(),
+			}))
+			return quotaReservation{}, false
+		}
+	}
+	if limits.DailyBytes == 0 {
+		return quotaReservation{}, true
+	}
+
+	reservedBytes := ctx.Request.ContentLength
+	if reservedBytes < 0 {
+		usedBytes, _, err := quotas.AddBytes(ctx.Request.Context(), principal.KeyID, 0)
+		if err != nil {
+			logger.WithError(err).Error("Error reading the bytes used by the key")
+			abortWithError(ctx, http.StatusServiceUnavailable, errQuotaUnavailable)
+			return quotaReservation{}, false
+		}
+		reservedBytes = max(limits.DailyBytes-usedBytes, 0)
+	}
+	usedBytes, resetAt, err := quotas.AddBytes(ctx.Request.Context(), principal.KeyID, reservedBytes)
+	if err != nil {
+		logger.WithError(err).Error("Error reserving the bytes of the request")
+		abortWithError(ctx, http.StatusServiceUnavailable, errQuotaUnavailable)
+		return quotaReservation{}, false
+	}
+	// Keys that used up their bytes are rejected even for empty bodies, since their response would take more
+	if previousBytes := usedBytes - reservedBytes; previousBytes >= limits.DailyBytes || usedBytes > limits.DailyBytes {
+		if _, _, err = quotas.AddBytes(ctx.Request.Context(), principal.KeyID, -reservedBytes); err != nil {
+			logger.WithError(err).Error("Error giving back the bytes reserved for the request", "reserved_bytes", reservedBytes)
+		}
+		logger.Info("Rejected request over the daily bytes of the key", "used_bytes", previousBytes, "content_length", ctx.Request.ContentLength)
+		ctx.Header("Retry-After", strconv.Itoa(retryAfter(resetAt)))
+		abortWithError(ctx, http.StatusTooManyRequests, withDetails(errQuotaExceeded, map[string]any{
+			"daily_bytes": limits.DailyBytes,
+			"used_bytes":  previousBytes,
+			"resets_at":   resetAt.UTC(),
+		}))
+		return quotaReservation{}, false
+	}
+	return quotaReservation{bytes: reservedBytes, resetAt: resetAt}, true
+}
+
+// bodyOverQuotaError Error reading a body of unknown size past the bytes reserved for it from the daily bytes of the key
+type bodyOverQuotaError struct {
+	reservedBytes int64
+	resetAt       time.Time
+}
+
+func (e *bodyOverQuotaError) Error() string {
+	return fmt.Sprintf("request body is larger than the %d bytes left to the key today", e.reservedBytes)
+}
+
+// abortIfBodyOverQuota aborts the request as exceeding the daily bytes of its key if err was caused by reading its body
+// past them, returning whether it did
+func abortIfBodyOverQuota(ctx *gin.Context, logger *logging.Logger, err error) bool {
+	var overQuotaErr *bodyOverQuotaError
+	if !errors.As(err, &overQuotaErr) {
+		return false
+	}
+	logger.WithError(err).Info("Rejected request body over the daily bytes of the key")
+	ctx.Header("Retry-After", strconv.Itoa(retryAfter(overQuotaErr.resetAt)))
+	abortWithError(ctx, http.StatusTooManyRequests, withDetails(errQuotaExceeded, map[string]any{
+		"reserved_bytes": overQuotaErr.reservedBytes,
+		"resets_at":      overQuotaErr.resetAt.UTC(),
+	}))
+	return true
+}
+
+// requestCredential returns the bearer credential of the Authorization header, or else the X-API-Key header
+func requestCredential(ctx *gin.Context) string {
+	scheme, credential, found := strings.Cut(ctx.GetHeader("Authorization"), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(credential)
+	}
+	return ctx.GetHeader(apiKeyHeader)
+}
+
+// retryAfter returns the seconds until resetAt, rounded up
+func retryAfter(resetAt time.Time) int {
+	return max(int(math.Ceil(time.Until(resetAt).Seconds())), 1)
+}
+
+// countingReadCloser Counts the bytes of the request body read by the handler, failing with limit once they go past
+// the bytes reserved by it, if it is set
+type countingReadCloser struct {
+	io.ReadCloser
+	n     int64
+	limit *bodyOverQuotaError
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	if c.limit != nil && int64(len(p)) > c.limit.reservedBytes-c.n {
+		// A byte more than reserved is read, to tell bodies ending right at the limit from those going past it
+		p = p[:c.limit.reservedBytes-c.n+1]
+	}
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	if c.limit != nil && c.n > c.limit.reservedBytes {
+		c.n--
+		return n - 1, c.limit
+	}
+	return n, err
+}
+
+// isAuthError returns whether err is caused by an invalid credential rather than by the authenticator failing
+func isAuthError(err error) bool {
+	return errors.Is(err, auth.ErrInvalidCredential) || errors.Is(err, auth.ErrUnknownKey) ||
+		errors.Is(err, auth.ErrRevokedKey) || errors.Is(err, auth.ErrExpiredToken)
+}
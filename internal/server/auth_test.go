@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"nsteg/api"
+	"nsteg/internal/auth"
+	"nsteg/internal/logging"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuthentication(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keysPath := filepath.Join(t.TempDir(), "keys.yaml")
+	keys := &auth.KeysFile{}
+	newKey := func(limits auth.Limits) string {
+		_, apiKey, err := keys.CreateKey("test", limits, time.Now())
+		if err != nil {
+			t.Fatalf("Error creating key: %s", err)
+		}
+		return apiKey
+	}
+	unlimitedKey := newKey(auth.Limits{})
+	rateLimitedKey := newKey(auth.Limits{RequestsPerMinute: 2})
+	quotaKey := newKey(auth.Limits{DailyBytes: 200})
+	if err := keys.Write(keysPath); err != nil {
+		t.Fatalf("Error writing keys file: %s", err)
+	}
+
+	store, err := auth.NewKeyStore(keysPath)
+	if err != nil {
+		t.Fatalf("Error creating key store: %s", err)
+	}
+	tokenSecret := bytes.Repeat([]byte{1}, auth.MinTokenSecretBytes)
+	token, err := auth.MintToken(tokenSecret, keys.Keys[0].ID, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Error minting token: %s", err)
+	}
+	router := newRouter(Config{Limits: DefaultLimits(), Auth: &Auth{
+		Authenticator: auth.NewAuthenticator(store, tokenSecret),
+		Quotas:        auth.NewMemoryQuotaStore(),
+	}})
+
+	// Malformed bodies are rejected by the handler, so a 400 shows that the request got through authentication
+	malformedBody := bytes.Repeat([]byte("x"), 50)
+	for _, testCase := range []struct {
+		name           string
+		headers        map[string]string
+		body           []byte
+		expectedStatus int
+		expectedCode   string
+	}{
+		{name: "no credential", expectedStatus: http.StatusUnauthorized, expectedCode: errUnauthorized.Code},
+		{name: "invalid API key", headers: map[string]string{apiKeyHeader: unlimitedKey + "x"}, expectedStatus: http.StatusUnauthorized, expectedCode: errUnauthorized.Code},
+		{name: "unsupported scheme", headers: map[string]string{"Authorization": "Basic " + unlimitedKey}, expectedStatus: http.StatusUnauthorized, expectedCode: errUnauthorized.Code},
+		{name: "API key header", headers: map[string]string{apiKeyHeader: unlimitedKey}, expectedStatus: http.StatusBadRequest, expectedCode: errRequestBodyDecode.Code},
+		{name: "bearer API key", headers: map[string]string{"Authorization": "Bearer " + unlimitedKey}, expectedStatus: http.StatusBadRequest, expectedCode: errRequestBodyDecode.Code},
+		{name: "bearer token", headers: map[string]string{"Authorization": "Bearer " + token}, expectedStatus: http.StatusBadRequest, expectedCode: errRequestBodyDecode.Code},
+		{name: "first request within rate limit", headers: map[string]string{apiKeyHeader: rateLimitedKey}, expectedStatus: http.StatusBadRequest},
+		{name: "second request within rate limit", headers: map[string]string{apiKeyHeader: rateLimitedKey}, expectedStatus: http.StatusBadRequest},
+		{name: "request over rate limit", headers: map[string]string{apiKeyHeader: rateLimitedKey}, expectedStatus: http.StatusTooManyRequests, expectedCode: errRateLimited.Code},
+		{name: "request over daily bytes", headers: map[string]string{apiKeyHeader: quotaKey}, body: make([]byte, 201), expectedStatus: http.StatusTooManyRequests, expectedCode: errQuotaExceeded.Code},
+		{name: "request within daily bytes", headers: map[string]string{apiKeyHeader: quotaKey}, expectedStatus: http.StatusBadRequest},
+		{name: "request once daily bytes used", headers: map[string]string{apiKeyHeader: quotaKey}, expectedStatus: http.StatusTooManyRequests, expectedCode: errQuotaExceeded.Code},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			body := testCase.body
+			if body == nil {
+				body = malformedBody
+			}
+			request := httptest.NewRequest(http.MethodPost, "/api/v1/image/decode", bytes.NewReader(body))
+			request.Header.Set("Content-Type", "application/json")
+			for header, value := range testCase.headers {
+				request.Header.Set(header, value)
+			}
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+
+			if response.Code != testCase.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", testCase.expectedStatus, response.Code, response.Body.String())
+			}
+			var apiErr api.Error
+			if err := json.Unmarshal(response.Body.Bytes(), &apiErr); err != nil {
+				t.Fatalf("Expected an api.Error, got %s", response.Body.String())
+			}
+			if testCase.expectedCode != "" && apiErr.Code != testCase.expectedCode {
+				t.Errorf("Expected error code %s, got %s", testCase.expectedCode, apiErr.Code)
+			}
+			switch response.Code {
+			case http.StatusUnauthorized:
+				if response.Header().Get("WWW-Authenticate") == "" {
+					t.Error("Expected WWW-Authenticate header on unauthorized response")
+				}
+			case http.StatusTooManyRequests:
+				if response.Header().Get("Retry-After") == "" {
+					t.Error("Expected Retry-After header on rate limited response")
+				}
+				if apiErr.Details["resets_at"] == nil {
+					t.Errorf("Expected resets_at in the details, got %v", apiErr.Details)
+				}
+			}
+		})
+	}
+
+	// Health checks stay open, for load balancers and orchestrators without credentials
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if response.Code != http.StatusOK {
+		t.Errorf("Expected /healthz to stay open, got %d", response.Code)
+	}
+}
+
+func TestDailyBytesReservation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keysPath := filepath.Join(t.TempDir(), "keys.yaml")
+	keys := &auth.KeysFile{}
+	_, apiKey, err := keys.CreateKey("test", auth.Limits{DailyBytes: 1000}, time.Now())
+	if err != nil {
+		t.Fatalf("Error creating key: %s", err)
+	}
+	if err = keys.Write(keysPath); err != nil {
+		t.Fatalf("Error writing keys file: %s", err)
+	}
+	store, err := auth.NewKeyStore(keysPath)
+	if err != nil {
+		t.Fatalf("Error creating key store: %s", err)
+	}
+
+	// The handler reads the whole body and holds the request until released, so that requests overlap
+	started, release := make(chan struct{}), make(chan struct{})
+	router := gin.New()
+	router.Use(authenticate(Auth{Authenticator: auth.NewAuthenticator(store, nil), Quotas: auth.NewMemoryQuotaStore()}))
+	router.POST("/", func(ctx *gin.Context) {
+		if _, err := io.ReadAll(ctx.Request.Body); err != nil {
+			abortWithBindError(ctx, logging.BuildLoggerFromCtx(ctx), err)
+			return
+		}
+		if ctx.Query("hold") != "" {
+			started <- struct{}{}
+			<-release
+		}
+		ctx.Status(http.StatusNoContent)
+	})
+	serve := func(body io.Reader, contentLength int64, query string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/"+query, body)
+		request.ContentLength = contentLength
+		request.Header.Set(apiKeyHeader, apiKey)
+		response := httptest.NewRecorder()
+		router.ServeHTTP(response, request)
+		return response
+	}
+
+	held := make(chan *httptest.ResponseRecorder)
+	go func() { held <- serve(bytes.NewReader(make([]byte, 600)), 600, "?hold=true") }()
+	<-started
+	// The bytes of the held request are reserved while it is handled, so a concurrent one cannot use them too
+	if response := serve(bytes.NewReader(make([]byte, 600)), 600, ""); response.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected concurrent request over the daily bytes to be rejected, got %d", response.Code)
+	}
+	close(release)
+	if response := <-held; response.Code != http.StatusNoContent {
+		t.Fatalf("Expected held request to be handled, got %d: %s", response.Code, response.Body.String())
+	}
+
+	// Bodies of unknown size are cut once they read past the 400 bytes left, and the bytes read are charged
+	response := serve(bytes.NewReader(make([]byte, 401)), -1, "")
+	if response.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected body of unknown size over the daily bytes to be rejected, got %d: %s", response.Code, response.Body.String())
+	}
+	if response.Header().Get("Retry-After") == "" {
+		t.Error("Expected Retry-After header on rejected body")
+	}
+	if response = serve(bytes.NewReader(make([]byte, 1)), -1, ""); response.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected request once daily bytes used to be rejected, got %d", response.Code)
+	}
+}
@@ -1,9 +1,156 @@
 package server
 
-import "nsteg/api"
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"nsteg"
+	"nsteg/api"
+	"nsteg/internal/logging"
+	"nsteg/pkg/carrier"
+	nstegImage "nsteg/pkg/image"
+	"nsteg/pkg/model"
+	"nsteg/pkg/payload"
+	"nsteg/pkg/seal"
+	"nsteg/pkg/signature"
+)
+
+// statusClientClosedRequest Non standard status, popularised by nginx, for requests aborted because the client
+// disconnected before the response was written. It is only ever logged, since nobody is left to receive it
+const statusClientClosedRequest = 499
 
 var (
-	errRequestBodyDecode       = api.Error{Error: "Error reading request body"}
-	errInvalidImage            = api.Error{Code: "invalid_image", Error: "Invalid image supplied in request body"}
-	errErrorConvertingRawImage = api.Error{Error: "Error converting raw image"}
+	errRequestBodyDecode = api.Error{Code: "malformed_request", Error: "Request body is not valid JSON of the expected shape"}
+	errInvalidImage      = api.Error{Code: "invalid_image", Error: "Invalid image supplied in request body"}
+	errInvalidLSBsToUse  = api.Error{Code: "invalid_lsbs_to_use", Error: "lsbs_to_use must be between 1 and 8"}
+	errReservedFileName  = api.Error{Code: "reserved_file_name", Error: signature.ErrReservedFileName.Error()}
+	errImageNotBigEnough = api.Error{Code: "image_not_big_enough", Error: nstegImage.ErrImageNotBigEnough.Error()}
+	errNotNstegImage     = api.Error{Code: "not_nsteg_image", Error: "Image does not hold files encoded by nsteg"}
+	errPayloadCorrupted  = api.Error{Code: "payload_corrupted", Error: "Files hidden in the image were modified or corrupted"}
+	errWrongKey          = api.Error{Code: "wrong_key", Error: "Files hidden in the image cannot be opened with the supplied key or identity"}
+	errInvalidIdentity   = api.Error{Code: "invalid_identity", Error: seal.ErrInvalidIdentity.Error()}
+	errConflictingKeys   = api.Error{Code: "conflicting_keys", Error: "Files encoded for recipients are decoded with an identity, not a key"}
+	errSignature         = api.Error{Code: "signature_error", Error: "Decoded files are not signed by a trusted signer, or their signature is invalid"}
 )
+
+// errorMapping Status and api.Error a request fails with when handling it fails with err
+type errorMapping struct {
+	errs   []error
+	status int
+	apiErr api.Error
+}
+
+// encodeErrorMappings Errors of encoding caused by the request, checked in order. Any other error is an internal
+// server error
+var encodeErrorMappings = []errorMapping{
+	{errs: []error{nsteg.ErrInvalidCarrier}, status: http.StatusBadRequest, apiErr: errInvalidImage},
+	{errs: []error{nstegImage.ErrInvalidLSBsToUse}, status: http.StatusBadRequest, apiErr: errInvalidLSBsToUse},
+	{errs: []error{signature.ErrReservedFileName}, status: http.StatusBadRequest, apiErr: errReservedFileName},
+	{errs: []error{nstegImage.ErrImageNotBigEnough, carrier.ErrCarrierTooSmall}, status: http.StatusUnprocessableEntity, apiErr: errImageNotBigEnough},
+}
+
+// decodeErrorMappings Errors of decoding caused by the request, checked in order. Any other error is an internal
+// server error
+var decodeErrorMappings = []errorMapping{
+	{errs: []error{nsteg.ErrInvalidCarrier}, status: http.StatusBadRequest, apiErr: errInvalidImage},
+	{errs: []error{nsteg.ErrConflictingOptions}, status: http.StatusBadRequest, apiErr: errConflictingKeys},
+	{errs: []error{seal.ErrWrongKey, seal.ErrNoMatchingIdentity, nstegImage.ErrNoVolumeFoundForKey}, status: http.StatusUnauthorized, apiErr: errWrongKey},
+	{errs: []error{seal.ErrAuthentication}, status: http.StatusUnprocessableEntity, apiErr: errPayloadCorrupted},
+	{errs: []error{signature.ErrInvalidSignature, signature.ErrUnsigned, signature.ErrUntrustedSigner}, status: http.StatusUnprocessableEntity, apiErr: errSignature},
+	{
+		// Decoding an image that does not hold nsteg files reads noise as the payload, which runs out of bounds or
+		// declares sizes that are too large
+		errs:   []error{nstegImage.ErrDecodeFileBounds, payload.ErrMaxAllocExceeded, payload.ErrMissingSignature, carrier.ErrOutOfBounds, io.ErrUnexpectedEOF},
+		status: http.StatusUnprocessableEntity, apiErr: errNotNstegImage,
+	},
+}
+
+// mapError returns the status and api.Error of the first mapping err matches, and false if it matches none
+func mapError(mappings []errorMapping, err error) (int, api.Error, bool) {
+	for _, mapping := range mappings {
+		for _, mappedErr := range mapping.errs {
+			if errors.Is(err, mappedErr) {
+				return mapping.status, mapping.apiErr, true
+			}
+		}
+	}
+	return 0, api.Error{}, false
+}
+
+// abortWithError aborts the request with the error as its response, recording its code for the metrics
+func abortWithError(ctx *gin.Context, status int, apiErr api.Error) {
+	ctx.Set(errorCodeContextKey, apiErr.Code)
+	ctx.AbortWithStatusJSON(status, apiErr)
+}
+
+// withDetails returns a copy of the error with the details, leaving the shared error untouched
+func withDetails(apiErr api.Error, details map[string]any) api.Error {
+	apiErr.Details = details
+	return apiErr
+}
+
+// abortWithBindError aborts a request whose body could not be bound, as being too large if it exceeded the limit, the
+// daily bytes of its key or the memory budget, as the server being busy if the budget had no room left for it, and as
+// malformed otherwise
+func abortWithBindError(ctx *gin.Context, logger *logging.Logger, err error) {
+	if abortIfBodyOverQuota(ctx, logger, err) || abortIfBodyOverBudget(ctx, logger, err) {
+		return
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		logger.WithError(err).Info("Rejected request larger than the limit")
+		abortWithError(ctx, http.StatusRequestEntityTooLarge, withDetails(errRequestTooLarge, map[string]any{"max_request_bytes": maxBytesErr.Limit}))
+		return
+	}
+	logger.WithError(err).Warn("Error reading request body")
+	abortWithError(ctx, http.StatusBadRequest, withDetails(errRequestBodyDecode, map[string]any{"reason": err.Error()}))
+}
+
+// abortWithEncodeError aborts an encode request that failed with err, with the status and api.Error it maps to. The
+// stats of the failed encode supply the bytes needed and available when the files do not fit
+func abortWithEncodeError(ctx *gin.Context, logger *logging.Logger, stats model.EncodeStats, lsbsToUse byte, err error) {
+	if abortIfBodyOverQuota(ctx, logger, err) {
+		return
+	}
+	if errors.Is(err, context.Canceled) {
+		logger.WithError(err).Warn("Client disconnected before the image was encoded")
+		ctx.AbortWithStatus(statusClientClosedRequest)
+		return
+	}
+	status, apiErr, mapped := mapError(encodeErrorMappings, err)
+	if !mapped {
+		logger.WithError(err).Error("Error encoding data to image")
+		abortWithError(ctx, http.StatusInternalServerError, errEncode)
+		return
+	}
+
+	logger.WithError(err).Warn("Request could not be encoded", "code", apiErr.Code)
+	if apiErr.Code == errImageNotBigEnough.Code {
+		apiErr = withDetails(apiErr, map[string]any{
+			"required_bytes":  stats.PayloadBytes,
+			"available_bytes": stats.CapacityBytes,
+			"lsbs_to_use":     lsbsToUse,
+		})
+	}
+	abortWithError(ctx, status, apiErr)
+}
+
+// abortWithDecodeError aborts a decode request that failed with err, with the status and api.Error it maps to
+func abortWithDecodeError(ctx *gin.Context, logger *logging.Logger, err error) {
+	if errors.Is(err, context.Canceled) {
+		logger.WithError(err).Warn("Client disconnected before the image was decoded")
+		ctx.AbortWithStatus(statusClientClosedRequest)
+		return
+	}
+	status, apiErr, mapped := mapError(decodeErrorMappings, err)
+	if !mapped {
+		logger.WithError(err).Error("Error decoding data from image")
+		abortWithError(ctx, http.StatusInternalServerError, errDecode)
+		return
+	}
+
+	logger.WithError(err).Warn("Request could not be decoded", "code", apiErr.Code)
+	abortWithError(ctx, status, apiErr)
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"nsteg"
+	"nsteg/api"
+	nstegImage "nsteg/pkg/image"
+	"nsteg/pkg/seal"
+	"nsteg/pkg/signature"
+	"nsteg/test"
+	"testing"
+)
+
+func TestErrorResponses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	carrierPNG := testCarrierPNG(t)
+	encodeRequest := func(lsbsToUse byte, fileName string, fileSize int) string {
+		body, err := json.Marshal(api.EncodeImageRequest{
+			LsbsToUse:     lsbsToUse,
+			ImageToEncode: carrierPNG,
+			FilesToHide:   []api.FileToHide{{Name: fileName, Content: test.GenerateRandomBytes(fileSize)}},
+		})
+		if err != nil {
+			t.Fatalf("Error building encode request: %s", err)
+		}
+		return string(body)
+	}
+	decodeRequest := func(request api.DecodeImageRequest) string {
+		body, err := json.Marshal(request)
+		if err != nil {
+			t.Fatalf("Error building decode request: %s", err)
+		}
+		return string(body)
+	}
+
+	keyedPNG := bytes.NewBuffer(nil)
+	files := []nsteg.File{{Name: "file", Content: bytes.NewReader(test.GenerateRandomBytes(100)), Size: 100}}
+	if _, err := nsteg.Hide(context.Background(), bytes.NewReader(carrierPNG), keyedPNG, files, nsteg.WithKey([]byte("key"))); err != nil {
+		t.Fatalf("Error encoding keyed image: %s", err)
+	}
+	identity, err := seal.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Error generating identity: %s", err)
+	}
+
+	for _, testCase := range []struct {
+		name            string
+		path            string
+		body            string
+		limits          Limits
+		expectedStatus  int
+		expectedCode    string
+		expectedDetails []string
+	}{
+		{name: "malformed JSON", path: "/api/v1/image/encode", body: `{"lsbs_to_use": "three"}`, expectedStatus: http.StatusBadRequest, expectedCode: errRequestBodyDecode.Code, expectedDetails: []string{"reason"}},
+		{name: "body over limit", path: "/api/v1/image/encode", body: encodeRequest(3, "file", 100), limits: Limits{MaxRequestBytes: 100}, expectedStatus: http.StatusRequestEntityTooLarge, expectedCode: errRequestTooLarge.Code, expectedDetails: []string{"max_request_bytes"}},
+		{name: "invalid LSBs", path: "/api/v1/image/encode", body: encodeRequest(9, "file", 100), expectedStatus: http.StatusBadRequest, expectedCode: errInvalidLSBsToUse.Code},
+		{name: "reserved file name", path: "/api/v1/image/encode", body: encodeRequest(3, signature.FileName, 100), expectedStatus: http.StatusBadRequest, expectedCode: errReservedFileName.Code},
+		{name: "image not big enough", path: "/api/v1/image/encode", body: encodeRequest(1, "file", 10000), expectedStatus: http.StatusUnprocessableEntity, expectedCode: errImageNotBigEnough.Code, expectedDetails: []string{"required_bytes", "available_bytes", "lsbs_to_use"}},
+		{name: "not an nsteg image", path: "/api/v1/image/decode", body: decodeRequest(api.DecodeImageRequest{ImageToDecode: carrierPNG}), expectedStatus: http.StatusUnprocessableEntity, expectedCode: errNotNstegImage.Code},
+		{name: "wrong key", path: "/api/v1/image/decode", body: decodeRequest(api.DecodeImageRequest{ImageToDecode: keyedPNG.Bytes(), Key: "wrong key"}), expectedStatus: http.StatusUnauthorized, expectedCode: errWrongKey.Code},
+		{name: "wrong identity", path: "/api/v1/image/decode", body: decodeRequest(api.DecodeImageRequest{ImageToDecode: keyedPNG.Bytes(), Identity: identity.String()}), expectedStatus: http.StatusUnauthorized, expectedCode: errWrongKey.Code},
+		{name: "invalid identity", path: "/api/v1/image/decode", body: decodeRequest(api.DecodeImageRequest{ImageToDecode: keyedPNG.Bytes(), Identity: "identity"}), expectedStatus: http.StatusBadRequest, expectedCode: errInvalidIdentity.Code},
+		{name: "key and identity", path: "/api/v1/image/decode", body: decodeRequest(api.DecodeImageRequest{ImageToDecode: keyedPNG.Bytes(), Key: "key", Identity: identity.String()}), expectedStatus: http.StatusBadRequest, expectedCode: errConflictingKeys.Code},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, testCase.path, bytes.NewReader([]byte(testCase.body)))
+			request.Header.Set("Content-Type", "application/json")
+			// Without a declared length the body is only found to be over the limit while it is read
+			request.ContentLength = -1
+			response := httptest.NewRecorder()
+			newRouter(Config{Limits: testCase.limits}).ServeHTTP(response, request)
+
+			if response.Code != testCase.expectedStatus {
+				t.Fatalf("Expected status %d, got %d: %s", testCase.expectedStatus, response.Code, response.Body.String())
+			}
+			var apiErr api.Error
+			if err := json.Unmarshal(response.Body.Bytes(), &apiErr); err != nil || apiErr.Code != testCase.expectedCode {
+				t.Fatalf("Expected error code %s, got %s", testCase.expectedCode, response.Body.String())
+			}
+			for _, detail := range testCase.expectedDetails {
+				if _, found := apiErr.Details[detail]; !found {
+					t.Errorf("Expected %s in the details of the error, got %v", detail, apiErr.Details)
+				}
+			}
+		})
+	}
+}
+
+func TestMapDecodeErrors(t *testing.T) {
+	for _, testCase := range []struct {
+		err            error
+		expectedStatus int
+		expectedCode   string
+	}{
+		{err: seal.ErrWrongKey, expectedStatus: http.StatusUnauthorized, expectedCode: errWrongKey.Code},
+		{err: nstegImage.ErrNoVolumeFoundForKey, expectedStatus: http.StatusUnauthorized, expectedCode: errWrongKey.Code},
+		{err: seal.ErrAuthentication, expectedStatus: http.StatusUnprocessableEntity, expectedCode: errPayloadCorrupted.Code},
+		{err: nstegImage.ErrDecodeFileBounds, expectedStatus: http.StatusUnprocessableEntity, expectedCode: errNotNstegImage.Code},
+	} {
+		t.Run(testCase.expectedCode, func(t *testing.T) {
+			status, apiErr, mapped := mapError(decodeErrorMappings, fmt.Errorf("wrapped: %w", testCase.err))
+			if !mapped || status != testCase.expectedStatus || apiErr.Code != testCase.expectedCode {
+				t.Errorf("Expected %s to map to %d %s, got %d %s", testCase.err, testCase.expectedStatus, testCase.expectedCode, status, apiErr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"nsteg/api"
+	"sync/atomic"
+)
+
+var (
+	errNotReady = api.Error{Code: "not_ready", Error: "Server is not accepting requests"}
+)
+
+// ready Whether the server accepts requests, which is only the case between it starting to listen and it starting to
+// shut down
+var ready atomic.Bool
+
+// HealthHandler godoc
+//
+// @Summary Check that the server is alive
+// @Description Succeeds as long as the server process is running, including while it is shutting down
+// @Tags health
+// @Produce json
+// @Success 200 {object} api.Status
+// @Router /healthz [get]
+func HealthHandler(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, api.Status{Status: "ok"})
+}
+
+// ReadyHandler godoc
+//
+// @Summary Check that the server accepts requests
+// @Description Fails once the server starts shutting down, so that load balancers stop sending it requests while the ones in flight are drained
+// @Tags health
+// @Produce json
+// @Success 200 {object} api.Status
+// @Failure 503 {object} api.Error
+// @Router /readyz [get]
+func ReadyHandler(ctx *gin.Context) {
+	if !ready.Load() {
+		abortWithError(ctx, http.StatusServiceUnavailable, errNotReady)
+		return
+	}
+	ctx.JSON(http.StatusOK, api.Status{Status: "ok"})
+}
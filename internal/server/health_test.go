@@ -0,0 +1,103 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newRouter(Config{Limits: DefaultLimits()})
+
+	for _, testCase := range []struct {
+		name           string
+		ready          bool
+		path           string
+		expectedStatus int
+	}{
+		{name: "healthy while ready", ready: true, path: "/healthz", expectedStatus: http.StatusOK},
+		{name: "healthy while shutting down", ready: false, path: "/healthz", expectedStatus: http.StatusOK},
+		{name: "ready", ready: true, path: "/readyz", expectedStatus: http.StatusOK},
+		{name: "not ready while shutting down", ready: false, path: "/readyz", expectedStatus: http.StatusServiceUnavailable},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			ready.Store(testCase.ready)
+			defer ready.Store(false)
+
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, httptest.NewRequest(http.MethodGet, testCase.path, nil))
+			if response.Code != testCase.expectedStatus {
+				t.Errorf("Expected status %d from %s, got %d", testCase.expectedStatus, testCase.path, response.Code)
+			}
+		})
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	for _, testCase := range []struct {
+		name            string
+		shutdownTimeout time.Duration
+		expectedErr     error
+		expectedStatus  int
+	}{
+		{name: "drains requests in flight", shutdownTimeout: 5 * time.Second, expectedStatus: http.StatusOK},
+		{name: "aborts requests outliving the timeout", shutdownTimeout: 50 * time.Millisecond, expectedErr: ErrShutdownTimeout},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			// The request in flight takes longer than the shortest shutdown timeout to complete
+			requestStarted := make(chan struct{})
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(requestStarted)
+				select {
+				case <-r.Context().Done():
+					return
+				case <-time.After(200 * time.Millisecond):
+				}
+				w.WriteHeader(http.StatusOK)
+			})}
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Error listening: %s", err)
+			}
+
+			ctx, shutdown := context.WithCancel(context.Background())
+			served := make(chan error, 1)
+			go func() {
+				served <- serve(ctx, server, listener, Timeouts{Shutdown: testCase.shutdownTimeout})
+			}()
+
+			responseStatus := make(chan int, 1)
+			go func() {
+				response, err := http.Get("http://" + listener.Addr().String())
+				if err != nil {
+					responseStatus <- 0
+					return
+				}
+				response.Body.Close()
+				responseStatus <- response.StatusCode
+			}()
+
+			<-requestStarted
+			if !ready.Load() {
+				t.Errorf("Expected the server to be ready while serving")
+			}
+			shutdown()
+
+			if err = <-served; !errors.Is(err, testCase.expectedErr) {
+				t.Errorf("Expected %v, got %v", testCase.expectedErr, err)
+			}
+			if status := <-responseStatus; status != testCase.expectedStatus {
+				t.Errorf("Expected status %d for the request in flight, got %d", testCase.expectedStatus, status)
+			}
+			if ready.Load() {
+				t.Errorf("Expected the server not to be ready once shut down")
+			}
+		})
+	}
+}
@@ -3,73 +3,100 @@ package server
 import (
 	"bytes"
 	"github.com/gin-gonic/gin"
-	"image"
 	"net/http"
+	"nsteg"
 	"nsteg/api"
 	"nsteg/internal/logging"
-	nstegImage "nsteg/pkg/image"
+	"nsteg/pkg/seal"
+	"nsteg/pkg/signature"
 )
 
 var (
-	errDecode = api.Error{Code: "decode_error", Error: "error while decoding files from image"}
+	errDecode         = api.Error{Code: "decode_error", Error: "error while decoding files from image"}
+	errTrustedSigners = api.Error{Code: "invalid_trusted_signers", Error: "Invalid public key supplied in trusted signers"}
 )
 
 // DecodeImageHandler godoc
 //
 // @Summary Decode data from an image
-// @Description This endpoint will decode the data previously encoded in the supplied image. The success response format is dictated by the Accept header, but all errors are returned as JSON
+// @Description This endpoint will decode the data previously encoded in the supplied image, opening it with the key or identity if the files were encoded under a key or for recipients. The success response format is dictated by the Accept header, but all errors are returned as JSON
 // @Tags image
 // @Accept json,octet-stream
 // @Produce json,octet-stream
 // @Param requestBody body api.DecodeImageRequest true "Body with image to decode"
 // @Success 200 {object} api.DecodeImageResponse
-// @Failure 400 {object} api.Error
-// @Failure 500 {object} api.Error
-// @Router /decode/image [post]
+// @Failure 400 {object} api.Error "malformed_request, invalid_image, invalid_identity, conflicting_keys or invalid_trusted_signers"
+// @Failure 401 {object} api.Error "unauthorized, or wrong_key if the image cannot be opened with the supplied key or identity"
+// @Failure 413 {object} api.Error "request_too_large or carrier_too_large"
+// @Failure 422 {object} api.Error "not_nsteg_image, payload_corrupted or signature_error"
+// @Failure 429 {object} api.Error "server_busy, rate_limited or quota_exceeded, retry after the Retry-After header"
+// @Failure 500 {object} api.Error "decode_error"
+// @Security ApiKeyAuth
+// @Router /image/decode [post]
 func DecodeImageHandler(ctx *gin.Context) {
 	var requestBody api.DecodeImageRequest
 
 	logger := logging.BuildLoggerFromCtx(ctx)
 	logger.Debug("Processing image decode request")
 
+	body, admitted := admitBody(ctx, logger)
+	if !admitted {
+		return
+	}
+	defer body.release()
 	if err := ctx.ShouldBindJSON(&requestBody); err != nil {
-		logger.WithError(err).Error("Error decoding request body")
-		ctx.AbortWithStatusJSON(http.StatusInternalServerError, errRequestBodyDecode)
+		abortWithBindError(ctx, logger, err)
 		return
 	}
 
-	rawImageToDecode, _, err := image.Decode(bytes.NewReader(requestBody.ImageToDecode))
-	if err != nil {
-		logger.WithError(err).Error("Error decoding request image")
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, errInvalidImage)
-		return
+	revealOpts := []nsteg.Option{nsteg.WithCarrierPool(carrierPool), nsteg.WithLogger(logger.Logger)}
+	if requestBody.Key != "" {
+		revealOpts = append(revealOpts, nsteg.WithKey([]byte(requestBody.Key)))
+	}
+	if requestBody.Identity != "" {
+		identity, err := seal.ParseIdentity(requestBody.Identity)
+		if err != nil {
+			logger.WithError(err).Warn("Error parsing identity")
+			abortWithError(ctx, http.StatusBadRequest, errInvalidIdentity)
+			return
+		}
+		revealOpts = append(revealOpts, nsteg.WithIdentities(identity))
 	}
 
-	rgbaImageToDecode, castOk := rawImageToDecode.(*image.RGBA)
-	if !castOk {
-		logger.Error("Supplied image was not RGBA, casting failed")
-		ctx.AbortWithStatusJSON(http.StatusInternalServerError, errErrorConvertingRawImage)
-		return
+	var trustedSigners []signature.TrustedKey
+	for _, trustedSigner := range requestBody.TrustedSigners {
+		publicKey, err := signature.ParsePublicKey(trustedSigner)
+		if err != nil {
+			logger.WithError(err).Error("Error parsing trusted signer")
+			abortWithError(ctx, http.StatusBadRequest, errTrustedSigners)
+			return
+		}
+		trustedSigners = append(trustedSigners, signature.TrustedKey{PublicKey: publicKey})
 	}
+	revealOpts = append(revealOpts, nsteg.WithTrustedSigners(trustedSigners...))
 
-	imageDecoder, err := nstegImage.NewImageDecoder(rgbaImageToDecode)
-	if err != nil {
-		handleDecodeError(ctx, logger, err)
+	// The body as read and the image decoded from it are held along with the carrier and the files revealed from it
+	imageBytes := int64(len(requestBody.ImageToDecode))
+	body.shrink(boundBodyHeldBytes(imageBytes))
+	carrier, releaseCarrier, admitted := admitCarrier(ctx, logger, bytes.NewReader(requestBody.ImageToDecode),
+		carrierBytesPerPixel+revealedBytesPerPixel, 0, body.bytes)
+	if !admitted {
 		return
 	}
+	defer releaseCarrier()
 
-	decodedFiles, err := imageDecoder.DecodeFiles()
+	revealed, err := nsteg.Reveal(ctx.Request.Context(), carrier, revealOpts...)
 	if err != nil {
-		handleDecodeError(ctx, logger, err)
+		abortWithDecodeError(ctx, logger, err)
 		return
 	}
 
-	logger.With("stats", toHumanizedDecodeStats(imageDecoder.Stats())).Info("Image decoding was successful")
-
-	ctx.JSON(http.StatusOK, api.DecodeImageResponse{DecodedFiles: decodedFiles})
-}
+	logger.With("stats", toHumanizedDecodeStats(revealed.Stats)).Info("Image decoding was successful")
+	var payloadBytes int64
+	for _, file := range revealed.Files {
+		payloadBytes += int64(len(file.Content))
+	}
+	metrics.observeDecode(revealed.Stats, imageBytes, payloadBytes)
 
-func handleDecodeError(ctx *gin.Context, logger *logging.Logger, err error) {
-	logger.WithError(err).Error("Error decoding data from image")
-	ctx.AbortWithStatusJSON(http.StatusInternalServerError, errDecode)
+	ctx.JSON(http.StatusOK, api.DecodeImageResponse{DecodedFiles: revealed.Files, Signer: revealed.Signer})
 }
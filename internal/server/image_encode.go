@@ -2,19 +2,25 @@ package server
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
 	"github.com/gin-gonic/gin"
 	flatbuffers "github.com/google/flatbuffers/go"
-	"image"
-	"image/draw"
 	"image/png"
 	"io"
 	"net/http"
+	"nsteg"
 	"nsteg/api"
 	"nsteg/api/nsteg/EncodeImage"
 	"nsteg/internal/logging"
-	"nsteg/pkg/config"
-	nstegImage "nsteg/pkg/image"
-	"nsteg/pkg/model"
+)
+
+const (
+	// encodedImageJSONPrefix and encodedImageJSONSuffix Surround the base64 encoded image in the response, which must
+	// unmarshal into an api.EncodeImageResponse
+	encodedImageJSONPrefix = `{"encoded_image":"`
+	encodedImageJSONSuffix = `"}`
 )
 
 var (
@@ -23,103 +29,162 @@ var (
 
 // EncodeImageHandler godoc
 //
-// @Summary Encode files into supplied image
-// @Description This endpoint will encode the supplied files into the image, and return the encoded image. The success response format is dictated by the Accept header, but all errors are returned as JSON
+// The JSON body is bound as a whole, since the size of every file is encoded ahead of its contents, but the size of a
+// base64 field is only known once it is read whole. Only /image/encode/stream never holds the files in memory, this
+// endpoint is kept for the clients built against it
+//
+// @Summary Encode files into supplied image, holding the whole request in memory
+// @Description This endpoint is kept for compatibility with existing clients, new clients should use /image/encode/stream. It encodes the supplied files into the image, and returns the encoded image. The success response format is dictated by the Accept header, but all errors are returned as JSON. The encoded image is streamed into the response, but the whole request, along with every file decoded from it, is held in memory, so its memory use is not bounded by the carrier like that of /image/encode/stream, and grows with the size of the files
+// @Deprecated
 // @Tags image
 // @Accept json,octet-stream
 // @Produce json,octet-stream
 // @Param requestBody body api.EncodeImageRequest true "Body with image to encode and files to encode within the image, as well as configuration for the encoding process"
 // @Success 200 {object} api.EncodeImageResponse
-// @Failure 400 {object} api.Error
-// @Failure 500 {object} api.Error
-// @Router /encode/image [post]
+// @Failure 400 {object} api.Error "malformed_request, invalid_image, invalid_lsbs_to_use or reserved_file_name"
+// @Failure 401 {object} api.Error "unauthorized"
+// @Failure 413 {object} api.Error "request_too_large, carrier_too_large, payload_too_large or too_many_files"
+// @Failure 422 {object} api.Error "image_not_big_enough, with the required_bytes and available_bytes in its details"
+// @Failure 429 {object} api.Error "server_busy, rate_limited or quota_exceeded, retry after the Retry-After header"
+// @Failure 500 {object} api.Error "encode_error"
+// @Security ApiKeyAuth
+// @Router /image/encode [post]
 func EncodeImageHandler(ctx *gin.Context) {
 	var requestBody api.EncodeImageRequest
 
 	logger := logging.BuildLoggerFromCtx(ctx)
 	logger.Debug("Processing image encode request")
 
-	if err := ctx.ShouldBindJSON(&requestBody); err != nil {
-		logger.WithError(err).Error("Error reading request body")
-		ctx.AbortWithStatusJSON(http.StatusInternalServerError, errRequestBodyDecode)
+	body, admitted := admitBody(ctx, logger)
+	if !admitted {
 		return
 	}
-
-	imageToEncode, _, err := image.Decode(bytes.NewReader(requestBody.ImageToEncode))
-	if err != nil {
-		logger.WithError(err).Error("Error decoding request image")
-		ctx.AbortWithStatusJSON(http.StatusBadRequest, errInvalidImage)
+	defer body.release()
+	if err := ctx.ShouldBindJSON(&requestBody); err != nil {
+		abortWithBindError(ctx, logger, err)
 		return
 	}
-
-	rgbaImg := image.NewRGBA(imageToEncode.Bounds())
-	draw.Draw(rgbaImg, rgbaImg.Bounds(), imageToEncode, rgbaImg.Bounds().Min, draw.Src)
-	imageToEncode = nil
-
-	imageEncoder, err := nstegImage.NewImageEncoder(rgbaImg, config.ImageEncodeConfig{
-		LSBsToUse:           requestBody.LsbsToUse,
-		PngCompressionLevel: png.DefaultCompression, // to reduce bandwidth costs since lower compression results in huge images
-	})
-	if err != nil {
-		handleEncodeError(ctx, logger, err)
+	if requestBody.LsbsToUse == 0 {
+		requestBody.LsbsToUse = defaultLSBsToUse
+	} else if requestBody.LsbsToUse > 8 {
+		abortWithError(ctx, http.StatusBadRequest, errInvalidLSBsToUse)
+		return
 	}
 
-	var filesToHide []model.InputFile
+	var filesToHide []nsteg.File
+	var fileSizes []int64
+	var payloadBytes int64
 	for _, reqFileToHide := range requestBody.FilesToHide {
-		filesToHide = append(filesToHide, model.InputFile{
+		filesToHide = append(filesToHide, nsteg.File{
 			Name:    reqFileToHide.Name,
 			Content: bytes.NewReader(reqFileToHide.Content),
 			Size:    int64(len(reqFileToHide.Content)),
 		})
+		fileSizes = append(fileSizes, int64(len(reqFileToHide.Content)))
+		payloadBytes += int64(len(reqFileToHide.Content))
 	}
-
-	encodedImageBuffer := bytes.NewBuffer(make([]byte, 0, len(requestBody.ImageToEncode))) // pre allocate with size of original, since it should be similar
-	err = imageEncoder.EncodeFiles(filesToHide)
-	if err != nil {
-		handleEncodeError(ctx, logger, err)
+	if !admitPayload(ctx, logger, fileSizes) {
 		return
 	}
-	err = imageEncoder.WriteEncodedPNG(encodedImageBuffer)
-	if err != nil {
-		handleEncodeError(ctx, logger, err)
+	// The body stays held along with the carrier, while the encoded image is streamed into the response
+	imageBytes := int64(len(requestBody.ImageToEncode))
+	body.shrink(boundBodyHeldBytes(imageBytes + payloadBytes))
+	carrier, releaseCarrier, admitted := admitCarrier(ctx, logger, bytes.NewReader(requestBody.ImageToEncode),
+		carrierBytesPerPixel+qualityMetricsBytesPerPixel, 0, body.bytes)
+	if !admitted {
+		return
+	}
+	defer releaseCarrier()
+
+	// The encoded image is streamed into the response as it is written, so it is never held in memory, neither as is
+	// nor encoded as base64. Encoding is aborted if the client disconnects, since nobody would receive the encoded image
+	response := &encodedImageJSONWriter{ctx: ctx}
+	stats, err := nsteg.Hide(ctx.Request.Context(), carrier, response, filesToHide,
+		nsteg.WithLSBs(requestBody.LsbsToUse),
+		nsteg.WithPNGCompression(png.DefaultCompression), // to reduce bandwidth costs since lower compression results in huge images
+		nsteg.WithQualityMetrics(),
+		nsteg.WithCarrierPool(carrierPool),
+		nsteg.WithLogger(logger.Logger),
+	)
+	if err == nil {
+		err = response.Close()
+	}
+	if err != nil && ctx.Writer.Written() {
+		// Once the image starts being written the status can no longer be changed, so later errors are only logged
+		logger.WithError(err).Error("Error streaming encoded image")
+		return
+	} else if err != nil {
+		abortWithEncodeError(ctx, logger, stats, requestBody.LsbsToUse, err)
 		return
 	}
 
-	logger.With("stats", toHumanizedEncodeStats(imageEncoder.Stats())).Info("Image encoding was successful")
+	logger.With("stats", toHumanizedEncodeStats(stats)).Info("Image encoding was successful")
+	metrics.observeEncode(stats, imageBytes)
+}
 
-	ctx.JSON(http.StatusOK, api.EncodeImageResponse{EncodedImage: encodedImageBuffer.Bytes()})
+// encodedImageJSONWriter Streams the encoded image into the response as the base64 encoded_image field of an
+// api.EncodeImageResponse. The response is only started once the image starts being written, so that errors up to
+// then are still returned as api.Error, and must be closed once the whole image is written
+type encodedImageJSONWriter struct {
+	ctx           *gin.Context
+	base64Encoder io.WriteCloser
 }
 
-func handleImageEncodeRequest(w http.ResponseWriter, r *http.Request) {
-	requestBody, err := io.ReadAll(r.Body)
-	if err != nil {
-		http.Error(w, "error reading body", http.StatusInternalServerError)
-		return
+func (w *encodedImageJSONWriter) Write(p []byte) (int, error) {
+	if w.base64Encoder == nil {
+		if err := w.start(); err != nil {
+			return 0, err
+		}
 	}
+	return w.base64Encoder.Write(p)
+}
 
-	encodeImageRequest := EncodeImage.GetRootAsImageEncodeRequest(requestBody, 0)
-	imageToEncodeSize := encodeImageRequest.ImageToEncodeLength()
-	imageToEncode, _, err := image.Decode(bytes.NewReader(encodeImageRequest.ImageToEncodeBytes()))
-	if err != nil {
-		http.Error(w, "supplied image is invalid", http.StatusBadRequest)
-		return
+// Close flushes the end of the base64 encoded image and closes the JSON object
+func (w *encodedImageJSONWriter) Close() error {
+	if w.base64Encoder == nil {
+		if err := w.start(); err != nil {
+			return err
+		}
+	}
+	if err := w.base64Encoder.Close(); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w.ctx.Writer, encodedImageJSONSuffix)
+	return err
+}
+
+func (w *encodedImageJSONWriter) start() error {
+	w.ctx.Header("Content-Type", "application/json; charset=utf-8")
+	w.ctx.Status(http.StatusOK)
+	if _, err := io.WriteString(w.ctx.Writer, encodedImageJSONPrefix); err != nil {
+		return err
 	}
+	// encoding/json encodes byte slices with the standard, padded, base64 encoding
+	w.base64Encoder = base64.NewEncoder(base64.StdEncoding, w.ctx.Writer)
+	return nil
+}
 
-	rgbaImg := image.NewRGBA(imageToEncode.Bounds())
-	draw.Draw(rgbaImg, rgbaImg.Bounds(), imageToEncode, rgbaImg.Bounds().Min, draw.Src)
-	imageToEncode = nil
+// boundBodyHeldBytes estimates the memory held by a bound JSON body from the bytes decoded from its base64 fields: the
+// body as read, and the decoded bytes
+func boundBodyHeldBytes(decodedBytes int64) int64 {
+	return base64Bytes(decodedBytes) + decodedBytes
+}
 
-	imageEncoder, err := nstegImage.NewImageEncoder(rgbaImg, config.ImageEncodeConfig{
-		LSBsToUse:           encodeImageRequest.LsbsToUse(),
-		PngCompressionLevel: png.BestCompression, // to reduce bandwidth costs since lower compression results in huge images
-	})
+// base64Bytes returns the length of n bytes once encoded as base64, as they are in JSON bodies
+func base64Bytes(n int64) int64 {
+	return int64(base64.StdEncoding.EncodedLen(int(n)))
+}
 
+func handleImageEncodeRequest(w http.ResponseWriter, r *http.Request) {
+	requestBody, err := io.ReadAll(r.Body)
 	if err != nil {
-		http.Error(w, "error encoding image", http.StatusInternalServerError)
+		http.Error(w, "error reading body", http.StatusInternalServerError)
 		return
 	}
 
-	var filesToHide []model.InputFile
+	encodeImageRequest := EncodeImage.GetRootAsImageEncodeRequest(requestBody, 0)
+	imageToEncodeSize := encodeImageRequest.ImageToEncodeLength()
+	var filesToHide []nsteg.File
 	for i := 0; i < encodeImageRequest.FilesToHideLength(); i++ {
 		var fbFileToHide EncodeImage.FileToHide
 		read := encodeImageRequest.FilesToHide(&fbFileToHide, i)
@@ -128,22 +193,27 @@ func handleImageEncodeRequest(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		filesToHide = append(filesToHide, model.InputFile{
+		filesToHide = append(filesToHide, nsteg.File{
 			Name:    string(fbFileToHide.Name()),
 			Size:    int64(fbFileToHide.ContentLength()),
 			Content: bytes.NewReader(fbFileToHide.ContentBytes()),
 		})
 	}
-	encodeImageRequest = nil
 
 	encodedImageBuffer := bytes.NewBuffer(make([]byte, 0, imageToEncodeSize)) // pre allocate with size of original, since it should be similar
-	err = imageEncoder.EncodeFiles(filesToHide)
-	if err != nil {
-		http.Error(w, "error encoding image", http.StatusInternalServerError)
+	_, err = nsteg.Hide(r.Context(), bytes.NewReader(encodeImageRequest.ImageToEncodeBytes()), encodedImageBuffer, filesToHide,
+		nsteg.WithLSBs(encodeImageRequest.LsbsToUse()),
+		nsteg.WithPNGCompression(png.BestCompression), // to reduce bandwidth costs since lower compression results in huge images
+		nsteg.WithCarrierPool(carrierPool),
+		nsteg.WithLogger(logging.Default().With("path", r.URL.Path)),
+	)
+	encodeImageRequest = nil
+	if errors.Is(err, context.Canceled) {
 		return
-	}
-	err = imageEncoder.WriteEncodedPNG(encodedImageBuffer)
-	if err != nil {
+	} else if errors.Is(err, nsteg.ErrInvalidCarrier) {
+		http.Error(w, "supplied image is invalid", http.StatusBadRequest)
+		return
+	} else if err != nil {
 		http.Error(w, "error encoding image", http.StatusInternalServerError)
 		return
 	}
@@ -163,8 +233,3 @@ func handleImageEncodeRequest(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/octet-stream")
 	}
 }
-
-func handleEncodeError(ctx *gin.Context, logger *logging.Logger, err error) {
-	logger.WithError(err).Error("Error encoding data to image")
-	ctx.AbortWithStatusJSON(http.StatusInternalServerError, errEncode)
-}
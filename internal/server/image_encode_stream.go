@@ -0,0 +1,242 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"nsteg"
+	"nsteg/api"
+	"nsteg/internal/logging"
+	"strconv"
+)
+
+const (
+	filesPartName = "files"
+	imagePartName = "image"
+	filePartName  = "file"
+
+	// defaultLSBsToUse LSBs used by the encode endpoints when the request does not set them
+	defaultLSBsToUse = 3
+)
+
+var (
+	errInvalidStreamRequest = api.Error{Code: "invalid_stream_request", Error: "Request must be multipart/form-data, with a files part, followed by an image part and one file part per file"}
+	errInvalidFileParts     = api.Error{Code: "invalid_file_parts", Error: "File parts do not match the files part, there must be one file part per file, in the same order and of the declared size"}
+
+	errPartMismatch = errors.New("request part does not match the expected part")
+)
+
+// EncodeImageStreamHandler godoc
+//
+// @Summary Encode files into supplied image, streaming them from the request
+// @Description This endpoint encodes the supplied files into the image, never holding the files nor the encoded image in memory, so its memory use is bounded by the decoded carrier plus a fixed buffer. It is the endpoint to encode files through, /image/encode being kept only for compatibility. The request is multipart/form-data with a files part, holding a JSON array with the name and size of every file, followed by an image part, holding the image to encode, followed by one file part per file, in the same order as the files part. The encoded image is streamed back as a PNG
+// @Tags image
+// @Accept mpfd
+// @Produce png
+// @Param lsbs_to_use query int false "Least significant bits to use from each pixel, 1-8" default(3)
+// @Param files formData string true "JSON array of api.StreamedFile, with the name and size of every file part"
+// @Param image formData file true "Image to encode the files into"
+// @Param file formData file true "Content of each file, in the same order as the files part"
+// @Success 200 {file} binary
+// @Failure 400 {object} api.Error "invalid_stream_request, invalid_file_parts, invalid_image, invalid_lsbs_to_use or reserved_file_name"
+// @Failure 401 {object} api.Error "unauthorized"
+// @Failure 413 {object} api.Error "request_too_large, carrier_too_large, payload_too_large or too_many_files"
+// @Failure 422 {object} api.Error "image_not_big_enough, with the required_bytes and available_bytes in its details"
+// @Failure 429 {object} api.Error "server_busy, rate_limited or quota_exceeded, retry after the Retry-After header"
+// @Failure 500 {object} api.Error "encode_error"
+// @Security ApiKeyAuth
+// @Router /image/encode/stream [post]
+func EncodeImageStreamHandler(ctx *gin.Context) {
+	logger := logging.BuildLoggerFromCtx(ctx)
+	logger.Debug("Processing streamed image encode request")
+
+	LSBsToUse, err := strconv.Atoi(ctx.DefaultQuery("lsbs_to_use", strconv.Itoa(defaultLSBsToUse)))
+	if err != nil || LSBsToUse < 1 || LSBsToUse > 8 {
+		abortWithError(ctx, http.StatusBadRequest, errInvalidLSBsToUse)
+		return
+	}
+
+	partReader, err := ctx.Request.MultipartReader()
+	if abortIfBodyOverQuota(ctx, logger, err) {
+		return
+	} else if err != nil {
+		logger.WithError(err).Error("Error reading multipart request")
+		abortWithError(ctx, http.StatusBadRequest, errInvalidStreamRequest)
+		return
+	}
+
+	streamedFiles, err := readFilesPart(partReader, requestLimits(ctx).MaxFilesPartBytes)
+	if abortIfBodyOverQuota(ctx, logger, err) {
+		return
+	} else if err != nil {
+		logger.WithError(err).Error("Error reading files part")
+		abortWithError(ctx, http.StatusBadRequest, errInvalidStreamRequest)
+		return
+	}
+	fileSizes := make([]int64, 0, len(streamedFiles))
+	for _, streamedFile := range streamedFiles {
+		fileSizes = append(fileSizes, streamedFile.Size)
+	}
+	if !admitPayload(ctx, logger, fileSizes) {
+		return
+	}
+
+	// The image is decoded straight from its part of the request, after which only the decoded image is held in memory
+	imagePart, err := nextPart(partReader, imagePartName)
+	if abortIfBodyOverQuota(ctx, logger, err) {
+		return
+	} else if err != nil {
+		logger.WithError(err).Error("Error reading image part")
+		abortWithError(ctx, http.StatusBadRequest, errInvalidStreamRequest)
+		return
+	}
+
+	var filesToHide []nsteg.File
+	for _, streamedFile := range streamedFiles {
+		filesToHide = append(filesToHide, nsteg.File{
+			Name:    streamedFile.Name,
+			Size:    streamedFile.Size,
+			Content: &filePartContent{partReader: partReader, size: streamedFile.Size},
+		})
+	}
+
+	carrierPart := &countingReader{r: imagePart}
+	// Neither the files nor the encoded image are held in memory, only the carrier
+	carrier, releaseCarrier, admitted := admitCarrier(ctx, logger, carrierPart, carrierBytesPerPixel, 0, 0)
+	if !admitted {
+		return
+	}
+	defer releaseCarrier()
+
+	// Quality metrics are not computed, since they require a copy of the image
+	stats, err := nsteg.Hide(ctx.Request.Context(), carrier, pngResponseWriter{ctx: ctx}, filesToHide,
+		nsteg.WithLSBs(byte(LSBsToUse)),
+		nsteg.WithPNGCompression(png.DefaultCompression),
+		nsteg.WithCarrierPool(carrierPool),
+		nsteg.WithLogger(logger.Logger),
+	)
+	if err != nil && ctx.Writer.Written() {
+		// Once the image starts being written the status can no longer be changed, so later errors are only logged
+		logger.WithError(err).Error("Error streaming encoded image")
+		return
+	} else if errors.Is(err, errPartMismatch) {
+		logger.WithError(err).Warn("Error reading file parts")
+		abortWithError(ctx, http.StatusBadRequest, errInvalidFileParts)
+		return
+	} else if err != nil {
+		abortWithEncodeError(ctx, logger, stats, byte(LSBsToUse), err)
+		return
+	}
+
+	logger.With("stats", toHumanizedEncodeStats(stats)).Info("Streamed image encoding was successful")
+	metrics.observeEncode(stats, carrierPart.n)
+}
+
+// countingReader Counts the bytes read from the image part, whose size is not known in advance
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// pngResponseWriter Streams the encoded image into the response, only setting its content type once the image starts
+// being written, so that errors up to then are still returned as JSON
+type pngResponseWriter struct {
+	ctx *gin.Context
+}
+
+func (w pngResponseWriter) Write(p []byte) (int, error) {
+	if !w.ctx.Writer.Written() {
+		w.ctx.Header("Content-Type", "image/png")
+		w.ctx.Status(http.StatusOK)
+	}
+	return w.ctx.Writer.Write(p)
+}
+
+// readFilesPart reads the files part, which is the only part read into memory as a whole, and therefore no longer than
+// maxSize, unless it is 0
+func readFilesPart(partReader *multipart.Reader, maxSize int64) ([]api.StreamedFile, error) {
+	part, err := nextPart(partReader, filesPartName)
+	if err != nil {
+		return nil, err
+	}
+
+	var filesPart io.Reader = part
+	if maxSize > 0 {
+		filesPart = io.LimitReader(part, maxSize)
+	}
+	var streamedFiles []api.StreamedFile
+	if err = json.NewDecoder(filesPart).Decode(&streamedFiles); err != nil {
+		return nil, err
+	}
+	for _, streamedFile := range streamedFiles {
+		if streamedFile.Size < 0 {
+			return nil, fmt.Errorf("%w: negative size for %s", errPartMismatch, streamedFile.Name)
+		}
+	}
+	return streamedFiles, nil
+}
+
+func nextPart(partReader *multipart.Reader, name string) (*multipart.Part, error) {
+	part, err := partReader.NextPart()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%w: missing %s part", errPartMismatch, name)
+	} else if err != nil {
+		return nil, err
+	}
+	if part.FormName() != name {
+		return nil, fmt.Errorf("%w: expected %s part, got %s", errPartMismatch, name, part.FormName())
+	}
+	return part, nil
+}
+
+// filePartContent Content of a file, read from its part of the request. Parts can only be read in order, so the part
+// is only fetched once the encoder starts reading the file, after it has read every preceding file
+type filePartContent struct {
+	partReader *multipart.Reader
+	part       *multipart.Part
+	size, read int64
+}
+
+func (f *filePartContent) Read(p []byte) (int, error) {
+	if f.part == nil {
+		part, err := nextPart(f.partReader, filePartName)
+		if err != nil {
+			return 0, err
+		}
+		f.part = part
+	}
+
+	if f.read == f.size {
+		// The part must end where the declared size says it does
+		if n, _ := f.part.Read(make([]byte, 1)); n > 0 {
+			return 0, fmt.Errorf("%w: %s is larger than %d bytes", errPartMismatch, f.part.FileName(), f.size)
+		}
+		return 0, io.EOF
+	}
+
+	n, err := f.part.Read(p[:min(int64(len(p)), f.size-f.read)])
+	f.read += int64(n)
+	if err == io.EOF {
+		if f.read < f.size {
+			return n, fmt.Errorf("%w: %s is smaller than %d bytes", errPartMismatch, f.part.FileName(), f.size)
+		}
+		err = nil
+	} else if err == nil && f.read == f.size {
+		// Files are never read past their declared size, so the part is checked to end there as soon as it is reached
+		if extra, _ := f.part.Read(make([]byte, 1)); extra > 0 {
+			return n, fmt.Errorf("%w: %s is larger than %d bytes", errPartMismatch, f.part.FileName(), f.size)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"image/png"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"nsteg"
+	"nsteg/api"
+	"nsteg/test"
+	"runtime"
+	"testing"
+)
+
+const (
+	memoryBenchImageSize = 2000
+	memoryBenchLSBsToUse = 8
+)
+
+// BenchmarkEncodeMemory compares the memory allocated by the JSON and streamed encode handlers as the size of the file
+// to hide grows. The streamed handler should allocate the same regardless of the size of the file, since it only holds
+// the decoded image in memory, while the JSON handler holds the whole request body but streams the encoded image into
+// the response. Either handler fails the benchmark if it allocates more than the memory admission estimates for it, so
+// that buffering the files or the encoded image again does not go unnoticed. For reference, with a 2000x2000 image the streamed
+// handler allocates about 17MB per request regardless of the file size, while the JSON handler allocates about 86MB
+// for a 1MB file and 136MB for an 8MB file, down from 124MB and 183MB when it buffered the encoded image
+func BenchmarkEncodeMemory(b *testing.B) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/image/encode", EncodeImageHandler)
+	router.POST("/image/encode/stream", EncodeImageStreamHandler)
+
+	imageBuffer := bytes.NewBuffer(nil)
+	if err := png.Encode(imageBuffer, test.GenerateNaturalImage(memoryBenchImageSize, memoryBenchImageSize, 4)); err != nil {
+		b.Fatalf("Error encoding benchmark image: %s", err)
+	}
+	imageToEncode := imageBuffer.Bytes()
+	carrierPixels := int64(memoryBenchImageSize * memoryBenchImageSize)
+
+	for _, fileSize := range []int64{1 << 20, 8 << 20} {
+		b.Run(fmt.Sprintf("FileSize=%dMB/json", fileSize>>20), func(b *testing.B) {
+			requestBody, err := json.Marshal(api.EncodeImageRequest{
+				LsbsToUse:     memoryBenchLSBsToUse,
+				ImageToEncode: imageToEncode,
+				FilesToHide:   []api.FileToHide{{Name: "file", Content: test.GenerateRandomBytes(int(fileSize))}},
+			})
+			if err != nil {
+				b.Fatalf("Error building request body: %s", err)
+			}
+
+			b.ReportAllocs()
+			allocatedBytes := measureAllocatedBytes(func() {
+				for i := 0; i < b.N; i++ {
+					request := httptest.NewRequest(http.MethodPost, "/image/encode", bytes.NewReader(requestBody))
+					serveEncodeBenchRequest(b, router, request)
+				}
+			})
+			// Binding the body also allocates up to twice the body on top of what it holds, as the JSON decoder grows its
+			// buffer while reading it
+			bodyBytes := int64(len(requestBody))
+			assertBytesPerOp(b, allocatedBytes, jsonBodyHeldBytes(bodyBytes)+2*bodyBytes+carrierPixels*(carrierBytesPerPixel+qualityMetricsBytesPerPixel))
+		})
+
+		b.Run(fmt.Sprintf("FileSize=%dMB/stream", fileSize>>20), func(b *testing.B) {
+			b.ReportAllocs()
+			allocatedBytes := measureAllocatedBytes(func() {
+				for i := 0; i < b.N; i++ {
+					bodyReader, bodyWriter := io.Pipe()
+					partWriter := multipart.NewWriter(bodyWriter)
+					go writeStreamedEncodeRequest(bodyWriter, partWriter, imageToEncode, fileSize)
+
+					request := httptest.NewRequest(http.MethodPost, fmt.Sprintf("/image/encode/stream?lsbs_to_use=%d", memoryBenchLSBsToUse), bodyReader)
+					request.Header.Set("Content-Type", partWriter.FormDataContentType())
+					serveEncodeBenchRequest(b, router, request)
+				}
+			})
+			assertBytesPerOp(b, allocatedBytes, carrierPixels*carrierBytesPerPixel)
+		})
+	}
+}
+
+// measureAllocatedBytes returns the bytes allocated while running f, by every goroutine
+func measureAllocatedBytes(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+// assertBytesPerOp fails the benchmark if its iterations allocated more than maxBytes each on average
+func assertBytesPerOp(b *testing.B, allocatedBytes uint64, maxBytes int64) {
+	if bytesPerOp := int64(allocatedBytes) / int64(b.N); bytesPerOp > maxBytes {
+		b.Fatalf("Expected at most %d bytes allocated per request, got %d", maxBytes, bytesPerOp)
+	}
+}
+
+// serveEncodeBenchRequest serves the request discarding the response, so that only the memory allocated by the
+// handler is measured
+func serveEncodeBenchRequest(b *testing.B, router http.Handler, request *http.Request) {
+	response := &discardResponseWriter{header: http.Header{}, status: http.StatusOK}
+	router.ServeHTTP(response, request)
+	if response.status != http.StatusOK {
+		b.Fatalf("Expected status %d, got %d", http.StatusOK, response.status)
+	}
+}
+
+type discardResponseWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+// writeStreamedEncodeRequest writes a streamed encode request, generating the contents of the file as they are written
+// so that they are never held in memory by the benchmark either
+func writeStreamedEncodeRequest(bodyWriter *io.PipeWriter, partWriter *multipart.Writer, imageToEncode []byte, fileSize int64) {
+	err := func() error {
+		filesPart, err := partWriter.CreateFormField(filesPartName)
+		if err != nil {
+			return err
+		}
+		if err = json.NewEncoder(filesPart).Encode([]api.StreamedFile{{Name: "file", Size: fileSize}}); err != nil {
+			return err
+		}
+
+		imagePart, err := partWriter.CreateFormFile(imagePartName, "image.png")
+		if err != nil {
+			return err
+		}
+		if _, err = imagePart.Write(imageToEncode); err != nil {
+			return err
+		}
+
+		filePart, err := partWriter.CreateFormFile(filePartName, "file")
+		if err != nil {
+			return err
+		}
+		if _, err = io.CopyN(filePart, rand.New(rand.NewSource(fileSize)), fileSize); err != nil {
+			return err
+		}
+		return partWriter.Close()
+	}()
+	bodyWriter.CloseWithError(err)
+}
+
+func TestReadFilesPart(t *testing.T) {
+	body := bytes.NewBuffer(nil)
+	partWriter := multipart.NewWriter(body)
+	if err := partWriter.WriteField(filesPartName, `[{"name": "file", "size": 100}]`); err != nil {
+		t.Fatalf("Error writing files part: %s", err)
+	}
+	partWriter.Close()
+
+	for _, testCase := range []struct {
+		name        string
+		maxSize     int64
+		expectError bool
+	}{
+		{name: "within limit", maxSize: 100},
+		{name: "over limit", maxSize: 10, expectError: true},
+		{name: "unlimited", maxSize: 0},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			streamedFiles, err := readFilesPart(multipart.NewReader(bytes.NewReader(body.Bytes()), partWriter.Boundary()), testCase.maxSize)
+			if testCase.expectError {
+				if err == nil {
+					t.Error("Expected an error reading a files part over the limit")
+				}
+				return
+			}
+			if err != nil || len(streamedFiles) != 1 || streamedFiles[0].Size != 100 {
+				t.Errorf("Expected the declared file, got %v, %v", streamedFiles, err)
+			}
+		})
+	}
+}
+
+// streamPart Part of a streamed encode request, written in order
+type streamPart struct {
+	name    string
+	content []byte
+}
+
+// newStreamedEncodeRequest returns a streamed encode request with the parts, in the order they are supplied
+func newStreamedEncodeRequest(t *testing.T, parts ...streamPart) *http.Request {
+	body := bytes.NewBuffer(nil)
+	partWriter := multipart.NewWriter(body)
+	for _, part := range parts {
+		var err error
+		if part.name == filesPartName {
+			err = partWriter.WriteField(part.name, string(part.content))
+		} else {
+			var partContent io.Writer
+			if partContent, err = partWriter.CreateFormFile(part.name, part.name); err == nil {
+				_, err = partContent.Write(part.content)
+			}
+		}
+		if err != nil {
+			t.Fatalf("Error writing %s part: %s", part.name, err)
+		}
+	}
+	if err := partWriter.Close(); err != nil {
+		t.Fatalf("Error closing request body: %s", err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/image/encode/stream", body)
+	request.Header.Set("Content-Type", partWriter.FormDataContentType())
+	return request
+}
+
+// filesPart returns the files part declaring the files
+func filesPart(t *testing.T, files ...api.StreamedFile) streamPart {
+	content, err := json.Marshal(files)
+	if err != nil {
+		t.Fatalf("Error building files part: %s", err)
+	}
+	return streamPart{name: filesPartName, content: content}
+}
+
+func TestEncodeImageStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	carrierPNG := testCarrierPNG(t)
+	first, second := test.GenerateRandomBytes(300), test.GenerateRandomBytes(200)
+
+	request := newStreamedEncodeRequest(t,
+		filesPart(t, api.StreamedFile{Name: "first", Size: 300}, api.StreamedFile{Name: "second", Size: 200}),
+		streamPart{name: imagePartName, content: carrierPNG},
+		streamPart{name: filePartName, content: first},
+		streamPart{name: filePartName, content: second},
+	)
+	response := httptest.NewRecorder()
+	newRouter(Config{Limits: DefaultLimits()}).ServeHTTP(response, request)
+	if response.Code != http.StatusOK || response.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Expected status %d with a PNG, got %d: %s", http.StatusOK, response.Code, response.Body.String())
+	}
+
+	revealed, err := nsteg.Reveal(context.Background(), response.Body)
+	if err != nil {
+		t.Fatalf("Error revealing files from the encoded image: %s", err)
+	}
+	if len(revealed.Files) != 2 || revealed.Files[0].Name != "first" || !bytes.Equal(revealed.Files[0].Content, first) ||
+		revealed.Files[1].Name != "second" || !bytes.Equal(revealed.Files[1].Content, second) {
+		t.Errorf("Expected the streamed files to be revealed, got %d files", len(revealed.Files))
+	}
+}
+
+func TestEncodeImageStreamErrors(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	carrierPNG := testCarrierPNG(t)
+	file := test.GenerateRandomBytes(100)
+	declared := api.StreamedFile{Name: "file", Size: 100}
+	imagePart := streamPart{name: imagePartName, content: carrierPNG}
+
+	for _, testCase := range []struct {
+		name         string
+		parts        []streamPart
+		expectedCode string
+	}{
+		{name: "missing files part", parts: []streamPart{imagePart, {name: filePartName, content: file}}, expectedCode: errInvalidStreamRequest.Code},
+		{name: "missing image part", parts: []streamPart{filesPart(t, declared)}, expectedCode: errInvalidStreamRequest.Code},
+		{name: "image part before files part", parts: []streamPart{imagePart, filesPart(t, declared), {name: filePartName, content: file}}, expectedCode: errInvalidStreamRequest.Code},
+		{name: "negative size", parts: []streamPart{filesPart(t, api.StreamedFile{Name: "file", Size: -1}), imagePart}, expectedCode: errInvalidStreamRequest.Code},
+		{name: "missing file part", parts: []streamPart{filesPart(t, declared), imagePart}, expectedCode: errInvalidFileParts.Code},
+		{name: "file part out of order", parts: []streamPart{filesPart(t, declared), imagePart, {name: imagePartName, content: file}}, expectedCode: errInvalidFileParts.Code},
+		{name: "file part shorter than declared", parts: []streamPart{filesPart(t, declared), imagePart, {name: filePartName, content: file[:50]}}, expectedCode: errInvalidFileParts.Code},
+		{name: "file part longer than declared", parts: []streamPart{filesPart(t, declared), imagePart, {name: filePartName, content: append(append([]byte{}, file...), 0)}}, expectedCode: errInvalidFileParts.Code},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			response := httptest.NewRecorder()
+			newRouter(Config{Limits: DefaultLimits()}).ServeHTTP(response, newStreamedEncodeRequest(t, testCase.parts...))
+
+			if response.Code != http.StatusBadRequest {
+				t.Fatalf("Expected status %d, got %d: %s", http.StatusBadRequest, response.Code, response.Body.String())
+			}
+			var apiErr api.Error
+			if err := json.Unmarshal(response.Body.Bytes(), &apiErr); err != nil || apiErr.Code != testCase.expectedCode {
+				t.Errorf("Expected error code %s, got %s", testCase.expectedCode, response.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"nsteg"
+	"nsteg/api"
+	"nsteg/test"
+	"testing"
+)
+
+func TestEncodeImage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	file := test.GenerateRandomBytes(300)
+	requestBody, err := json.Marshal(api.EncodeImageRequest{
+		LsbsToUse:     3,
+		ImageToEncode: testCarrierPNG(t),
+		FilesToHide:   []api.FileToHide{{Name: "file", Content: file}},
+	})
+	if err != nil {
+		t.Fatalf("Error building encode request: %s", err)
+	}
+
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/image/encode", bytes.NewReader(requestBody))
+	request.Header.Set("Content-Type", "application/json")
+	response := httptest.NewRecorder()
+	newRouter(Config{Limits: DefaultLimits()}).ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d: %s", http.StatusOK, response.Code, response.Body.String())
+	}
+
+	// The streamed response must be indistinguishable from one marshalled by encoding/json
+	var encodeResponse api.EncodeImageResponse
+	if err = json.Unmarshal(response.Body.Bytes(), &encodeResponse); err != nil {
+		t.Fatalf("Error unmarshalling the streamed response: %s", err)
+	}
+	expectedBody, err := json.Marshal(encodeResponse)
+	if err != nil {
+		t.Fatalf("Error marshalling the response: %s", err)
+	}
+	if !bytes.Equal(response.Body.Bytes(), expectedBody) {
+		t.Errorf("Expected the streamed response to match the marshalled response")
+	}
+
+	revealed, err := nsteg.Reveal(context.Background(), bytes.NewReader(encodeResponse.EncodedImage))
+	if err != nil {
+		t.Fatalf("Error revealing files from the encoded image: %s", err)
+	}
+	if len(revealed.Files) != 1 || revealed.Files[0].Name != "file" || !bytes.Equal(revealed.Files[0].Content, file) {
+		t.Errorf("Expected the file to be revealed, got %d files", len(revealed.Files))
+	}
+}
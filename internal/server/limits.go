@@ -0,0 +1,101 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"nsteg/api"
+	"nsteg/internal/logging"
+	"time"
+)
+
+const (
+	// DefaultMaxRequestBytes Largest request body accepted by default, which leaves room for the largest carrier
+	// accepted by default along with the files filling it
+	DefaultMaxRequestBytes = 1 << 30
+
+	// DefaultMaxFilesPartBytes Largest files part of streamed encode requests accepted by default
+	DefaultMaxFilesPartBytes = 1 << 20
+
+	// DefaultMaxCarrierPixels Largest carrier accepted by default, in pixels, which is 8192x8192
+	DefaultMaxCarrierPixels = 1 << 26
+
+	// DefaultMemoryBudgetBytes Memory the requests handled at once may take by default
+	DefaultMemoryBudgetBytes = 2 << 30
+
+	// DefaultAdmissionTimeout Time a request waits by default for the memory budget to have room for its carrier
+	DefaultAdmissionTimeout = 10 * time.Second
+
+	limitsContextKey = "limits"
+)
+
+var (
+	errRequestTooLarge = api.Error{Code: "request_too_large", Error: "Request body is larger than the server accepts"}
+)
+
+// Limits Bounds on the requests accepted by the server
+type Limits struct {
+	// MaxRequestBytes Largest request body accepted, unlimited if 0
+	MaxRequestBytes int64
+
+	// MaxFilesPartBytes Largest files part accepted by the streamed encode endpoint, which is the only part it reads
+	// into memory as a whole. Unlimited if 0
+	MaxFilesPartBytes int64
+
+	// MaxCarrierPixels Largest carrier accepted, in pixels, checked from the header of the image before decoding it.
+	// Unlimited if 0
+	MaxCarrierPixels int64
+
+	// MaxPayloadBytes Largest total size of the files to encode, unlimited if 0
+	MaxPayloadBytes int64
+
+	// MaxFiles Most files encoded by a single request, unlimited if 0
+	MaxFiles int
+
+	// MemoryBudgetBytes Memory the requests being handled may take altogether, estimated from the dimensions of their
+	// carrier and the size of their bodies. Requests that do not fit in the room left wait for it, and requests that do
+	// not fit in the whole budget are rejected. Unlimited if 0
+	MemoryBudgetBytes int64
+
+	// AdmissionTimeout Time a request waits for the memory budget to have room for its body or its carrier, after which
+	// it is rejected as the server being busy. Requests do not wait at all if 0
+	AdmissionTimeout time.Duration
+}
+
+// DefaultLimits returns the limits the server applies unless configured otherwise
+func DefaultLimits() Limits {
+	return Limits{
+		MaxRequestBytes:   DefaultMaxRequestBytes,
+		MaxFilesPartBytes: DefaultMaxFilesPartBytes,
+		MaxCarrierPixels:  DefaultMaxCarrierPixels,
+		MemoryBudgetBytes: DefaultMemoryBudgetBytes,
+		AdmissionTimeout:  DefaultAdmissionTimeout,
+	}
+}
+
+// limitRequests rejects requests declaring a body larger than the limits, and stops reading the body of those that do
+// not declare its size once the limit is reached. The limits, along with the memory budget shared by the requests, are
+// stored in the context for the handlers
+func limitRequests(limits Limits) gin.HandlerFunc {
+	budget := newMemoryBudget(limits.MemoryBudgetBytes)
+	return func(ctx *gin.Context) {
+		ctx.Set(limitsContextKey, limits)
+		ctx.Set(memoryBudgetContextKey, budget)
+		if limits.MaxRequestBytes > 0 {
+			if ctx.Request.ContentLength > limits.MaxRequestBytes {
+				logging.BuildLoggerFromCtx(ctx).Info("Rejected request larger than the limit", "content_length", ctx.Request.ContentLength)
+				abortWithError(ctx, http.StatusRequestEntityTooLarge, withDetails(errRequestTooLarge, map[string]any{"max_request_bytes": limits.MaxRequestBytes}))
+				return
+			}
+			ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, limits.MaxRequestBytes)
+		}
+		ctx.Next()
+	}
+}
+
+// requestLimits returns the limits stored in the context by limitRequests, or the default ones if there are none
+func requestLimits(ctx *gin.Context) Limits {
+	if limits, ok := ctx.Value(limitsContextKey).(Limits); ok {
+		return limits
+	}
+	return DefaultLimits()
+}
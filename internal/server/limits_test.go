@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLimitRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(limitRequests(Limits{MaxRequestBytes: 10, MaxFilesPartBytes: 5}))
+	router.POST("/echo", func(ctx *gin.Context) {
+		if limits := requestLimits(ctx); limits.MaxFilesPartBytes != 5 {
+			t.Errorf("Expected the configured limits in the context, got %+v", limits)
+		}
+		if _, err := io.ReadAll(ctx.Request.Body); err != nil {
+			ctx.Status(http.StatusRequestEntityTooLarge)
+			return
+		}
+		ctx.Status(http.StatusOK)
+	})
+
+	for _, testCase := range []struct {
+		name           string
+		bodySize       int
+		unknownLength  bool
+		expectedStatus int
+	}{
+		{name: "within limit", bodySize: 10, expectedStatus: http.StatusOK},
+		{name: "declared over limit", bodySize: 11, expectedStatus: http.StatusRequestEntityTooLarge},
+		{name: "undeclared over limit", bodySize: 11, unknownLength: true, expectedStatus: http.StatusRequestEntityTooLarge},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodPost, "/echo", bytes.NewReader(make([]byte, testCase.bodySize)))
+			if testCase.unknownLength {
+				request.ContentLength = -1
+			}
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			if response.Code != testCase.expectedStatus {
+				t.Errorf("Expected status %d, got %d", testCase.expectedStatus, response.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"nsteg/pkg/model"
+	"strconv"
+	"time"
+)
+
+const (
+	metricsNamespace = "nsteg"
+
+	operationEncode = "encode"
+	operationDecode = "decode"
+
+	// unmatchedRoute Route label of requests not matching any route, so that unknown paths do not create new series
+	unmatchedRoute = "unmatched"
+
+	// unknownErrorCode Code label of errors without a code
+	unknownErrorCode = "unknown"
+
+	errorCodeContextKey = "error_code"
+)
+
+// metrics Metrics of the server, exposed on /metrics
+var metrics = newServerMetrics(prometheus.NewRegistry())
+
+// serverMetrics Prometheus metrics of the requests handled by the server, and of the encoding and decoding they do
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	requests        *prometheus.CounterVec
+	requestDuration *prometheus.HistogramVec
+	inFlight        prometheus.Gauge
+	errors          *prometheus.CounterVec
+
+	// stageDuration Duration of each stage of model.EncodeStats and model.DecodeStats, by operation and stage
+	stageDuration *prometheus.HistogramVec
+	payloadBytes  *prometheus.HistogramVec
+	carrierBytes  *prometheus.HistogramVec
+}
+
+func newServerMetrics(registry *prometheus.Registry) *serverMetrics {
+	durationBuckets := prometheus.ExponentialBuckets(0.001, 2, 16)
+	bytesBuckets := prometheus.ExponentialBuckets(1024, 4, 10)
+	m := &serverMetrics{
+		registry: registry,
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Requests handled, by route, method and status",
+		}, []string{"route", "method", "status"}),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to handle requests, by route, method and status",
+			Buckets:   durationBuckets,
+		}, []string{"route", "method", "status"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_in_flight",
+			Help:      "Requests being handled",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_errors_total",
+			Help:      "Errors returned, by the code of their api.Error",
+		}, []string{"code"}),
+		stageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "stage_duration_seconds",
+			Help:      "Time taken by each stage of successful encodes and decodes",
+			Buckets:   durationBuckets,
+		}, []string{"operation", "stage"}),
+		payloadBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "payload_bytes",
+			Help:      "Size of the payloads hidden in or revealed from images, including framing and encryption overhead when encoding",
+			Buckets:   bytesBuckets,
+		}, []string{"operation"}),
+		carrierBytes: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "carrier_bytes",
+			Help:      "Size of the images supplied to encode into or decode from",
+			Buckets:   bytesBuckets,
+		}, []string{"operation"}),
+	}
+
+	registry.MustRegister(
+		m.requests, m.requestDuration, m.inFlight, m.errors, m.stageDuration, m.payloadBytes, m.carrierBytes,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// middleware records the metrics of every request, and of the error it was aborted with through abortWithError
+func (m *serverMetrics) middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		m.inFlight.Inc()
+		start := time.Now()
+		ctx.Next()
+		m.inFlight.Dec()
+
+		route := ctx.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		status := strconv.Itoa(ctx.Writer.Status())
+		m.requests.WithLabelValues(route, ctx.Request.Method, status).Inc()
+		m.requestDuration.WithLabelValues(route, ctx.Request.Method, status).Observe(time.Since(start).Seconds())
+
+		if code, found := ctx.Get(errorCodeContextKey); found {
+			if code == "" {
+				code = unknownErrorCode
+			}
+			m.errors.WithLabelValues(code.(string)).Inc()
+		}
+	}
+}
+
+// handler serves the metrics in the Prometheus exposition format
+func (m *serverMetrics) handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
+
+// observeEncode records the stages and sizes of a successful encode, whose carrier is carrierBytes long
+func (m *serverMetrics) observeEncode(stats model.EncodeStats, carrierBytes int64) {
+	m.stageDuration.WithLabelValues(operationEncode, "setup").Observe(stats.Setup.Seconds())
+	m.stageDuration.WithLabelValues(operationEncode, "data_encoding").Observe(stats.DataEncoding.Seconds())
+	m.stageDuration.WithLabelValues(operationEncode, "output_image_encoding").Observe(stats.OutputImageEncoding.Seconds())
+	m.payloadBytes.WithLabelValues(operationEncode).Observe(float64(stats.PayloadBytes))
+	m.carrierBytes.WithLabelValues(operationEncode).Observe(float64(carrierBytes))
+}
+
+// observeDecode records the stages and sizes of a successful decode, whose files add up to payloadBytes
+func (m *serverMetrics) observeDecode(stats model.DecodeStats, carrierBytes, payloadBytes int64) {
+	m.stageDuration.WithLabelValues(operationDecode, "data_decoding").Observe(stats.DataDecoding.Seconds())
+	m.payloadBytes.WithLabelValues(operationDecode).Observe(float64(payloadBytes))
+	m.carrierBytes.WithLabelValues(operationDecode).Observe(float64(carrierBytes))
+}
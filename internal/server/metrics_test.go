@@ -0,0 +1,68 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"nsteg/api"
+	"nsteg/test"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := httptest.NewServer(newRouter(Config{Limits: DefaultLimits()}))
+	defer server.Close()
+
+	carrierPNG := testCarrierPNG(t)
+	encodeRequest, err := json.Marshal(api.EncodeImageRequest{
+		LsbsToUse:     3,
+		ImageToEncode: carrierPNG,
+		FilesToHide:   []api.FileToHide{{Name: "file", Content: test.GenerateRandomBytes(100)}},
+	})
+	if err != nil {
+		t.Fatalf("Error building encode request: %s", err)
+	}
+	postJSON(t, server.URL+"/api/v1/image/encode", encodeRequest, http.StatusOK)
+	postJSON(t, server.URL+"/api/v1/image/decode", []byte(`{"image_to_decode": "bm90IGFuIGltYWdl"}`), http.StatusBadRequest)
+
+	response, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Error scraping metrics: %s", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Error reading metrics: %s", err)
+	}
+
+	for _, expected := range []string{
+		`nsteg_http_requests_total{method="POST",route="/api/v1/image/encode",status="200"}`,
+		`nsteg_http_request_duration_seconds_count{method="POST",route="/api/v1/image/decode",status="400"}`,
+		`nsteg_http_requests_in_flight`,
+		`nsteg_http_errors_total{code="invalid_image"}`,
+		`nsteg_stage_duration_seconds_count{operation="encode",stage="data_encoding"}`,
+		`nsteg_stage_duration_seconds_count{operation="encode",stage="output_image_encoding"}`,
+		`nsteg_payload_bytes_count{operation="encode"}`,
+		`nsteg_carrier_bytes_count{operation="encode"}`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected metrics to contain %s", expected)
+		}
+	}
+}
+
+func postJSON(t *testing.T, url string, body []byte, expectedStatus int) {
+	response, err := http.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error sending request to %s: %s", url, err)
+	}
+	response.Body.Close()
+	if response.StatusCode != expectedStatus {
+		t.Fatalf("Expected status %d from %s, got %d", expectedStatus, url, response.StatusCode)
+	}
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"image"
+	"math/bits"
+	"sync"
+)
+
+const (
+	// rgbaSizeClassSteps Size classes of the carrier pool between two powers of two, so that the pixels of a pooled
+	// image take at most an eighth more than the image needs
+	rgbaSizeClassSteps = 8
+
+	// rgbaSizeClasses Size classes of every length of pixels an int can hold
+	rgbaSizeClasses = bits.UintSize * rgbaSizeClassSteps
+)
+
+// carrierPool Pool of the images carriers of every request are converted into, see nsteg.WithCarrierPool
+var carrierPool = &rgbaPool{}
+
+// rgbaPool Pools RGBA images by the size of their pixels, so that the carrier of a request is converted into the image
+// of an earlier request of about the same size, instead of a newly allocated one. Sizes are rounded up to a fixed set
+// of size classes, so the number of pools is bounded whatever the dimensions of the carriers. Images are held by
+// sync.Pools, which drop those left unused across garbage collections, so the pool does not keep the memory of past
+// requests once the server is idle. Implements nsteg.CarrierPool
+type rgbaPool struct {
+	// classes One pool per size class, holding images whose pixels have the capacity of the class
+	classes [rgbaSizeClasses]sync.Pool
+}
+
+func (p *rgbaPool) Get(bounds image.Rectangle) *image.RGBA {
+	n := 4 * bounds.Dx() * bounds.Dy()
+	class, capacity := rgbaSizeClass(n)
+	if class < 0 {
+		return image.NewRGBA(bounds)
+	}
+
+	img, ok := p.classes[class].Get().(*image.RGBA)
+	if !ok {
+		img = &image.RGBA{Pix: make([]byte, n, capacity)}
+	}
+	img.Pix, img.Stride, img.Rect = img.Pix[:n], 4*bounds.Dx(), bounds
+	return img
+}
+
+func (p *rgbaPool) Put(img *image.RGBA) {
+	// Sub images share their pixels with the image they were taken from, so they are not reusable on their own
+	if img.Stride != 4*img.Rect.Dx() || len(img.Pix) != img.Stride*img.Rect.Dy() {
+		return
+	}
+	// Images not allocated by the pool go to the largest class their pixels can hold
+	class, capacity := rgbaSizeClass(cap(img.Pix))
+	if capacity > cap(img.Pix) {
+		class--
+	}
+	if class >= 0 {
+		p.classes[class].Put(img)
+	}
+}
+
+// rgbaSizeClass returns the size class of the pixels of n bytes, along with the capacity of the pixels of the class,
+// which is n rounded up to the next of rgbaSizeClassSteps steps between two powers of two. Pixels too small to be
+// worth pooling have no class, and -1 is returned
+func rgbaSizeClass(n int) (int, int) {
+	if n <= rgbaSizeClassSteps {
+		return -1, n
+	}
+	// 2^exponent < n <= 2^(exponent+1), which is split in steps of 2^exponent/rgbaSizeClassSteps
+	exponent := bits.Len(uint(n-1)) - 1
+	stepSize := 1 << (exponent - bits.Len(rgbaSizeClassSteps-1))
+	step := (n-1-1<<exponent)/stepSize + 1
+	return exponent*rgbaSizeClassSteps + step - 1, 1<<exponent + step*stepSize
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"io"
+	"nsteg"
+	"nsteg/test"
+	"testing"
+)
+
+const poolBenchImageSize = 1000
+
+func TestRGBASizeClass(t *testing.T) {
+	for _, testCase := range []struct {
+		n                int
+		expectedClass    int
+		expectedCapacity int
+	}{
+		{n: 8, expectedClass: -1, expectedCapacity: 8},
+		{n: 9, expectedClass: 24, expectedCapacity: 9},
+		{n: 16, expectedClass: 31, expectedCapacity: 16},
+		{n: 17, expectedClass: 32, expectedCapacity: 18},
+		{n: 4 * 1000 * 1000, expectedClass: 175, expectedCapacity: 4194304},
+		{n: 4 * 1024 * 1024, expectedClass: 175, expectedCapacity: 4194304},
+		{n: 4*1024*1024 + 1, expectedClass: 176, expectedCapacity: 4718592},
+	} {
+		class, capacity := rgbaSizeClass(testCase.n)
+		if class != testCase.expectedClass || capacity != testCase.expectedCapacity {
+			t.Errorf("Expected class %d of capacity %d for %d bytes, got class %d of capacity %d", testCase.expectedClass, testCase.expectedCapacity, testCase.n, class, capacity)
+		}
+		if class >= rgbaSizeClasses || capacity < testCase.n || capacity > testCase.n+testCase.n/rgbaSizeClassSteps {
+			t.Errorf("Expected a bounded class with at most an eighth more capacity than %d bytes, got class %d of capacity %d", testCase.n, class, capacity)
+		}
+	}
+}
+
+func TestRGBAPool(t *testing.T) {
+	pool := &rgbaPool{}
+	img := pool.Get(image.Rect(0, 0, 1000, 1000))
+	if len(img.Pix) != 4*1000*1000 || img.Stride != 4*1000 {
+		t.Fatalf("Expected pixels of a 1000x1000 image, got %d with stride %d", len(img.Pix), img.Stride)
+	}
+	pool.Put(img)
+
+	// Images of other dimensions in the same size class reuse the pixels, which sync.Pool may have dropped meanwhile
+	reused := pool.Get(image.Rect(0, 0, 1024, 1000))
+	if len(reused.Pix) != 4*1024*1000 || reused.Stride != 4*1024 || reused.Rect != image.Rect(0, 0, 1024, 1000) {
+		t.Errorf("Expected pixels of a 1024x1000 image, got %d with stride %d and bounds %s", len(reused.Pix), reused.Stride, reused.Rect)
+	}
+}
+
+// BenchmarkCarrierPool compares the memory allocated hiding a file in JPEG carriers, which must be converted to RGBA,
+// with and without the carrier pool used by the handlers
+func BenchmarkCarrierPool(b *testing.B) {
+	carrier := bytes.NewBuffer(nil)
+	if err := jpeg.Encode(carrier, test.GenerateNaturalImage(poolBenchImageSize, poolBenchImageSize, 4), nil); err != nil {
+		b.Fatalf("Error encoding benchmark image: %s", err)
+	}
+	content := test.GenerateRandomBytes(1024)
+
+	for _, benchmark := range []struct {
+		name string
+		opts []nsteg.Option
+	}{
+		{name: "NoPool"},
+		{name: "Pool", opts: []nsteg.Option{nsteg.WithCarrierPool(carrierPool)}},
+	} {
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				files := []nsteg.File{{Name: "file", Content: bytes.NewReader(content), Size: int64(len(content))}}
+				if _, err := nsteg.Hide(context.Background(), bytes.NewReader(carrier.Bytes()), io.Discard, files, benchmark.opts...); err != nil {
+					b.Fatalf("Error hiding file: %s", err)
+				}
+			}
+		})
+	}
+}
@@ -1,30 +1,147 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
+	"net"
 	"net/http"
 	_ "nsteg/docs"
 	"nsteg/internal/logging"
+	"time"
 )
 
+var (
+	ErrShutdownTimeout = errors.New("requests in flight were not drained before the shutdown timeout")
+)
+
+// Config Settings of the server
+type Config struct {
+	// Address Host and port to listen on, such as :8080 to listen on every interface
+	Address  string
+	Limits   Limits
+	Timeouts Timeouts
+
+	// Auth Authentication and quotas of the requests to the API, which is open to anyone if nil
+	Auth *Auth
+}
+
+// Timeouts Bounds on the time connections and requests may take, and on how long shutting down may take. Each of
+// them is unlimited if 0
+type Timeouts struct {
+	// Read Time allowed to read a whole request, including its body
+	Read time.Duration
+
+	// Write Time allowed from the end of reading the request headers to the end of writing the response, which
+	// includes encoding the image
+	Write time.Duration
+
+	// Idle Time a keep-alive connection is kept open waiting for the next request
+	Idle time.Duration
+
+	// ShutdownDelay Time between readiness failing and the server no longer accepting connections, which leaves load
+	// balancers time to notice that it is shutting down
+	ShutdownDelay time.Duration
+
+	// Shutdown Time allowed for the requests in flight to complete once the server no longer accepts connections,
+	// after which they are aborted
+	Shutdown time.Duration
+}
+
+// DefaultTimeouts returns the timeouts the server applies unless configured otherwise
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Read:     5 * time.Minute,
+		Write:    5 * time.Minute,
+		Idle:     2 * time.Minute,
+		Shutdown: 30 * time.Second,
+	}
+}
+
 // StartServer godoc
 // @title nSteg API
 // @version 1.0
 // @description An API to perform steganography on images
 // @BasePath /api/v1
-func StartServer(port string) {
+// @securityDefinitions.apikey ApiKeyAuth
+// @in header
+// @name Authorization
+// @description API key or token, as "Bearer <credential>", when the server is started with a keys file
+func StartServer(ctx context.Context, config Config) error {
+	http.HandleFunc("/encode/image", handleImageEncodeRequest)
+	if config.Auth == nil {
+		logging.Default().Warn("API is not authenticated, anyone reaching the server can use it")
+	}
+
+	server := &http.Server{
+		Addr:         config.Address,
+		Handler:      newRouter(config),
+		ReadTimeout:  config.Timeouts.Read,
+		WriteTimeout: config.Timeouts.Write,
+		IdleTimeout:  config.Timeouts.Idle,
+	}
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return err
+	}
+	return serve(ctx, server, listener, config.Timeouts)
+}
+
+// serve serves requests until the context is done, and then shuts the server down gracefully: readiness fails right
+// away, new connections are refused after the shutdown delay, and the requests in flight are given the shutdown
+// timeout to complete before being aborted
+func serve(ctx context.Context, server *http.Server, listener net.Listener, timeouts Timeouts) error {
+	logger := logging.Default()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.Serve(listener)
+	}()
+
+	ready.Store(true)
+	logger.Info("Server started", "address", listener.Addr().String())
+	select {
+	case err := <-serveErr:
+		ready.Store(false)
+		return err
+	case <-ctx.Done():
+	}
+
+	ready.Store(false)
+	logger.Info("Shutting down server", "delay", timeouts.ShutdownDelay, "timeout", timeouts.Shutdown)
+	time.Sleep(timeouts.ShutdownDelay)
+
+	shutdownCtx := context.Background()
+	if timeouts.Shutdown > 0 {
+		var cancel context.CancelFunc
+		shutdownCtx, cancel = context.WithTimeout(shutdownCtx, timeouts.Shutdown)
+		defer cancel()
+	}
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		// Closing the connections left cancels the context of their requests, which aborts their encoding
+		server.Close()
+		return fmt.Errorf("%w: %w", ErrShutdownTimeout, err)
+	}
+	logger.Info("Server shut down")
+	return nil
+}
+
+func newRouter(config Config) *gin.Engine {
 	r := gin.New()
-	r.Use(logging.NewGinLogger(), gin.Recovery())
+	r.Use(logging.RequestID(), traceRequests(), logging.NewGinLogger(), metrics.middleware(), gin.Recovery(), limitRequests(config.Limits))
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+	r.GET("/metrics", metrics.handler())
+	r.GET("/healthz", HealthHandler)
+	r.GET("/readyz", ReadyHandler)
 
 	v1 := r.Group("/api/v1")
+	if config.Auth != nil {
+		v1.Use(authenticate(*config.Auth))
+	}
 	v1.POST("/image/encode", EncodeImageHandler)
+	v1.POST("/image/encode/stream", EncodeImageStreamHandler)
 	v1.POST("/image/decode", DecodeImageHandler)
-
-	http.HandleFunc("/encode/image", handleImageEncodeRequest)
-
-	r.Run(fmt.Sprintf(":%s", port))
+	return r
 }
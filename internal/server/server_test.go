@@ -0,0 +1,17 @@
+package server
+
+import (
+	"bytes"
+	"image/png"
+	"nsteg/test"
+	"testing"
+)
+
+// testCarrierPNG returns a PNG carrier of 100x100 pixels, which fits the few hundred bytes hidden by the tests
+func testCarrierPNG(t testing.TB) []byte {
+	imageBuffer := bytes.NewBuffer(nil)
+	if err := png.Encode(imageBuffer, test.GenerateNaturalImage(100, 100, 4)); err != nil {
+		t.Fatalf("Error encoding test image: %s", err)
+	}
+	return imageBuffer.Bytes()
+}
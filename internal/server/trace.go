@@ -0,0 +1,55 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"net/http"
+	"nsteg/internal/logging"
+)
+
+// requestIDAttribute Attribute of the server span holding the request ID, so that traces can be found from logs
+const requestIDAttribute = "nsteg.request_id"
+
+// traceRequests starts a server span for every request, as a child of the span of the client if the request carries
+// W3C trace context headers. The span is stored in the context of the request, so that the spans of nsteg.Hide and
+// nsteg.Reveal are its children
+func traceRequests() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		propagator := otel.GetTextMapPropagator()
+		requestCtx := propagator.Extract(ctx.Request.Context(), propagation.HeaderCarrier(ctx.Request.Header))
+
+		route := ctx.FullPath()
+		spanName := ctx.Request.Method
+		if route != "" {
+			spanName += " " + route
+		}
+		requestCtx, span := otel.Tracer("nsteg/internal/server").Start(requestCtx, spanName,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(ctx.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(ctx.Request.URL.Path),
+				semconv.ClientAddress(ctx.ClientIP()),
+				attribute.String(requestIDAttribute, ctx.Writer.Header().Get(logging.RequestIDHeader)),
+			),
+		)
+		defer span.End()
+
+		ctx.Request = ctx.Request.WithContext(requestCtx)
+		ctx.Next()
+
+		status := ctx.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if code := ctx.GetString(errorCodeContextKey); code != "" {
+			span.SetAttributes(attribute.String("nsteg.error_code", code))
+		}
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+	}
+}
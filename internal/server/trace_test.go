@@ -0,0 +1,78 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net/http"
+	"net/http/httptest"
+	"nsteg/api"
+	"nsteg/test"
+	"testing"
+)
+
+func TestTracePropagation(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	previousProvider, previousPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer func() {
+		otel.SetTracerProvider(previousProvider)
+		otel.SetTextMapPropagator(previousPropagator)
+	}()
+
+	carrierPNG := testCarrierPNG(t)
+	encodeRequest, err := json.Marshal(api.EncodeImageRequest{
+		LsbsToUse:     3,
+		ImageToEncode: carrierPNG,
+		FilesToHide:   []api.FileToHide{{Name: "file", Content: test.GenerateRandomBytes(100)}},
+	})
+	if err != nil {
+		t.Fatalf("Error building encode request: %s", err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	const traceID, parentSpanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/image/encode", bytes.NewReader(encodeRequest))
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("traceparent", "00-"+traceID+"-"+parentSpanID+"-01")
+	response := httptest.NewRecorder()
+	newRouter(Config{Limits: DefaultLimits()}).ServeHTTP(response, request)
+	if response.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, response.Code)
+	}
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = span
+		if span.SpanContext().TraceID().String() != traceID {
+			t.Errorf("Expected span %s to be part of trace %s, got %s", span.Name(), traceID, span.SpanContext().TraceID())
+		}
+	}
+
+	serverSpan, found := spans["POST /api/v1/image/encode"]
+	if !found {
+		t.Fatalf("Expected a server span, got %v", spans)
+	}
+	if serverSpan.Parent().SpanID().String() != parentSpanID || !serverSpan.Parent().IsRemote() {
+		t.Errorf("Expected the server span to be a child of the remote span %s, got %s", parentSpanID, serverSpan.Parent().SpanID())
+	}
+	for _, name := range []string{
+		"nsteg.Hide",
+		"nsteg.decodeCarrier",
+		"image.Encoder.setupDataReader",
+		"image.Encoder.encodeDataToRawImage",
+		"image.Encoder.encodeRawImage",
+	} {
+		if _, found := spans[name]; !found {
+			t.Errorf("Expected a %s span", name)
+		}
+	}
+	if hideSpan, found := spans["nsteg.Hide"]; found && hideSpan.Parent().SpanID() != serverSpan.SpanContext().SpanID() {
+		t.Errorf("Expected the nsteg.Hide span to be a child of the server span")
+	}
+}
@@ -0,0 +1,100 @@
+// Package telemetry sets up the OpenTelemetry tracer provider the spans of nsteg are recorded by, along with the W3C
+// trace context propagation through which the spans of a request join the trace of the client that sent it
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"net/url"
+	"os"
+)
+
+const (
+	ExporterNone   = "none"
+	ExporterStdout = "stdout"
+	ExporterOTLP   = "otlp"
+)
+
+var (
+	ErrInvalidExporter    = errors.New("trace exporter must be one of " + ExporterNone + ", " + ExporterStdout + " or " + ExporterOTLP)
+	ErrInvalidEndpoint    = errors.New("trace endpoint must be an http or https URL")
+	ErrInvalidSampleRatio = errors.New("trace sample ratio must be between 0 and 1")
+)
+
+// Config Where spans are exported to, and which share of traces is sampled
+type Config struct {
+	// Exporter Either none, in which case spans are not recorded, stdout, or otlp to export them to a collector
+	Exporter string
+
+	// Endpoint URL spans are sent to by the otlp exporter, such as http://localhost:4318/v1/traces. The
+	// OTEL_EXPORTER_OTLP_* environment variables, or the local collector, are used if empty
+	Endpoint string
+
+	// SampleRatio Share of the traces started by nsteg that are sampled, from 0 to 1. Traces started by the client are
+	// sampled if the client sampled them, whatever the ratio
+	SampleRatio float64
+}
+
+// Setup sets up the global tracer provider and propagator as configured. The returned function flushes the spans not
+// exported yet and stops the exporter, and must be called before exiting
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if config.SampleRatio < 0 || config.SampleRatio > 1 {
+		return nil, fmt.Errorf("%w, got %v", ErrInvalidSampleRatio, config.SampleRatio)
+	}
+	exporter, err := newExporter(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	if exporter == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName("nsteg")),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// newExporter returns the exporter of the config, or nil if spans are not exported
+func newExporter(ctx context.Context, config Config) (sdktrace.SpanExporter, error) {
+	switch config.Exporter {
+	case ExporterNone, "":
+		return nil, nil
+	case ExporterStdout:
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case ExporterOTLP:
+		var options []otlptracehttp.Option
+		if config.Endpoint != "" {
+			endpoint, err := url.Parse(config.Endpoint)
+			if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+				return nil, fmt.Errorf("%w, got %s", ErrInvalidEndpoint, config.Endpoint)
+			}
+			options = append(options, otlptracehttp.WithEndpointURL(config.Endpoint))
+		}
+		return otlptracehttp.New(ctx, options...)
+	default:
+		return nil, fmt.Errorf("%w, got %s", ErrInvalidExporter, config.Exporter)
+	}
+}
@@ -0,0 +1,17 @@
+// Package tracing holds the helpers shared by the packages that record spans. It only depends on the OpenTelemetry
+// API, so that the library packages do not pull in the exporters set up by internal/telemetry
+package tracing
+
+import (
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// EndSpan marks the span as failed if there was an error, and ends it
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,228 @@
+// Package nsteg hides files in images and reveals them again. Hide and Reveal take care of decoding the carrier
+// image in whatever format it is in, converting it to the RGBA image the encoders work on, and picking the encoder or
+// decoder matching the supplied options, so services embedding nsteg do not need to assemble pkg/image themselves
+package nsteg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"image"
+	"image/draw"
+	"io"
+	"nsteg/internal/tracing"
+	nstegImage "nsteg/pkg/image"
+	"nsteg/pkg/model"
+	"sync"
+)
+
+var (
+	ErrInvalidCarrier     = errors.New("carrier is not a valid image")
+	ErrConflictingOptions = errors.New("conflicting options")
+)
+
+// tracer returns the tracer of Hide and Reveal, whose spans are children of the span in their context. It is looked up
+// on every call, so that spans go to whichever tracer provider the application set up, if any
+func tracer() trace.Tracer {
+	return otel.Tracer("nsteg")
+}
+
+// encoderPool Encoders reused across calls to Hide, through Encoder.Reset, so that the buffers they allocate, including
+// the copy of the carrier kept for the quality metrics, are only allocated once for carriers of the same size. Encoders
+// are released before being put back, so that pooled encoders do not hold the carrier itself
+var encoderPool = sync.Pool{
+	New: func() any {
+		return &nstegImage.Encoder{}
+	},
+}
+
+// CarrierPool Supplies the RGBA images carriers are converted into, and takes them back once Hide or Reveal are done
+// with them, so that carriers need not be allocated for every call. See WithCarrierPool
+type CarrierPool interface {
+	// Get returns an image with the supplied bounds, whose pixels are all overwritten by the carrier
+	Get(bounds image.Rectangle) *image.RGBA
+	Put(img *image.RGBA)
+}
+
+type (
+	// File File to hide, whose Content is read while it is hidden
+	File = model.InputFile
+
+	// RevealedFile File revealed from an image
+	RevealedFile = model.OutputFile
+
+	// Signer Key that signed revealed files, and whether it is one of the trusted signers
+	Signer = model.Signer
+
+	EncodeStats = model.EncodeStats
+	DecodeStats = model.DecodeStats
+)
+
+// Revealed Files revealed from an image, along with who signed them and how long revealing them took
+type Revealed struct {
+	Files  []RevealedFile
+	Signer *Signer
+	Stats  DecodeStats
+}
+
+// Hide hides the files in the carrier image, writing the resulting PNG image to out. By default the files are hidden
+// in the clear using 3 LSBs, see the With* functions for the other modes. Hiding stops as soon as the context is
+// done, returning its error, in which case out may hold an incomplete image
+func Hide(ctx context.Context, carrier io.Reader, out io.Writer, files []File, opts ...Option) (_ EncodeStats, err error) {
+	ctx, span := tracer().Start(ctx, "nsteg.Hide", trace.WithAttributes(attribute.Int("nsteg.files", len(files))))
+	defer func() { tracing.EndSpan(span, err) }()
+
+	o, err := newOptions(opts)
+	if err != nil {
+		return EncodeStats{}, err
+	}
+	span.SetAttributes(attribute.Int("nsteg.lsbs", int(o.encodeConfig.LSBsToUse)))
+
+	o.report(model.StageReading)
+	img, err := decodeCarrier(ctx, carrier, o.carrierPool)
+	if err != nil {
+		return EncodeStats{}, err
+	}
+	defer o.releaseCarrier(img)
+
+	var encoder *nstegImage.Encoder
+	if o.raw {
+		encoder, err = nstegImage.NewRawImageEncoder(img, o.encodeConfig, o.key)
+	} else {
+		encoder = encoderPool.Get().(*nstegImage.Encoder)
+		defer func() {
+			encoder.Release()
+			encoderPool.Put(encoder)
+		}()
+		err = encoder.Reset(img, o.encodeConfig)
+	}
+	if err != nil {
+		return EncodeStats{}, err
+	}
+
+	encodeOpts := nstegImage.EncodeOptions{Progress: o.progress}
+	switch {
+	case len(o.recipients) > 0:
+		err = encoder.EncodeFilesForRecipientsContext(ctx, files, o.recipients, encodeOpts)
+	case o.key != nil && !o.raw:
+		volumes := []model.Volume{{Key: o.key, Files: files}}
+		if o.decoy != nil {
+			volumes = append(volumes, *o.decoy)
+		}
+		err = encoder.EncodeVolumesContext(ctx, volumes, encodeOpts)
+	default:
+		err = encoder.EncodeFilesContext(ctx, files, encodeOpts)
+	}
+	if err != nil {
+		return encoder.Stats(), err
+	}
+
+	o.report(model.StageWriting)
+	err = encoder.WriteEncodedPNGContext(ctx, out)
+	return encoder.Stats(), err
+}
+
+// Reveal reveals the files hidden in the carrier image, with the same options the image was encoded with. If the
+// files fail signature verification, the returned Revealed holds no files but does hold the signer, if there was one,
+// so that callers can report who signed them
+func Reveal(ctx context.Context, carrier io.Reader, opts ...Option) (_ *Revealed, err error) {
+	ctx, span := tracer().Start(ctx, "nsteg.Reveal")
+	defer func() { tracing.EndSpan(span, err) }()
+
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	o.report(model.StageReading)
+	img, err := decodeCarrier(ctx, carrier, o.carrierPool)
+	if err != nil {
+		return nil, err
+	}
+	defer o.releaseCarrier(img)
+
+	o.report(model.StageSetup)
+	var decoder *nstegImage.Decoder
+	switch {
+	case len(o.identities) > 0:
+		decoder, err = nstegImage.NewRecipientImageDecoder(img, o.identities)
+	case o.raw:
+		decoder, err = nstegImage.NewRawImageDecoder(img, o.encodeConfig.LSBsToUse, o.key)
+	case o.key != nil:
+		decoder, err = nstegImage.NewKeyedImageDecoder(img, o.key)
+	default:
+		decoder, err = nstegImage.NewImageDecoder(img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	decoder.ChunkSizeMultiplier = o.encodeConfig.ChunkSizeMultiplier
+	decoder.TrustSigners(o.trustedSigners)
+
+	files, err := decoder.DecodeFilesContext(ctx, nstegImage.DecodeOptions{Progress: o.progress, Logger: o.logger})
+	if err != nil {
+		return &Revealed{Signer: decoder.Signer(), Stats: decoder.Stats()}, err
+	}
+	return &Revealed{Files: files, Signer: decoder.Signer(), Stats: decoder.Stats()}, nil
+}
+
+// DecodeCarrier decodes an image in any of the supported formats, converting it to RGBA if needed, since that is the
+// only type of image nsteg hides files in
+func DecodeCarrier(carrier io.Reader) (*image.RGBA, error) {
+	return decodeCarrier(context.Background(), carrier, nil)
+}
+
+// decodeCarrier decodes the carrier as DecodeCarrier does, converting it into an image from the pool if there is one.
+// Decoding and converting are traced as separate spans, since either of them can dominate depending on the format
+func decodeCarrier(ctx context.Context, carrier io.Reader, pool CarrierPool) (*image.RGBA, error) {
+	_, span := tracer().Start(ctx, "nsteg.decodeCarrier")
+	decodedImage, format, err := image.Decode(&contextReader{ctx: ctx, reader: carrier})
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		tracing.EndSpan(span, ctxErr)
+		return nil, ctxErr
+	} else if err != nil {
+		err = fmt.Errorf("%w: %w", ErrInvalidCarrier, err)
+		tracing.EndSpan(span, err)
+		return nil, err
+	}
+	bounds := decodedImage.Bounds()
+	span.SetAttributes(attribute.String("image.format", format), attribute.Int("image.width", bounds.Dx()), attribute.Int("image.height", bounds.Dy()))
+	span.End()
+	if rgbaImg, ok := decodedImage.(*image.RGBA); ok {
+		return rgbaImg, nil
+	}
+
+	_, span = tracer().Start(ctx, "nsteg.convertCarrier", trace.WithAttributes(
+		attribute.String("image.type", fmt.Sprintf("%T", decodedImage)),
+		attribute.Int("image.width", bounds.Dx()),
+		attribute.Int("image.height", bounds.Dy()),
+		attribute.Bool("nsteg.pooled", pool != nil),
+	))
+	defer span.End()
+
+	// TODO: Work with 16-bit images
+	var rgbaImg *image.RGBA
+	if pool != nil {
+		rgbaImg = pool.Get(decodedImage.Bounds())
+	} else {
+		rgbaImg = image.NewRGBA(decodedImage.Bounds())
+	}
+	draw.Draw(rgbaImg, rgbaImg.Bounds(), decodedImage, rgbaImg.Bounds().Min, draw.Src)
+	return rgbaImg, nil
+}
+
+// contextReader Reader failing with the error of the context once it is done, which stops decoding large carriers
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (r *contextReader) Read(b []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.reader.Read(b)
+}
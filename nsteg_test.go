@@ -0,0 +1,203 @@
+package nsteg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"image/jpeg"
+	"nsteg/pkg/seal"
+	"nsteg/pkg/signature"
+	"nsteg/test"
+	"testing"
+)
+
+const testCarrierSize = 300
+
+func TestHideReveal(t *testing.T) {
+	identity, err := seal.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Error generating identity: %s", err)
+	}
+	signerPublicKey, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating signing key: %s", err)
+	}
+
+	decoyContent := test.GenerateRandomBytes(512)
+	testCases := []struct {
+		name        string
+		hideOpts    []Option
+		revealOpts  []Option
+		wantContent []byte
+	}{
+		{name: "plain"},
+		{name: "lsbs", hideOpts: []Option{WithLSBs(6), WithQualityMetrics()}},
+		{name: "raw", hideOpts: []Option{WithRaw([]byte("raw key")), WithLSBs(2)}, revealOpts: []Option{WithRaw([]byte("raw key")), WithLSBs(2)}},
+		{
+			name:       "key",
+			hideOpts:   []Option{WithKey([]byte("key")), WithDecoy([]byte("decoy key"), []File{{Name: "decoy", Content: bytes.NewReader(decoyContent), Size: int64(len(decoyContent))}})},
+			revealOpts: []Option{WithKey([]byte("key"))},
+		},
+		{
+			name:        "decoy",
+			hideOpts:    []Option{WithKey([]byte("key")), WithDecoy([]byte("decoy key"), []File{{Name: "decoy", Content: bytes.NewReader(decoyContent), Size: int64(len(decoyContent))}})},
+			revealOpts:  []Option{WithKey([]byte("decoy key"))},
+			wantContent: decoyContent,
+		},
+		{
+			name:       "signed recipients",
+			hideOpts:   []Option{WithRecipients(identity.Recipient()), WithSigningKey(signingKey)},
+			revealOpts: []Option{WithIdentities(identity), WithTrustedSigners(signature.TrustedKey{Name: "sender", PublicKey: signerPublicKey})},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			content := test.GenerateRandomBytes(1024)
+			files := []File{{Name: "file", Content: bytes.NewReader(content), Size: int64(len(content))}}
+
+			// JPEG carriers decode into YCbCr images, which must be converted to RGBA before hiding files in them
+			carrier := bytes.NewBuffer(nil)
+			if err := jpeg.Encode(carrier, test.GenerateNaturalImage(testCarrierSize, testCarrierSize, 4), nil); err != nil {
+				t.Fatalf("Error encoding carrier: %s", err)
+			}
+
+			encoded := bytes.NewBuffer(nil)
+			if _, err := Hide(context.Background(), carrier, encoded, files, tc.hideOpts...); err != nil {
+				t.Fatalf("Error hiding files: %s", err)
+			}
+			revealed, err := Reveal(context.Background(), encoded, tc.revealOpts...)
+			if err != nil {
+				t.Fatalf("Error revealing files: %s", err)
+			}
+
+			wantContent := content
+			if tc.wantContent != nil {
+				wantContent = tc.wantContent
+			}
+			if len(revealed.Files) != 1 || !bytes.Equal(revealed.Files[0].Content, wantContent) {
+				t.Errorf("Revealed files do not match hidden files")
+			}
+		})
+	}
+}
+
+func TestRevealUntrustedSigner(t *testing.T) {
+	_, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating signing key: %s", err)
+	}
+	trustedPublicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating trusted key: %s", err)
+	}
+
+	carrier := bytes.NewBuffer(nil)
+	if err = jpeg.Encode(carrier, test.GenerateNaturalImage(testCarrierSize, testCarrierSize, 4), nil); err != nil {
+		t.Fatalf("Error encoding carrier: %s", err)
+	}
+	encoded := bytes.NewBuffer(nil)
+	if _, err = Hide(context.Background(), carrier, encoded, []File{{Name: "file", Content: bytes.NewReader([]byte("content")), Size: 7}}, WithSigningKey(signingKey)); err != nil {
+		t.Fatalf("Error hiding files: %s", err)
+	}
+
+	revealed, err := Reveal(context.Background(), encoded, WithTrustedSigners(signature.TrustedKey{PublicKey: trustedPublicKey}))
+	if !errors.Is(err, signature.ErrUntrustedSigner) {
+		t.Fatalf("Expected %s, got %v", signature.ErrUntrustedSigner, err)
+	}
+	if revealed == nil || revealed.Signer == nil || len(revealed.Files) > 0 {
+		t.Errorf("Expected the untrusted signer and no files to be revealed")
+	}
+}
+
+func TestHideInvalidOptions(t *testing.T) {
+	testCases := []struct {
+		name string
+		opts []Option
+		want error
+	}{
+		{name: "decoy without key", opts: []Option{WithDecoy([]byte("decoy key"), nil)}, want: ErrConflictingOptions},
+		{name: "raw with decoy", opts: []Option{WithRaw([]byte("key")), WithDecoy([]byte("decoy key"), nil)}, want: ErrConflictingOptions},
+		{name: "recipients with key", opts: []Option{WithKey([]byte("key")), WithRecipients(&seal.Recipient{})}, want: ErrConflictingOptions},
+		{name: "raw without key", opts: []Option{WithRaw(nil)}, want: ErrConflictingOptions},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Hide(context.Background(), bytes.NewReader(nil), bytes.NewBuffer(nil), nil, tc.opts...); !errors.Is(err, tc.want) {
+				t.Errorf("Expected %s, got %v", tc.want, err)
+			}
+		})
+	}
+
+	if _, err := Hide(context.Background(), bytes.NewReader([]byte("not an image")), bytes.NewBuffer(nil), nil); !errors.Is(err, ErrInvalidCarrier) {
+		t.Errorf("Expected %s, got %v", ErrInvalidCarrier, err)
+	}
+}
+
+func TestHideRevealSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+	carrier := bytes.NewBuffer(nil)
+	if err := jpeg.Encode(carrier, test.GenerateNaturalImage(testCarrierSize, testCarrierSize, 4), nil); err != nil {
+		t.Fatalf("Error encoding carrier: %s", err)
+	}
+	encoded := bytes.NewBuffer(nil)
+	if _, err := Hide(context.Background(), carrier, encoded, []File{{Name: "file", Content: bytes.NewReader([]byte("content")), Size: 7}}, WithLSBs(2)); err != nil {
+		t.Fatalf("Error hiding files: %s", err)
+	}
+	if _, err := Reveal(context.Background(), encoded); err != nil {
+		t.Fatalf("Error revealing files: %s", err)
+	}
+	if _, err := Reveal(context.Background(), bytes.NewReader([]byte("not an image"))); !errors.Is(err, ErrInvalidCarrier) {
+		t.Fatalf("Expected %s, got %v", ErrInvalidCarrier, err)
+	}
+
+	spanAttributes := make(map[string]map[attribute.Key]attribute.Value)
+	var failedReveals int
+	for _, span := range recorder.Ended() {
+		attributes := make(map[attribute.Key]attribute.Value)
+		for _, attr := range span.Attributes() {
+			attributes[attr.Key] = attr.Value
+		}
+		if _, found := spanAttributes[span.Name()]; !found {
+			spanAttributes[span.Name()] = attributes
+		}
+		if span.Name() == "nsteg.Reveal" && span.Status().Code == codes.Error {
+			failedReveals++
+		}
+	}
+
+	for name, expected := range map[string]map[attribute.Key]attribute.Value{
+		"nsteg.Hide":                         {"nsteg.lsbs": attribute.IntValue(2), "nsteg.files": attribute.IntValue(1)},
+		"nsteg.decodeCarrier":                {"image.format": attribute.StringValue("jpeg"), "image.width": attribute.IntValue(testCarrierSize)},
+		"nsteg.convertCarrier":               {"image.type": attribute.StringValue("*image.YCbCr")},
+		"image.Encoder.setupDataReader":      {"nsteg.lsbs": attribute.IntValue(2)},
+		"image.Encoder.encodeDataToRawImage": {"nsteg.lsbs": attribute.IntValue(2)},
+		"image.Encoder.encodeRawImage":       {"image.height": attribute.IntValue(testCarrierSize)},
+		"image.Decoder.DecodeFiles":          {"nsteg.lsbs": attribute.IntValue(2), "nsteg.sealed": attribute.BoolValue(false)},
+	} {
+		attributes, found := spanAttributes[name]
+		if !found {
+			t.Errorf("Expected a %s span", name)
+			continue
+		}
+		for key, value := range expected {
+			if attributes[key] != value {
+				t.Errorf("Expected %s of span %s to be %s, got %s", key, name, value.Emit(), attributes[key].Emit())
+			}
+		}
+	}
+	if failedReveals != 1 {
+		t.Errorf("Expected the reveal of an invalid carrier to be traced as an error")
+	}
+}
@@ -0,0 +1,195 @@
+package nsteg
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"image"
+	"image/png"
+	"log/slog"
+	"nsteg/pkg/config"
+	"nsteg/pkg/model"
+	"nsteg/pkg/seal"
+	"nsteg/pkg/signature"
+)
+
+const (
+	defaultLSBsToUse = 3
+)
+
+// Option Configures Hide and Reveal. Options that only apply to one of them are ignored by the other
+type Option func(*options)
+
+type options struct {
+	encodeConfig config.ImageEncodeConfig
+	progress     model.ProgressFunc
+
+	// key Key of the hidden volume, or of the keystream in raw mode
+	key   []byte
+	raw   bool
+	decoy *model.Volume
+
+	recipients     []*seal.Recipient
+	identities     []*seal.Identity
+	trustedSigners []signature.TrustedKey
+
+	carrierPool CarrierPool
+	logger      *slog.Logger
+}
+
+func newOptions(opts []Option) (*options, error) {
+	o := &options{encodeConfig: config.ImageEncodeConfig{LSBsToUse: defaultLSBsToUse}}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if o.encodeConfig.Logger == nil {
+		o.encodeConfig.Logger = o.logger
+	}
+
+	keyed := o.key != nil
+	if o.raw && !keyed {
+		return nil, fmt.Errorf("%w: raw mode requires a key", ErrConflictingOptions)
+	} else if o.raw && o.decoy != nil {
+		return nil, fmt.Errorf("%w: raw mode does not support decoy files", ErrConflictingOptions)
+	} else if o.decoy != nil && !keyed {
+		return nil, fmt.Errorf("%w: decoy files can only be hidden along with files hidden under a key", ErrConflictingOptions)
+	} else if (len(o.recipients) > 0 || len(o.identities) > 0) && keyed {
+		return nil, fmt.Errorf("%w: files hidden for recipients cannot also be hidden under a key", ErrConflictingOptions)
+	}
+	return o, nil
+}
+
+// report reports the start of a stage that Hide or Reveal go through on top of those reported by the encoders and
+// decoders
+func (o *options) report(stage model.Stage) {
+	if o.progress != nil {
+		o.progress(model.Progress{Stage: stage})
+	}
+}
+
+// releaseCarrier hands the carrier back to the carrier pool, if there is one, once Hide or Reveal are done with it.
+// Carriers that were already RGBA when decoded are handed back too, since they are just as reusable
+func (o *options) releaseCarrier(img *image.RGBA) {
+	if o.carrierPool != nil {
+		o.carrierPool.Put(img)
+	}
+}
+
+// WithLSBs sets the least significant bits of each sub pixel to hide the files in, from 1 to 8. Reveal only needs it in
+// raw mode, since otherwise it is stored in the image
+func WithLSBs(LSBsToUse byte) Option {
+	return func(o *options) {
+		o.encodeConfig.LSBsToUse = LSBsToUse
+	}
+}
+
+// WithChunkSizeMultiplier sets the size of the chunks embedded or extracted by a single goroutine, in multiples of the
+// smallest chunk. It only affects how the work is split, so images can be revealed with a different setting than they
+// were hidden with
+func WithChunkSizeMultiplier(chunkSizeMultiplier int) Option {
+	return func(o *options) {
+		o.encodeConfig.ChunkSizeMultiplier = chunkSizeMultiplier
+	}
+}
+
+// WithEncodeConfig replaces the whole encoding configuration, for callers that need to tune it beyond what the other
+// options allow
+func WithEncodeConfig(encodeConfig config.ImageEncodeConfig) Option {
+	return func(o *options) {
+		o.encodeConfig = encodeConfig
+	}
+}
+
+// WithPNGCompression sets the compression of the PNG image written by Hide
+func WithPNGCompression(level png.CompressionLevel) Option {
+	return func(o *options) {
+		o.encodeConfig.PngCompressionLevel = level
+	}
+}
+
+// WithQualityMetrics makes Hide measure the visual damage done to the image, returned in EncodeStats.Quality, which
+// requires keeping a copy of the original image in memory
+func WithQualityMetrics() Option {
+	return func(o *options) {
+		o.encodeConfig.ComputeQualityMetrics = true
+	}
+}
+
+// WithSigningKey makes Hide sign the files, so that Reveal can tell who hid them
+func WithSigningKey(key ed25519.PrivateKey) Option {
+	return func(o *options) {
+		o.encodeConfig.SigningKey = key
+	}
+}
+
+// WithTrustedSigners makes Reveal fail unless the files were signed by one of the keys. Without trusted signers any
+// valid signature is accepted, while invalid signatures are always rejected
+func WithTrustedSigners(trustedSigners ...signature.TrustedKey) Option {
+	return func(o *options) {
+		o.trustedSigners = append(o.trustedSigners, trustedSigners...)
+	}
+}
+
+// WithKey hides the files in a hidden volume encrypted under the key, which cannot be told apart from noise without
+// it, or reveals the files of the hidden volume opened by the key
+func WithKey(key []byte) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// WithDecoy hides the decoy files in a second hidden volume under their own key, which can be revealed under coercion
+// without giving away the files hidden under WithKey. Only used by Hide, Reveal opens the decoy volume through WithKey
+func WithDecoy(key []byte, files []File) Option {
+	return func(o *options) {
+		o.decoy = &model.Volume{Key: key, Files: files}
+	}
+}
+
+// WithRaw stores nothing in the clear, masking the files with the key instead of encrypting them into a hidden volume.
+// Revealing them requires the same key and LSBs setting, which are not stored in the image
+func WithRaw(key []byte) Option {
+	return func(o *options) {
+		o.key = key
+		o.raw = true
+	}
+}
+
+// WithRecipients makes Hide encrypt the files for the recipients, so that they can only be revealed with the identity
+// of one of them
+func WithRecipients(recipients ...*seal.Recipient) Option {
+	return func(o *options) {
+		o.recipients = append(o.recipients, recipients...)
+	}
+}
+
+// WithIdentities makes Reveal decrypt files hidden for recipients with whichever of the identities they were hidden for
+func WithIdentities(identities ...*seal.Identity) Option {
+	return func(o *options) {
+		o.identities = append(o.identities, identities...)
+	}
+}
+
+// WithCarrierPool converts carriers that are not RGBA into images taken from the pool, and hands every carrier back to
+// it once done with it, which saves allocating a full size image per call when hiding in or revealing from many
+// carriers
+func WithCarrierPool(pool CarrierPool) Option {
+	return func(o *options) {
+		o.carrierPool = pool
+	}
+}
+
+// WithProgress reports the progress of Hide and Reveal to the function, which is called from the goroutine running
+// them, so it should not block
+func WithProgress(progress model.ProgressFunc) Option {
+	return func(o *options) {
+		o.progress = progress
+	}
+}
+
+// WithLogger logs the diagnostics of the encoders and decoders used by Hide and Reveal to the logger, at debug level
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
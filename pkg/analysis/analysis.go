@@ -0,0 +1,93 @@
+package analysis
+
+import (
+	"image"
+)
+
+const (
+	// CleanRateThreshold Estimated embedding rates below this value are within what natural images produce
+	CleanRateThreshold = 0.02
+	// DetectedRateThreshold Estimated embedding rates above this value are considered a certain detection
+	DetectedRateThreshold = 0.2
+)
+
+var (
+	channelNames = [3]string{"red", "green", "blue"}
+)
+
+// ChannelReport holds the results of every steganalysis method for a single colour channel
+type ChannelReport struct {
+	Channel string `json:"channel"`
+
+	// ChiSquareProbability Probability, according to the chi-square attack, that data was embedded starting from the
+	// first pixel of the channel
+	ChiSquareProbability float64 `json:"chi_square_probability"`
+	// ChiSquareRate Fraction of the channel, starting from the first pixel, that the chi-square attack flags
+	ChiSquareRate float64 `json:"chi_square_rate"`
+	// RSRate Embedding rate estimated by RS (regular/singular groups) analysis
+	RSRate float64 `json:"rs_rate"`
+	// SPARate Embedding rate estimated by sample pair analysis
+	SPARate float64 `json:"spa_rate"`
+}
+
+// EstimatedRate Embedding rate for the channel. RS and sample pair analysis measure it directly, but become unreliable
+// when nearly every LSB carries data, or when several LSBs of each pixel are replaced, cases which the chi-square
+// attack detects reliably for data embedded sequentially
+func (c ChannelReport) EstimatedRate() float64 {
+	rate := (c.RSRate + c.SPARate) / 2
+	if c.ChiSquareProbability > 0.5 {
+		rate = max(rate, c.ChiSquareRate)
+	}
+	return rate
+}
+
+// Report holds the steganalysis results for an image. Rates are expressed as the fraction of LSBs of the opaque
+// pixels that carry data, from 0 to 1
+type Report struct {
+	Channels      [3]ChannelReport `json:"channels"`
+	EmbeddingRate float64          `json:"embedding_rate"`
+	// Suspicion Score from 0 (looks clean) to 1 (almost certainly carrying hidden data)
+	Suspicion float64 `json:"suspicion"`
+}
+
+// Analyze runs the chi-square attack, RS analysis and sample pair analysis on each colour channel of the supplied
+// image. Only opaque pixels are analyzed, since those are the only ones nsteg encodes data into
+func Analyze(img *image.RGBA) Report {
+	var report Report
+	for channel := 0; channel < len(report.Channels); channel++ {
+		samples := channelSamples(img, channel)
+		chiSquareProbability, chiSquareRate := ChiSquare(samples)
+		channelReport := ChannelReport{
+			Channel:              channelNames[channel],
+			ChiSquareProbability: chiSquareProbability,
+			ChiSquareRate:        chiSquareRate,
+			RSRate:               RS(samples),
+			SPARate:              SamplePairs(samples),
+		}
+		report.Channels[channel] = channelReport
+
+		report.EmbeddingRate += channelReport.EstimatedRate() / float64(len(report.Channels))
+		report.Suspicion = max(report.Suspicion, suspicion(channelReport))
+	}
+	return report
+}
+
+func suspicion(c ChannelReport) float64 {
+	rateScore := (c.EstimatedRate() - CleanRateThreshold) / (DetectedRateThreshold - CleanRateThreshold)
+	return clamp(max(rateScore, c.ChiSquareProbability), 0, 1)
+}
+
+// channelSamples returns the values of the supplied channel for every opaque pixel, in the order nsteg encodes them
+func channelSamples(img *image.RGBA, channel int) []byte {
+	samples := make([]byte, 0, len(img.Pix)/4)
+	for p := 0; p < len(img.Pix); p += 4 {
+		if img.Pix[p+3] == 255 {
+			samples = append(samples, img.Pix[p+channel])
+		}
+	}
+	return samples
+}
+
+func clamp(v, lower, upper float64) float64 {
+	return min(max(v, lower), upper)
+}
@@ -0,0 +1,79 @@
+package analysis_test
+
+import (
+	"bytes"
+	"image"
+	"math"
+	"nsteg/pkg/analysis"
+	"nsteg/pkg/config"
+	nstegImage "nsteg/pkg/image"
+	"nsteg/test"
+	"testing"
+)
+
+const analysisTestImageSize = 512
+
+func TestAnalyzeCleanImage(t *testing.T) {
+	report := analysis.Analyze(test.GenerateNaturalImage(analysisTestImageSize, analysisTestImageSize, 2))
+	if report.EmbeddingRate > analysis.CleanRateThreshold {
+		t.Errorf("Expected estimated embedding rate of clean image to be below %f, was %f",
+			analysis.CleanRateThreshold, report.EmbeddingRate)
+	}
+	if report.Suspicion > 0.5 {
+		t.Errorf("Expected clean image not to be suspicious, suspicion was %f", report.Suspicion)
+	}
+}
+
+func TestAnalyzeEncodedImages(t *testing.T) {
+	for LSBsToUse := byte(1); LSBsToUse <= 8; LSBsToUse++ {
+		for _, fill := range []float64{0.1, 0.5} {
+			img := test.GenerateNaturalImage(analysisTestImageSize, analysisTestImageSize, 2)
+			encodeRandomData(t, img, LSBsToUse, fill)
+
+			report := analysis.Analyze(img)
+			if math.Abs(report.EmbeddingRate-fill) > 0.1 {
+				t.Errorf("Expected estimated embedding rate with %d LSBs to be close to %f, was %f", LSBsToUse, fill,
+					report.EmbeddingRate)
+			}
+			if report.Suspicion < 0.9 {
+				t.Errorf("Expected image encoded with %d LSBs to be suspicious, suspicion was %f", LSBsToUse,
+					report.Suspicion)
+			}
+		}
+	}
+}
+
+func TestAnalyzeComparesLSBsSettings(t *testing.T) {
+	payloadSize := analysisTestImageSize * analysisTestImageSize * 3 / 8 / 4
+
+	var previousRate float64
+	for _, LSBsToUse := range []byte{4, 2, 1} {
+		img := test.GenerateNaturalImage(analysisTestImageSize, analysisTestImageSize, 2)
+		encoder, err := nstegImage.NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: LSBsToUse})
+		if err != nil {
+			t.Fatalf("Error creating image encoder: %s", err)
+		}
+		if err = encoder.Encode(bytes.NewReader(test.GenerateRandomBytes(payloadSize))); err != nil {
+			t.Fatalf("Error encoding data: %s", err)
+		}
+
+		// The same payload spread over fewer LSBs touches more pixels, which makes it easier to detect
+		report := analysis.Analyze(img)
+		if report.EmbeddingRate <= previousRate {
+			t.Errorf("Expected estimated embedding rate with %d LSBs to be above %f, was %f", LSBsToUse,
+				previousRate, report.EmbeddingRate)
+		}
+		previousRate = report.EmbeddingRate
+	}
+}
+
+func encodeRandomData(t *testing.T, img *image.RGBA, LSBsToUse byte, fill float64) {
+	encoder, err := nstegImage.NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: LSBsToUse})
+	if err != nil {
+		t.Fatalf("Error creating image encoder: %s", err)
+	}
+	availableBytes := (len(img.Pix)/4 - 1) * int(LSBsToUse) * 3 / 8
+	if err = encoder.Encode(bytes.NewReader(test.GenerateRandomBytes(int(float64(availableBytes) * fill)))); err != nil {
+		t.Fatalf("Error encoding data: %s", err)
+	}
+}
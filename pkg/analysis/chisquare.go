@@ -0,0 +1,114 @@
+package analysis
+
+import "math"
+
+const (
+	// chiSquareSteps Number of increasingly larger prefixes of the samples the chi-square attack is run on
+	chiSquareSteps = 100
+	// minChiSquareSamples Smallest prefix the chi-square attack is run on, since smaller ones yield unreliable results
+	minChiSquareSamples = 1000
+	// minExpectedFrequency Pairs of values expected less often than this are skipped, since they would skew the test
+	minExpectedFrequency = 5
+)
+
+// ChiSquare runs the chi-square attack described by Westfeld and Pfitzmann. Embedding data into the LSBs of the
+// samples equalizes the frequencies of each pair of values that only differ in their LSB (2k, 2k+1), which the attack
+// measures. Since nsteg embeds data sequentially from the first pixel, the attack is run on increasingly larger
+// prefixes of the samples, returning the probability of embedding for the first prefix, and the fraction of the
+// samples up to which the probability of embedding stays above 0.5
+func ChiSquare(samples []byte) (probability, rate float64) {
+	if len(samples) == 0 {
+		return 0, 0
+	}
+
+	stepSize := max(len(samples)/chiSquareSteps, min(minChiSquareSamples, len(samples)))
+	var histogram [256]int
+	var analyzedSamples int
+	for prefixEnd := stepSize; analyzedSamples < len(samples); prefixEnd += stepSize {
+		for _, sample := range samples[analyzedSamples:min(prefixEnd, len(samples))] {
+			histogram[sample]++
+		}
+		analyzedSamples = min(prefixEnd, len(samples))
+
+		prefixProbability := chiSquareProbability(histogram)
+		if analyzedSamples <= stepSize {
+			probability = prefixProbability
+		}
+		if prefixProbability <= 0.5 {
+			break
+		}
+		rate = float64(analyzedSamples) / float64(len(samples))
+	}
+	return probability, rate
+}
+
+// chiSquareProbability returns the probability that the pairs of values in the histogram have equal frequencies
+func chiSquareProbability(histogram [256]int) float64 {
+	var chiSquare float64
+	var categories int
+	for k := 0; k < len(histogram); k += 2 {
+		expected := float64(histogram[k]+histogram[k+1]) / 2
+		if expected < minExpectedFrequency {
+			continue
+		}
+		observed := float64(histogram[k])
+		chiSquare += (observed - expected) * (observed - expected) / expected
+		categories++
+	}
+
+	degreesOfFreedom := categories - 1
+	if degreesOfFreedom < 1 {
+		return 0
+	}
+	return upperRegularizedGamma(float64(degreesOfFreedom)/2, chiSquare/2)
+}
+
+// upperRegularizedGamma computes Q(a, x) = 1 - P(a, x), using the series expansion of P(a, x) for x < a+1, and the
+// continued fraction expansion of Q(a, x) otherwise
+func upperRegularizedGamma(a, x float64) float64 {
+	if x <= 0 {
+		return 1
+	}
+
+	lgammaA, _ := math.Lgamma(a)
+	prefactor := math.Exp(-x + a*math.Log(x) - lgammaA)
+
+	if x < a+1 {
+		term := 1 / a
+		sum := term
+		for n := 1; n < 1000; n++ {
+			term *= x / (a + float64(n))
+			sum += term
+			if math.Abs(term) < math.Abs(sum)*1e-15 {
+				break
+			}
+		}
+		return clamp(1-sum*prefactor, 0, 1)
+	}
+
+	// Modified Lentz's method
+	const tiny = 1e-300
+	b := x + 1 - a
+	c := 1 / tiny
+	d := 1 / b
+	h := d
+	for n := 1; n < 1000; n++ {
+		an := -float64(n) * (float64(n) - a)
+		b += 2
+		d = an*d + b
+		if math.Abs(d) < tiny {
+			d = tiny
+		}
+		c = b + an/c
+		if math.Abs(c) < tiny {
+			c = tiny
+		}
+		d = 1 / d
+		delta := d * c
+		h *= delta
+		if math.Abs(delta-1) < 1e-15 {
+			break
+		}
+	}
+	return clamp(prefactor*h, 0, 1)
+}
@@ -0,0 +1,18 @@
+package analysis
+
+import (
+	"math"
+	"testing"
+)
+
+func TestUpperRegularizedGamma(t *testing.T) {
+	for _, x := range []float64{0.1, 0.5, 1, 2, 5, 20} {
+		// Q(1, x) = e^-x and Q(0.5, x) = erfc(sqrt(x))
+		if q := upperRegularizedGamma(1, x); math.Abs(q-math.Exp(-x)) > 1e-9 {
+			t.Errorf("Expected Q(1, %f) to be %f, was %f", x, math.Exp(-x), q)
+		}
+		if q := upperRegularizedGamma(0.5, x); math.Abs(q-math.Erfc(math.Sqrt(x))) > 1e-9 {
+			t.Errorf("Expected Q(0.5, %f) to be %f, was %f", x, math.Erfc(math.Sqrt(x)), q)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package analysis
+
+import (
+	"image"
+	"math"
+)
+
+// NoiseLevel estimates the standard deviation of the noise in the luminance of the image, using the method described
+// by Immerkær. Noisy and highly textured images hide the changes done to their LSBs better than smooth ones
+func NoiseLevel(img *image.RGBA) float64 {
+	width, height := img.Bounds().Dx(), img.Bounds().Dy()
+	if width < 3 || height < 3 {
+		return 0
+	}
+
+	luminance := make([]float64, width*height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := y*img.Stride + x*4
+			luminance[y*width+x] = 0.299*float64(img.Pix[p]) + 0.587*float64(img.Pix[p+1]) + 0.114*float64(img.Pix[p+2])
+		}
+	}
+
+	// Convolve with a mask that cancels out the structure of the image (edges and gradients), leaving only its noise
+	//	 1 -2  1
+	//	-2  4 -2
+	//	 1 -2  1
+	var sum float64
+	for y := 1; y < height-1; y++ {
+		for x := 1; x < width-1; x++ {
+			l := func(dx, dy int) float64 { return luminance[(y+dy)*width+x+dx] }
+			sum += math.Abs(l(-1, -1) - 2*l(0, -1) + l(1, -1) -
+				2*l(-1, 0) + 4*l(0, 0) - 2*l(1, 0) +
+				l(-1, 1) - 2*l(0, 1) + l(1, 1))
+		}
+	}
+
+	return sum * math.Sqrt(math.Pi/2) / (6 * float64(width-2) * float64(height-2))
+}
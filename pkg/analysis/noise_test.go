@@ -0,0 +1,21 @@
+package analysis
+
+import "testing"
+
+func TestNoiseLevel(t *testing.T) {
+	if noise := NoiseLevel(generateGradientImage(64, 64)); noise > 0.5 {
+		t.Errorf("Expected noise level of a smooth gradient to be close to 0, was %f", noise)
+	}
+
+	noisyImage := generateGradientImage(64, 64)
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			if (x+y)%2 == 0 {
+				noisyImage.Pix[noisyImage.PixOffset(x, y)] += 10
+			}
+		}
+	}
+	if noise := NoiseLevel(noisyImage); noise < 1 {
+		t.Errorf("Expected noise level of a noisy image to be above 1, was %f", noise)
+	}
+}
@@ -0,0 +1,123 @@
+package analysis
+
+import (
+	"errors"
+	"image"
+	"math"
+	"nsteg/pkg/model"
+)
+
+const (
+	// MaxPSNR PSNR reported for identical images, for which it would otherwise be infinite and impossible to serialize
+	MaxPSNR = 100
+
+	// ssimWindowSize Size of the side of the square windows SSIM is computed on, and ssimWindowStride the distance
+	// between consecutive windows
+	ssimWindowSize   = 8
+	ssimWindowStride = 4
+)
+
+var (
+	ErrDifferentBounds = errors.New("images to compare must have the same bounds")
+
+	// Stabilization constants from the original SSIM paper, for 8 bit samples
+	ssimC1 = math.Pow(0.01*255, 2)
+	ssimC2 = math.Pow(0.03*255, 2)
+)
+
+// Compare measures the visual damage done to the original image by hiding data in it, computing the MSE, PSNR and
+// SSIM of the colour channels of both images. Alpha channels are ignored, since nsteg never modifies them
+func Compare(original, modified *image.RGBA) (model.ImageQuality, error) {
+	if original.Bounds() != modified.Bounds() {
+		return model.ImageQuality{}, ErrDifferentBounds
+	}
+
+	var squaredError float64
+	var samples int
+	for p := 0; p < len(original.Pix); p += 4 {
+		for c := 0; c < 3; c++ {
+			diff := float64(original.Pix[p+c]) - float64(modified.Pix[p+c])
+			squaredError += diff * diff
+		}
+		samples += 3
+	}
+
+	quality := model.ImageQuality{PSNR: MaxPSNR, SSIM: ssim(original, modified)}
+	if samples > 0 {
+		quality.MSE = squaredError / float64(samples)
+	}
+	if quality.MSE > 0 {
+		quality.PSNR = min(10*math.Log10(255*255/quality.MSE), MaxPSNR)
+	}
+	return quality, nil
+}
+
+// DifferenceHeatmap generates an image showing where the supplied images differ, with the largest channel difference
+// of each pixel multiplied by amplification, so that changes to the LSBs become visible. Unchanged pixels are black,
+// and increasingly large differences go from red to yellow to white
+func DifferenceHeatmap(original, modified *image.RGBA, amplification int) (*image.RGBA, error) {
+	if original.Bounds() != modified.Bounds() {
+		return nil, ErrDifferentBounds
+	}
+
+	heatmap := image.NewRGBA(original.Bounds())
+	for p := 0; p < len(original.Pix); p += 4 {
+		var maxDiff int
+		for c := 0; c < 3; c++ {
+			maxDiff = max(maxDiff, abs(int(original.Pix[p+c])-int(modified.Pix[p+c])))
+		}
+
+		heat := min(maxDiff*amplification, 3*255)
+		heatmap.Pix[p] = uint8(min(heat, 255))
+		heatmap.Pix[p+1] = uint8(min(max(heat-255, 0), 255))
+		heatmap.Pix[p+2] = uint8(max(heat-2*255, 0))
+		heatmap.Pix[p+3] = 255
+	}
+	return heatmap, nil
+}
+
+// ssim computes the mean structural similarity of the colour channels of both images, over windows of
+// ssimWindowSize pixels overlapping by ssimWindowStride pixels. Images smaller than a window are compared as a whole
+func ssim(original, modified *image.RGBA) float64 {
+	width, height := original.Bounds().Dx(), original.Bounds().Dy()
+	windowWidth, windowHeight := min(ssimWindowSize, width), min(ssimWindowSize, height)
+	if windowWidth == 0 || windowHeight == 0 {
+		return 1
+	}
+
+	var ssimSum float64
+	var windows int
+	for y := 0; y+windowHeight <= height; y += ssimWindowStride {
+		for x := 0; x+windowWidth <= width; x += ssimWindowStride {
+			for c := 0; c < 3; c++ {
+				ssimSum += windowSSIM(original, modified, x, y, windowWidth, windowHeight, c)
+				windows++
+			}
+		}
+	}
+	return ssimSum / float64(windows)
+}
+
+func windowSSIM(original, modified *image.RGBA, x0, y0, width, height, channel int) float64 {
+	var sumA, sumB, sumAA, sumBB, sumAB float64
+	for y := y0; y < y0+height; y++ {
+		for x := x0; x < x0+width; x++ {
+			a := float64(original.Pix[y*original.Stride+x*4+channel])
+			b := float64(modified.Pix[y*modified.Stride+x*4+channel])
+			sumA += a
+			sumB += b
+			sumAA += a * a
+			sumBB += b * b
+			sumAB += a * b
+		}
+	}
+
+	n := float64(width * height)
+	meanA, meanB := sumA/n, sumB/n
+	varianceA := sumAA/n - meanA*meanA
+	varianceB := sumBB/n - meanB*meanB
+	covariance := sumAB/n - meanA*meanB
+
+	return ((2*meanA*meanB + ssimC1) * (2*covariance + ssimC2)) /
+		((meanA*meanA + meanB*meanB + ssimC1) * (varianceA + varianceB + ssimC2))
+}
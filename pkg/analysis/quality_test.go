@@ -0,0 +1,88 @@
+package analysis
+
+import (
+	"errors"
+	"image"
+	"math"
+	"testing"
+)
+
+func TestCompareIdenticalImages(t *testing.T) {
+	img := generateGradientImage(64, 64)
+
+	quality, err := Compare(img, img)
+	if err != nil {
+		t.Fatalf("Error comparing images: %s", err)
+	}
+	if quality.MSE != 0 || quality.PSNR != MaxPSNR || math.Abs(quality.SSIM-1) > 1e-9 {
+		t.Errorf("Expected identical images to have MSE|PSNR|SSIM of 0|%d|1, got %f|%f|%f", MaxPSNR, quality.MSE,
+			quality.PSNR, quality.SSIM)
+	}
+}
+
+func TestCompareModifiedImage(t *testing.T) {
+	original := generateGradientImage(64, 64)
+	modified := image.NewRGBA(original.Bounds())
+	copy(modified.Pix, original.Pix)
+	for p := 0; p < len(modified.Pix); p += 4 {
+		modified.Pix[p] ^= 1
+	}
+
+	quality, err := Compare(original, modified)
+	if err != nil {
+		t.Fatalf("Error comparing images: %s", err)
+	}
+	// One of every three channels differs by exactly one
+	expectedMSE := 1.0 / 3
+	if math.Abs(quality.MSE-expectedMSE) > 1e-9 {
+		t.Errorf("Expected MSE to be %f, was %f", expectedMSE, quality.MSE)
+	}
+	if expectedPSNR := 10 * math.Log10(255*255/expectedMSE); math.Abs(quality.PSNR-expectedPSNR) > 1e-9 {
+		t.Errorf("Expected PSNR to be %f, was %f", expectedPSNR, quality.PSNR)
+	}
+	if quality.SSIM >= 1 || quality.SSIM < 0.9 {
+		t.Errorf("Expected SSIM to be slightly below 1, was %f", quality.SSIM)
+	}
+}
+
+func TestCompareDifferentBounds(t *testing.T) {
+	_, err := Compare(generateGradientImage(64, 64), generateGradientImage(32, 64))
+	if !errors.Is(err, ErrDifferentBounds) {
+		t.Errorf("Expected %s, got %v", ErrDifferentBounds, err)
+	}
+}
+
+func TestDifferenceHeatmap(t *testing.T) {
+	original := generateGradientImage(64, 64)
+	modified := image.NewRGBA(original.Bounds())
+	copy(modified.Pix, original.Pix)
+	modified.Pix[modified.PixOffset(10, 10)+1] ^= 1
+
+	heatmap, err := DifferenceHeatmap(original, modified, 64)
+	if err != nil {
+		t.Fatalf("Error generating heatmap: %s", err)
+	}
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			p := heatmap.PixOffset(x, y)
+			if x == 10 && y == 10 {
+				if heatmap.Pix[p] != 64 {
+					t.Errorf("Expected modified pixel to have a heat of 64, was %d", heatmap.Pix[p])
+				}
+			} else if heatmap.Pix[p] != 0 || heatmap.Pix[p+1] != 0 || heatmap.Pix[p+2] != 0 {
+				t.Errorf("Expected unmodified pixel %d,%d to be black", x, y)
+			}
+		}
+	}
+}
+
+func generateGradientImage(width, height int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := img.PixOffset(x, y)
+			img.Pix[p], img.Pix[p+1], img.Pix[p+2], img.Pix[p+3] = uint8(x*2), uint8(y*2), uint8(x+y), 255
+		}
+	}
+	return img
+}
@@ -0,0 +1,125 @@
+package analysis
+
+import "math"
+
+var (
+	// rsMask Mask applied to each group of samples during RS analysis, 1 meaning the flipping function is applied
+	rsMask = [4]int{0, 1, 1, 0}
+)
+
+// rsCounts Number of regular and singular groups found with the mask and the negated mask
+type rsCounts struct {
+	regular, singular, negRegular, negSingular float64
+}
+
+// RS runs RS (regular/singular groups) analysis as described by Fridrich, Goljan and Du, estimating the fraction of
+// samples whose LSBs carry data. Samples are split into groups, each classified as regular or singular depending on
+// whether flipping LSBs increases or decreases its noise. In clean images flipping LSBs and flipping them with an
+// offset affect groups equally, while LSB embedding makes them diverge proportionally to the embedding rate
+func RS(samples []byte) float64 {
+	if len(samples) < len(rsMask) {
+		return 0
+	}
+
+	flippedSamples := make([]byte, len(samples))
+	for i, sample := range samples {
+		flippedSamples[i] = sample ^ 1
+	}
+
+	counts := countRSGroups(samples)
+	flippedCounts := countRSGroups(flippedSamples)
+
+	d0 := counts.regular - counts.singular
+	d1 := flippedCounts.regular - flippedCounts.singular
+	negD0 := counts.negRegular - counts.negSingular
+	negD1 := flippedCounts.negRegular - flippedCounts.negSingular
+
+	a := 2 * (d1 + d0)
+	b := negD0 - negD1 - d1 - 3*d0
+	c := d0 - negD0
+
+	var x float64
+	if a == 0 {
+		if b == 0 {
+			return 0
+		}
+		x = -c / b
+	} else {
+		discriminant := b*b - 4*a*c
+		if discriminant < 0 {
+			return 0
+		}
+		x1 := (-b + math.Sqrt(discriminant)) / (2 * a)
+		x2 := (-b - math.Sqrt(discriminant)) / (2 * a)
+		x = x1
+		if math.Abs(x2) < math.Abs(x1) {
+			x = x2
+		}
+	}
+
+	if x == 0.5 {
+		return 1
+	}
+	return clamp(x/(x-0.5), 0, 1)
+}
+
+func countRSGroups(samples []byte) rsCounts {
+	var counts rsCounts
+	var groups float64
+	var group, flipped, negFlipped [4]int
+	for g := 0; g+len(rsMask) <= len(samples); g += len(rsMask) {
+		for i := range group {
+			group[i] = int(samples[g+i])
+			flipped[i], negFlipped[i] = group[i], group[i]
+			if rsMask[i] == 1 {
+				flipped[i] = flip(group[i])
+				negFlipped[i] = negativeFlip(group[i])
+			}
+		}
+
+		noise := groupNoise(group)
+		if flippedNoise := groupNoise(flipped); flippedNoise > noise {
+			counts.regular++
+		} else if flippedNoise < noise {
+			counts.singular++
+		}
+		if negFlippedNoise := groupNoise(negFlipped); negFlippedNoise > noise {
+			counts.negRegular++
+		} else if negFlippedNoise < noise {
+			counts.negSingular++
+		}
+		groups++
+	}
+
+	counts.regular /= groups
+	counts.singular /= groups
+	counts.negRegular /= groups
+	counts.negSingular /= groups
+	return counts
+}
+
+// flip swaps values that only differ in their LSB (0 <-> 1, 2 <-> 3, ...)
+func flip(v int) int {
+	return v ^ 1
+}
+
+// negativeFlip swaps values shifted by one (-1 <-> 0, 1 <-> 2, ...)
+func negativeFlip(v int) int {
+	return flip(v+1) - 1
+}
+
+// groupNoise Discrimination function measuring the smoothness of a group, lower values meaning smoother groups
+func groupNoise(group [4]int) int {
+	var noise int
+	for i := 1; i < len(group); i++ {
+		noise += abs(group[i] - group[i-1])
+	}
+	return noise
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
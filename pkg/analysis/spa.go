@@ -0,0 +1,44 @@
+package analysis
+
+import "math"
+
+// SamplePairs runs sample pair analysis as described by Dumitrescu, Wu and Wang, estimating the fraction of samples
+// whose LSBs carry data from the statistics of pairs of adjacent samples. LSB embedding moves pairs between sets that
+// are balanced in natural images, and the amount by which they become unbalanced reveals the embedding rate
+func SamplePairs(samples []byte) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+
+	var x, y, k float64
+	pairs := float64(len(samples) - 1)
+	for i := 1; i < len(samples); i++ {
+		u, v := samples[i-1], samples[i]
+		if (v%2 == 0 && u < v) || (v%2 == 1 && u > v) {
+			x++
+		}
+		if (v%2 == 0 && u > v) || (v%2 == 1 && u < v) {
+			y++
+		}
+		if u>>1 == v>>1 {
+			k++
+		}
+	}
+
+	if k == 0 {
+		return 0
+	}
+
+	a := 2 * k
+	b := 2 * (2*x - pairs)
+	c := y - x
+	discriminant := b*b - 4*a*c
+	if discriminant < 0 {
+		return 0
+	}
+
+	// The smallest root estimates the fraction of LSBs flipped by the embedding, which is half of the samples carrying
+	// data, since on average half of the embedded bits will match the LSB they replace
+	flippedRate := min((-b+math.Sqrt(discriminant))/(2*a), (-b-math.Sqrt(discriminant))/(2*a))
+	return clamp(2*flippedRate, 0, 1)
+}
@@ -0,0 +1,142 @@
+package carrier
+
+import (
+	"errors"
+	"io"
+	"nsteg/pkg/model"
+	"nsteg/pkg/payload"
+)
+
+var (
+	ErrOutOfBounds     = errors.New("tried to access bits beyond the capacity of the carrier")
+	ErrCarrierTooSmall = errors.New("carrier not big enough to contain the supplied files to hide")
+)
+
+// Carrier is a medium in which bits can be hidden, such as the LSBs of the pixels of an image. Carriers only need to
+// expose their usable bits as a flat sequence, the payload framing is shared by all carriers through EncodeFiles and
+// DecodeFiles
+type Carrier interface {
+	// Capacity returns the number of bits that can be hidden in the carrier
+	Capacity() uint64
+
+	// WriteBits hides the n least significant bits of b starting at bit position pos, with the least significant bit
+	// of b being written to pos. n must be between 1 and 8
+	WriteBits(pos uint64, b byte, n uint) error
+
+	// ReadBits reads n bits starting at bit position pos, returning them in the n least significant bits of the
+	// returned byte. n must be between 1 and 8
+	ReadBits(pos uint64, n uint) (byte, error)
+}
+
+// ChunkCarrier is a Carrier which can hide whole chunks of bytes at once, which Writer and Reader use instead of
+// hiding each byte on its own. Chunks which do not share any bits of the carrier can be written or read concurrently
+type ChunkCarrier interface {
+	Carrier
+
+	// WriteChunk hides the chunk starting at bit position pos. Nothing is written if the chunk does not fit
+	WriteChunk(pos uint64, chunk []byte) error
+
+	// ReadChunk fills the chunk with the bits hidden starting at bit position pos
+	ReadChunk(pos uint64, chunk []byte) error
+}
+
+// Writer hides a stream of bytes sequentially in a Carrier
+type Writer struct {
+	carrier Carrier
+	pos     uint64
+}
+
+func NewWriter(c Carrier) *Writer {
+	return &Writer{carrier: c}
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if c, ok := w.carrier.(ChunkCarrier); ok {
+		n := bytesLeft(c, w.pos, len(p))
+		if err := c.WriteChunk(w.pos, p[:n]); err != nil {
+			return 0, err
+		}
+		w.pos += uint64(n) * 8
+		if n < len(p) {
+			return n, ErrOutOfBounds
+		}
+		return n, nil
+	}
+
+	for i, b := range p {
+		if err := w.carrier.WriteBits(w.pos, b, 8); err != nil {
+			return i, err
+		}
+		w.pos += 8
+	}
+	return len(p), nil
+}
+
+// Reader reads bytes previously hidden in a Carrier by a Writer
+type Reader struct {
+	carrier Carrier
+	pos     uint64
+}
+
+func NewReader(c Carrier) *Reader {
+	return &Reader{carrier: c}
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if c, ok := r.carrier.(ChunkCarrier); ok {
+		n := bytesLeft(c, r.pos, len(p))
+		if n == 0 && len(p) > 0 {
+			return 0, io.EOF
+		}
+		if err := c.ReadChunk(r.pos, p[:n]); err != nil {
+			return 0, err
+		}
+		r.pos += uint64(n) * 8
+		return n, nil
+	}
+
+	for i := range p {
+		if r.pos+8 > r.carrier.Capacity() {
+			if i == 0 {
+				return 0, io.EOF
+			}
+			return i, nil
+		}
+
+		b, err := r.carrier.ReadBits(r.pos, 8)
+		if err != nil {
+			return i, err
+		}
+		p[i] = b
+		r.pos += 8
+	}
+	return len(p), nil
+}
+
+// bytesLeft returns how many of n bytes fit in the carrier from bit position pos onwards
+func bytesLeft(c Carrier, pos uint64, n int) int {
+	if pos >= c.Capacity() {
+		return 0
+	}
+	return int(min(uint64(n), (c.Capacity()-pos)/8))
+}
+
+// EncodeFiles hides the supplied files in the carrier, using the same payload framing as every other carrier
+func EncodeFiles(c Carrier, files []model.InputFile) error {
+	dataReader, payloadSize := payload.NewReader(files)
+	if uint64(payloadSize)*8 > c.Capacity() {
+		return ErrCarrierTooSmall
+	}
+
+	_, err := io.Copy(NewWriter(c), dataReader)
+	return err
+}
+
+// DecodeFiles reads the files previously hidden in the carrier by EncodeFiles
+func DecodeFiles(c Carrier) ([]model.OutputFile, error) {
+	files, err := payload.ReadFiles(NewReader(c))
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, ErrOutOfBounds
+	}
+	return files, err
+}
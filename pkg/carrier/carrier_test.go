@@ -0,0 +1,134 @@
+package carrier
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"nsteg/pkg/model"
+	"nsteg/test"
+	"testing"
+)
+
+// bitCarrier hides a single bit in each byte it holds
+type bitCarrier struct {
+	slots []byte
+}
+
+func (c *bitCarrier) Capacity() uint64 {
+	return uint64(len(c.slots))
+}
+
+func (c *bitCarrier) WriteBits(pos uint64, b byte, n uint) error {
+	if pos+uint64(n) > c.Capacity() {
+		return ErrOutOfBounds
+	}
+	for i := uint64(0); i < uint64(n); i++ {
+		c.slots[pos+i] = c.slots[pos+i]&^1 | (b>>i)&1
+	}
+	return nil
+}
+
+func (c *bitCarrier) ReadBits(pos uint64, n uint) (byte, error) {
+	if pos+uint64(n) > c.Capacity() {
+		return 0, ErrOutOfBounds
+	}
+	var b byte
+	for i := uint64(0); i < uint64(n); i++ {
+		b |= (c.slots[pos+i] & 1) << i
+	}
+	return b, nil
+}
+
+func TestEncodeDecodeFiles(t *testing.T) {
+	content := test.GenerateRandomBytes(1000)
+	testCarrier := &bitCarrier{slots: test.GenerateRandomBytes(10000 * 8)}
+
+	err := EncodeFiles(testCarrier, []model.InputFile{
+		{Name: "file", Content: bytes.NewReader(content), Size: int64(len(content))},
+	})
+	if err != nil {
+		t.Fatalf("Error encoding files: %s", err)
+	}
+
+	decodedFiles, err := DecodeFiles(testCarrier)
+	if err != nil {
+		t.Fatalf("Error decoding files: %s", err)
+	}
+	if len(decodedFiles) != 1 || decodedFiles[0].Name != "file" || !bytes.Equal(decodedFiles[0].Content, content) {
+		t.Errorf("Decoded files do not match encoded files")
+	}
+}
+
+func TestEncodeFilesWithSmallCarrier(t *testing.T) {
+	content := test.GenerateRandomBytes(1000)
+	testCarrier := &bitCarrier{slots: make([]byte, 1000*8)}
+
+	err := EncodeFiles(testCarrier, []model.InputFile{
+		{Name: "file", Content: bytes.NewReader(content), Size: int64(len(content))},
+	})
+	if !errors.Is(err, ErrCarrierTooSmall) {
+		t.Errorf("Expected %s, got %v", ErrCarrierTooSmall, err)
+	}
+}
+
+// chunkBitCarrier hides chunks in a bitCarrier, a byte at a time
+type chunkBitCarrier struct {
+	bitCarrier
+}
+
+func (c *chunkBitCarrier) WriteChunk(pos uint64, chunk []byte) error {
+	if pos+uint64(len(chunk))*8 > c.Capacity() {
+		return ErrOutOfBounds
+	}
+	for i, b := range chunk {
+		if err := c.WriteBits(pos+uint64(i)*8, b, 8); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *chunkBitCarrier) ReadChunk(pos uint64, chunk []byte) error {
+	if pos+uint64(len(chunk))*8 > c.Capacity() {
+		return ErrOutOfBounds
+	}
+	for i := range chunk {
+		b, err := c.ReadBits(pos+uint64(i)*8, 8)
+		if err != nil {
+			return err
+		}
+		chunk[i] = b
+	}
+	return nil
+}
+
+func TestChunkCarrierWriterReader(t *testing.T) {
+	for _, testCase := range []struct {
+		name          string
+		testCarrier   Carrier
+		expectedBytes int
+	}{
+		{name: "bits", testCarrier: &bitCarrier{slots: make([]byte, 10*8+3)}, expectedBytes: 10},
+		{name: "chunks", testCarrier: &chunkBitCarrier{bitCarrier{slots: make([]byte, 10*8+3)}}, expectedBytes: 10},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			data := test.GenerateRandomBytes(16)
+			writer := NewWriter(testCase.testCarrier)
+			if n, err := writer.Write(data[:4]); n != 4 || err != nil {
+				t.Fatalf("Expected 4 bytes written, got %d: %v", n, err)
+			}
+			// Only the bytes that fit are written, the trailing bits of the carrier are left unused
+			if n, err := writer.Write(data[4:]); n != testCase.expectedBytes-4 || !errors.Is(err, ErrOutOfBounds) {
+				t.Fatalf("Expected %d bytes written and %s, got %d: %v", testCase.expectedBytes-4, ErrOutOfBounds, n, err)
+			}
+
+			read, err := io.ReadAll(NewReader(testCase.testCarrier))
+			if err != nil {
+				t.Fatalf("Error reading carrier: %s", err)
+			}
+			if !bytes.Equal(read, data[:testCase.expectedBytes]) {
+				t.Errorf("Expected %x, got %x", data[:testCase.expectedBytes], read)
+			}
+		})
+	}
+}
@@ -1,6 +1,10 @@
 package config
 
-import "image/png"
+import (
+	"crypto/ed25519"
+	"image/png"
+	"log/slog"
+)
 
 const (
 	DefaultChunkSizeMultiplier = 32 * 1024
@@ -11,9 +15,20 @@ type ImageEncodeConfig struct {
 	ChunkSizeMultiplier int
 	SlowPngEncode       bool
 	PngCompressionLevel png.CompressionLevel
+
+	// ComputeQualityMetrics Whether EncodeFiles should measure the visual damage done to the image, which requires
+	// keeping a copy of the original image in memory
+	ComputeQualityMetrics bool
+
+	// SigningKey Key with which to sign the encoded files, so that recipients can verify who sent them. Files are not
+	// signed if unset
+	SigningKey ed25519.PrivateKey
+
+	// Logger Receives the diagnostics of the encoder, at debug level. Optional
+	Logger *slog.Logger
 }
 
-func (c ImageEncodeConfig) PopulateUnsetConfigVars() {
+func (c *ImageEncodeConfig) PopulateUnsetConfigVars() {
 	if c.LSBsToUse < 1 || c.LSBsToUse > 8 {
 		c.LSBsToUse = 3
 	}
@@ -0,0 +1,97 @@
+package image
+
+import (
+	"image"
+	"nsteg/pkg/seal"
+)
+
+const (
+	// lsbsSettingPixels Opaque pixels taken up by the LSBs setting, which is stored in the first opaque pixel. The data
+	// starts at the following opaque pixel, so the whole pixel is taken up, even though the setting only needs 3 bits
+	lsbsSettingPixels = 1
+)
+
+// Capacity Result of scanning an image for the space available to hide data in
+type Capacity struct {
+	OpaquePixels uint64 `json:"opaque_pixels"`
+}
+
+// ScanCapacity counts the opaque pixels of the image, which are the only ones data can be hidden in
+func ScanCapacity(img *image.RGBA) Capacity {
+	return Capacity{OpaquePixels: countOpaquePixels(img.Pix)}
+}
+
+// AvailableBytes returns the largest payload, in bytes, that fits in the image when using the supplied LSBs
+func (c Capacity) AvailableBytes(LSBsToUse byte) int64 {
+	return int64(c.availableBits(LSBsToUse, lsbsSettingPixels) / 8)
+}
+
+// Fits returns whether a payload of the supplied size, in bytes, fits in the image when using the supplied LSBs
+func (c Capacity) Fits(payloadSize int64, LSBsToUse byte) bool {
+	return uint64(payloadSize)*8 <= c.availableBits(LSBsToUse, lsbsSettingPixels)
+}
+
+// MinLSBsToFit returns the smallest LSBs setting with which a payload of the supplied size fits in the image
+func (c Capacity) MinLSBsToFit(payloadSize int64) (byte, bool) {
+	for LSBsToUse := byte(1); LSBsToUse <= 8; LSBsToUse++ {
+		if c.Fits(payloadSize, LSBsToUse) {
+			return LSBsToUse, true
+		}
+	}
+	return 0, false
+}
+
+// RawAvailableBytes returns the largest payload, in bytes, that fits in the image in raw mode when using the supplied
+// LSBs. Raw mode does not store the LSBs setting, so the payload takes up every opaque pixel, see NewRawImageEncoder
+func (c Capacity) RawAvailableBytes(LSBsToUse byte) int64 {
+	return int64(c.availableBits(LSBsToUse, 0) / 8)
+}
+
+// FitsRaw returns whether a payload of the supplied size, in bytes, fits in the image in raw mode when using the
+// supplied LSBs
+func (c Capacity) FitsRaw(payloadSize int64, LSBsToUse byte) bool {
+	return uint64(payloadSize)*8 <= c.availableBits(LSBsToUse, 0)
+}
+
+// VolumeAvailableBytes returns the largest payload, in bytes, that fits in each hidden volume when using the supplied
+// LSBs. Each volume only gets half of the opaque pixels, minus the pixels taken up by its salt and LSBs setting and the
+// bytes taken up by its encryption, so each volume holds slightly less than half of what AvailableBytes returns
+func (c Capacity) VolumeAvailableBytes(LSBsToUse byte) int64 {
+	return max(int64(c.volumeAvailableBits(LSBsToUse)/8)-seal.Overhead, 0)
+}
+
+// FitsVolume returns whether a payload of the supplied size, in bytes, fits in a hidden volume when using the supplied
+// LSBs
+func (c Capacity) FitsVolume(payloadSize int64, LSBsToUse byte) bool {
+	return uint64(payloadSize+seal.Overhead)*8 <= c.volumeAvailableBits(LSBsToUse)
+}
+
+// MinLSBsToFitVolume returns the smallest LSBs setting with which a payload of the supplied size fits in a hidden
+// volume
+func (c Capacity) MinLSBsToFitVolume(payloadSize int64) (byte, bool) {
+	for LSBsToUse := byte(1); LSBsToUse <= 8; LSBsToUse++ {
+		if c.FitsVolume(payloadSize, LSBsToUse) {
+			return LSBsToUse, true
+		}
+	}
+	return 0, false
+}
+
+// availableBits Bits available for the payload, once the reserved pixels, such as the one holding the LSBs setting, are
+// taken out
+func (c Capacity) availableBits(LSBsToUse byte, reservedPixels uint64) uint64 {
+	if c.OpaquePixels < reservedPixels {
+		return 0
+	}
+	return (c.OpaquePixels - reservedPixels) * uint64(channelsToWrite) * uint64(LSBsToUse)
+}
+
+// volumeAvailableBits Bits available in the smaller half of the opaque pixels, once the salt and LSBs setting pixels
+// are taken out
+func (c Capacity) volumeAvailableBits(LSBsToUse byte) uint64 {
+	halfPixels := c.OpaquePixels / MaxVolumes
+	if halfPixels <= uint64(VolumeReservedPixels) {
+		return 0
+	}
+	return (halfPixels - uint64(VolumeReservedPixels)) * uint64(channelsToWrite) * uint64(LSBsToUse)
+}
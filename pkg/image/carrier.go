@@ -0,0 +1,138 @@
+package image
+
+import (
+	"image"
+	"nsteg/pkg/carrier"
+)
+
+// RGBACarrier exposes the LSBs of the opaque pixels of an image.RGBA as a carrier.ChunkCarrier. The first opaque pixel
+// is reserved for the LSBs setting, as written by Encoder, which hides and Decoder reads all data through this carrier
+type RGBACarrier struct {
+	image     *image.RGBA
+	LSBsToUse byte
+
+	// index Locates the opaque pixels data is hidden in, so that chunks are located independently of each other
+	index opaquePixelIndex
+
+	// Cached position of the last accessed pixel, since bits are mostly accessed sequentially. cursorPixel is the index
+	// in image.Pix of the start of the opaque pixel number cursorOrdinal
+	cursorOrdinal uint64
+	cursorPixel   int
+}
+
+func NewRGBACarrier(img *image.RGBA, LSBsToUse byte) (*RGBACarrier, error) {
+	firstOpaquePixel, found := findFirstOpaquePixel(img)
+	if !found {
+		return nil, ErrImageNotBigEnough
+	}
+
+	c := &RGBACarrier{}
+	c.reset(img, LSBsToUse, firstOpaquePixel+4, maxIndexSegmentPixels)
+	return c, nil
+}
+
+// reset makes the carrier hide data in the opaque pixels of the image from dataStart onwards, an index in image.Pix,
+// indexed in segments of segmentPixels pixels. The index of the previous image is reused if there is room for it
+func (c *RGBACarrier) reset(img *image.RGBA, LSBsToUse byte, dataStart, segmentPixels int) {
+	c.image, c.LSBsToUse = img, LSBsToUse
+	c.index.reset(img.Pix, dataStart, segmentPixels)
+	c.cursorOrdinal, c.cursorPixel = 0, c.index.locate(0)
+}
+
+func (c *RGBACarrier) Capacity() uint64 {
+	return c.index.capacity(c.LSBsToUse)
+}
+
+func (c *RGBACarrier) WriteBits(pos uint64, b byte, n uint) error {
+	if pos+uint64(n) > c.Capacity() {
+		return carrier.ErrOutOfBounds
+	}
+	writeSlotBits(c.image.Pix, c, c.LSBsToUse, pos, b, n)
+	return nil
+}
+
+func (c *RGBACarrier) ReadBits(pos uint64, n uint) (byte, error) {
+	if pos+uint64(n) > c.Capacity() {
+		return 0, carrier.ErrOutOfBounds
+	}
+	return readSlotBits(c.image.Pix, c, c.LSBsToUse, pos, n), nil
+}
+
+// WriteChunk hides the chunk as embedChunk does. Unlike WriteBits, it can be called concurrently for chunks which do
+// not share any sub pixels
+func (c *RGBACarrier) WriteChunk(pos uint64, chunk []byte) error {
+	if pos+uint64(len(chunk))*8 > c.Capacity() {
+		return carrier.ErrOutOfBounds
+	}
+	embedChunk(c.image.Pix, chunk, c.index.position(pos, c.LSBsToUse), c.LSBsToUse)
+	return nil
+}
+
+// ReadChunk fills the chunk as extractChunk does. Unlike ReadBits, it can be called concurrently
+func (c *RGBACarrier) ReadChunk(pos uint64, chunk []byte) error {
+	if pos+uint64(len(chunk))*8 > c.Capacity() {
+		return carrier.ErrOutOfBounds
+	}
+	extractChunk(c.image.Pix, chunk, c.index.position(pos, c.LSBsToUse), c.LSBsToUse)
+	return nil
+}
+
+// subPixelForSlot returns the index in image.Pix of the sub pixel holding the LSBs of the supplied slot, where each
+// opaque pixel has one slot per channel written to
+func (c *RGBACarrier) subPixelForSlot(slot uint64) int {
+	ordinal := slot / uint64(channelsToWrite)
+	channel := int(slot % uint64(channelsToWrite))
+	switch {
+	case ordinal == c.cursorOrdinal:
+	case ordinal == c.cursorOrdinal+1:
+		c.cursorPixel += 4
+		for c.image.Pix[c.cursorPixel+3] != 255 {
+			c.cursorPixel += 4
+		}
+	default:
+		c.cursorPixel = c.index.locate(ordinal)
+	}
+	c.cursorOrdinal = ordinal
+	return c.cursorPixel + channel
+}
+
+// slotMapper maps the slots of a carrier, each holding the LSBs of one sub pixel, to the sub pixels of an image
+type slotMapper interface {
+	subPixelForSlot(slot uint64) int
+}
+
+// writeSlotBits hides the n least significant bits of b starting at bit position pos, where each slot holds LSBsToUse
+// bits, starting from the least significant one
+func writeSlotBits(pix []byte, mapper slotMapper, LSBsToUse byte, pos uint64, b byte, n uint) {
+	bitsPerSlot := uint(LSBsToUse)
+	for n > 0 {
+		subPixel := mapper.subPixelForSlot(pos / uint64(bitsPerSlot))
+		bitInSubPixel := uint(pos % uint64(bitsPerSlot))
+		bitsToWrite := min(n, bitsPerSlot-bitInSubPixel)
+
+		mask := byte((1<<bitsToWrite - 1) << bitInSubPixel)
+		pix[subPixel] = pix[subPixel]&^mask | (b<<bitInSubPixel)&mask
+
+		b >>= bitsToWrite
+		n -= bitsToWrite
+		pos += uint64(bitsToWrite)
+	}
+}
+
+// readSlotBits reads n bits starting at bit position pos, written by writeSlotBits
+func readSlotBits(pix []byte, mapper slotMapper, LSBsToUse byte, pos uint64, n uint) byte {
+	bitsPerSlot := uint(LSBsToUse)
+	var readBits byte
+	var bitsRead uint
+	for bitsRead < n {
+		subPixel := mapper.subPixelForSlot(pos / uint64(bitsPerSlot))
+		bitInSubPixel := uint(pos % uint64(bitsPerSlot))
+		bitsToRead := min(n-bitsRead, bitsPerSlot-bitInSubPixel)
+
+		readBits |= ((pix[subPixel] >> bitInSubPixel) & (1<<bitsToRead - 1)) << bitsRead
+
+		bitsRead += bitsToRead
+		pos += uint64(bitsToRead)
+	}
+	return readBits
+}
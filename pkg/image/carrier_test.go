@@ -0,0 +1,99 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"nsteg/pkg/carrier"
+	"nsteg/pkg/config"
+	"nsteg/test"
+	"testing"
+)
+
+const carrierTestImageSize = 500
+
+func TestRGBACarrierMatchesEncoder(t *testing.T) {
+	runImageTestsWithAllLSBsAndOpaquenessSettings(t, func(t *testing.T, LSBsToUse byte, randomizePixelOpaqueness bool) {
+		encoderImage, opaquePixels := generateImage(carrierTestImageSize, carrierTestImageSize, randomizePixelOpaqueness)
+		carrierImage := cloneImage(encoderImage)
+		testFiles := generateFilesToEncode(calculateBytesThatFitInImage(opaquePixels, LSBsToUse))
+
+		encoder, err := NewImageEncoder(encoderImage, config.ImageEncodeConfig{LSBsToUse: LSBsToUse})
+		if err != nil {
+			t.Fatalf("Error creating image encoder: %s", err)
+		}
+		if err = encoder.EncodeFiles(convertTestInputToStandardInput(testFiles)); err != nil {
+			t.Fatalf("Error encoding files: %s", err)
+		}
+
+		// The carrier does not write the LSBs setting, so we reuse the encoder to do so
+		if _, err = NewImageEncoder(carrierImage, config.ImageEncodeConfig{LSBsToUse: LSBsToUse}); err != nil {
+			t.Fatalf("Error creating image encoder: %s", err)
+		}
+		rgbaCarrier, err := NewRGBACarrier(carrierImage, LSBsToUse)
+		if err != nil {
+			t.Fatalf("Error creating RGBA carrier: %s", err)
+		}
+		if err = carrier.EncodeFiles(rgbaCarrier, convertTestInputToStandardInput(testFiles)); err != nil {
+			t.Fatalf("Error encoding files through carrier: %s", err)
+		}
+
+		if !bytes.Equal(encoderImage.Pix, carrierImage.Pix) {
+			t.Errorf("Image encoded through carrier does not match image encoded by encoder with %d LSBs", LSBsToUse)
+		}
+
+		decoder, err := NewImageDecoder(encoderImage)
+		if err != nil {
+			t.Fatalf("Error creating image decoder: %s", err)
+		}
+		decodedFiles, err := carrier.DecodeFiles(rgbaCarrier)
+		if err != nil {
+			t.Fatalf("Error decoding files through carrier: %s", err)
+		}
+		decoderFiles, err := decoder.DecodeFiles()
+		if err != nil {
+			t.Fatalf("Error decoding files: %s", err)
+		}
+		if len(decodedFiles) != len(testFiles) || len(decoderFiles) != len(testFiles) {
+			t.Fatalf("Expected %d decoded files, carrier decoded %d and decoder %d", len(testFiles),
+				len(decodedFiles), len(decoderFiles))
+		}
+		for i := range testFiles {
+			if !bytes.Equal(decodedFiles[i].Content, testFiles[i].Content) || !bytes.Equal(decoderFiles[i].Content, testFiles[i].Content) {
+				t.Errorf("Decoded file %d does not match the encoded file with %d LSBs", i, LSBsToUse)
+			}
+		}
+	})
+}
+
+func TestRGBACarrierBitsMatchChunks(t *testing.T) {
+	runImageTestsWithAllLSBsAndOpaquenessSettings(t, func(t *testing.T, LSBsToUse byte, randomizePixelOpaqueness bool) {
+		img, _ := generateImage(carrierTestImageSize, carrierTestImageSize, randomizePixelOpaqueness)
+		rgbaCarrier, err := NewRGBACarrier(img, LSBsToUse)
+		if err != nil {
+			t.Fatalf("Error creating RGBA carrier: %s", err)
+		}
+
+		// Bits are written in runs of varying lengths, which start and end halfway through sub pixels
+		data := test.GenerateRandomBytes(int(rgbaCarrier.Capacity() / 8))
+		var pos uint64
+		for i, b := range data {
+			for written, n := uint(0), uint(i%8)+1; written < 8; written, n = written+n, 8-n {
+				if err = rgbaCarrier.WriteBits(pos+uint64(written), b>>written, n); err != nil {
+					t.Fatalf("Error writing bits: %s", err)
+				}
+			}
+			pos += 8
+		}
+
+		chunk := make([]byte, len(data))
+		if err = rgbaCarrier.ReadChunk(0, chunk); err != nil {
+			t.Fatalf("Error reading chunk: %s", err)
+		}
+		if !bytes.Equal(chunk, data) {
+			t.Errorf("Chunk read does not match bits written with %d LSBs", LSBsToUse)
+		}
+		if err = rgbaCarrier.ReadChunk(pos, make([]byte, 1)); !errors.Is(err, carrier.ErrOutOfBounds) {
+			t.Errorf("Expected %s reading past the capacity, got %v", carrier.ErrOutOfBounds, err)
+		}
+	})
+}
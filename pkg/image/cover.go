@@ -0,0 +1,98 @@
+package image
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math/rand"
+	"nsteg/pkg/analysis"
+	"nsteg/pkg/config"
+	"sort"
+)
+
+const (
+	// noisyCoverThreshold Noise level above which a cover is considered textured enough to mask changes to its LSBs
+	noisyCoverThreshold = 3
+)
+
+// CoverEvaluation Suitability of an image as the cover for a payload, used to rank candidate covers
+type CoverEvaluation struct {
+	Name     string   `json:"name"`
+	Capacity Capacity `json:"capacity"`
+	Fits     bool     `json:"fits"`
+	// LSBsToUse Smallest LSBs setting with which the payload fits in the cover
+	LSBsToUse byte `json:"lsbs_to_use"`
+	// CapacityUsed Fraction of the capacity of the cover, with LSBsToUse, that the payload takes up
+	CapacityUsed float64 `json:"capacity_used"`
+	NoiseLevel   float64 `json:"noise_level"`
+	// PredictedSuspicion Suspicion score the steganalysis methods assign to the cover once the payload is encoded
+	PredictedSuspicion float64 `json:"predicted_suspicion"`
+	// PredictedEmbeddingRate Embedding rate the steganalysis methods estimate once the payload is encoded
+	PredictedEmbeddingRate float64  `json:"predicted_embedding_rate"`
+	Score                  float64  `json:"score"`
+	Reasons                []string `json:"reasons"`
+}
+
+// EvaluateCover evaluates the supplied image as a cover for a payload of the supplied size, in bytes. Detectability
+// is predicted by encoding random data of the same size into a copy of the image, with the smallest LSBs setting that
+// fits it, and analyzing the result. The supplied image is not modified
+func EvaluateCover(name string, img *image.RGBA, payloadSize int64) (CoverEvaluation, error) {
+	evaluation := CoverEvaluation{
+		Name:       name,
+		Capacity:   ScanCapacity(img),
+		NoiseLevel: analysis.NoiseLevel(img),
+	}
+
+	evaluation.LSBsToUse, evaluation.Fits = evaluation.Capacity.MinLSBsToFit(payloadSize)
+	if !evaluation.Fits {
+		evaluation.Reasons = append(evaluation.Reasons, fmt.Sprintf("payload of %d bytes does not fit even with 8 LSBs, which hold %d bytes",
+			payloadSize, evaluation.Capacity.AvailableBytes(8)))
+		return evaluation, nil
+	}
+	evaluation.CapacityUsed = float64(payloadSize) / float64(evaluation.Capacity.AvailableBytes(evaluation.LSBsToUse))
+	evaluation.Reasons = append(evaluation.Reasons, fmt.Sprintf("fits with %d LSBs, using %.1f%% of the capacity",
+		evaluation.LSBsToUse, evaluation.CapacityUsed*100))
+
+	encoder, err := NewImageEncoder(cloneImage(img), config.ImageEncodeConfig{LSBsToUse: evaluation.LSBsToUse})
+	if err != nil {
+		return evaluation, err
+	}
+	if err = encoder.Encode(io.LimitReader(rand.New(rand.NewSource(payloadSize)), payloadSize)); err != nil {
+		return evaluation, err
+	}
+	report := analysis.Analyze(encoder.image)
+	evaluation.PredictedSuspicion = report.Suspicion
+	evaluation.PredictedEmbeddingRate = report.EmbeddingRate
+
+	if evaluation.NoiseLevel >= noisyCoverThreshold {
+		evaluation.Reasons = append(evaluation.Reasons, fmt.Sprintf("textured image (noise level %.2f) masks changes to the LSBs",
+			evaluation.NoiseLevel))
+	} else {
+		evaluation.Reasons = append(evaluation.Reasons, fmt.Sprintf("smooth image (noise level %.2f) makes changes to the LSBs stand out",
+			evaluation.NoiseLevel))
+	}
+	evaluation.Reasons = append(evaluation.Reasons, fmt.Sprintf("predicted suspicion of %.2f, with an estimated embedding rate of %.1f%%",
+		evaluation.PredictedSuspicion, evaluation.PredictedEmbeddingRate*100))
+
+	// Detectability weighs the most, both how suspicious the image looks and how much of it looks modified, followed by
+	// how much of each pixel is rewritten, and how well the image's own noise masks the changes
+	noiseScore := min(evaluation.NoiseLevel/(2*noisyCoverThreshold), 1)
+	evaluation.Score = 0.4*(1-evaluation.PredictedSuspicion) +
+		0.3*(1-evaluation.PredictedEmbeddingRate) +
+		0.15*(1-float64(evaluation.LSBsToUse-1)/7) +
+		0.15*noiseScore
+	return evaluation, nil
+}
+
+// RankCovers sorts the evaluated covers from most to least suitable, with covers the payload does not fit in last
+func RankCovers(evaluations []CoverEvaluation) {
+	sort.SliceStable(evaluations, func(i, j int) bool {
+		if evaluations[i].Fits != evaluations[j].Fits {
+			return evaluations[i].Fits
+		}
+		if evaluations[i].Score != evaluations[j].Score {
+			return evaluations[i].Score > evaluations[j].Score
+		}
+		return evaluations[i].Capacity.OpaquePixels > evaluations[j].Capacity.OpaquePixels
+	})
+}
@@ -0,0 +1,60 @@
+package image
+
+import (
+	"bytes"
+	"image"
+	"nsteg/test"
+	"testing"
+)
+
+func TestCapacityMatchesEncoder(t *testing.T) {
+	img, opaquePixels := generateImage(carrierTestImageSize, carrierTestImageSize, false)
+	capacity := ScanCapacity(img)
+	if capacity.OpaquePixels != uint64(opaquePixels) {
+		t.Fatalf("Expected %d opaque pixels, got %d", opaquePixels, capacity.OpaquePixels)
+	}
+
+	for LSBsToUse := byte(1); LSBsToUse <= 8; LSBsToUse++ {
+		availableBytes := capacity.AvailableBytes(LSBsToUse)
+		if !capacity.Fits(availableBytes, LSBsToUse) || capacity.Fits(availableBytes+1, LSBsToUse) {
+			t.Errorf("Expected exactly %d bytes to fit with %d LSBs", availableBytes, LSBsToUse)
+		}
+		if minLSBs, fits := capacity.MinLSBsToFit(availableBytes); !fits || minLSBs != LSBsToUse {
+			t.Errorf("Expected %d bytes to need %d LSBs, got %d", availableBytes, LSBsToUse, minLSBs)
+		}
+	}
+}
+
+func TestRankCovers(t *testing.T) {
+	smallImage, _ := generateImage(10, 10, false)
+	noisyImage := test.GenerateNaturalImage(carrierTestImageSize, carrierTestImageSize, 8)
+	smoothImage := test.GenerateNaturalImage(carrierTestImageSize, carrierTestImageSize, 1)
+	originalNoisyImage := cloneImage(noisyImage)
+
+	payloadSize := int64(1000)
+	var evaluations []CoverEvaluation
+	for name, img := range map[string]*image.RGBA{"small": smallImage, "noisy": noisyImage, "smooth": smoothImage} {
+		evaluation, err := EvaluateCover(name, img, payloadSize)
+		if err != nil {
+			t.Fatalf("Error evaluating cover %s: %s", name, err)
+		}
+		evaluations = append(evaluations, evaluation)
+	}
+	RankCovers(evaluations)
+
+	expectedOrder := []string{"noisy", "smooth", "small"}
+	for i, evaluation := range evaluations {
+		if evaluation.Name != expectedOrder[i] {
+			t.Errorf("Expected cover %d to be %s, was %s", i+1, expectedOrder[i], evaluation.Name)
+		}
+	}
+	if evaluations[2].Fits {
+		t.Errorf("Expected payload not to fit in the small cover")
+	}
+	if evaluations[0].LSBsToUse != 1 {
+		t.Errorf("Expected payload to fit in the noisy cover with 1 LSB, needed %d", evaluations[0].LSBsToUse)
+	}
+	if !bytes.Equal(originalNoisyImage.Pix, noisyImage.Pix) {
+		t.Errorf("Evaluating a cover should not modify it")
+	}
+}
@@ -1,30 +1,59 @@
 package image
 
 import (
+	"bytes"
+	"context"
+	"crypto/cipher"
 	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"image"
+	"io"
+	"nsteg/internal/tracing"
+	"nsteg/pkg/config"
 	"nsteg/pkg/model"
+	"nsteg/pkg/payload"
+	"nsteg/pkg/signature"
 	"time"
 )
 
 const (
-	MaxBytesAllocatedAtOnce = 1000 * 1000 * 1000
+	MaxBytesAllocatedAtOnce = payload.MaxBytesAllocatedAtOnce
 )
 
 var (
 	ErrDecodeFileBounds = errors.New("decoding exceeded image bounds, the file was likely not encoded using nsteg")
-	ErrMaxAllocExceeded = errors.New("tried to allocate too much memory at once during decoding, which could lead to OOM panic")
+	ErrMaxAllocExceeded = payload.ErrMaxAllocExceeded
 )
 
 type Decoder struct {
-	LSBsToUse, bitsLeftToReadInSubPixel byte
+	LSBsToUse byte
 
-	// currentSubPixel Represents the pixel/channel the decoder is on. A value of 3, according to the RGBA order of
-	// image.RGBA, would represent the blue channel of the first pixel
-	currentSubPixel int
+	// ChunkSizeMultiplier Size of the chunks extracted by a single goroutine, in multiples of the smallest chunk, as
+	// config.ImageEncodeConfig.ChunkSizeMultiplier is for encoding. Chunks do not change how data is laid out in the
+	// image, so any value decodes any image. config.DefaultChunkSizeMultiplier is used if unset
+	ChunkSizeMultiplier int
+
+	// dataStart Index in image.Pix of the pixel the data stream starts at, and bitsDecoded how many bits of the stream
+	// have been decoded so far
+	dataStart   int
+	bitsDecoded uint64
+
+	// carrier Reads the data stream from the image, created on the first read
+	carrier *RGBACarrier
 
 	image *image.RGBA
 	stats model.DecodeStats
+
+	// sealed Decrypted payload, only set when decoding an image holding a sealed payload, as encoded by
+	// Encoder.EncodeVolumes or Encoder.EncodeFilesForRecipients
+	sealed io.Reader
+
+	// keystream Unmasks all decoded data in raw mode, see NewRawImageDecoder
+	keystream cipher.Stream
+
+	trustedSigners []signature.TrustedKey
+	signer         *model.Signer
 }
 
 func NewImageDecoder(image *image.RGBA) (*Decoder, error) {
@@ -51,75 +80,102 @@ func (d *Decoder) Decode(numOfBytesToDecode int) ([]byte, error) {
 	return d.readBytes(uint(numOfBytesToDecode))
 }
 
+// DecodeFiles decodes the files hidden in the image, verifying their signature if they were signed. See TrustSigners
+// for how signatures are checked, and Signer for who signed the files
 func (d *Decoder) DecodeFiles() ([]model.OutputFile, error) {
+	return d.DecodeFilesContext(context.Background(), DecodeOptions{})
+}
+
+// DecodeFilesContext decodes the files as DecodeFiles does, reporting progress to opts.Progress. Decoding stops as
+// soon as the context is done, returning its error
+func (d *Decoder) DecodeFilesContext(ctx context.Context, opts DecodeOptions) (_ []model.OutputFile, err error) {
+	ctx, span := tracer().Start(ctx, "image.Decoder.DecodeFiles", trace.WithAttributes(
+		attribute.Int("nsteg.lsbs", int(d.LSBsToUse)),
+		attribute.Bool("nsteg.sealed", d.sealed != nil),
+		attribute.Int("image.width", d.image.Rect.Dx()),
+		attribute.Int("image.height", d.image.Rect.Dy()),
+	))
 	decodeStart := time.Now()
 	defer func() {
 		d.stats.DataDecoding = time.Since(decodeStart)
+		tracing.EndSpan(span, err)
 	}()
+	logger := loggerOrDiscard(opts.Logger)
 
-	var decodedFiles []model.OutputFile
-
-	numOfFilesToDecode, err := d.readUInt()
+	tracker := newProgressTracker(ctx, opts.Progress, model.StageExtracting, 0)
+	files, signatureEntry, err := d.decodeFiles(tracker.wrap(d))
 	if err != nil {
+		logger.Debug("Error decoding files from image", "lsbs", d.LSBsToUse, "sealed", d.sealed != nil, "error", err)
 		return nil, err
 	}
-	for f := uint(0); f < numOfFilesToDecode; f++ {
-		fileNameLength, err := d.readUInt()
-		if err != nil {
-			return nil, err
-		}
-		fileName, err := d.readBytes(fileNameLength)
-		if err != nil {
-			return nil, err
-		}
-		fileLength, err := d.readUInt()
-		if err != nil {
-			return nil, err
-		}
-		fileBytes, err := d.readBytes(fileLength)
+
+	files, d.signer, err = signature.Verify(files, signatureEntry, d.trustedSigners)
+	logger.Debug("Decoded files from image",
+		"lsbs", d.LSBsToUse,
+		"sealed", d.sealed != nil,
+		"files", len(files),
+		"signed", d.signer != nil,
+		"duration", time.Since(decodeStart),
+	)
+	return files, err
+}
+
+// TrustSigners sets the keys trusted to sign decoded files, after which DecodeFiles fails unless the files were signed
+// by one of them. Without trusted keys any valid signature is accepted, while invalid signatures are always rejected
+func (d *Decoder) TrustSigners(trustedSigners []signature.TrustedKey) {
+	d.trustedSigners = trustedSigners
+}
+
+// Signer returns who signed the files returned by DecodeFiles, or nil if they were not signed
+func (d *Decoder) Signer() *model.Signer {
+	return d.signer
+}
+
+// decodeFiles reads the files from r, which reads from the decoder, along with their signature entry if they were signed
+func (d *Decoder) decodeFiles(r io.Reader) ([]model.OutputFile, []byte, error) {
+	if d.sealed != nil {
+		// Sealed payloads are only authenticated once fully read, so they are never decoded into files before that
+		sealedBytes, err := io.ReadAll(r)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
+		return payload.ReadSignedFiles(bytes.NewReader(sealedBytes))
+	}
+	return payload.ReadSignedFiles(r)
+}
 
-		decodedFiles = append(decodedFiles, model.OutputFile{
-			Name:    string(fileName),
-			Content: fileBytes,
-		})
+// Read implements io.Reader, reading the data encoded in the image sequentially. Reading past the last opaque pixel
+// returns ErrDecodeFileBounds
+func (d *Decoder) Read(p []byte) (int, error) {
+	if d.sealed != nil {
+		n, err := d.sealed.Read(p)
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return n, ErrDecodeFileBounds
+		}
+		return n, err
 	}
 
-	return decodedFiles, nil
+	n, err := d.readInto(p)
+	if d.keystream != nil {
+		d.keystream.XORKeyStream(p[:n], p[:n])
+	}
+	return n, err
 }
 
 func (d *Decoder) decodeLSBsToUse() error {
 	// Find first opaque pixel, which will contain the LSBs
-	var opaquePixelFound bool
-	for p := 3; p < len(d.image.Pix); p += 4 {
-		if d.image.Pix[p] == 255 {
-			d.currentSubPixel = p - 3
-			opaquePixelFound = true
-			break
-		}
-	}
-
+	firstOpaquePixel, opaquePixelFound := findFirstOpaquePixel(d.image)
 	if !opaquePixelFound {
 		return ErrDecodeFileBounds
 	}
 
-	firstPixel := d.image.Pix[d.currentSubPixel : d.currentSubPixel+3]
+	firstPixel := d.image.Pix[firstOpaquePixel : firstOpaquePixel+3]
 	// Value will be 0-7 (3 bit value), we add 1 to restore the original 1-8 value
 	d.LSBsToUse = (firstPixel[0] & 1) + (firstPixel[1]&1)<<1 + (firstPixel[2]&1)<<2 + 1
-	d.currentSubPixel += 4
+	d.dataStart = firstOpaquePixel + 4
 	return nil
 }
 
-func (d *Decoder) readUInt() (uint, error) {
-	intBytes, err := d.readBytes(8)
-	if err != nil {
-		return 0, err
-	}
-	return bytesToInt(intBytes), nil
-}
-
 func (d *Decoder) readBytes(numOfBytesToRead uint) (b []byte, retErr error) {
 	// Images not encoded with nsteg will cause random data to be read, which will likely lead to an attempt to decode a
 	// random number of bytes. We set a hard limit to catch these cases and prevent an OOM panic from crashing the
@@ -130,83 +186,44 @@ func (d *Decoder) readBytes(numOfBytesToRead uint) (b []byte, retErr error) {
 		return nil, ErrMaxAllocExceeded
 	}
 
-	d.advanceToNextOpaquePixelIfOnNonOpaquePixel()
-
 	readBytes := make([]byte, numOfBytesToRead)
-	var currByte, currBit byte
-	var currByteIdx uint
-	for currByteIdx < numOfBytesToRead {
-
-		// This path is only traversed by LSB settings of 3, 5, 6 and 7, since these values can cause a pixel to fill a
-		// byte, and have some bits leftover to read. As an example, if LSBs == 3, a pixel will contain 9 bits of
-		// encoded data, which will fill a byte, and one bit will be left over, this path reads that leftover bit
-		// into the current byte
-		if d.bitsLeftToReadInSubPixel > 0 {
-			bitsPreviouslyReadFromPixel := d.LSBsToUse - d.bitsLeftToReadInSubPixel
-			currByte += (d.image.Pix[d.currentSubPixel] & ((1<<d.bitsLeftToReadInSubPixel - 1) << (bitsPreviouslyReadFromPixel))) >> bitsPreviouslyReadFromPixel
-			currBit += d.bitsLeftToReadInSubPixel
-			d.bitsLeftToReadInSubPixel = 0
-			err := d.advanceToNextOpaqueSubpixel()
-			if err != nil {
-				return nil, err
-			}
-		}
-
-		// This path is traversed by all LSB settings
-		if currBit+d.LSBsToUse <= 8 {
-			currByte += (d.image.Pix[d.currentSubPixel] & (1<<d.LSBsToUse - 1)) << currBit
-			currBit += d.LSBsToUse
-			err := d.advanceToNextOpaqueSubpixel()
-			if err != nil {
-				return nil, err
-			}
-		} else { // This path is traversed by all LSB settings
-
-			// This path is only traversed by LSB settings of 3, 5, 6 and 7. As explained above, these LSB settings
-			// cause pixels to only be partially read to fill a byte. Here we finish filling the current byte with
-			// however bits its missing from the current pixel. The remaining bits will be read on the next iteration
-			// in the other if statement targeting these LSB settings
-			if bitsReadFromPixel := 8 - currBit; bitsReadFromPixel > 0 {
-				currByte += (d.image.Pix[d.currentSubPixel] & (1<<bitsReadFromPixel - 1)) << currBit
-				d.bitsLeftToReadInSubPixel = d.LSBsToUse - bitsReadFromPixel
-			}
-
-			readBytes[currByteIdx] = currByte
-			currByteIdx++
-			currByte = 0
-			currBit = 0
-		}
+	if _, err := io.ReadFull(d, readBytes); err != nil {
+		return nil, err
 	}
-
 	return readBytes, nil
 }
 
-func (d *Decoder) advanceToNextOpaqueSubpixel() error {
-	d.currentSubPixel++
-	if d.currentSubPixel%4 == 3 { // Skip alpha channel
-		d.currentSubPixel++
-		d.advanceToNextOpaquePixelIfOnNonOpaquePixel()
+// readInto fills readBytes with the data encoded in the image, carrying on from where the previous read stopped. Reads
+// larger than a chunk are split in chunks, which are located in the image from their offset in the data stream and
+// extracted concurrently, one worker per available CPU
+func (d *Decoder) readInto(readBytes []byte) (int, error) {
+	if d.carrier == nil {
+		d.carrier = &RGBACarrier{}
+		d.carrier.reset(d.image, d.LSBsToUse, d.dataStart, maxIndexSegmentPixels)
 	}
 
-	if d.currentSubPixel > len(d.image.Pix) {
-		return ErrDecodeFileBounds
+	bytesToRead := int(min(uint64(len(readBytes)), (d.carrier.Capacity()-d.bitsDecoded)/8))
+	chunkSizeMultiplier := d.ChunkSizeMultiplier
+	if chunkSizeMultiplier < 1 {
+		chunkSizeMultiplier = config.DefaultChunkSizeMultiplier
 	}
-	return nil
-}
-
-func (d *Decoder) advanceToNextOpaquePixelIfOnNonOpaquePixel() {
-	for d.currentSubPixel < len(d.image.Pix) && d.image.Pix[(d.currentSubPixel/4)*4+3] != 255 {
-		d.currentSubPixel += 4
+	chunkSize := int(d.LSBsToUse) * int(channelsToWrite) * chunkSizeMultiplier
+	err := forEachSpanWithError((bytesToRead+chunkSize-1)/chunkSize, func(from, to int) error {
+		for c := from; c < to; c++ {
+			chunk := readBytes[c*chunkSize : min((c+1)*chunkSize, bytesToRead)]
+			if err := d.carrier.ReadChunk(d.bitsDecoded+uint64(c*chunkSize)*8, chunk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
 	}
-}
+	d.bitsDecoded += uint64(bytesToRead) * 8
 
-func bytesToInt(bytes []byte) uint {
-	var intFromBytes uint
-	for i := 0; i < 7; i++ {
-		intFromBytes += uint(bytes[i])
-		intFromBytes <<= 8
+	if bytesToRead < len(readBytes) {
+		return bytesToRead, ErrDecodeFileBounds
 	}
-	intFromBytes += uint(bytes[len(bytes)-1])
-
-	return intFromBytes
+	return bytesToRead, nil
 }
@@ -1,18 +1,25 @@
 package image
 
 import (
-	"bytes"
+	"context"
+	"crypto/cipher"
 	"errors"
 	fastpng "github.com/amarburg/go-fast-png"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"image"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"log/slog"
 	"nsteg/internal/bits"
+	"nsteg/internal/tracing"
+	"nsteg/pkg/analysis"
 	"nsteg/pkg/config"
 	"nsteg/pkg/model"
-	"os"
-	"strings"
+	"nsteg/pkg/payload"
+	"nsteg/pkg/signature"
+	"runtime"
 	"sync"
 	"time"
 )
@@ -32,29 +39,70 @@ func init() {
 }
 
 type Encoder struct {
-	minChunkSize, chunkSizeMultiplier                int
-	currentByte, currentSubPixel, currentSubPixelBit int
+	minChunkSize, chunkSizeMultiplier int
+
+	// dataStart Index in image.Pix of the pixel the data stream starts at, and bitsEncoded how many bits of the stream
+	// have been encoded so far
+	dataStart   int
+	bitsEncoded uint64
+
+	// carrier Hides the data stream in the image, kept across calls to Reset so that its index is only allocated once
+	carrier RGBACarrier
 
 	image  *image.RGBA
 	config config.ImageEncodeConfig
 	stats  model.EncodeStats
+
+	// original Copy of the image before any data was encoded, only kept when quality metrics are to be computed
+	original *image.RGBA
+
+	// keystream Masks all encoded data in raw mode, see NewRawImageEncoder
+	keystream cipher.Stream
+
+	// chunkBuffers Buffers chunks were read into, kept across calls to Encode and Reset so that they are only allocated
+	// once
+	chunkBuffers [][]byte
+
+	logger *slog.Logger
 }
 
 func NewImageEncoder(image *image.RGBA, iConfig config.ImageEncodeConfig) (*Encoder, error) {
+	enc := &Encoder{}
+	if err := enc.Reset(image, iConfig); err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// Reset prepares the encoder to encode into the image, as if it had just been returned by NewImageEncoder, so it
+// writes the LSBs setting into the image right away. The buffers allocated for previous images are reused, including
+// the copy of the image kept to compute quality metrics, so that a batch of images of the same size encoded by a single
+// encoder only allocates them once. Raw encoders are reset into regular encoders. The zero Encoder is ready to be reset
+func (e *Encoder) Reset(image *image.RGBA, iConfig config.ImageEncodeConfig) error {
 	iConfig.PopulateUnsetConfigVars()
 
-	enc := &Encoder{
+	segmentOrdinals, original, chunkBuffers := e.carrier.index.segmentOrdinals, e.original, e.chunkBuffers
+	*e = Encoder{
 		image:               image,
 		config:              iConfig,
 		minChunkSize:        int(iConfig.LSBsToUse) * int(channelsToWrite),
-		chunkSizeMultiplier: config.DefaultChunkSizeMultiplier,
+		chunkSizeMultiplier: iConfig.ChunkSizeMultiplier,
+		carrier:             RGBACarrier{index: opaquePixelIndex{segmentOrdinals: segmentOrdinals}},
+		chunkBuffers:        chunkBuffers,
+		logger:              loggerOrDiscard(iConfig.Logger),
 	}
-
-	err := enc.encodeLSBsToImage()
-	if err != nil {
-		return nil, err
+	if iConfig.ComputeQualityMetrics {
+		e.original = cloneImageInto(original, image)
 	}
-	return enc, nil
+	return e.encodeLSBsToImage()
+}
+
+// Release drops the image the encoder encoded into, so that an encoder kept to be reset later, such as in a pool, does
+// not hold on to images it is done with. The buffers of the encoder, including the copy of the image kept to compute
+// quality metrics, are kept for the next Reset
+func (e *Encoder) Release() {
+	e.image, e.keystream = nil, nil
+	e.carrier = RGBACarrier{index: opaquePixelIndex{segmentOrdinals: e.carrier.index.segmentOrdinals}}
 }
 
 func (e *Encoder) Stats() model.EncodeStats {
@@ -62,172 +110,262 @@ func (e *Encoder) Stats() model.EncodeStats {
 }
 
 func (e *Encoder) Encode(dataReader io.Reader) error {
-	e.encodeDataToRawImage(dataReader)
-	return nil
+	return e.encodeDataToRawImage(context.Background(), dataReader)
 }
 
 func (e *Encoder) EncodeFiles(files []model.InputFile) error {
+	return e.EncodeFilesContext(context.Background(), files, EncodeOptions{})
+}
+
+// EncodeFilesContext encodes the files as EncodeFiles does, reporting progress to opts.Progress. Encoding stops as
+// soon as the context is done, returning its error and leaving the image partially encoded
+func (e *Encoder) EncodeFilesContext(ctx context.Context, files []model.InputFile, opts EncodeOptions) error {
 	e.stats = model.EncodeStats{}
 
-	dataToEncode, err := e.setupDataReader(files)
+	newProgressTracker(ctx, opts.Progress, model.StageSetup, 0)
+	dataToEncode, payloadSize, err := e.setupDataReader(ctx, files)
 	if err != nil {
 		return err
 	}
 
-	e.encodeDataToRawImage(dataToEncode)
-	return nil
+	tracker := newProgressTracker(ctx, opts.Progress, model.StageEmbedding, payloadSize)
+	if err = e.encodeDataToRawImage(ctx, tracker.wrap(dataToEncode)); err != nil {
+		return err
+	}
+	e.logEmbedded("files")
+	return e.measureQuality()
 }
 
 func (e *Encoder) WriteEncodedPNG(output io.Writer) error {
-	return e.encodeRawImage(output)
+	return e.WriteEncodedPNGContext(context.Background(), output)
+}
+
+// WriteEncodedPNGContext writes the encoded image as WriteEncodedPNG does, tracing it as part of the context
+func (e *Encoder) WriteEncodedPNGContext(ctx context.Context, output io.Writer) error {
+	return e.encodeRawImage(ctx, output)
 }
 
 func (e *Encoder) encodeLSBsToImage() error {
 	packedLSBsToUse := e.config.LSBsToUse - 1 // Save LSBs to use as value 0-7 so it fits in 3 bits (one pixel)
 	LSBsBitReader := bits.NewBitReader([]byte{packedLSBsToUse})
 
-	var opaquePixelFound bool
-	for p := 3; p < len(e.image.Pix); p += 4 {
-		if e.image.Pix[p] == 255 {
-			e.currentSubPixel = p - 3
-			opaquePixelFound = true
-			break
-		}
-	}
-
+	firstOpaquePixel, opaquePixelFound := findFirstOpaquePixel(e.image)
 	if !opaquePixelFound {
 		return ErrImageNotBigEnough
 	}
 
-	for i := 0; i < 3; i++ {
-		e.fillSubPixelLSBs(LSBsBitReader, 1)
-		e.currentSubPixel++
+	for subPixel := firstOpaquePixel; subPixel < firstOpaquePixel+3; subPixel++ {
+		e.image.Pix[subPixel] = ((e.image.Pix[subPixel] >> 1) << 1) + LSBsBitReader.ReadBits(1)
 	}
-	e.currentSubPixel++
+	e.dataStart = firstOpaquePixel + 4
 	return nil
 }
 
-func (e *Encoder) setupDataReader(filesToHide []model.InputFile) (io.Reader, error) {
+func (e *Encoder) setupDataReader(ctx context.Context, filesToHide []model.InputFile) (_ io.Reader, _ int64, err error) {
+	_, span := tracer().Start(ctx, "image.Encoder.setupDataReader", trace.WithAttributes(
+		attribute.Int("nsteg.lsbs", int(e.config.LSBsToUse)),
+		attribute.Int("nsteg.files", len(filesToHide)),
+		attribute.Bool("nsteg.signed", e.config.SigningKey != nil),
+	))
 	setupStart := time.Now()
 	defer func() {
 		e.stats.Setup = time.Since(setupStart)
+		span.SetAttributes(attribute.Int64("nsteg.payload_bytes", e.stats.PayloadBytes), attribute.Int64("nsteg.capacity_bytes", e.stats.CapacityBytes))
+		tracing.EndSpan(span, err)
 	}()
 
-	var dataReaders []io.Reader
-
 	// Scan ahead to count opaque pixels
-	availablePixelChan := make(chan uint64)
+	capacityChan := make(chan Capacity)
 	go func() {
-		var availablePixels uint64
-		for p := 3; p < len(e.image.Pix); p += 4 {
-			if e.image.Pix[p] == 255 {
-				availablePixels++
-			}
-		}
-		availablePixelChan <- availablePixels
+		capacityChan <- ScanCapacity(e.image)
 	}()
 
-	dataReaders = append(dataReaders, bytes.NewReader(intToBitArray(len(filesToHide))))
+	dataReader, payloadSize, err := e.newPayloadReader(filesToHide)
+	capacity := <-capacityChan
+	if err != nil {
+		return nil, 0, err
+	}
+	LSBsToUse := e.config.LSBsToUse
+	availableBytes, fits := capacity.AvailableBytes(LSBsToUse), capacity.Fits(payloadSize, LSBsToUse)
+	if e.keystream != nil {
+		// Raw mode stores no LSBs setting, so the data starts at the first opaque pixel
+		availableBytes, fits = capacity.RawAvailableBytes(LSBsToUse), capacity.FitsRaw(payloadSize, LSBsToUse)
+	}
+	e.stats.PayloadBytes, e.stats.CapacityBytes = payloadSize, availableBytes
+	if !fits {
+		return nil, 0, ErrImageNotBigEnough
+	}
 
-	// encoding requires 3 bits for the LSBs setting and 64 (8 bytes) for the number of files encoded aside from,
-	// aside from the length of the encoded data
-	requiredBitsForEncoding := int64(3 + 64)
-	for _, fileToHide := range filesToHide {
-		splitPathToFile := strings.Split(fileToHide.Name, string(os.PathSeparator))
-		fileName := splitPathToFile[max(len(splitPathToFile)-1, 0)]
-		dataReaders = append(dataReaders,
-			bytes.NewReader(intToBitArray(len(fileName))),
-			bytes.NewReader([]byte(fileName)),
-			bytes.NewReader(intToBitArray(int(fileToHide.Size))),
-			fileToHide.Content)
+	return dataReader, payloadSize, nil
+}
 
-		// length of file name (8 bytes) + file name + length of file (8 bytes) + file contents
-		requiredBitsForEncoding += (8 + int64(len(fileName)) + 8 + fileToHide.Size) * 8
+// newPayloadReader frames the files into a payload, signed with the configured signing key if there is one. Files named
+// like the signature entry are rejected, since they would be mistaken for a signature when decoding
+func (e *Encoder) newPayloadReader(files []model.InputFile) (io.Reader, int64, error) {
+	if err := signature.CheckFileNames(files); err != nil {
+		return nil, 0, err
 	}
-
-	availableBitsInImage := <-availablePixelChan * uint64(channelsToWrite) * uint64(e.config.LSBsToUse)
-	if uint64(requiredBitsForEncoding) > availableBitsInImage {
-		return nil, ErrImageNotBigEnough
+	if e.config.SigningKey != nil {
+		dataReader, payloadSize := signature.NewSignedReader(files, e.config.SigningKey)
+		return dataReader, payloadSize, nil
 	}
-
-	return io.MultiReader(dataReaders...), nil
+	dataReader, payloadSize := payload.NewReader(files)
+	return dataReader, payloadSize, nil
 }
 
-func (e *Encoder) encodeDataToRawImage(dataReader io.Reader) {
+// encodeDataToRawImage reads the data in chunks, which are embedded concurrently by one worker per available CPU. Every
+// chunk is located in the image from its offset in the data stream, so chunks are embedded independently of each other
+func (e *Encoder) encodeDataToRawImage(ctx context.Context, dataReader io.Reader) (err error) {
+	_, span := tracer().Start(ctx, "image.Encoder.encodeDataToRawImage")
 	encodeStart := time.Now()
+	bitsEncodedBefore := e.bitsEncoded
 	defer func() {
 		e.stats.DataEncoding = time.Since(encodeStart)
+		span.SetAttributes(attribute.Int64("nsteg.bytes_encoded", int64(e.bitsEncoded-bitsEncodedBefore)/8))
+		tracing.EndSpan(span, err)
 	}()
 
+	if e.keystream != nil {
+		dataReader = &cipher.StreamReader{S: e.keystream, R: dataReader}
+	}
+
 	chunkSize := max(e.minChunkSize, e.minChunkSize*e.chunkSizeMultiplier)
+	workers := runtime.GOMAXPROCS(0)
+	e.logger.Debug("Embedding data into image", "chunk_size", chunkSize, "workers", workers, "raw", e.keystream != nil)
+	span.SetAttributes(
+		attribute.Int("nsteg.lsbs", int(e.config.LSBsToUse)),
+		attribute.Int("nsteg.chunk_size", chunkSize),
+		attribute.Int("nsteg.workers", workers),
+		attribute.Bool("nsteg.raw", e.keystream != nil),
+	)
+	if e.carrier.image == nil {
+		// Every chunk fills chunkSize*8/minChunkSize opaque pixels, so index segments are kept no larger than a chunk,
+		// to keep locating a chunk cheap compared to embedding it
+		e.carrier.reset(e.image, e.config.LSBsToUse, e.dataStart, chunkSize*8/e.minChunkSize)
+	}
 
-	bytesRead := chunkSize
-	var eofErr error
-	var wg sync.WaitGroup
-	for bytesRead == chunkSize && eofErr != io.EOF {
-		chunkBytes := make([]byte, chunkSize)
-		bytesRead, eofErr = io.ReadFull(dataReader, chunkBytes)
-		chunkBytes = chunkBytes[:bytesRead]
-
-		br := bits.NewBitReader(chunkBytes)
-		LSBsToUse := int(e.config.LSBsToUse)
-
-		// Previous encode left a partially empty pixel, we will finish filling it and then continue encoding as usual
-		if e.currentSubPixelBit > 0 {
-			// example
-			// LSBs 3 - currentSubPixelBit 1 - bitsToFillPixel 01 (binary)
-			// subpixel 10101100
-			// result should be 10101010 (bits 2-3 modified)
-			numOfBitsLeftInPixel := uint(LSBsToUse - e.currentSubPixelBit)
-			bitsToFillPixel := br.ReadBits(numOfBitsLeftInPixel)
-			// Clear bits that we want to fill
-			e.image.Pix[e.currentSubPixel] -= ((e.image.Pix[e.currentSubPixel] << (8 - LSBsToUse)) >> (8 - LSBsToUse + e.currentSubPixelBit)) << e.currentSubPixelBit
-			// Set bits at designated location
-			e.image.Pix[e.currentSubPixel] += bitsToFillPixel << e.currentSubPixelBit
-			e.currentSubPixelBit = 0
-			e.currentSubPixel++
+	type chunk struct {
+		data      []byte
+		bitOffset uint64
+	}
+	chunks := make(chan chunk, workers)
+	// Buffers of embedded chunks are reused, so that memory use does not grow with the size of the data, since at most
+	// one chunk per worker, plus the ones queued and the one being read, are held at once
+	freeBuffers := make(chan []byte, 2*workers+1)
+	for _, buffer := range e.chunkBuffers {
+		if cap(buffer) >= chunkSize && len(freeBuffers) < cap(freeBuffers) {
+			freeBuffers <- buffer
 		}
-		//TODO: error if encoding exceeds image bounds
-		for e.currentSubPixel < len(e.image.Pix) {
-			subPixelInCurrentPixel := e.currentSubPixel % 4
-			if subPixelInCurrentPixel == 0 && e.image.Pix[e.currentSubPixel+3] != 255 {
-				e.currentSubPixel += 4 // Skip to next pixel, since data encoded in non-opaque pixels cannot be recovered reliably
-			} else if br.BitsLeftToRead() >= LSBsToUse || subPixelInCurrentPixel == 3 {
-				if subPixelInCurrentPixel != 3 {
-					e.fillSubPixelLSBs(br, e.config.LSBsToUse)
+	}
+	// embedErrs Holds the first error embedding a chunk, the rest are dropped
+	embedErrs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				if err := e.carrier.WriteChunk(c.bitOffset, c.data); err != nil {
+					select {
+					case embedErrs <- err:
+					default:
+					}
 				}
-				e.currentSubPixel++
-			} else {
-				break // if on opaque pixel, and there is not enough data to fill the pixel, exit loop
+				freeBuffers <- c.data[:chunkSize]
 			}
+		}()
+	}
+
+	for err == nil {
+		// Reading stops as soon as a worker fails, since the rest of the data would never be embedded
+		select {
+		case err = <-embedErrs:
+			continue
+		default:
+		}
+
+		var chunkBytes []byte
+		select {
+		case chunkBytes = <-freeBuffers:
+		default:
+			chunkBytes = make([]byte, chunkSize)
+		}
+		// Chunks are read at multiples of the chunk size into the data stream, which fill whole pixels, so no two
+		// chunks share a sub pixel, even if a previous call to Encode stopped halfway through a chunk
+		chunkBytes = chunkBytes[:chunkSize-int(e.bitsEncoded/8%uint64(chunkSize))]
+		var bytesRead int
+		bytesRead, err = io.ReadFull(dataReader, chunkBytes)
+		if e.bitsEncoded+uint64(bytesRead)*8 > e.carrier.Capacity() {
+			err, bytesRead = ErrImageNotBigEnough, 0
 		}
-		// We have some leftover bits that won't fill a pixel, so we write them in a way that only affects the necessary
-		// number of bits, while leaving the rest intact (in case those bits are modified at some other point in time)
-		if e.currentSubPixel < len(e.image.Pix) && br.BitsLeftToRead() > 0 {
-			// example
-			// LSBs 3 - remainingBits 11 (binary)
-			// subpixel 10101010
-			// result should be 10101011 (bits 1-2 modified)
-
-			numOfBitsLeftToRead := uint(br.BitsLeftToRead())
-			e.image.Pix[e.currentSubPixel] = ((e.image.Pix[e.currentSubPixel] >> numOfBitsLeftToRead) << numOfBitsLeftToRead) + br.ReadBits(numOfBitsLeftToRead)
-			e.currentSubPixelBit = int(numOfBitsLeftToRead)
+		if bytesRead > 0 {
+			chunks <- chunk{data: chunkBytes[:bytesRead], bitOffset: e.bitsEncoded}
+			e.bitsEncoded += uint64(bytesRead) * 8
+		} else {
+			freeBuffers <- chunkBytes[:chunkSize]
 		}
 	}
+	close(chunks)
 	wg.Wait()
+	// Workers may also fail after the data was read to its end
+	select {
+	case embedErr := <-embedErrs:
+		err = embedErr
+	default:
+	}
+
+	e.chunkBuffers = e.chunkBuffers[:0]
+	for len(freeBuffers) > 0 {
+		e.chunkBuffers = append(e.chunkBuffers, <-freeBuffers)
+	}
+
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil
+	}
+	return err
+}
+
+func (e *Encoder) measureQuality() error {
+	if e.original == nil {
+		return nil
+	}
+
+	quality, err := analysis.Compare(e.original, e.image)
+	if err != nil {
+		return err
+	}
+	e.stats.Quality = &quality
+	e.logger.Debug("Measured image quality", "psnr", quality.PSNR, "mse", quality.MSE, "ssim", quality.SSIM)
+	return nil
 }
 
-func (e *Encoder) fillSubPixelLSBs(br *bits.BitReader, LSBsToUse byte) {
-	// Clear least significant bits to use, and then add the new bits
-	e.image.Pix[e.currentSubPixel] = ((e.image.Pix[e.currentSubPixel] >> LSBsToUse) << LSBsToUse) + br.ReadBits(uint(LSBsToUse))
+// logEmbedded logs the stats of embedding the payload, encoded in the mode
+func (e *Encoder) logEmbedded(mode string) {
+	e.logger.Debug("Embedded payload into image",
+		"mode", mode,
+		"lsbs", e.config.LSBsToUse,
+		"payload_bytes", e.stats.PayloadBytes,
+		"capacity_bytes", e.stats.CapacityBytes,
+		"setup", e.stats.Setup,
+		"data_encoding", e.stats.DataEncoding,
+	)
 }
 
-func (e *Encoder) encodeRawImage(outputWriter io.Writer) error {
+func (e *Encoder) encodeRawImage(ctx context.Context, outputWriter io.Writer) (err error) {
+	_, span := tracer().Start(ctx, "image.Encoder.encodeRawImage", trace.WithAttributes(
+		attribute.Int("image.width", e.image.Rect.Dx()),
+		attribute.Int("image.height", e.image.Rect.Dy()),
+		attribute.Int("png.compression", int(e.config.PngCompressionLevel)),
+		attribute.Bool("png.slow_encoder", e.config.SlowPngEncode),
+	))
 	imageEncodeStart := time.Now()
 	defer func() {
 		e.stats.OutputImageEncoding = time.Since(imageEncodeStart)
+		e.logger.Debug("Encoded output PNG", "compression", e.config.PngCompressionLevel, "slow_png", e.config.SlowPngEncode, "duration", e.stats.OutputImageEncoding)
+		tracing.EndSpan(span, err)
 	}()
 
+	outputWriter = &contextWriter{ctx: ctx, writer: outputWriter}
 	if e.config.SlowPngEncode {
 		enc := png.Encoder{CompressionLevel: e.config.PngCompressionLevel}
 		return enc.Encode(outputWriter, e.image)
@@ -236,11 +374,36 @@ func (e *Encoder) encodeRawImage(outputWriter io.Writer) error {
 	return enc.Encode(outputWriter, e.image)
 }
 
-func intToBitArray(i int) []byte {
-	byteArr := make([]byte, 8)
-	for b := uint(0); b < 8; b++ {
-		byteArr[b] = byte((i << (b * 8)) >> 56)
+// findFirstOpaquePixel returns the index in image.Pix of the first opaque pixel, which holds the LSBs setting
+func findFirstOpaquePixel(img *image.RGBA) (int, bool) {
+	for p := 3; p < len(img.Pix); p += 4 {
+		if img.Pix[p] == 255 {
+			return p - 3, true
+		}
 	}
+	return 0, false
+}
 
-	return byteArr
+func cloneImage(img *image.RGBA) *image.RGBA {
+	return cloneImageInto(nil, img)
+}
+
+// cloneImageInto copies the image into dst, reusing its pixels if there is room for those of the image
+func cloneImageInto(dst, img *image.RGBA) *image.RGBA {
+	if dst == nil || cap(dst.Pix) < len(img.Pix) {
+		dst = &image.RGBA{Pix: make([]byte, len(img.Pix))}
+	}
+	dst.Pix, dst.Stride, dst.Rect = dst.Pix[:len(img.Pix)], img.Stride, img.Rect
+	copy(dst.Pix, img.Pix)
+	return dst
+}
+
+func countOpaquePixels(pix []byte) uint64 {
+	var opaquePixels uint64
+	for p := 3; p < len(pix); p += 4 {
+		if pix[p] == 255 {
+			opaquePixels++
+		}
+	}
+	return opaquePixels
 }
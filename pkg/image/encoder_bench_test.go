@@ -7,11 +7,18 @@ import (
 	"io"
 	"nsteg/pkg/config"
 	"nsteg/test"
+	"runtime"
 	"testing"
 )
 
 const (
 	benchImageSize = 5000
+
+	// parallelismBenchLSBsToUse LSBs setting used to benchmark how throughput scales with the number of CPUs
+	parallelismBenchLSBsToUse = 3
+
+	batchBenchImageSize = 1000
+	batchBenchLSBsToUse = 3
 )
 
 func BenchmarkEncodeWithPNGOutput(b *testing.B) {
@@ -127,3 +134,96 @@ func BenchmarkEncodeFiles(b *testing.B) {
 		})
 	}
 }
+
+// BenchmarkEncodeBatch compares the allocations of encoding a batch of images of the same size with a new encoder per
+// image against a single encoder that is reset for every image
+func BenchmarkEncodeBatch(b *testing.B) {
+	img, _ := generateImage(batchBenchImageSize, batchBenchImageSize, false)
+	bytesToEncode := test.GenerateRandomBytes(int(ScanCapacity(img).AvailableBytes(batchBenchLSBsToUse)))
+	iConfig := config.ImageEncodeConfig{LSBsToUse: batchBenchLSBsToUse, ComputeQualityMetrics: true}
+
+	b.Run("NewEncoder", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			testImageEncoder, err := NewImageEncoder(img, iConfig)
+			if err != nil {
+				b.Fatalf("Error creating image encoder for benchmark")
+			}
+			if err = testImageEncoder.Encode(bytes.NewReader(bytesToEncode)); err != nil {
+				b.Fatalf("Error during image encoding: %s", err)
+			}
+		}
+	})
+
+	b.Run("Reset", func(b *testing.B) {
+		b.ReportAllocs()
+		testImageEncoder := &Encoder{}
+		for i := 0; i < b.N; i++ {
+			if err := testImageEncoder.Reset(img, iConfig); err != nil {
+				b.Fatalf("Error resetting image encoder for benchmark")
+			}
+			if err := testImageEncoder.Encode(bytes.NewReader(bytesToEncode)); err != nil {
+				b.Fatalf("Error during image encoding: %s", err)
+			}
+		}
+	})
+}
+
+// BenchmarkEncodeParallelism measures the throughput of embedding data into a large image as the number of CPUs used to
+// embed chunks concurrently grows
+func BenchmarkEncodeParallelism(b *testing.B) {
+	for _, randomizePixelOpaqueness := range []bool{false, true} {
+		b.Run(getOpaquenessLabel(randomizePixelOpaqueness), func(b *testing.B) {
+			img, _ := generateImage(benchImageSize, benchImageSize, randomizePixelOpaqueness)
+			bytesToEncode := test.GenerateRandomBytes(int(ScanCapacity(img).AvailableBytes(parallelismBenchLSBsToUse)))
+			forEachParallelism(b, func(b *testing.B) {
+				b.SetBytes(int64(len(bytesToEncode)))
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					testImageEncoder, err := NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: parallelismBenchLSBsToUse})
+					if err != nil {
+						b.Fatalf("Error creating image encoder for benchmark")
+					}
+					bytesReader := bytes.NewReader(bytesToEncode)
+					b.StartTimer()
+					err = testImageEncoder.Encode(bytesReader)
+					if err != nil {
+						b.Fatalf("Error during image encoding: %s", err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkDecodeParallelism measures the throughput of extracting data from a large image as the number of CPUs used
+// to extract chunks concurrently grows
+func BenchmarkDecodeParallelism(b *testing.B) {
+	for _, randomizePixelOpaqueness := range []bool{false, true} {
+		b.Run(getOpaquenessLabel(randomizePixelOpaqueness), func(b *testing.B) {
+			img, _ := generateImage(benchImageSize, benchImageSize, randomizePixelOpaqueness)
+			numOfBytesToDecode := int(ScanCapacity(img).AvailableBytes(parallelismBenchLSBsToUse))
+			forEachParallelism(b, func(b *testing.B) {
+				b.SetBytes(int64(numOfBytesToDecode))
+				for i := 0; i < b.N; i++ {
+					testImageDecoder := Decoder{image: img, LSBsToUse: parallelismBenchLSBsToUse}
+					_, err := testImageDecoder.Decode(numOfBytesToDecode)
+					if err != nil {
+						b.Fatalf("Error during image decode: %s", err)
+					}
+				}
+			})
+		})
+	}
+}
+
+// forEachParallelism runs the benchmark with GOMAXPROCS set to every power of two up to the number of CPUs
+func forEachParallelism(b *testing.B, benchmark func(b *testing.B)) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(0))
+	for procs := 1; procs <= runtime.NumCPU(); procs *= 2 {
+		b.Run(fmt.Sprintf("GOMAXPROCS=%d", procs), func(b *testing.B) {
+			runtime.GOMAXPROCS(procs)
+			benchmark(b)
+		})
+	}
+}
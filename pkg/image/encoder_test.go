@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"image"
 	"image/png"
+	"math"
 	"math/rand"
 	"nsteg/internal/bits"
 	"nsteg/pkg/config"
@@ -23,17 +24,107 @@ func TestMultiPassEncode(t *testing.T) {
 	runImageTestsWithAllLSBsAndOpaquenessSettings(t, testEncode(true))
 }
 
+func TestEncodeFilesQualityMetrics(t *testing.T) {
+	img, opaquePixels := generateImage(carrierTestImageSize, carrierTestImageSize, false)
+	testFiles := generateFilesToEncode(calculateBytesThatFitInImage(opaquePixels, 1))
+
+	encoder, err := NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: 1, ComputeQualityMetrics: true})
+	if err != nil {
+		t.Fatalf("Error creating image encoder")
+	}
+	err = encoder.EncodeFiles(convertTestInputToStandardInput(testFiles))
+	if err != nil {
+		t.Fatalf("Error encoding files %s", err)
+	}
+
+	// Rewriting every LSB with random data changes half of them on average
+	quality := encoder.Stats().Quality
+	if quality == nil {
+		t.Fatalf("Expected quality metrics to be computed")
+	}
+	if math.Abs(quality.MSE-0.5) > 0.01 {
+		t.Errorf("Expected MSE to be close to 0.5, was %f", quality.MSE)
+	}
+}
+
+func TestEncoderReset(t *testing.T) {
+	runImageTestsWithAllLSBsAndOpaquenessSettings(t, func(t *testing.T, LSBsToUse byte, randomizePixelOpaqueness bool) {
+		// The encoder is first used on a larger image, so every buffer it reuses holds data left over from it
+		previousImage, _ := generateImage(parallelTestImageSize*2, parallelTestImageSize, randomizePixelOpaqueness)
+		resetEncoder, err := NewImageEncoder(previousImage, config.ImageEncodeConfig{LSBsToUse: 8, ChunkSizeMultiplier: 1, ComputeQualityMetrics: true})
+		if err != nil {
+			t.Fatalf("Error creating image encoder: %s", err)
+		}
+		if err = resetEncoder.Encode(bytes.NewReader(test.GenerateRandomBytes(int(ScanCapacity(previousImage).AvailableBytes(8))))); err != nil {
+			t.Fatalf("Error encoding data: %s", err)
+		}
+
+		newEncoderImage, _ := generateImage(parallelTestImageSize, parallelTestImageSize, randomizePixelOpaqueness)
+		resetEncoderImage := cloneImage(newEncoderImage)
+		testFiles := generateFilesToEncode(int(ScanCapacity(newEncoderImage).AvailableBytes(LSBsToUse)))
+		iConfig := config.ImageEncodeConfig{LSBsToUse: LSBsToUse, ChunkSizeMultiplier: 1, ComputeQualityMetrics: true}
+
+		newEncoder, err := NewImageEncoder(newEncoderImage, iConfig)
+		if err != nil {
+			t.Fatalf("Error creating image encoder: %s", err)
+		}
+		if err = newEncoder.EncodeFiles(convertTestInputToStandardInput(testFiles)); err != nil {
+			t.Fatalf("Error encoding files: %s", err)
+		}
+		if err = resetEncoder.Reset(resetEncoderImage, iConfig); err != nil {
+			t.Fatalf("Error resetting image encoder: %s", err)
+		}
+		if err = resetEncoder.EncodeFiles(convertTestInputToStandardInput(testFiles)); err != nil {
+			t.Fatalf("Error encoding files: %s", err)
+		}
+
+		if !bytes.Equal(newEncoderImage.Pix, resetEncoderImage.Pix) {
+			t.Errorf("Image encoded by reset encoder does not match image encoded by new encoder")
+		}
+		if *newEncoder.Stats().Quality != *resetEncoder.Stats().Quality {
+			t.Errorf("Expected quality metrics %+v from reset encoder, got %+v", *newEncoder.Stats().Quality, *resetEncoder.Stats().Quality)
+		}
+	})
+}
+
+func TestEncoderRelease(t *testing.T) {
+	img, _ := generateImage(testImageSize, testImageSize, false)
+	iConfig := config.ImageEncodeConfig{LSBsToUse: 3, ChunkSizeMultiplier: 1, ComputeQualityMetrics: true}
+	encoder, err := NewImageEncoder(img, iConfig)
+	if err != nil {
+		t.Fatalf("Error creating image encoder: %s", err)
+	}
+	originalPix := encoder.original.Pix
+	encoder.Release()
+	if encoder.image != nil {
+		t.Fatal("Expected released encoder not to hold the image")
+	}
+
+	if err = encoder.Reset(img, iConfig); err != nil {
+		t.Fatalf("Error resetting released image encoder: %s", err)
+	}
+	if &encoder.original.Pix[0] != &originalPix[0] {
+		t.Error("Expected the copy of the image for the quality metrics to be reused once reset")
+	}
+	if err = encoder.EncodeFiles(convertTestInputToStandardInput(generateFilesToEncode(100))); err != nil {
+		t.Fatalf("Error encoding files with released image encoder: %s", err)
+	}
+	if encoder.Stats().Quality == nil {
+		t.Error("Expected quality metrics from released image encoder once reset")
+	}
+}
+
 func encodeFiles(t *testing.T, LSBsToUse byte, randomizePixelOpaqueness bool) {
 	img, opaquePixels := generateImage(testImageSize, testImageSize, randomizePixelOpaqueness)
 	testFiles := generateFilesToEncode(calculateBytesThatFitInImage(opaquePixels, LSBsToUse))
 
 	var expectedEncodedBytes []byte
-	expectedEncodedBytes = append(expectedEncodedBytes, intToBitArray(len(testFiles))...)
+	expectedEncodedBytes = append(expectedEncodedBytes, uint64ToBytes(uint64(len(testFiles)))...)
 	for _, file := range testFiles {
-		expectedEncodedBytes = append(expectedEncodedBytes, intToBitArray(len(file.Name))...)
+		expectedEncodedBytes = append(expectedEncodedBytes, uint64ToBytes(uint64(len(file.Name)))...)
 		expectedEncodedBytes = append(expectedEncodedBytes, []byte(file.Name)...)
 
-		expectedEncodedBytes = append(expectedEncodedBytes, intToBitArray(len(file.Content))...)
+		expectedEncodedBytes = append(expectedEncodedBytes, uint64ToBytes(uint64(len(file.Content)))...)
 		fileContent := file.Content
 		expectedEncodedBytes = append(expectedEncodedBytes, fileContent...)
 	}
@@ -2,12 +2,14 @@ package image
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"crypto/sha512"
 	"fmt"
 	"image/png"
 	"math/rand"
 	"nsteg/pkg/config"
 	"nsteg/pkg/model"
+	"nsteg/pkg/signature"
 	"nsteg/test"
 	"testing"
 )
@@ -129,3 +131,43 @@ func calculateOutputFileHashes(file []model.OutputFile) []string {
 
 	return hashes
 }
+
+func TestEncodeDecodeSignedFiles(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating signing key: %s", err)
+	}
+	img, opaquePixels := generateImage(carrierTestImageSize, carrierTestImageSize, true)
+	testFiles := generateFilesToEncode(calculateBytesThatFitInImage(opaquePixels, 2) / 2)
+
+	encoder, err := NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: 2, SigningKey: privateKey})
+	if err != nil {
+		t.Fatalf("Error creating image encoder: %s", err)
+	}
+	if err = encoder.EncodeFiles(convertTestInputToStandardInput(testFiles)); err != nil {
+		t.Fatalf("Error encoding files: %s", err)
+	}
+
+	decoder, err := NewImageDecoder(img)
+	if err != nil {
+		t.Fatalf("Error creating image decoder: %s", err)
+	}
+	decoder.TrustSigners([]signature.TrustedKey{{Name: "sender", PublicKey: publicKey}})
+	decodedFiles, err := decoder.DecodeFiles()
+	if err != nil {
+		t.Fatalf("Error decoding signed files: %s", err)
+	}
+	if signer := decoder.Signer(); signer == nil || signer.Name != "sender" || !signer.Trusted {
+		t.Errorf("Expected files to be signed by the trusted sender, got %+v", signer)
+	}
+
+	originalHashes, decodedHashes := calculateInputFileHashes(testFiles), calculateOutputFileHashes(decodedFiles)
+	if len(originalHashes) != len(decodedHashes) {
+		t.Fatalf("Expected %d decoded files, got %d", len(originalHashes), len(decodedHashes))
+	}
+	for i := range originalHashes {
+		if originalHashes[i] != decodedHashes[i] {
+			t.Errorf("Hash for file %d is not the same after decoding", i)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package image
+
+import (
+	"context"
+	"log/slog"
+)
+
+// discardLogger Logger of encoders and decoders not given one
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler Drops every record, without formatting them
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// loggerOrDiscard returns the logger, or a logger dropping every record if it is nil
+func loggerOrDiscard(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		return discardLogger
+	}
+	return logger
+}
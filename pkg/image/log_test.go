@@ -0,0 +1,41 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"nsteg/pkg/config"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecodeLogging(t *testing.T) {
+	logs := bytes.NewBuffer(nil)
+	logger := slog.New(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	img, _ := generateImage(parallelTestImageSize, parallelTestImageSize, false)
+	encoder, err := NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: 3, Logger: logger})
+	if err != nil {
+		t.Fatalf("Error creating image encoder: %s", err)
+	}
+	if err = encoder.EncodeFiles(convertTestInputToStandardInput(generateFilesToEncode(1024))); err != nil {
+		t.Fatalf("Error encoding files: %s", err)
+	}
+	if err = encoder.WriteEncodedPNG(bytes.NewBuffer(nil)); err != nil {
+		t.Fatalf("Error writing encoded image: %s", err)
+	}
+
+	decoder, err := NewImageDecoder(img)
+	if err != nil {
+		t.Fatalf("Error creating image decoder: %s", err)
+	}
+	if _, err = decoder.DecodeFilesContext(context.Background(), DecodeOptions{Logger: logger}); err != nil {
+		t.Fatalf("Error decoding files: %s", err)
+	}
+
+	for _, message := range []string{"Embedding data into image", "Embedded payload into image", "Encoded output PNG", "Decoded files from image"} {
+		if !strings.Contains(logs.String(), message) {
+			t.Errorf("Expected %q to be logged, got %s", message, logs.String())
+		}
+	}
+}
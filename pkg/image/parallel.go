@@ -0,0 +1,203 @@
+package image
+
+import (
+	"nsteg/internal/bits"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+const (
+	// maxIndexSegmentPixels Largest number of pixels per segment of an opaquePixelIndex, which bounds the number of
+	// pixels scanned to locate an opaque pixel
+	maxIndexSegmentPixels = 4096
+)
+
+// streamPosition Location of a bit of the data stream, which is the sub pixel holding it, and the bit within the LSBs
+// of that sub pixel
+type streamPosition struct {
+	subPixel      int
+	bitInSubPixel uint
+}
+
+// opaquePixelIndex Locates the opaque pixels of an image by their ordinal, counting from the pixel at firstPixel. The
+// pixels are split in segments whose opaque pixels are counted concurrently, so that locating an opaque pixel only
+// requires scanning the segment holding it. This allows every chunk of the data stream to be located, and encoded or
+// decoded, independently of the chunks preceding it
+type opaquePixelIndex struct {
+	pix                       []byte
+	firstPixel, segmentPixels int
+
+	// segmentOrdinals Ordinal of the first opaque pixel of each segment, followed by the total number of opaque pixels
+	segmentOrdinals []uint64
+	fullyOpaque     bool
+}
+
+// reset indexes the opaque pixels of pix, reusing the segment ordinals of the previously indexed pixels if there is
+// room for those of pix
+func (idx *opaquePixelIndex) reset(pix []byte, firstPixel, segmentPixels int) {
+	pixels := max(len(pix)-firstPixel, 0) / 4
+	segmentPixels = max(1, min(segmentPixels, maxIndexSegmentPixels))
+	segments := (pixels + segmentPixels - 1) / segmentPixels
+
+	segmentOrdinals := idx.segmentOrdinals[:0]
+	if cap(segmentOrdinals) < segments+1 {
+		segmentOrdinals = make([]uint64, 0, segments+1)
+	}
+	*idx = opaquePixelIndex{
+		pix:             pix,
+		firstPixel:      firstPixel,
+		segmentPixels:   segmentPixels,
+		segmentOrdinals: segmentOrdinals[:segments+1],
+	}
+	idx.segmentOrdinals[0] = 0
+	forEachSpan(segments, func(from, to int) {
+		for s := from; s < to; s++ {
+			idx.segmentOrdinals[s+1] = countOpaquePixels(idx.segment(s))
+		}
+	})
+	for s := 1; s <= segments; s++ {
+		idx.segmentOrdinals[s] += idx.segmentOrdinals[s-1]
+	}
+	idx.fullyOpaque = idx.count() == uint64(pixels)
+}
+
+// count returns the number of opaque pixels from the first pixel onwards
+func (idx *opaquePixelIndex) count() uint64 {
+	return idx.segmentOrdinals[len(idx.segmentOrdinals)-1]
+}
+
+// locate returns the index in pix of the opaque pixel with the supplied ordinal, or len(pix) if there are not that
+// many opaque pixels
+func (idx *opaquePixelIndex) locate(ordinal uint64) int {
+	if ordinal >= idx.count() {
+		return len(idx.pix)
+	}
+	if idx.fullyOpaque {
+		return idx.firstPixel + int(ordinal)*4
+	}
+
+	s := sort.Search(len(idx.segmentOrdinals)-1, func(s int) bool {
+		return idx.segmentOrdinals[s+1] > ordinal
+	})
+	opaquePixelsToSkip := ordinal - idx.segmentOrdinals[s]
+	segment := idx.segment(s)
+	for p := 0; ; p += 4 {
+		if segment[p+3] != 255 {
+			continue
+		}
+		if opaquePixelsToSkip == 0 {
+			return idx.firstPixel + s*idx.segmentPixels*4 + p
+		}
+		opaquePixelsToSkip--
+	}
+}
+
+// position returns where the bit at the supplied offset of the data stream is hidden, when hiding LSBsToUse bits in
+// each channel written to of every opaque pixel
+func (idx *opaquePixelIndex) position(bitOffset uint64, LSBsToUse byte) streamPosition {
+	slot := bitOffset / uint64(LSBsToUse)
+	return streamPosition{
+		subPixel:      idx.locate(slot/uint64(channelsToWrite)) + int(slot%uint64(channelsToWrite)),
+		bitInSubPixel: uint(bitOffset % uint64(LSBsToUse)),
+	}
+}
+
+// capacity returns the number of bits that can be hidden from the first pixel onwards
+func (idx *opaquePixelIndex) capacity(LSBsToUse byte) uint64 {
+	return idx.count() * uint64(channelsToWrite) * uint64(LSBsToUse)
+}
+
+func (idx *opaquePixelIndex) segment(s int) []byte {
+	start := idx.firstPixel + s*idx.segmentPixels*4
+	return idx.pix[start:min(start+idx.segmentPixels*4, len(idx.pix))]
+}
+
+// embedChunk hides the chunk in the LSBs of the opaque pixels, starting at pos. Any bits that do not fill the LSBs of
+// the last sub pixel are written to its least significant bits, leaving the rest intact, so that the following chunk
+// can be embedded before or after this one
+func embedChunk(pix, chunk []byte, pos streamPosition, LSBsToUse byte) {
+	br := bits.NewBitReader(chunk)
+	subPixel, bitInSubPixel := pos.subPixel, pos.bitInSubPixel
+	for br.BitsLeftToRead() > 0 && subPixel < len(pix) {
+		if subPixel%4 == 3 {
+			subPixel++ // Skip alpha channel
+			continue
+		}
+		if subPixel%4 == 0 && pix[subPixel+3] != 255 {
+			subPixel += 4 // Skip to next pixel, since data encoded in non-opaque pixels cannot be recovered reliably
+			continue
+		}
+
+		bitsToWrite := min(uint(LSBsToUse)-bitInSubPixel, uint(br.BitsLeftToRead()))
+		mask := byte((1<<bitsToWrite - 1) << bitInSubPixel)
+		pix[subPixel] = pix[subPixel]&^mask | (br.ReadBits(bitsToWrite)<<bitInSubPixel)&mask
+		bitInSubPixel = 0
+		subPixel++
+	}
+}
+
+// extractChunk fills the chunk with the bits hidden by embedChunk, starting at pos. The caller must make sure there
+// are enough opaque pixels left to fill the chunk
+func extractChunk(pix, chunk []byte, pos streamPosition, LSBsToUse byte) {
+	var pending uint32
+	var pendingBits uint
+	subPixel, bitInSubPixel := pos.subPixel, pos.bitInSubPixel
+	for i := 0; i < len(chunk); {
+		if subPixel%4 == 3 {
+			subPixel++ // Skip alpha channel
+			continue
+		}
+		if subPixel%4 == 0 && pix[subPixel+3] != 255 {
+			subPixel += 4
+			continue
+		}
+
+		bitsToRead := uint(LSBsToUse) - bitInSubPixel
+		pending |= uint32((pix[subPixel]>>bitInSubPixel)&(1<<bitsToRead-1)) << pendingBits
+		pendingBits += bitsToRead
+		bitInSubPixel = 0
+		subPixel++
+
+		for ; pendingBits >= 8 && i < len(chunk); i++ {
+			chunk[i] = byte(pending)
+			pending >>= 8
+			pendingBits -= 8
+		}
+	}
+}
+
+// forEachSpan splits [0, n) into one contiguous span per available CPU, and calls f concurrently for each of them
+func forEachSpan(n int, f func(from, to int)) {
+	spans := min(runtime.GOMAXPROCS(0), n)
+	if spans <= 1 {
+		f(0, n)
+		return
+	}
+
+	var wg sync.WaitGroup
+	for span := 0; span < spans; span++ {
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+			f(from, to)
+		}(span*n/spans, (span+1)*n/spans)
+	}
+	wg.Wait()
+}
+
+// forEachSpanWithError calls f as forEachSpan does, returning the first error returned by any of the calls
+func forEachSpanWithError(n int, f func(from, to int) error) error {
+	var mu sync.Mutex
+	var firstErr error
+	forEachSpan(n, func(from, to int) {
+		if err := f(from, to); err != nil {
+			mu.Lock()
+			defer mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	})
+	return firstErr
+}
@@ -0,0 +1,77 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"nsteg/pkg/config"
+	"nsteg/test"
+	"testing"
+)
+
+const parallelTestImageSize = 300
+
+func TestChunkedEncodeDecodeMatchesSingleChunk(t *testing.T) {
+	runImageTestsWithAllLSBsAndOpaquenessSettings(t, func(t *testing.T, LSBsToUse byte, randomizePixelOpaqueness bool) {
+		singleChunkImage, _ := generateImage(parallelTestImageSize, parallelTestImageSize, randomizePixelOpaqueness)
+		chunkedImage := cloneImage(singleChunkImage)
+		data := test.GenerateRandomBytes(int(ScanCapacity(singleChunkImage).AvailableBytes(LSBsToUse)))
+
+		singleChunkEncoder, err := NewImageEncoder(singleChunkImage, config.ImageEncodeConfig{LSBsToUse: LSBsToUse, ChunkSizeMultiplier: len(data)})
+		if err != nil {
+			t.Fatalf("Error creating image encoder: %s", err)
+		}
+		if err = singleChunkEncoder.Encode(bytes.NewReader(data)); err != nil {
+			t.Fatalf("Error encoding data: %s", err)
+		}
+
+		// Encoding in several calls leaves chunks unfinished, which the following call must complete before carrying on
+		chunkedEncoder, err := NewImageEncoder(chunkedImage, config.ImageEncodeConfig{LSBsToUse: LSBsToUse, ChunkSizeMultiplier: 1})
+		if err != nil {
+			t.Fatalf("Error creating image encoder: %s", err)
+		}
+		for _, part := range [][]byte{data[:1], data[1:8], data[8 : len(data)/2], data[len(data)/2:]} {
+			if err = chunkedEncoder.Encode(bytes.NewReader(part)); err != nil {
+				t.Fatalf("Error encoding data: %s", err)
+			}
+		}
+
+		if !bytes.Equal(singleChunkImage.Pix, chunkedImage.Pix) {
+			t.Fatalf("Image encoded in chunks does not match image encoded in a single chunk")
+		}
+
+		decoder, err := NewImageDecoder(chunkedImage)
+		if err != nil {
+			t.Fatalf("Error creating image decoder: %s", err)
+		}
+		decoder.ChunkSizeMultiplier = 1
+		// Reads of varying sizes start and end halfway through sub pixels and chunks
+		decoded := make([]byte, len(data))
+		var readStart int
+		for _, readEnd := range []int{1, 4, 13, len(data) / 3, len(data)} {
+			if _, err = io.ReadFull(decoder, decoded[readStart:readEnd]); err != nil {
+				t.Fatalf("Error decoding data: %s", err)
+			}
+			readStart = readEnd
+		}
+		if !bytes.Equal(decoded, data) {
+			t.Errorf("Decoded data does not match encoded data")
+		}
+		if _, err = decoder.Read(make([]byte, 1)); !errors.Is(err, ErrDecodeFileBounds) {
+			t.Errorf("Expected %s reading past the last opaque pixel, got %v", ErrDecodeFileBounds, err)
+		}
+	})
+}
+
+func TestEncodeExceedingImage(t *testing.T) {
+	img, _ := generateImage(parallelTestImageSize, parallelTestImageSize, true)
+	encoder, err := NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: 2, ChunkSizeMultiplier: 1})
+	if err != nil {
+		t.Fatalf("Error creating image encoder: %s", err)
+	}
+
+	data := test.GenerateRandomBytes(int(ScanCapacity(img).AvailableBytes(2)) + 1)
+	if err = encoder.Encode(bytes.NewReader(data)); !errors.Is(err, ErrImageNotBigEnough) {
+		t.Errorf("Expected %s encoding more data than fits, got %v", ErrImageNotBigEnough, err)
+	}
+}
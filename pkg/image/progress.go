@@ -0,0 +1,77 @@
+package image
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"nsteg/pkg/model"
+)
+
+// EncodeOptions Options of the context aware encoding methods, such as Encoder.EncodeFilesContext
+type EncodeOptions struct {
+	// Progress Called whenever the stage changes and as data is embedded. Optional
+	Progress model.ProgressFunc
+}
+
+// DecodeOptions Options of Decoder.DecodeFilesContext
+type DecodeOptions struct {
+	// Progress Called whenever the stage changes and as data is extracted. Optional
+	Progress model.ProgressFunc
+
+	// Logger Receives the diagnostics of the decoder, at debug level. Optional
+	Logger *slog.Logger
+}
+
+// progressTracker Reports the progress of a stage, and stops it once its context is done
+type progressTracker struct {
+	ctx      context.Context
+	progress model.Progress
+	report   model.ProgressFunc
+}
+
+func newProgressTracker(ctx context.Context, report model.ProgressFunc, stage model.Stage, totalBytes int64) *progressTracker {
+	t := &progressTracker{ctx: ctx, progress: model.Progress{Stage: stage, TotalBytes: totalBytes}, report: report}
+	if report != nil {
+		report(t.progress)
+	}
+	return t
+}
+
+// wrap returns a reader counting the bytes read from r towards the progress of the stage. Reads fail with the error
+// of the context once it is done, which aborts whatever is consuming the reader
+func (t *progressTracker) wrap(r io.Reader) io.Reader {
+	return &progressReader{tracker: t, reader: r}
+}
+
+type progressReader struct {
+	tracker *progressTracker
+	reader  io.Reader
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	if err := p.tracker.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := p.reader.Read(b)
+	if n > 0 {
+		p.tracker.progress.BytesProcessed += int64(n)
+		if p.tracker.report != nil {
+			p.tracker.report(p.tracker.progress)
+		}
+	}
+	return n, err
+}
+
+// contextWriter Writer failing with the error of the context once it is done, which aborts whatever is writing to it
+type contextWriter struct {
+	ctx    context.Context
+	writer io.Writer
+}
+
+func (w *contextWriter) Write(b []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return w.writer.Write(b)
+}
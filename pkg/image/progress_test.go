@@ -0,0 +1,88 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"nsteg/pkg/config"
+	"nsteg/pkg/model"
+	"nsteg/pkg/payload"
+	"testing"
+)
+
+func TestEncodeDecodeFilesContextProgress(t *testing.T) {
+	img, opaquePixels := generateImage(carrierTestImageSize, carrierTestImageSize, false)
+	testFiles := generateFilesToEncode(calculateBytesThatFitInImage(opaquePixels, 1))
+	filesToHide := convertTestInputToStandardInput(testFiles)
+	payloadSize := payload.Size(filesToHide)
+
+	encoder, err := NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: 1})
+	if err != nil {
+		t.Fatalf("Error creating image encoder: %s", err)
+	}
+	var encodeProgress []model.Progress
+	err = encoder.EncodeFilesContext(context.Background(), filesToHide, EncodeOptions{Progress: func(p model.Progress) {
+		encodeProgress = append(encodeProgress, p)
+	}})
+	if err != nil {
+		t.Fatalf("Error encoding files: %s", err)
+	}
+
+	if len(encodeProgress) < 3 || encodeProgress[0].Stage != model.StageSetup || encodeProgress[1].Stage != model.StageEmbedding {
+		t.Fatalf("Expected setup and embedding stages to be reported in order, got %+v", encodeProgress)
+	}
+	lastProgress := encodeProgress[len(encodeProgress)-1]
+	if lastProgress.BytesProcessed != payloadSize || lastProgress.TotalBytes != payloadSize {
+		t.Errorf("Expected %d of %d bytes to be embedded, got %+v", payloadSize, payloadSize, lastProgress)
+	}
+
+	decoder, err := NewImageDecoder(img)
+	if err != nil {
+		t.Fatalf("Error creating image decoder: %s", err)
+	}
+	var decodeProgress model.Progress
+	_, err = decoder.DecodeFilesContext(context.Background(), DecodeOptions{Progress: func(p model.Progress) {
+		decodeProgress = p
+	}})
+	if err != nil {
+		t.Fatalf("Error decoding files: %s", err)
+	}
+	if decodeProgress.Stage != model.StageExtracting || decodeProgress.BytesProcessed != payloadSize {
+		t.Errorf("Expected %d bytes to be extracted, got %+v", payloadSize, decodeProgress)
+	}
+}
+
+func TestEncodeDecodeFilesContextCancelled(t *testing.T) {
+	img, opaquePixels := generateImage(carrierTestImageSize, carrierTestImageSize, false)
+	testFiles := generateFilesToEncode(calculateBytesThatFitInImage(opaquePixels, 8))
+
+	encoder, err := NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: 8})
+	if err != nil {
+		t.Fatalf("Error creating image encoder: %s", err)
+	}
+	encoder.chunkSizeMultiplier = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var embeddedAfterCancel int64
+	err = encoder.EncodeFilesContext(ctx, convertTestInputToStandardInput(testFiles), EncodeOptions{Progress: func(p model.Progress) {
+		if p.BytesProcessed > 0 {
+			if ctx.Err() != nil {
+				embeddedAfterCancel = p.BytesProcessed
+			}
+			cancel()
+		}
+	}})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected encoding to be cancelled, got %v", err)
+	}
+	if embeddedAfterCancel != 0 {
+		t.Errorf("Expected no data to be embedded after cancelling, %d bytes were", embeddedAfterCancel)
+	}
+
+	decoder, err := NewImageDecoder(img)
+	if err != nil {
+		t.Fatalf("Error creating image decoder: %s", err)
+	}
+	if _, err = decoder.DecodeFilesContext(ctx, DecodeOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected decoding to be cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package image
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"image"
+	"nsteg/pkg/config"
+	"nsteg/pkg/seal"
+)
+
+var (
+	ErrInvalidLSBsToUse = errors.New("LSBs to use must be between 1 and 8")
+)
+
+// NewRawImageEncoder returns an encoder for raw mode, in which nothing identifying is stored in the clear. The LSBs
+// setting is not written to the first opaque pixel, so it must be supplied out of band to decode, and everything that
+// is encoded, including the counts and file table written by EncodeFiles, is masked with a keystream derived from the
+// key, so that it cannot be told apart from random LSBs without the key.
+//
+// There is nowhere to store a salt in raw mode, so the key is salted with a digest of the bits of the image that
+// encoding leaves untouched. Encoding different payloads into the same cover image with the same key reuses the
+// keystream, which reveals the XOR of both payloads to anyone holding both images, so a key should never be reused
+// with the same cover
+func NewRawImageEncoder(img *image.RGBA, iConfig config.ImageEncodeConfig, key []byte) (*Encoder, error) {
+	if iConfig.LSBsToUse < 1 || iConfig.LSBsToUse > 8 {
+		return nil, ErrInvalidLSBsToUse
+	}
+	iConfig.PopulateUnsetConfigVars()
+
+	firstOpaquePixel, found := findFirstOpaquePixel(img)
+	if !found {
+		return nil, ErrImageNotBigEnough
+	}
+
+	enc := &Encoder{
+		image:               img,
+		config:              iConfig,
+		minChunkSize:        int(iConfig.LSBsToUse) * int(channelsToWrite),
+		chunkSizeMultiplier: iConfig.ChunkSizeMultiplier,
+		dataStart:           firstOpaquePixel,
+		keystream:           newRawKeystream(img, iConfig.LSBsToUse, key),
+		logger:              loggerOrDiscard(iConfig.Logger),
+	}
+	if iConfig.ComputeQualityMetrics {
+		enc.original = cloneImage(img)
+	}
+	return enc, nil
+}
+
+// NewRawImageDecoder returns a decoder for images encoded by an encoder returned by NewRawImageEncoder, with the same
+// LSBs setting and key. Decoding with a wrong key or LSBs setting yields random data
+func NewRawImageDecoder(img *image.RGBA, LSBsToUse byte, key []byte) (*Decoder, error) {
+	if LSBsToUse < 1 || LSBsToUse > 8 {
+		return nil, ErrInvalidLSBsToUse
+	}
+
+	firstOpaquePixel, found := findFirstOpaquePixel(img)
+	if !found {
+		return nil, ErrDecodeFileBounds
+	}
+
+	return &Decoder{
+		image:     img,
+		LSBsToUse: LSBsToUse,
+		dataStart: firstOpaquePixel,
+		keystream: newRawKeystream(img, LSBsToUse, key),
+	}, nil
+}
+
+func newRawKeystream(img *image.RGBA, LSBsToUse byte, key []byte) cipher.Stream {
+	return seal.NewKeystream(seal.DeriveKey(key, coverDigest(img, LSBsToUse)[:seal.SaltSize]))
+}
+
+// coverDigest hashes the bits of the image that are left untouched when encoding with the supplied LSBs setting, so
+// that it is the same before and after encoding
+func coverDigest(img *image.RGBA, LSBsToUse byte) []byte {
+	h := sha256.New()
+	mask := ^byte(1<<LSBsToUse - 1)
+	row := make([]byte, img.Rect.Dx()*4)
+	for y := 0; y < img.Rect.Dy(); y++ {
+		copy(row, img.Pix[y*img.Stride:])
+		for p := 0; p < len(row); p += 4 {
+			// Non opaque pixels are never written to, so they are hashed whole
+			if row[p+3] == 255 {
+				row[p] &= mask
+				row[p+1] &= mask
+				row[p+2] &= mask
+			}
+		}
+		h.Write(row)
+	}
+	return h.Sum(nil)
+}
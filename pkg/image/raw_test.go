@@ -0,0 +1,140 @@
+package image
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"nsteg/pkg/config"
+	"nsteg/pkg/model"
+	"nsteg/pkg/payload"
+	"nsteg/test"
+	"testing"
+)
+
+const rawTestImageSize = 300
+
+func TestRawEncodeDecodeFiles(t *testing.T) {
+	for _, LSBsToUse := range []byte{1, 3, 8} {
+		for _, randomizePixelOpaqueness := range []bool{false, true} {
+			t.Run(fmt.Sprintf("LSBsToUse-%d/%s", LSBsToUse, getOpaquenessLabel(randomizePixelOpaqueness)), func(t *testing.T) {
+				img, opaquePixels := generateImage(rawTestImageSize, rawTestImageSize, randomizePixelOpaqueness)
+				testFiles := generateFilesToEncode(calculateBytesThatFitInImage(opaquePixels, LSBsToUse))
+				originalDigest := coverDigest(img, LSBsToUse)
+
+				encoder, err := NewRawImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: LSBsToUse}, []byte("key"))
+				if err != nil {
+					t.Fatalf("Error creating raw image encoder: %s", err)
+				}
+				if err = encoder.EncodeFiles(convertTestInputToStandardInput(testFiles)); err != nil {
+					t.Fatalf("Error encoding files: %s", err)
+				}
+				if !bytes.Equal(originalDigest, coverDigest(img, LSBsToUse)) {
+					t.Fatalf("Encoding modified bits of the image outside of the LSBs in use")
+				}
+
+				decoder, err := NewRawImageDecoder(img, LSBsToUse, []byte("key"))
+				if err != nil {
+					t.Fatalf("Error creating raw image decoder: %s", err)
+				}
+				decodedFiles, err := decoder.DecodeFiles()
+				if err != nil {
+					t.Fatalf("Error decoding files: %s", err)
+				}
+
+				originalHashes, decodedHashes := calculateInputFileHashes(testFiles), calculateOutputFileHashes(decodedFiles)
+				if len(originalHashes) != len(decodedHashes) {
+					t.Fatalf("Expected %d decoded files, got %d", len(originalHashes), len(decodedHashes))
+				}
+				for i := range originalHashes {
+					if originalHashes[i] != decodedHashes[i] {
+						t.Errorf("Hash for file %d is not the same after decoding", i)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRawModeHidesFraming(t *testing.T) {
+	img, _ := generateImage(rawTestImageSize, rawTestImageSize, false)
+	payload := test.GenerateRandomBytes(1000)
+	encoder, err := NewRawImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: 2}, []byte("key"))
+	if err != nil {
+		t.Fatalf("Error creating raw image encoder: %s", err)
+	}
+	if err = encoder.Encode(bytes.NewReader(append(uint64ToBytes(1), payload...))); err != nil {
+		t.Fatalf("Error encoding: %s", err)
+	}
+
+	// Without the key, the count stored at the start of the image must not be readable in the clear, neither with
+	// nor without skipping the first opaque pixel as the LSBs setting
+	for _, decoder := range []*Decoder{{image: img, LSBsToUse: 2}, {image: img, LSBsToUse: 2, dataStart: 4}} {
+		count, err := decoder.Decode(8)
+		if err != nil {
+			t.Fatalf("Error decoding: %s", err)
+		}
+		if bytes.Equal(count, uint64ToBytes(1)) {
+			t.Errorf("Count is stored in the clear")
+		}
+	}
+
+	for _, key := range []string{"key", "wrong key"} {
+		decoder, err := NewRawImageDecoder(img, 2, []byte(key))
+		if err != nil {
+			t.Fatalf("Error creating raw image decoder: %s", err)
+		}
+		decoded, err := decoder.Decode(8 + len(payload))
+		if err != nil {
+			t.Fatalf("Error decoding: %s", err)
+		}
+		if matches := bytes.Equal(decoded[8:], payload); matches != (key == "key") {
+			t.Errorf("Expected decoding with %q to match the payload: %t, got %t", key, key == "key", matches)
+		}
+	}
+}
+
+func TestRawEncodeExactFit(t *testing.T) {
+	for _, randomizePixelOpaqueness := range []bool{false, true} {
+		t.Run(getOpaquenessLabel(randomizePixelOpaqueness), func(t *testing.T) {
+			img, _ := generateImage(rawTestImageSize, rawTestImageSize, randomizePixelOpaqueness)
+			availableBytes := ScanCapacity(img).RawAvailableBytes(2)
+			if ScanCapacity(img).AvailableBytes(2) >= availableBytes {
+				t.Fatalf("Expected raw mode to hold more than %d bytes, got %d", ScanCapacity(img).AvailableBytes(2), availableBytes)
+			}
+
+			for _, extraBytes := range []int64{0, 1} {
+				// The file fills the whole image, plus the extra bytes, once framed into a payload
+				contentSize := availableBytes - payload.Size([]model.InputFile{{Name: "file"}}) + extraBytes
+				content := test.GenerateRandomBytes(int(contentSize))
+				files := []model.InputFile{{Name: "file", Content: bytes.NewReader(content), Size: contentSize}}
+
+				encoder, err := NewRawImageEncoder(cloneImage(img), config.ImageEncodeConfig{LSBsToUse: 2}, []byte("key"))
+				if err != nil {
+					t.Fatalf("Error creating raw image encoder: %s", err)
+				}
+				err = encoder.EncodeFiles(files)
+				if extraBytes > 0 {
+					if !errors.Is(err, ErrImageNotBigEnough) {
+						t.Errorf("Expected %s encoding %d bytes more than fit, got %v", ErrImageNotBigEnough, extraBytes, err)
+					}
+					continue
+				}
+				if err != nil {
+					t.Fatalf("Error encoding files that fit exactly: %s", err)
+				}
+
+				decoder, err := NewRawImageDecoder(encoder.image, 2, []byte("key"))
+				if err != nil {
+					t.Fatalf("Error creating raw image decoder: %s", err)
+				}
+				decodedFiles, err := decoder.DecodeFiles()
+				if err != nil {
+					t.Fatalf("Error decoding files: %s", err)
+				}
+				if len(decodedFiles) != 1 || !bytes.Equal(decodedFiles[0].Content, content) {
+					t.Errorf("Decoded files do not match the files that fit exactly")
+				}
+			}
+		})
+	}
+}
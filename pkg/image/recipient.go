@@ -0,0 +1,84 @@
+package image
+
+import (
+	"context"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"image"
+	"io"
+	"nsteg/internal/tracing"
+	"nsteg/pkg/carrier"
+	"nsteg/pkg/model"
+	"nsteg/pkg/seal"
+	"time"
+)
+
+// EncodeFilesForRecipients hides the files sealed for the supplied recipients, so that only the holders of their
+// identities can decode them. The key wrapped for each recipient is hidden in the LSBs along with the payload, as
+// written by seal.SealForRecipients, right after the LSBs setting
+func (e *Encoder) EncodeFilesForRecipients(files []model.InputFile, recipients []*seal.Recipient) error {
+	return e.EncodeFilesForRecipientsContext(context.Background(), files, recipients, EncodeOptions{})
+}
+
+// EncodeFilesForRecipientsContext encodes the files as EncodeFilesForRecipients does, reporting progress to
+// opts.Progress. Encoding stops as soon as the context is done, returning its error
+func (e *Encoder) EncodeFilesForRecipientsContext(ctx context.Context, files []model.InputFile, recipients []*seal.Recipient, opts EncodeOptions) (err error) {
+	ctx, span := tracer().Start(ctx, "image.Encoder.EncodeFilesForRecipients", trace.WithAttributes(
+		attribute.Int("nsteg.lsbs", int(e.config.LSBsToUse)),
+		attribute.Int("nsteg.files", len(files)),
+		attribute.Int("nsteg.recipients", len(recipients)),
+	))
+	defer func() { tracing.EndSpan(span, err) }()
+	e.stats = model.EncodeStats{}
+
+	newProgressTracker(ctx, opts.Progress, model.StageSetup, 0)
+	setupStart := time.Now()
+	dataReader, payloadSize, err := e.newPayloadReader(files)
+	if err != nil {
+		return err
+	}
+	capacity := ScanCapacity(e.image)
+	e.stats.PayloadBytes = payloadSize + seal.RecipientsOverhead(len(recipients))
+	e.stats.CapacityBytes = capacity.AvailableBytes(e.config.LSBsToUse)
+	if !capacity.Fits(e.stats.PayloadBytes, e.config.LSBsToUse) {
+		return ErrImageNotBigEnough
+	}
+	c, err := NewRGBACarrier(e.image, e.config.LSBsToUse)
+	if err != nil {
+		return err
+	}
+	e.stats.Setup = time.Since(setupStart)
+
+	tracker := newProgressTracker(ctx, opts.Progress, model.StageEmbedding, payloadSize)
+	encodeStart := time.Now()
+	if err = seal.SealForRecipients(carrier.NewWriter(c), recipients, tracker.wrap(dataReader), payloadSize); err != nil {
+		return err
+	}
+	e.stats.DataEncoding = time.Since(encodeStart)
+	e.logEmbedded("recipients")
+
+	return e.measureQuality()
+}
+
+// NewRecipientImageDecoder returns a decoder for the files encoded by Encoder.EncodeFilesForRecipients, opened with
+// whichever of the supplied identities they were sealed for. seal.ErrNoMatchingIdentity is returned if none was
+func NewRecipientImageDecoder(img *image.RGBA, identities []*seal.Identity) (*Decoder, error) {
+	d, err := NewImageDecoder(img)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewRGBACarrier(img, d.LSBsToUse)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := seal.OpenWithIdentities(carrier.NewReader(c), identities)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, ErrDecodeFileBounds
+	} else if err != nil {
+		return nil, err
+	}
+	d.sealed = sealed
+	return d, nil
+}
@@ -0,0 +1,61 @@
+package image
+
+import (
+	"errors"
+	"nsteg/pkg/config"
+	"nsteg/pkg/seal"
+	"testing"
+)
+
+func TestEncodeDecodeFilesForRecipients(t *testing.T) {
+	var identities []*seal.Identity
+	var recipients []*seal.Recipient
+	for i := 0; i < 2; i++ {
+		identity, err := seal.GenerateIdentity()
+		if err != nil {
+			t.Fatalf("Error generating identity: %s", err)
+		}
+		identities, recipients = append(identities, identity), append(recipients, identity.Recipient())
+	}
+
+	img, opaquePixels := generateImage(carrierTestImageSize, carrierTestImageSize, true)
+	availableBytes := calculateBytesThatFitInImage(opaquePixels, 3) - int(seal.RecipientsOverhead(len(recipients)))
+	testFiles := generateFilesToEncode(availableBytes)
+
+	encoder, err := NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: 3})
+	if err != nil {
+		t.Fatalf("Error creating image encoder: %s", err)
+	}
+	if err = encoder.EncodeFilesForRecipients(convertTestInputToStandardInput(testFiles), recipients); err != nil {
+		t.Fatalf("Error encoding files: %s", err)
+	}
+
+	for i, identity := range identities {
+		decoder, err := NewRecipientImageDecoder(img, []*seal.Identity{identity})
+		if err != nil {
+			t.Fatalf("Error creating decoder for identity %d: %s", i, err)
+		}
+		decodedFiles, err := decoder.DecodeFiles()
+		if err != nil {
+			t.Fatalf("Error decoding files with identity %d: %s", i, err)
+		}
+
+		originalHashes, decodedHashes := calculateInputFileHashes(testFiles), calculateOutputFileHashes(decodedFiles)
+		if len(originalHashes) != len(decodedHashes) {
+			t.Fatalf("Expected %d decoded files, got %d", len(originalHashes), len(decodedHashes))
+		}
+		for f := range originalHashes {
+			if originalHashes[f] != decodedHashes[f] {
+				t.Errorf("Hash for file %d decoded with identity %d is not the same after decoding", f, i)
+			}
+		}
+	}
+
+	outsider, err := seal.GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Error generating identity: %s", err)
+	}
+	if _, err = NewRecipientImageDecoder(img, []*seal.Identity{outsider}); !errors.Is(err, seal.ErrNoMatchingIdentity) {
+		t.Errorf("Expected %s, got %v", seal.ErrNoMatchingIdentity, err)
+	}
+}
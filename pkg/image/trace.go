@@ -0,0 +1,13 @@
+package image
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer returns the tracer of the stages of encoding and decoding, from the global tracer provider, so nothing is
+// recorded unless the application embedding nsteg sets one up. It is looked up on every call rather than once, since
+// tracers obtained before the provider is replaced keep using the previous one
+func tracer() trace.Tracer {
+	return otel.Tracer("nsteg/pkg/image")
+}
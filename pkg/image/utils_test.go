@@ -2,6 +2,7 @@ package image
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"image"
 	"image/color"
@@ -87,6 +88,11 @@ func generateFilesToEncode(availableBytes int) (testFiles []testInputFile) {
 			bytesToUseForFile = availableBytes - numOfBytesGenerated - (8 + len(fileName) + 8)
 			bytesRequiredForNextFile = 8 + len(fileName) + 8 + bytesToUseForFile
 			exit = true
+
+			// Not even an empty file fits in the remaining bytes
+			if bytesToUseForFile < 0 {
+				break
+			}
 		}
 
 		filesToEncode = append(filesToEncode, testInputFile{
@@ -100,6 +106,10 @@ func generateFilesToEncode(availableBytes int) (testFiles []testInputFile) {
 	return filesToEncode
 }
 
+func uint64ToBytes(i uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, i)
+}
+
 func getOpaquenessLabel(randomizeOpaqueness bool) string {
 	if randomizeOpaqueness {
 		return "non-opaque"
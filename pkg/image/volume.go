@@ -0,0 +1,282 @@
+package image
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"image"
+	"io"
+	"nsteg/internal/tracing"
+	"nsteg/pkg/carrier"
+	"nsteg/pkg/model"
+	"nsteg/pkg/seal"
+	"time"
+)
+
+const (
+	// MaxVolumes Number of hidden volumes an image can hold, one per half of its opaque pixels
+	MaxVolumes = 2
+
+	// volumeSaltPixels Pixels at the start of each half of the image holding the salt of its volume, in the least
+	// significant bit of each channel
+	volumeSaltPixels = (seal.SaltSize*8 + int(channelsToWrite) - 1) / int(channelsToWrite)
+
+	// VolumeReservedPixels Pixels of each half of the image not available to the payload of its volume, which hold the
+	// salt and LSBs setting of the volume
+	VolumeReservedPixels = volumeSaltPixels + 1
+
+	// noiseChunkSize Random bytes generated at once when filling the LSBs of the image with noise
+	noiseChunkSize = 64 * 1024
+)
+
+var (
+	ErrVolumeCount         = errors.New("either one or two hidden volumes can be encoded into an image")
+	ErrSameVolumeKeys      = errors.New("hidden volumes must be encoded using different keys")
+	ErrNoVolumeFoundForKey = errors.New("no hidden volume in the image could be opened with the supplied key, either the key is wrong or the image does not hold hidden volumes")
+)
+
+// EncodeVolumes hides each volume in its own half of the opaque pixels of the image, encrypted and authenticated with
+// a key derived from the volume key. Every LSB of the image is overwritten with noise beforehand, so without a key
+// neither volume can be told apart from the noise, nor from each other. This allows revealing a decoy volume under
+// coercion, while denying the existence of the other one.
+//
+// Each half is laid out as follows, with pixels after the salt visited in an order given by a permutation keyed by the
+// volume key:
+//
+//	salt (16 bytes, 1 LSB per channel) | LSBs setting (1 pixel, masked) | sealed payload
+func (e *Encoder) EncodeVolumes(volumes []model.Volume) error {
+	return e.EncodeVolumesContext(context.Background(), volumes, EncodeOptions{})
+}
+
+// EncodeVolumesContext encodes the volumes as EncodeVolumes does, reporting progress to opts.Progress, with the total
+// being the size of all volumes. Encoding stops as soon as the context is done, returning its error
+func (e *Encoder) EncodeVolumesContext(ctx context.Context, volumes []model.Volume, opts EncodeOptions) (err error) {
+	ctx, span := tracer().Start(ctx, "image.Encoder.EncodeVolumes", trace.WithAttributes(
+		attribute.Int("nsteg.lsbs", int(e.config.LSBsToUse)),
+		attribute.Int("nsteg.volumes", len(volumes)),
+	))
+	defer func() { tracing.EndSpan(span, err) }()
+	e.stats = model.EncodeStats{}
+	if len(volumes) == 0 || len(volumes) > MaxVolumes {
+		return ErrVolumeCount
+	}
+	if len(volumes) == 2 && bytes.Equal(volumes[0].Key, volumes[1].Key) {
+		return ErrSameVolumeKeys
+	}
+
+	newProgressTracker(ctx, opts.Progress, model.StageSetup, 0)
+	setupStart := time.Now()
+	halves := splitOpaquePixels(e.image)
+	capacity := ScanCapacity(e.image)
+	dataReaders := make([]io.Reader, len(volumes))
+	payloadSizes := make([]int64, len(volumes))
+	for i, volume := range volumes {
+		dataReaders[i], payloadSizes[i], err = e.newPayloadReader(volume.Files)
+		if err != nil {
+			return err
+		}
+		e.stats.PayloadBytes += payloadSizes[i] + seal.Overhead
+		e.stats.CapacityBytes += capacity.VolumeAvailableBytes(e.config.LSBsToUse) + seal.Overhead
+		if !capacity.FitsVolume(payloadSizes[i], e.config.LSBsToUse) {
+			return ErrImageNotBigEnough
+		}
+	}
+	if err := fillLSBsWithNoise(e.image, halves, e.config.LSBsToUse); err != nil {
+		return err
+	}
+
+	carriers := make([]*volumeCarrier, len(volumes))
+	keys := make([]seal.Key, len(volumes))
+	for i, volume := range volumes {
+		salt := make([]byte, seal.SaltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return err
+		}
+		writeVolumeSalt(e.image, halves[i], salt)
+
+		keys[i] = seal.DeriveKey(volume.Key, salt)
+		carriers[i] = newVolumeCarrier(e.image, halves[i][volumeSaltPixels:], keys[i], e.config.LSBsToUse)
+		carriers[i].writeLSBsToUse()
+	}
+	e.stats.Setup = time.Since(setupStart)
+
+	var totalSize int64
+	for _, payloadSize := range payloadSizes {
+		totalSize += payloadSize
+	}
+	tracker := newProgressTracker(ctx, opts.Progress, model.StageEmbedding, totalSize)
+	encodeStart := time.Now()
+	for i := range volumes {
+		if err := seal.Seal(carrier.NewWriter(carriers[i]), keys[i], tracker.wrap(dataReaders[i]), payloadSizes[i]); err != nil {
+			return err
+		}
+	}
+	e.stats.DataEncoding = time.Since(encodeStart)
+	e.logEmbedded("volumes")
+
+	return e.measureQuality()
+}
+
+// NewKeyedImageDecoder returns a decoder for the hidden volume, encoded by Encoder.EncodeVolumes, which can be opened
+// with the supplied key. ErrNoVolumeFoundForKey is returned if neither volume can be opened with it
+func NewKeyedImageDecoder(img *image.RGBA, key []byte) (*Decoder, error) {
+	for _, half := range splitOpaquePixels(img) {
+		if len(half) <= volumeSaltPixels {
+			continue
+		}
+
+		volumeKey := seal.DeriveKey(key, readVolumeSalt(img, half))
+		vc := newVolumeCarrier(img, half[volumeSaltPixels:], volumeKey, 1)
+		vc.readLSBsToUse()
+
+		volumeReader, err := seal.Open(carrier.NewReader(vc), volumeKey)
+		if errors.Is(err, seal.ErrWrongKey) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		return &Decoder{image: img, LSBsToUse: vc.LSBsToUse, sealed: volumeReader}, nil
+	}
+	return nil, ErrNoVolumeFoundForKey
+}
+
+// volumeCarrier exposes the LSBs of one half of the opaque pixels of an image as a carrier.Carrier, visiting them in
+// an order given by a keyed permutation. The first pixel in that order holds the LSBs setting of the volume
+type volumeCarrier struct {
+	image       *image.RGBA
+	LSBsToUse   byte
+	pixels      []uint32
+	permutation *seal.Permutation
+	lsbsMask    byte
+
+	// Cached image pixel of the last accessed data pixel, since carriers are mostly accessed sequentially
+	cachedDataPixel uint64
+	cachedPixel     int
+}
+
+func newVolumeCarrier(img *image.RGBA, pixels []uint32, key seal.Key, LSBsToUse byte) *volumeCarrier {
+	vc := &volumeCarrier{
+		image:       img,
+		LSBsToUse:   LSBsToUse,
+		pixels:      pixels,
+		permutation: seal.NewPermutation(key.Subkey("permutation"), uint64(len(pixels))),
+		lsbsMask:    key.Subkey("lsbs")[0] & 7,
+	}
+	vc.cachedPixel = vc.pixelAt(0)
+	return vc
+}
+
+func (c *volumeCarrier) Capacity() uint64 {
+	if len(c.pixels) == 0 {
+		return 0
+	}
+	return uint64(len(c.pixels)-1) * uint64(channelsToWrite) * uint64(c.LSBsToUse)
+}
+
+func (c *volumeCarrier) WriteBits(pos uint64, b byte, n uint) error {
+	if pos+uint64(n) > c.Capacity() {
+		return carrier.ErrOutOfBounds
+	}
+	writeSlotBits(c.image.Pix, c, c.LSBsToUse, pos, b, n)
+	return nil
+}
+
+func (c *volumeCarrier) ReadBits(pos uint64, n uint) (byte, error) {
+	if pos+uint64(n) > c.Capacity() {
+		return 0, carrier.ErrOutOfBounds
+	}
+	return readSlotBits(c.image.Pix, c, c.LSBsToUse, pos, n), nil
+}
+
+func (c *volumeCarrier) subPixelForSlot(slot uint64) int {
+	// Data pixels start after the LSBs setting pixel, which is the first one in the permuted order
+	dataPixel := slot/uint64(channelsToWrite) + 1
+	if dataPixel != c.cachedDataPixel {
+		c.cachedDataPixel, c.cachedPixel = dataPixel, c.pixelAt(dataPixel)
+	}
+	return c.cachedPixel + int(slot%uint64(channelsToWrite))
+}
+
+// pixelAt returns the index in image.Pix of the pixel found at the supplied position of the permuted order
+func (c *volumeCarrier) pixelAt(i uint64) int {
+	if len(c.pixels) == 0 {
+		return 0
+	}
+	return int(c.pixels[c.permutation.Index(i)]) * 4
+}
+
+// writeLSBsToUse stores the LSBs setting in the first pixel of the permuted order, masked with bits derived from the
+// key so that it looks as random as the rest of the LSBs
+func (c *volumeCarrier) writeLSBsToUse() {
+	packedLSBsToUse := (c.LSBsToUse - 1) ^ c.lsbsMask
+	pixel := c.pixelAt(0)
+	for channel := 0; channel < int(channelsToWrite); channel++ {
+		c.image.Pix[pixel+channel] = c.image.Pix[pixel+channel]&^1 | (packedLSBsToUse>>channel)&1
+	}
+}
+
+func (c *volumeCarrier) readLSBsToUse() {
+	var packedLSBsToUse byte
+	pixel := c.pixelAt(0)
+	for channel := 0; channel < int(channelsToWrite); channel++ {
+		packedLSBsToUse |= (c.image.Pix[pixel+channel] & 1) << channel
+	}
+	c.LSBsToUse = (packedLSBsToUse ^ c.lsbsMask) + 1
+}
+
+// splitOpaquePixels splits the opaque pixels of the image into two disjoint halves, returning the pixel numbers (index
+// in image.Pix / 4) of each. Alternating pixels are assigned to each half, so both spread across the whole image
+func splitOpaquePixels(img *image.RGBA) [MaxVolumes][]uint32 {
+	var halves [MaxVolumes][]uint32
+	var ordinal int
+	for p := 3; p < len(img.Pix); p += 4 {
+		if img.Pix[p] == 255 {
+			halves[ordinal%MaxVolumes] = append(halves[ordinal%MaxVolumes], uint32(p/4))
+			ordinal++
+		}
+	}
+	return halves
+}
+
+// fillLSBsWithNoise replaces the LSBs of every opaque pixel with random data, so that pixels not used by any volume
+// cannot be told apart from pixels used by one
+func fillLSBsWithNoise(img *image.RGBA, halves [MaxVolumes][]uint32, LSBsToUse byte) error {
+	mask := byte(1<<LSBsToUse - 1)
+	noise := make([]byte, noiseChunkSize)
+	noiseIdx := len(noise)
+	for _, half := range halves {
+		for _, pixel := range half {
+			for channel := 0; channel < int(channelsToWrite); channel++ {
+				if noiseIdx == len(noise) {
+					if _, err := rand.Read(noise); err != nil {
+						return err
+					}
+					noiseIdx = 0
+				}
+				subPixel := int(pixel)*4 + channel
+				img.Pix[subPixel] = img.Pix[subPixel]&^mask | noise[noiseIdx]&mask
+				noiseIdx++
+			}
+		}
+	}
+	return nil
+}
+
+func writeVolumeSalt(img *image.RGBA, half []uint32, salt []byte) {
+	for bit := 0; bit < len(salt)*8; bit++ {
+		subPixel := int(half[bit/int(channelsToWrite)])*4 + bit%int(channelsToWrite)
+		img.Pix[subPixel] = img.Pix[subPixel]&^1 | (salt[bit/8]>>(bit%8))&1
+	}
+}
+
+func readVolumeSalt(img *image.RGBA, half []uint32) []byte {
+	salt := make([]byte, seal.SaltSize)
+	for bit := 0; bit < len(salt)*8; bit++ {
+		subPixel := int(half[bit/int(channelsToWrite)])*4 + bit%int(channelsToWrite)
+		salt[bit/8] |= (img.Pix[subPixel] & 1) << (bit % 8)
+	}
+	return salt
+}
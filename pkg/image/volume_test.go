@@ -0,0 +1,116 @@
+package image
+
+import (
+	"errors"
+	"fmt"
+	"nsteg/pkg/config"
+	"nsteg/pkg/model"
+	"nsteg/pkg/seal"
+	"nsteg/test"
+	"testing"
+)
+
+const volumeTestImageSize = 300
+
+func TestEncodeDecodeVolumes(t *testing.T) {
+	for _, LSBsToUse := range []byte{1, 3, 8} {
+		for _, randomizePixelOpaqueness := range []bool{false, true} {
+			t.Run(fmt.Sprintf("LSBsToUse-%d/%s", LSBsToUse, getOpaquenessLabel(randomizePixelOpaqueness)), func(t *testing.T) {
+				img, _ := generateImage(volumeTestImageSize, volumeTestImageSize, randomizePixelOpaqueness)
+				availableBytes := int(ScanCapacity(img).VolumeAvailableBytes(LSBsToUse))
+				decoyFiles := generateFilesToEncode(availableBytes)
+				hiddenFiles := generateFilesToEncode(availableBytes / 2)
+
+				encoder, err := NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: LSBsToUse})
+				if err != nil {
+					t.Fatalf("Error creating image encoder: %s", err)
+				}
+				err = encoder.EncodeVolumes([]model.Volume{
+					{Key: []byte("decoy key"), Files: convertTestInputToStandardInput(decoyFiles)},
+					{Key: []byte("hidden key"), Files: convertTestInputToStandardInput(hiddenFiles)},
+				})
+				if err != nil {
+					t.Fatalf("Error encoding volumes: %s", err)
+				}
+
+				for key, files := range map[string][]testInputFile{"decoy key": decoyFiles, "hidden key": hiddenFiles} {
+					decoder, err := NewKeyedImageDecoder(img, []byte(key))
+					if err != nil {
+						t.Fatalf("Error creating decoder with %q: %s", key, err)
+					}
+					decodedFiles, err := decoder.DecodeFiles()
+					if err != nil {
+						t.Fatalf("Error decoding volume with %q: %s", key, err)
+					}
+
+					originalHashes, decodedHashes := calculateInputFileHashes(files), calculateOutputFileHashes(decodedFiles)
+					if len(originalHashes) != len(decodedHashes) {
+						t.Fatalf("Expected %d files in volume, got %d", len(originalHashes), len(decodedHashes))
+					}
+					for i := range originalHashes {
+						if originalHashes[i] != decodedHashes[i] {
+							t.Errorf("Hash for file %d of volume opened with %q is not the same after decoding", i, key)
+						}
+					}
+				}
+
+				if _, err = NewKeyedImageDecoder(img, []byte("wrong key")); !errors.Is(err, ErrNoVolumeFoundForKey) {
+					t.Errorf("Expected %s when decoding with the wrong key, got %v", ErrNoVolumeFoundForKey, err)
+				}
+			})
+		}
+	}
+}
+
+func TestEncodeVolumesValidation(t *testing.T) {
+	img, _ := generateImage(volumeTestImageSize, volumeTestImageSize, false)
+	encoder, err := NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: 1})
+	if err != nil {
+		t.Fatalf("Error creating image encoder: %s", err)
+	}
+
+	sameKeyVolumes := []model.Volume{{Key: []byte("key")}, {Key: []byte("key")}}
+	if err = encoder.EncodeVolumes(sameKeyVolumes); !errors.Is(err, ErrSameVolumeKeys) {
+		t.Errorf("Expected %s, got %v", ErrSameVolumeKeys, err)
+	}
+	if err = encoder.EncodeVolumes(nil); !errors.Is(err, ErrVolumeCount) {
+		t.Errorf("Expected %s, got %v", ErrVolumeCount, err)
+	}
+
+	// Number of files, file name length, file name and file length take up 25 bytes
+	tooBigFile := testInputFile{Name: "f", Content: test.GenerateRandomBytes(int(ScanCapacity(img).VolumeAvailableBytes(1)) - 25 + 1)}
+	tooBigVolume := []model.Volume{{Key: []byte("key"), Files: convertTestInputToStandardInput([]testInputFile{tooBigFile})}}
+	if err = encoder.EncodeVolumes(tooBigVolume); !errors.Is(err, ErrImageNotBigEnough) {
+		t.Errorf("Expected %s, got %v", ErrImageNotBigEnough, err)
+	}
+}
+
+func TestVolumeTamperingDetected(t *testing.T) {
+	img, _ := generateImage(volumeTestImageSize, volumeTestImageSize, false)
+	encoder, err := NewImageEncoder(img, config.ImageEncodeConfig{LSBsToUse: 2})
+	if err != nil {
+		t.Fatalf("Error creating image encoder: %s", err)
+	}
+	files := generateFilesToEncode(int(ScanCapacity(img).VolumeAvailableBytes(2)))
+	if err = encoder.EncodeVolumes([]model.Volume{{Key: []byte("key"), Files: convertTestInputToStandardInput(files)}}); err != nil {
+		t.Fatalf("Error encoding volume: %s", err)
+	}
+
+	// Flip a bit of the encrypted payload, past the check value so that the key is still accepted
+	half := splitOpaquePixels(img)[0]
+	key := seal.DeriveKey([]byte("key"), readVolumeSalt(img, half))
+	vc := newVolumeCarrier(img, half[volumeSaltPixels:], key, 2)
+	tamperedBitPos := uint64(100 * 8)
+	bit, _ := vc.ReadBits(tamperedBitPos, 1)
+	if err = vc.WriteBits(tamperedBitPos, bit^1, 1); err != nil {
+		t.Fatalf("Error tampering with volume: %s", err)
+	}
+
+	decoder, err := NewKeyedImageDecoder(img, []byte("key"))
+	if err != nil {
+		t.Fatalf("Error creating decoder: %s", err)
+	}
+	if _, err = decoder.DecodeFiles(); !errors.Is(err, seal.ErrAuthentication) {
+		t.Errorf("Expected %s when decoding a tampered volume, got %v", seal.ErrAuthentication, err)
+	}
+}
@@ -12,3 +12,16 @@ type OutputFile struct {
 	Name    string `json:"name"`
 	Content []byte `json:"content"`
 }
+
+// Volume Files hidden under their own key, independently of any other files hidden in the same image
+type Volume struct {
+	Key   []byte
+	Files []InputFile
+}
+
+// Signer Key that signed decoded files, and whether it is trusted by the decoder
+type Signer struct {
+	Name      string `json:"name,omitempty"`
+	PublicKey string `json:"public_key"`
+	Trusted   bool   `json:"trusted"`
+}
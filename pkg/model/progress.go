@@ -0,0 +1,26 @@
+package model
+
+// Stage Step of an encode or decode in progress
+type Stage string
+
+const (
+	StageReading    Stage = "reading"
+	StageSetup      Stage = "setup"
+	StageEmbedding  Stage = "embedding"
+	StageExtracting Stage = "extracting"
+	StageWriting    Stage = "writing"
+)
+
+// Progress How far an encode or decode has gone
+type Progress struct {
+	Stage Stage `json:"stage"`
+
+	// BytesProcessed Bytes of the payload embedded or extracted so far in the current stage
+	BytesProcessed int64 `json:"bytes_processed"`
+
+	// TotalBytes Size of the payload, or 0 when it is not known, as is the case while decoding
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+// ProgressFunc Receives progress updates, from the goroutine performing the encode or decode, so it should not block
+type ProgressFunc func(Progress)
@@ -8,8 +8,29 @@ type EncodeStats struct {
 	Setup               time.Duration `json:"setup"`
 	DataEncoding        time.Duration `json:"data_encoding"`
 	OutputImageEncoding time.Duration `json:"output_image_encoding"`
+	Quality             *ImageQuality `json:"quality,omitempty"`
+
+	// PayloadBytes Bytes hidden in the image, including framing and encryption overhead, out of the CapacityBytes
+	// available with the LSBs setting used. Hidden volumes add up the payload and capacity of every volume
+	PayloadBytes  int64 `json:"payload_bytes"`
+	CapacityBytes int64 `json:"capacity_bytes"`
+}
+
+// CapacityUsed returns the fraction of the capacity of the image taken up by the payload, from 0 to 1
+func (s EncodeStats) CapacityUsed() float64 {
+	if s.CapacityBytes <= 0 {
+		return 0
+	}
+	return float64(s.PayloadBytes) / float64(s.CapacityBytes)
 }
 
 type DecodeStats struct {
 	DataDecoding time.Duration `json:"data_decoding"`
 }
+
+// ImageQuality Measures of the visual damage done to an image by hiding data in it
+type ImageQuality struct {
+	MSE  float64 `json:"mse"`
+	PSNR float64 `json:"psnr"`
+	SSIM float64 `json:"ssim"`
+}
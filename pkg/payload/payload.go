@@ -0,0 +1,156 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"nsteg/pkg/model"
+	"os"
+	"strings"
+)
+
+const (
+	// intSize Number of bytes used to store each of the counts and lengths in the payload
+	intSize = 8
+
+	MaxBytesAllocatedAtOnce = 1000 * 1000 * 1000
+
+	// signedFlag Bit of the file count set when the last entry of the file table is the signature of the other files,
+	// which is then never decoded as a file. Decoders from before signed payloads read the flagged count as far more
+	// files than the payload holds, so they fail to decode signed payloads instead of writing their signature out
+	signedFlag = 1 << 63
+)
+
+var (
+	ErrMaxAllocExceeded = errors.New("tried to allocate too much memory at once during decoding, which could lead to OOM panic")
+	ErrMissingSignature = errors.New("payload is flagged as signed but holds no signature entry")
+)
+
+// NewReader returns a reader producing the framed payload for the supplied files, along with the number of bytes the
+// reader will produce. The payload is laid out as follows, with all counts and lengths stored as 8 byte big endian
+// integers:
+//
+//	number of files | file name length | file name | file length | file contents | file name length | ...
+//
+// File contents are streamed from each model.InputFile, so they are never fully held in memory
+func NewReader(files []model.InputFile) (io.Reader, int64) {
+	return newReader(files, uint64(len(files))), Size(files)
+}
+
+// newReader returns a reader producing the framed payload for the files, starting with the supplied file count
+func newReader(files []model.InputFile, count uint64) io.Reader {
+	dataReaders := []io.Reader{bytes.NewReader(uint64ToBytes(count))}
+
+	for _, file := range files {
+		fileName := FileName(file.Name)
+		dataReaders = append(dataReaders,
+			bytes.NewReader(uint64ToBytes(uint64(len(fileName)))),
+			bytes.NewReader([]byte(fileName)),
+			bytes.NewReader(uint64ToBytes(uint64(file.Size))),
+			// Contents are never read past their declared size, so that files growing after it was read do not shift
+			// the framing of the files after them
+			io.LimitReader(file.Content, file.Size))
+	}
+
+	return io.MultiReader(dataReaders...)
+}
+
+// NewSignedReader returns a reader producing the framed payload for the supplied files, as NewReader does, with the
+// signature entry appended to the file table and flagged as such in the file count. See ReadSignedFiles
+func NewSignedReader(files []model.InputFile, signature model.InputFile) (io.Reader, int64) {
+	files = append(files[:len(files):len(files)], signature)
+	return newReader(files, uint64(len(files))|signedFlag), Size(files)
+}
+
+// Size returns the number of bytes the framed payload for the supplied files takes up, without reading their contents
+func Size(files []model.InputFile) int64 {
+	payloadSize := int64(intSize)
+	for _, file := range files {
+		// length of file name (8 bytes) + file name + length of file (8 bytes) + file contents
+		payloadSize += intSize + int64(len(FileName(file.Name))) + intSize + file.Size
+	}
+	return payloadSize
+}
+
+// ReadFiles reads a framed payload, as produced by NewReader, from the supplied reader. The signature entry of signed
+// payloads is dropped, see ReadSignedFiles to get it. Any error returned by the reader is returned as is, so that
+// callers can detect carrier specific errors such as reading out of bounds
+func ReadFiles(r io.Reader) ([]model.OutputFile, error) {
+	files, _, err := ReadSignedFiles(r)
+	return files, err
+}
+
+// ReadSignedFiles reads a framed payload as ReadFiles does, also returning the contents of its signature entry if it
+// was produced by NewSignedReader, or nil otherwise
+func ReadSignedFiles(r io.Reader) ([]model.OutputFile, []byte, error) {
+	numOfFilesToDecode, err := readUInt(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	signed := numOfFilesToDecode&signedFlag != 0
+	numOfFilesToDecode &^= signedFlag
+	if signed && numOfFilesToDecode == 0 {
+		return nil, nil, ErrMissingSignature
+	}
+
+	var decodedFiles []model.OutputFile
+	for f := uint64(0); f < numOfFilesToDecode; f++ {
+		fileName, err := readField(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		fileBytes, err := readField(r)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		decodedFiles = append(decodedFiles, model.OutputFile{
+			Name:    string(fileName),
+			Content: fileBytes,
+		})
+	}
+
+	if !signed {
+		return decodedFiles, nil, nil
+	}
+	return decodedFiles[:len(decodedFiles)-1], decodedFiles[len(decodedFiles)-1].Content, nil
+}
+
+// FileName strips any directories from the supplied path, since only the file name is stored in the payload
+func FileName(path string) string {
+	splitPathToFile := strings.Split(path, string(os.PathSeparator))
+	return splitPathToFile[max(len(splitPathToFile)-1, 0)]
+}
+
+func readField(r io.Reader) ([]byte, error) {
+	fieldLength, err := readUInt(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Carriers not holding an nsteg payload will yield random data, which will likely lead to an attempt to read a
+	// random number of bytes. We set a hard limit to catch these cases and prevent an OOM panic from crashing the
+	// program
+	if fieldLength > MaxBytesAllocatedAtOnce {
+		return nil, ErrMaxAllocExceeded
+	}
+
+	field := make([]byte, fieldLength)
+	if _, err = io.ReadFull(r, field); err != nil {
+		return nil, err
+	}
+	return field, nil
+}
+
+func readUInt(r io.Reader) (uint64, error) {
+	intBytes := make([]byte, intSize)
+	if _, err := io.ReadFull(r, intBytes); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(intBytes), nil
+}
+
+func uint64ToBytes(i uint64) []byte {
+	return binary.BigEndian.AppendUint64(make([]byte, 0, intSize), i)
+}
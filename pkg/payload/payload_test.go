@@ -0,0 +1,137 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"nsteg/pkg/model"
+	"nsteg/test"
+	"testing"
+)
+
+func TestPayloadLayout(t *testing.T) {
+	content := []byte("hidden")
+	dataReader, payloadSize := NewReader([]model.InputFile{
+		{Name: "dir/file.txt", Content: bytes.NewReader(content), Size: int64(len(content))},
+	})
+
+	var expectedPayload []byte
+	expectedPayload = binary.BigEndian.AppendUint64(expectedPayload, 1)
+	expectedPayload = binary.BigEndian.AppendUint64(expectedPayload, uint64(len("file.txt")))
+	expectedPayload = append(expectedPayload, "file.txt"...)
+	expectedPayload = binary.BigEndian.AppendUint64(expectedPayload, uint64(len(content)))
+	expectedPayload = append(expectedPayload, content...)
+
+	producedPayload, err := io.ReadAll(dataReader)
+	if err != nil {
+		t.Fatalf("Error reading payload: %s", err)
+	}
+	if !bytes.Equal(expectedPayload, producedPayload) {
+		t.Errorf("Payload layout does not match, expected|got %v|%v", expectedPayload, producedPayload)
+	}
+	if payloadSize != int64(len(expectedPayload)) {
+		t.Errorf("Expected payload size to be %d, was %d", len(expectedPayload), payloadSize)
+	}
+}
+
+func TestPayloadRoundTrip(t *testing.T) {
+	var inputFiles []model.InputFile
+	var contents [][]byte
+	for i := 0; i < 5; i++ {
+		content := test.GenerateRandomBytes(i * 1000)
+		contents = append(contents, content)
+		inputFiles = append(inputFiles, model.InputFile{
+			Name:    string(rune('a' + i)),
+			Content: bytes.NewReader(content),
+			Size:    int64(len(content)),
+		})
+	}
+
+	dataReader, _ := NewReader(inputFiles)
+	outputFiles, err := ReadFiles(dataReader)
+	if err != nil {
+		t.Fatalf("Error reading files from payload: %s", err)
+	}
+
+	if len(outputFiles) != len(inputFiles) {
+		t.Fatalf("Expected %d files, got %d", len(inputFiles), len(outputFiles))
+	}
+	for i, outputFile := range outputFiles {
+		if outputFile.Name != inputFiles[i].Name || !bytes.Equal(outputFile.Content, contents[i]) {
+			t.Errorf("File %d does not match after reading payload", i)
+		}
+	}
+}
+
+func TestSignedPayload(t *testing.T) {
+	content, signature := []byte("hidden"), []byte("signature")
+	dataReader, payloadSize := NewSignedReader(
+		[]model.InputFile{{Name: "file.txt", Content: bytes.NewReader(content), Size: int64(len(content))}},
+		model.InputFile{Name: ".signature", Content: bytes.NewReader(signature), Size: int64(len(signature))},
+	)
+	signedPayload, err := io.ReadAll(dataReader)
+	if err != nil {
+		t.Fatalf("Error reading signed payload: %s", err)
+	}
+	if payloadSize != int64(len(signedPayload)) {
+		t.Errorf("Expected payload size to be %d, was %d", len(signedPayload), payloadSize)
+	}
+	// Decoders from before signed payloads read the flagged count as is, far more files than the payload holds
+	if count := binary.BigEndian.Uint64(signedPayload); count != 2|signedFlag {
+		t.Errorf("Expected file count of 2 flagged as signed, got %x", count)
+	}
+
+	files, signatureEntry, err := ReadSignedFiles(bytes.NewReader(signedPayload))
+	if err != nil {
+		t.Fatalf("Error reading signed files: %s", err)
+	}
+	if len(files) != 1 || files[0].Name != "file.txt" || !bytes.Equal(signatureEntry, signature) {
+		t.Errorf("Expected the file apart from its signature, got %+v and %q", files, signatureEntry)
+	}
+	if files, err = ReadFiles(bytes.NewReader(signedPayload)); err != nil || len(files) != 1 || files[0].Name != "file.txt" {
+		t.Errorf("Expected the signature to be dropped reading files, got %+v, %v", files, err)
+	}
+
+	unsignedReader, _ := NewReader([]model.InputFile{{Name: "file.txt", Content: bytes.NewReader(content), Size: int64(len(content))}})
+	if _, signatureEntry, err = ReadSignedFiles(unsignedReader); err != nil || signatureEntry != nil {
+		t.Errorf("Expected no signature entry for unsigned files, got %q, %v", signatureEntry, err)
+	}
+	if _, _, err = ReadSignedFiles(bytes.NewReader(binary.BigEndian.AppendUint64(nil, signedFlag))); !errors.Is(err, ErrMissingSignature) {
+		t.Errorf("Expected %s, got %v", ErrMissingSignature, err)
+	}
+}
+
+func TestReadFilesWithRandomData(t *testing.T) {
+	randomData := binary.BigEndian.AppendUint64(nil, 1)
+	randomData = binary.BigEndian.AppendUint64(randomData, MaxBytesAllocatedAtOnce+1)
+
+	_, err := ReadFiles(bytes.NewReader(randomData))
+	if !errors.Is(err, ErrMaxAllocExceeded) {
+		t.Errorf("Expected %s, got %v", ErrMaxAllocExceeded, err)
+	}
+}
+
+func TestPayloadStopsAtDeclaredSize(t *testing.T) {
+	// The first file grew after its size was read, which must not shift the second file out of its framing
+	grown, second := test.GenerateRandomBytes(200), test.GenerateRandomBytes(100)
+	dataReader, payloadSize := NewReader([]model.InputFile{
+		{Name: "grown", Content: bytes.NewReader(grown), Size: 150},
+		{Name: "second", Content: bytes.NewReader(second), Size: int64(len(second))},
+	})
+
+	producedPayload, err := io.ReadAll(dataReader)
+	if err != nil {
+		t.Fatalf("Error reading payload: %s", err)
+	}
+	if int64(len(producedPayload)) != payloadSize {
+		t.Fatalf("Expected payload of %d bytes, got %d", payloadSize, len(producedPayload))
+	}
+	outputFiles, err := ReadFiles(bytes.NewReader(producedPayload))
+	if err != nil {
+		t.Fatalf("Error reading files from payload: %s", err)
+	}
+	if len(outputFiles) != 2 || !bytes.Equal(outputFiles[0].Content, grown[:150]) || !bytes.Equal(outputFiles[1].Content, second) {
+		t.Errorf("Expected the grown file to be cut at its declared size, and the second file to be intact")
+	}
+}
@@ -0,0 +1,36 @@
+package seal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	KeySize  = 32
+	SaltSize = 16
+
+	// Argon2id parameters recommended by RFC 9106 for memory constrained environments
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+)
+
+// Key Secret from which every key used to hide a payload is derived
+type Key [KeySize]byte
+
+// DeriveKey derives a key from a passphrase, using Argon2id to slow down brute force attacks. The salt does not need
+// to be secret, but must be random and unique for each payload
+func DeriveKey(passphrase, salt []byte) Key {
+	var key Key
+	copy(key[:], argon2.IDKey(passphrase, salt, argon2Time, argon2Memory, argon2Threads, KeySize))
+	return key
+}
+
+// Subkey derives an independent key for the supplied purpose, so that the same key is never used for different
+// purposes
+func (k Key) Subkey(purpose string) []byte {
+	mac := hmac.New(sha256.New, k[:])
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
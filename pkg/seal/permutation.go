@@ -0,0 +1,67 @@
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	feistelRounds = 4
+)
+
+// Permutation Keyed pseudorandom permutation of the integers in [0, n), used to scatter data over a carrier in an
+// order only the holder of the key can reproduce. It is computed on demand with a Feistel network and cycle walking,
+// so it takes up constant memory regardless of n
+type Permutation struct {
+	n                   uint64
+	halfBits            uint
+	halfMask            uint64
+	roundFunctionCipher cipher.Block
+	roundInput          [aes.BlockSize]byte
+	roundOutput         [aes.BlockSize]byte
+}
+
+func NewPermutation(key []byte, n uint64) *Permutation {
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		panic(err) // Only possible with an invalid key size
+	}
+
+	// The Feistel network permutes a domain of 2^(2*halfBits) values, the smallest such domain containing [0, n)
+	halfBits := uint(max((bits.Len64(max(n, 1)-1)+1)/2, 1))
+	return &Permutation{
+		n:                   n,
+		halfBits:            halfBits,
+		halfMask:            1<<halfBits - 1,
+		roundFunctionCipher: block,
+	}
+}
+
+// Index returns the value i is mapped to. i must be in [0, n)
+func (p *Permutation) Index(i uint64) uint64 {
+	// Cycle walking: values outside [0, n) are permuted again until they fall inside it, which still yields a
+	// permutation of [0, n). Since the domain is at most 4n, few iterations are needed on average
+	for {
+		i = p.feistel(i)
+		if i < p.n {
+			return i
+		}
+	}
+}
+
+func (p *Permutation) feistel(i uint64) uint64 {
+	left, right := i>>p.halfBits, i&p.halfMask
+	for round := 0; round < feistelRounds; round++ {
+		left, right = right, left^p.roundFunction(round, right)
+	}
+	return left<<p.halfBits | right
+}
+
+func (p *Permutation) roundFunction(round int, v uint64) uint64 {
+	binary.BigEndian.PutUint64(p.roundInput[:8], uint64(round))
+	binary.BigEndian.PutUint64(p.roundInput[8:], v)
+	p.roundFunctionCipher.Encrypt(p.roundOutput[:], p.roundInput[:])
+	return binary.BigEndian.Uint64(p.roundOutput[:8]) & p.halfMask
+}
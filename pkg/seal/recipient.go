@@ -0,0 +1,250 @@
+package seal
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"nsteg/internal/keystring"
+	"strings"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	RecipientPrefix = "nsteg-pub-"
+	IdentityPrefix  = "NSTEG-SECRET-KEY-"
+
+	// MaxRecipients Highest number of recipients a payload can be sealed for, which bounds the memory allocated when
+	// reading the recipient count of images not sealed for recipients
+	MaxRecipients = 256
+
+	recipientCountSize = 8
+	wrappedKeySize     = KeySize + 16 // Key plus the GCM tag
+	stanzaSize         = 32 + wrappedKeySize
+
+	wrapKeyInfo = "nsteg x25519 key wrap"
+)
+
+var (
+	ErrNoRecipients       = errors.New("at least one recipient is needed to seal a payload for recipients")
+	ErrTooManyRecipients  = fmt.Errorf("payloads can be sealed for at most %d recipients", MaxRecipients)
+	ErrNoMatchingIdentity = errors.New("none of the supplied identities is a recipient of the payload")
+	ErrInvalidRecipient   = errors.New("invalid recipient, expected a public key starting with " + RecipientPrefix)
+	ErrInvalidIdentity    = errors.New("invalid identity, expected a secret key starting with " + IdentityPrefix)
+)
+
+// Recipient X25519 public key a payload can be sealed for
+type Recipient struct {
+	publicKey *ecdh.PublicKey
+}
+
+// Identity X25519 private key, which opens the payloads sealed for its Recipient
+type Identity struct {
+	privateKey *ecdh.PrivateKey
+}
+
+func GenerateIdentity() (*Identity, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{privateKey: privateKey}, nil
+}
+
+func (i *Identity) Recipient() *Recipient {
+	return &Recipient{publicKey: i.privateKey.PublicKey()}
+}
+
+func (i *Identity) String() string {
+	return keystring.Format(IdentityPrefix, i.privateKey.Bytes())
+}
+
+func (r *Recipient) String() string {
+	return keystring.Format(RecipientPrefix, r.publicKey.Bytes())
+}
+
+func ParseRecipient(s string) (*Recipient, error) {
+	keyBytes, found := keystring.Parse(s, RecipientPrefix)
+	if !found {
+		return nil, ErrInvalidRecipient
+	}
+	publicKey, err := ecdh.X25519().NewPublicKey(keyBytes)
+	if err != nil {
+		return nil, ErrInvalidRecipient
+	}
+	return &Recipient{publicKey: publicKey}, nil
+}
+
+func ParseIdentity(s string) (*Identity, error) {
+	keyBytes, found := keystring.Parse(s, IdentityPrefix)
+	if !found {
+		return nil, ErrInvalidIdentity
+	}
+	privateKey, err := ecdh.X25519().NewPrivateKey(keyBytes)
+	if err != nil {
+		return nil, ErrInvalidIdentity
+	}
+	return &Identity{privateKey: privateKey}, nil
+}
+
+// ParseIdentities reads an identity file, holding one identity per line. Empty lines and lines starting with # are
+// ignored, so that identity files can be annotated, for example with their public key
+func ParseIdentities(r io.Reader) ([]*Identity, error) {
+	var identities []*Identity
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		identity, err := ParseIdentity(line)
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, identity)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(identities) == 0 {
+		return nil, ErrInvalidIdentity
+	}
+	return identities, nil
+}
+
+// RecipientsOverhead Number of bytes a payload sealed for the supplied number of recipients takes up aside from the
+// payload itself
+func RecipientsOverhead(recipients int) int64 {
+	return recipientCountSize + int64(recipients)*stanzaSize + Overhead
+}
+
+// SealForRecipients seals the payload with a random key, which is wrapped for each recipient, writing to w:
+//
+//	number of recipients | stanza for each recipient | sealed payload, as written by Seal
+//
+// Each stanza holds an ephemeral X25519 public key, and the payload key encrypted with AES-256-GCM under a key derived
+// from the shared secret between the ephemeral key and the recipient. Any one recipient can then unwrap the payload
+// key, without the recipients being listed in the clear
+func SealForRecipients(w io.Writer, recipients []*Recipient, payload io.Reader, payloadSize int64) error {
+	if len(recipients) == 0 {
+		return ErrNoRecipients
+	} else if len(recipients) > MaxRecipients {
+		return ErrTooManyRecipients
+	}
+
+	var payloadKey Key
+	if _, err := rand.Read(payloadKey[:]); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(binary.BigEndian.AppendUint64(nil, uint64(len(recipients)))); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		stanza, err := wrapKey(payloadKey, recipient)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(stanza); err != nil {
+			return err
+		}
+	}
+
+	return Seal(w, payloadKey, payload, payloadSize)
+}
+
+// OpenWithIdentities unwraps the payload key of a payload sealed by SealForRecipients with any of the supplied
+// identities, and opens the payload as Open does. ErrNoMatchingIdentity is returned if no identity is a recipient
+func OpenWithIdentities(r io.Reader, identities []*Identity) (io.Reader, error) {
+	countBytes := make([]byte, recipientCountSize)
+	if _, err := io.ReadFull(r, countBytes); err != nil {
+		return nil, err
+	}
+	recipientCount := binary.BigEndian.Uint64(countBytes)
+	if recipientCount == 0 || recipientCount > MaxRecipients {
+		return nil, ErrNoMatchingIdentity
+	}
+
+	// Every stanza is read even after a match, so that the payload is positioned right after them
+	var payloadKey *Key
+	stanza := make([]byte, stanzaSize)
+	for s := uint64(0); s < recipientCount; s++ {
+		if _, err := io.ReadFull(r, stanza); err != nil {
+			return nil, err
+		}
+		for _, identity := range identities {
+			if payloadKey != nil {
+				break
+			}
+			payloadKey = unwrapKey(stanza, identity)
+		}
+	}
+	if payloadKey == nil {
+		return nil, ErrNoMatchingIdentity
+	}
+
+	return Open(r, *payloadKey)
+}
+
+func wrapKey(payloadKey Key, recipient *Recipient) ([]byte, error) {
+	ephemeralKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := ephemeralKey.ECDH(recipient.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ephemeralPublicKey := ephemeralKey.PublicKey().Bytes()
+	aead := newWrapAEAD(sharedSecret, ephemeralPublicKey, recipient.publicKey.Bytes())
+	return aead.Seal(ephemeralPublicKey, make([]byte, aead.NonceSize()), payloadKey[:], nil), nil
+}
+
+// unwrapKey returns the payload key wrapped in the stanza, or nil if the stanza was not wrapped for the identity
+func unwrapKey(stanza []byte, identity *Identity) *Key {
+	ephemeralPublicKey, err := ecdh.X25519().NewPublicKey(stanza[:32])
+	if err != nil {
+		return nil
+	}
+	sharedSecret, err := identity.privateKey.ECDH(ephemeralPublicKey)
+	if err != nil {
+		return nil
+	}
+
+	aead := newWrapAEAD(sharedSecret, stanza[:32], identity.privateKey.PublicKey().Bytes())
+	unwrapped, err := aead.Open(nil, make([]byte, aead.NonceSize()), stanza[32:], nil)
+	if err != nil {
+		return nil
+	}
+	var payloadKey Key
+	copy(payloadKey[:], unwrapped)
+	return &payloadKey
+}
+
+// newWrapAEAD returns the cipher wrapping a payload key for a recipient. Its key is derived from the shared secret and
+// both public keys, and is only ever used once since the ephemeral key is random, so a zero nonce is safe
+func newWrapAEAD(sharedSecret, ephemeralPublicKey, recipientPublicKey []byte) cipher.AEAD {
+	wrapKey := make([]byte, KeySize)
+	salt := append(append([]byte{}, ephemeralPublicKey...), recipientPublicKey...)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, salt, []byte(wrapKeyInfo)), wrapKey); err != nil {
+		panic(err) // HKDF can only fail when reading more than 255 hashes worth of key
+	}
+
+	block, err := aes.NewCipher(wrapKey)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
@@ -0,0 +1,83 @@
+package seal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"nsteg/test"
+	"strings"
+	"testing"
+)
+
+func TestSealForRecipients(t *testing.T) {
+	identities := make([]*Identity, 3)
+	recipients := make([]*Recipient, len(identities))
+	for i := range identities {
+		identity, err := GenerateIdentity()
+		if err != nil {
+			t.Fatalf("Error generating identity: %s", err)
+		}
+		identities[i], recipients[i] = identity, identity.Recipient()
+	}
+	payload := test.GenerateRandomBytes(10000)
+
+	sealedPayload := bytes.NewBuffer(nil)
+	if err := SealForRecipients(sealedPayload, recipients, bytes.NewReader(payload), int64(len(payload))); err != nil {
+		t.Fatalf("Error sealing payload: %s", err)
+	}
+	if int64(sealedPayload.Len()) != int64(len(payload))+RecipientsOverhead(len(recipients)) {
+		t.Errorf("Expected sealed payload to take up %d bytes, took up %d", int64(len(payload))+RecipientsOverhead(len(recipients)), sealedPayload.Len())
+	}
+
+	for i, identity := range identities {
+		payloadReader, err := OpenWithIdentities(bytes.NewReader(sealedPayload.Bytes()), []*Identity{identity})
+		if err != nil {
+			t.Fatalf("Error opening payload with identity %d: %s", i, err)
+		}
+		openedPayload, err := io.ReadAll(payloadReader)
+		if err != nil {
+			t.Fatalf("Error reading payload opened with identity %d: %s", i, err)
+		}
+		if !bytes.Equal(payload, openedPayload) {
+			t.Errorf("Payload opened with identity %d does not match sealed payload", i)
+		}
+	}
+
+	outsider, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Error generating identity: %s", err)
+	}
+	if _, err = OpenWithIdentities(bytes.NewReader(sealedPayload.Bytes()), []*Identity{outsider}); !errors.Is(err, ErrNoMatchingIdentity) {
+		t.Errorf("Expected %s, got %v", ErrNoMatchingIdentity, err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	identity, err := GenerateIdentity()
+	if err != nil {
+		t.Fatalf("Error generating identity: %s", err)
+	}
+
+	identityFile := "# public key: " + identity.Recipient().String() + "\n\n" + identity.String() + "\n"
+	parsedIdentities, err := ParseIdentities(strings.NewReader(identityFile))
+	if err != nil {
+		t.Fatalf("Error parsing identity file: %s", err)
+	}
+	if len(parsedIdentities) != 1 || parsedIdentities[0].String() != identity.String() {
+		t.Errorf("Parsed identity does not match generated identity")
+	}
+
+	parsedRecipient, err := ParseRecipient(identity.Recipient().String())
+	if err != nil {
+		t.Fatalf("Error parsing recipient: %s", err)
+	}
+	if parsedRecipient.String() != identity.Recipient().String() {
+		t.Errorf("Parsed recipient does not match generated recipient")
+	}
+
+	for _, invalid := range []string{"", "nsteg-pub-", identity.String(), RecipientPrefix + "!!!"} {
+		if _, err = ParseRecipient(invalid); !errors.Is(err, ErrInvalidRecipient) {
+			t.Errorf("Expected %s parsing %q, got %v", ErrInvalidRecipient, invalid, err)
+		}
+	}
+}
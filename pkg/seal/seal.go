@@ -0,0 +1,146 @@
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+)
+
+const (
+	checkSize  = 8
+	lengthSize = 8
+	macSize    = sha256.Size
+
+	// Overhead Number of bytes a sealed payload takes up aside from the payload itself
+	Overhead = checkSize + lengthSize + macSize
+)
+
+var (
+	ErrWrongKey       = errors.New("the supplied key does not open the payload")
+	ErrAuthentication = errors.New("the payload failed authentication, it was either modified or corrupted")
+)
+
+// Seal encrypts and authenticates a payload of the supplied size, writing it to w as follows:
+//
+//	check value | encrypted payload length | encrypted payload | MAC
+//
+// The check value lets Open quickly reject wrong keys, and every other field is indistinguishable from random data
+// without the key. The payload is encrypted with AES-256 in CTR mode and authenticated with HMAC-SHA256, so it is
+// streamed without being held in memory
+func Seal(w io.Writer, key Key, payload io.Reader, payloadSize int64) error {
+	if _, err := w.Write(checkValue(key)); err != nil {
+		return err
+	}
+
+	mac := hmac.New(sha256.New, key.Subkey("mac"))
+	encryptedWriter := io.MultiWriter(w, mac)
+	streamWriter := &cipher.StreamWriter{S: newStream(key), W: encryptedWriter}
+
+	if _, err := streamWriter.Write(binary.BigEndian.AppendUint64(nil, uint64(payloadSize))); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(streamWriter, payload, payloadSize); err != nil {
+		return err
+	}
+
+	_, err := w.Write(mac.Sum(nil))
+	return err
+}
+
+// Open checks whether the sealed payload read from r was sealed with the supplied key, returning ErrWrongKey
+// otherwise, and returns a reader producing the decrypted payload. Since the payload is authenticated as it is read,
+// the reader returns ErrAuthentication instead of io.EOF after the last byte if the payload was modified, so callers
+// must read it fully before trusting it
+func Open(r io.Reader, key Key) (io.Reader, error) {
+	check := make([]byte, checkSize)
+	if _, err := io.ReadFull(r, check); err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(check, checkValue(key)) {
+		return nil, ErrWrongKey
+	}
+
+	mac := hmac.New(sha256.New, key.Subkey("mac"))
+	streamReader := &cipher.StreamReader{S: newStream(key), R: io.TeeReader(r, mac)}
+
+	encryptedLength := make([]byte, lengthSize)
+	if _, err := io.ReadFull(streamReader, encryptedLength); err != nil {
+		return nil, err
+	}
+
+	return &openReader{
+		source:        r,
+		payload:       streamReader,
+		mac:           mac,
+		bytesToVerify: int64(binary.BigEndian.Uint64(encryptedLength)),
+	}, nil
+}
+
+type openReader struct {
+	source        io.Reader
+	payload       io.Reader
+	mac           hash.Hash
+	bytesToVerify int64
+	verified      bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	if o.bytesToVerify == 0 {
+		if err := o.verify(); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+
+	n, err := o.payload.Read(p[:min(int64(len(p)), o.bytesToVerify)])
+	o.bytesToVerify -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (o *openReader) verify() error {
+	if o.verified {
+		return nil
+	}
+
+	expectedMAC := make([]byte, macSize)
+	if _, err := io.ReadFull(o.source, expectedMAC); err != nil {
+		return err
+	}
+	if !hmac.Equal(expectedMAC, o.mac.Sum(nil)) {
+		return ErrAuthentication
+	}
+	o.verified = true
+	return nil
+}
+
+// NewKeystream returns a keystream derived from the key, for masking data that cannot be sealed, such as data which
+// has to be readable as a stream with no room for a MAC. It is independent of the keystream used by Seal
+func NewKeystream(key Key) cipher.Stream {
+	return newCTRStream(key.Subkey("keystream"))
+}
+
+// checkValue Value derived from the key, which only someone in possession of the key can compute
+func checkValue(key Key) []byte {
+	return key.Subkey("check")[:checkSize]
+}
+
+func newStream(key Key) cipher.Stream {
+	return newCTRStream(key.Subkey("encryption"))
+}
+
+func newCTRStream(subkey []byte) cipher.Stream {
+	block, err := aes.NewCipher(subkey)
+	if err != nil {
+		panic(err) // Only possible with an invalid key size, which Subkey never produces
+	}
+	// A zero IV is safe since each key only ever encrypts a single payload
+	return cipher.NewCTR(block, make([]byte, aes.BlockSize))
+}
@@ -0,0 +1,81 @@
+package seal
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"nsteg/test"
+	"testing"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := DeriveKey([]byte("passphrase"), test.GenerateRandomBytes(SaltSize))
+	payload := test.GenerateRandomBytes(10000)
+
+	sealedPayload := bytes.NewBuffer(nil)
+	if err := Seal(sealedPayload, key, bytes.NewReader(payload), int64(len(payload))); err != nil {
+		t.Fatalf("Error sealing payload: %s", err)
+	}
+	if sealedPayload.Len() != len(payload)+Overhead {
+		t.Errorf("Expected sealed payload to take up %d bytes, took up %d", len(payload)+Overhead, sealedPayload.Len())
+	}
+
+	// Trailing data, such as the rest of a carrier, must not affect opening the payload
+	sealedPayload.Write(test.GenerateRandomBytes(100))
+	payloadReader, err := Open(sealedPayload, key)
+	if err != nil {
+		t.Fatalf("Error opening payload: %s", err)
+	}
+	openedPayload, err := io.ReadAll(payloadReader)
+	if err != nil {
+		t.Fatalf("Error reading opened payload: %s", err)
+	}
+	if !bytes.Equal(payload, openedPayload) {
+		t.Errorf("Opened payload does not match sealed payload")
+	}
+}
+
+func TestOpenWithWrongKey(t *testing.T) {
+	salt := test.GenerateRandomBytes(SaltSize)
+	sealedPayload := bytes.NewBuffer(nil)
+	if err := Seal(sealedPayload, DeriveKey([]byte("passphrase"), salt), bytes.NewReader([]byte("payload")), 7); err != nil {
+		t.Fatalf("Error sealing payload: %s", err)
+	}
+
+	_, err := Open(sealedPayload, DeriveKey([]byte("wrong passphrase"), salt))
+	if !errors.Is(err, ErrWrongKey) {
+		t.Errorf("Expected %s, got %v", ErrWrongKey, err)
+	}
+}
+
+func TestOpenTamperedPayload(t *testing.T) {
+	key := DeriveKey([]byte("passphrase"), test.GenerateRandomBytes(SaltSize))
+	sealedPayload := bytes.NewBuffer(nil)
+	if err := Seal(sealedPayload, key, bytes.NewReader([]byte("payload")), 7); err != nil {
+		t.Fatalf("Error sealing payload: %s", err)
+	}
+	sealedPayload.Bytes()[checkSize+lengthSize] ^= 1
+
+	payloadReader, err := Open(sealedPayload, key)
+	if err != nil {
+		t.Fatalf("Error opening payload: %s", err)
+	}
+	if _, err = io.ReadAll(payloadReader); !errors.Is(err, ErrAuthentication) {
+		t.Errorf("Expected %s, got %v", ErrAuthentication, err)
+	}
+}
+
+func TestPermutation(t *testing.T) {
+	key := DeriveKey([]byte("passphrase"), test.GenerateRandomBytes(SaltSize)).Subkey("permutation")
+	for _, n := range []uint64{1, 2, 3, 17, 1000, 65536, 100003} {
+		permutation := NewPermutation(key, n)
+		seen := make([]bool, n)
+		for i := uint64(0); i < n; i++ {
+			index := permutation.Index(i)
+			if index >= n || seen[index] {
+				t.Fatalf("Permutation of %d values maps %d to %d, which is out of range or repeated", n, i, index)
+			}
+			seen[index] = true
+		}
+	}
+}
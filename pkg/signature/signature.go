@@ -0,0 +1,244 @@
+package signature
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"nsteg/internal/keystring"
+	"nsteg/pkg/model"
+	"nsteg/pkg/payload"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// FileName Name of the entry of the file table holding the signature, which is always the last one. The entry is
+	// flagged as a signature in the framing, see payload.NewSignedReader, so it is never decoded as a file, but its name
+	// is still reserved so that no decoded file is ever mistaken for it
+	FileName = ".nsteg-signature"
+
+	PublicKeyPrefix  = "nsteg-sig-"
+	PrivateKeyPrefix = "NSTEG-SIGNING-KEY-"
+
+	// entrySize Size of the signature entry contents, the public key of the signer followed by the signature
+	entrySize = ed25519.PublicKeySize + ed25519.SignatureSize
+
+	digestDomain = "nsteg signed payload v1"
+)
+
+var (
+	ErrInvalidSignature = errors.New("the signature of the decoded files is invalid, they were either modified or not signed by the claimed signer")
+	ErrUnsigned         = errors.New("the decoded files are not signed, but only files signed by a trusted key are accepted")
+	ErrUntrustedSigner  = errors.New("the decoded files are signed by a key that is not trusted")
+	ErrInvalidKey       = errors.New("invalid key, expected a key starting with " + PublicKeyPrefix + " or " + PrivateKeyPrefix)
+	ErrReservedFileName = errors.New("files cannot be named " + FileName + ", which is reserved for the signature of signed files")
+)
+
+// TrustedKey Public key whose signatures are trusted, along with a name identifying its owner
+type TrustedKey struct {
+	Name      string
+	PublicKey ed25519.PublicKey
+}
+
+// NewSignedReader returns a reader producing the framed payload for the supplied files, as payload.NewSignedReader
+// does, with the signature of the files as its signature entry. The signature covers the name, size and a digest of
+// the contents of every file, which are digested as they are streamed, so files are never fully held in memory.
+// Payloads read with payload.ReadFiles drop the signature, while decoders from before signed payloads fail to read
+// them at all
+func NewSignedReader(files []model.InputFile, key ed25519.PrivateKey) (io.Reader, int64) {
+	contentHashes := make([]hash.Hash, len(files))
+	signedFiles := make([]model.InputFile, 0, len(files)+1)
+	for i, file := range files {
+		contentHashes[i] = sha512.New()
+		file.Content = io.TeeReader(file.Content, contentHashes[i])
+		signedFiles = append(signedFiles, file)
+	}
+
+	signatureEntry := &lazyReader{build: func() []byte {
+		entries := make([]entry, len(files))
+		for i, file := range files {
+			entries[i] = entry{name: payload.FileName(file.Name), size: uint64(file.Size), contentSum: contentHashes[i].Sum(nil)}
+		}
+		publicKey := key.Public().(ed25519.PublicKey)
+		return append(append([]byte{}, publicKey...), ed25519.Sign(key, digest(entries))...)
+	}}
+
+	return payload.NewSignedReader(signedFiles, model.InputFile{Name: FileName, Size: entrySize, Content: signatureEntry})
+}
+
+// CheckFileNames returns ErrReservedFileName if any of the files is stored under the name of the signature entry,
+// whether the files are signed or not
+func CheckFileNames(files []model.InputFile) error {
+	for _, file := range files {
+		if payload.FileName(file.Name) == FileName {
+			return fmt.Errorf("%w: %s", ErrReservedFileName, file.Name)
+		}
+	}
+	return nil
+}
+
+// Verify checks the signature entry of the decoded files, as returned by payload.ReadSignedFiles for payloads produced
+// by NewSignedReader, returning the files along with who signed them. If trusted keys are supplied, the files must be
+// signed by one of them, otherwise any valid signature is accepted, and reported as untrusted. Unsigned files, whose
+// signature entry is nil, are returned as is, with a nil signer, unless trusted keys are supplied
+func Verify(files []model.OutputFile, signatureEntry []byte, trusted []TrustedKey) ([]model.OutputFile, *model.Signer, error) {
+	if signatureEntry == nil {
+		if len(trusted) > 0 {
+			return nil, nil, ErrUnsigned
+		}
+		return files, nil, nil
+	}
+
+	if len(signatureEntry) != entrySize {
+		return nil, nil, ErrInvalidSignature
+	}
+	publicKey := ed25519.PublicKey(signatureEntry[:ed25519.PublicKeySize])
+
+	entries := make([]entry, len(files))
+	for i, file := range files {
+		contentSum := sha512.Sum512(file.Content)
+		entries[i] = entry{name: file.Name, size: uint64(len(file.Content)), contentSum: contentSum[:]}
+	}
+	if !ed25519.Verify(publicKey, digest(entries), signatureEntry[ed25519.PublicKeySize:]) {
+		return nil, nil, ErrInvalidSignature
+	}
+
+	signer := &model.Signer{PublicKey: FormatPublicKey(publicKey)}
+	for _, trustedKey := range trusted {
+		if trustedKey.PublicKey.Equal(publicKey) {
+			signer.Name, signer.Trusted = trustedKey.Name, true
+			break
+		}
+	}
+	if len(trusted) > 0 && !signer.Trusted {
+		return nil, signer, ErrUntrustedSigner
+	}
+	return files, signer, nil
+}
+
+func FormatPublicKey(key ed25519.PublicKey) string {
+	return keystring.Format(PublicKeyPrefix, key)
+}
+
+// FormatPrivateKey encodes the seed of the private key, from which the whole key is derived
+func FormatPrivateKey(key ed25519.PrivateKey) string {
+	return keystring.Format(PrivateKeyPrefix, key.Seed())
+}
+
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	keyBytes, found := keystring.Parse(s, PublicKeyPrefix)
+	if !found || len(keyBytes) != ed25519.PublicKeySize {
+		return nil, ErrInvalidKey
+	}
+	return keyBytes, nil
+}
+
+func ParsePrivateKey(s string) (ed25519.PrivateKey, error) {
+	seed, found := keystring.Parse(s, PrivateKeyPrefix)
+	if !found || len(seed) != ed25519.SeedSize {
+		return nil, ErrInvalidKey
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// ReadPrivateKey reads a signing key file, as generated by nsteg keygen --signing
+func ReadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	keys, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) != 1 {
+		return nil, ErrInvalidKey
+	}
+	return ParsePrivateKey(keys[0])
+}
+
+// ReadTrustedKeys reads every file in the directory, each holding one or more public keys of a trusted signer, which
+// is named after the file without its extension
+func ReadTrustedKeys(dir string) ([]TrustedKey, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var trustedKeys []TrustedKey
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			continue
+		}
+		keys, err := readKeyFile(filepath.Join(dir, dirEntry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.TrimSuffix(dirEntry.Name(), filepath.Ext(dirEntry.Name()))
+		for _, key := range keys {
+			publicKey, err := ParsePublicKey(key)
+			if err != nil {
+				return nil, err
+			}
+			trustedKeys = append(trustedKeys, TrustedKey{Name: name, PublicKey: publicKey})
+		}
+	}
+	return trustedKeys, nil
+}
+
+// entry Signed fields of a file of the file table
+type entry struct {
+	name       string
+	size       uint64
+	contentSum []byte
+}
+
+func digest(entries []entry) []byte {
+	h := sha512.New()
+	h.Write([]byte(digestDomain))
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(entries))))
+	for _, e := range entries {
+		h.Write(binary.BigEndian.AppendUint64(nil, uint64(len(e.name))))
+		h.Write([]byte(e.name))
+		h.Write(binary.BigEndian.AppendUint64(nil, e.size))
+		h.Write(e.contentSum)
+	}
+	return h.Sum(nil)
+}
+
+// lazyReader reads the bytes returned by build, which is only called on the first read, once every preceding reader
+// of the payload has been fully read
+type lazyReader struct {
+	build  func() []byte
+	reader io.Reader
+}
+
+func (l *lazyReader) Read(p []byte) (int, error) {
+	if l.reader == nil {
+		l.reader = bytes.NewReader(l.build())
+	}
+	return l.reader.Read(p)
+}
+
+// readKeyFile returns the keys in the file, one per line, ignoring empty lines and lines starting with #
+func readKeyFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return keys, scanner.Err()
+}
@@ -0,0 +1,130 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"errors"
+	"nsteg/pkg/model"
+	"nsteg/pkg/payload"
+	"nsteg/test"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func signAndDecode(t *testing.T, key ed25519.PrivateKey, contents ...[]byte) ([]model.OutputFile, []byte) {
+	var files []model.InputFile
+	for i, content := range contents {
+		files = append(files, model.InputFile{Name: filepath.Join("dir", string(rune('a'+i))), Content: bytes.NewReader(content), Size: int64(len(content))})
+	}
+
+	signedReader, size := NewSignedReader(files, key)
+	signedPayload := bytes.NewBuffer(nil)
+	if n, err := signedPayload.ReadFrom(signedReader); err != nil || n != size {
+		t.Fatalf("Expected to read %d bytes of signed payload, read %d: %v", size, n, err)
+	}
+
+	decodedFiles, signatureEntry, err := payload.ReadSignedFiles(signedPayload)
+	if err != nil {
+		t.Fatalf("Error reading signed payload: %s", err)
+	}
+	return decodedFiles, signatureEntry
+}
+
+func TestSignVerify(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	otherPublicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	contents := [][]byte{test.GenerateRandomBytes(1000), {}, test.GenerateRandomBytes(10)}
+	decodedFiles, signatureEntry := signAndDecode(t, privateKey, contents...)
+
+	verifiedFiles, signer, err := Verify(decodedFiles, signatureEntry, []TrustedKey{{Name: "other", PublicKey: otherPublicKey}, {Name: "colleague", PublicKey: publicKey}})
+	if err != nil {
+		t.Fatalf("Error verifying signature: %s", err)
+	}
+	if signer.Name != "colleague" || !signer.Trusted || signer.PublicKey != FormatPublicKey(publicKey) {
+		t.Errorf("Unexpected signer %+v", signer)
+	}
+	if len(verifiedFiles) != len(contents) {
+		t.Fatalf("Expected %d verified files, got %d", len(contents), len(verifiedFiles))
+	}
+	for i, content := range contents {
+		if !bytes.Equal(verifiedFiles[i].Content, content) {
+			t.Errorf("Content of verified file %d does not match signed file", i)
+		}
+	}
+
+	if _, signer, err = Verify(decodedFiles, signatureEntry, nil); err != nil || signer.Trusted {
+		t.Errorf("Expected a valid untrusted signer without trusted keys, got %+v, %v", signer, err)
+	}
+	if _, _, err = Verify(decodedFiles, signatureEntry, []TrustedKey{{Name: "other", PublicKey: otherPublicKey}}); !errors.Is(err, ErrUntrustedSigner) {
+		t.Errorf("Expected %s, got %v", ErrUntrustedSigner, err)
+	}
+
+	decodedFiles[0].Content[0] ^= 1
+	if _, _, err = Verify(decodedFiles, signatureEntry, nil); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected %s verifying modified files, got %v", ErrInvalidSignature, err)
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	unsignedFiles := []model.OutputFile{{Name: "a", Content: []byte("content")}}
+	if files, signer, err := Verify(unsignedFiles, nil, nil); err != nil || signer != nil || len(files) != 1 {
+		t.Errorf("Expected unsigned files to be returned as is, got %v, %+v, %v", files, signer, err)
+	}
+
+	publicKey, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	if _, _, err = Verify(unsignedFiles, nil, []TrustedKey{{PublicKey: publicKey}}); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("Expected %s, got %v", ErrUnsigned, err)
+	}
+}
+
+func TestCheckFileNames(t *testing.T) {
+	if err := CheckFileNames([]model.InputFile{{Name: "a"}, {Name: "dir/b"}}); err != nil {
+		t.Errorf("Expected regular names to be accepted, got %v", err)
+	}
+	for _, name := range []string{FileName, "dir/" + FileName} {
+		if err := CheckFileNames([]model.InputFile{{Name: "a"}, {Name: name}}); !errors.Is(err, ErrReservedFileName) {
+			t.Errorf("Expected %s for %s, got %v", ErrReservedFileName, name, err)
+		}
+	}
+}
+
+func TestReadKeys(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	dir := t.TempDir()
+	keyPath := filepath.Join(dir, "key.txt")
+	trustDir := filepath.Join(dir, "trusted")
+	if err = os.WriteFile(keyPath, []byte("# public key: "+FormatPublicKey(publicKey)+"\n"+FormatPrivateKey(privateKey)+"\n"), 0600); err != nil {
+		t.Fatalf("Error writing key file: %s", err)
+	}
+	if err = os.Mkdir(trustDir, 0700); err != nil {
+		t.Fatalf("Error creating trusted keys dir: %s", err)
+	}
+	if err = os.WriteFile(filepath.Join(trustDir, "colleague.pub"), []byte(FormatPublicKey(publicKey)+"\n"), 0600); err != nil {
+		t.Fatalf("Error writing trusted key file: %s", err)
+	}
+
+	readPrivateKey, err := ReadPrivateKey(keyPath)
+	if err != nil || !readPrivateKey.Equal(privateKey) {
+		t.Errorf("Read private key does not match written key: %v", err)
+	}
+	trustedKeys, err := ReadTrustedKeys(trustDir)
+	if err != nil {
+		t.Fatalf("Error reading trusted keys: %s", err)
+	}
+	if len(trustedKeys) != 1 || trustedKeys[0].Name != "colleague" || !trustedKeys[0].PublicKey.Equal(publicKey) {
+		t.Errorf("Unexpected trusted keys %+v", trustedKeys)
+	}
+}
@@ -1,6 +1,10 @@
 package test
 
-import "math/rand"
+import (
+	"image"
+	"math"
+	"math/rand"
+)
 
 func GenerateRandomBytes(numOfBytesToGenerate int) []byte {
 	generatedBytes := make([]byte, numOfBytesToGenerate)
@@ -10,3 +14,27 @@ func GenerateRandomBytes(numOfBytesToGenerate int) []byte {
 	}
 	return generatedBytes
 }
+
+// GenerateNaturalImage generates an opaque image made of smooth gradients with sensor-like noise of the supplied
+// standard deviation and a tone curve applied, which steganalysis methods treat like a photograph, unlike images made
+// of random pixels. The same image is generated for the same arguments
+func GenerateNaturalImage(width, height int, noiseLevel float64) *image.RGBA {
+	noise := rand.New(rand.NewSource(1))
+	var toneCurve [256]uint8
+	for v := range toneCurve {
+		toneCurve[v] = uint8(math.Round(255 * math.Pow(float64(v)/255, 0.7)))
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := img.PixOffset(x, y)
+			for c := 0; c < 3; c++ {
+				v := 110 + 60*math.Sin(float64(x+c*50)/40) + 40*math.Cos(float64(y-c*30)/30) + noise.NormFloat64()*noiseLevel
+				img.Pix[p+c] = toneCurve[uint8(min(max(v, 0), 255))]
+			}
+			img.Pix[p+3] = 255
+		}
+	}
+	return img
+}